@@ -0,0 +1,176 @@
+package audio
+
+import (
+	"encoding/binary"
+	"github.com/pkg/errors"
+	"io"
+	"math"
+	"time"
+)
+
+// Buffer holds decoded audio as interleaved samples in [-1, 1].
+type Buffer struct {
+	SampleRate int
+	Channels   int
+	BitDepth   int // 源数据的位深，编码时未指定位深则沿用
+	Data       []float64
+}
+
+// Frames returns the number of samples per channel.
+func (b *Buffer) Frames() int {
+	if b.Channels == 0 {
+		return 0
+	}
+	return len(b.Data) / b.Channels
+}
+
+// Duration returns the length of the audio.
+func (b *Buffer) Duration() time.Duration {
+	if b.SampleRate == 0 {
+		return 0
+	}
+	return time.Duration(int64(b.Frames()) * int64(time.Second) / int64(b.SampleRate))
+}
+
+// Decode reads a whole WAV stream. The data chunk may be of unknown size, in
+// which case everything up to EOF is taken; a trailing partial frame is dropped.
+func Decode(r io.Reader) (*Buffer, error) {
+	format, dataSize, err := ReadHeader(r)
+	if err != nil {
+		return nil, err
+	}
+	var data []byte
+	if dataSize == UnknownSize {
+		data, err = io.ReadAll(r)
+	} else {
+		data = make([]byte, dataSize)
+		var n int
+		n, err = io.ReadFull(r, data)
+		data = data[:n]
+		if errors.Is(err, io.ErrUnexpectedEOF) {
+			return nil, errors.Errorf("data chunk truncated at %d of %d bytes", n, dataSize)
+		}
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "read data chunk")
+	}
+	data = data[:len(data)-len(data)%format.BlockAlign()]
+
+	b := &Buffer{
+		SampleRate: int(format.SampleRate),
+		Channels:   int(format.Channels),
+		BitDepth:   int(format.BitsPerSample),
+	}
+	width := int(format.BitsPerSample) / 8
+	b.Data = make([]float64, len(data)/width)
+	for i := range b.Data {
+		s := data[i*width : (i+1)*width]
+		switch {
+		case format.AudioFormat == FormatMuLaw:
+			b.Data[i] = float64(mulawToLinear(s[0])) / 32768
+		case format.AudioFormat == FormatALaw:
+			b.Data[i] = float64(alawToLinear(s[0])) / 32768
+		case format.AudioFormat == FormatFloat:
+			b.Data[i] = float64(math.Float32frombits(binary.LittleEndian.Uint32(s)))
+		case width == 1:
+			b.Data[i] = (float64(s[0]) - 128) / 128
+		case width == 2:
+			b.Data[i] = float64(int16(binary.LittleEndian.Uint16(s))) / (1 << 15)
+		case width == 3:
+			v := int32(s[0]) | int32(s[1])<<8 | int32(int8(s[2]))<<16
+			b.Data[i] = float64(v) / (1 << 23)
+		default:
+			b.Data[i] = float64(int32(binary.LittleEndian.Uint32(s))) / (1 << 31)
+		}
+	}
+	if format.AudioFormat == FormatMuLaw || format.AudioFormat == FormatALaw {
+		// G.711 相当于 14/13 位线性 PCM
+		b.BitDepth = 16
+	}
+	return b, nil
+}
+
+// quantize converts a sample in [-1, 1] to a signed integer of bits bits,
+// clipping out of range values.
+func quantize(v float64, bits int) int32 {
+	max := float64(int64(1)<<(bits-1)) - 1
+	x := math.Round(v * (max + 1))
+	if x > max {
+		x = max
+	}
+	if x < -max-1 {
+		x = -max - 1
+	}
+	return int32(x)
+}
+
+// WriteWAV encodes b as integer PCM of the given bit depth (8, 16, 24 or 32).
+func WriteWAV(w io.Writer, b *Buffer, bits int) error {
+	switch bits {
+	case 8, 16, 24, 32:
+	default:
+		return errors.Wrapf(ErrBadFormat, "%d bits per sample", bits)
+	}
+	format := Format{
+		AudioFormat:   FormatPCM,
+		Channels:      uint16(b.Channels),
+		SampleRate:    uint32(b.SampleRate),
+		BitsPerSample: uint16(bits),
+	}
+	width := bits / 8
+	size := len(b.Data) * width
+	if int64(size)+36 > math.MaxUint32-1 {
+		return errors.New("wav exceeds 4GB")
+	}
+	if err := WriteHeader(w, format, uint32(size)); err != nil {
+		return err
+	}
+	out := make([]byte, size)
+	for i, v := range b.Data {
+		s := quantize(v, bits)
+		p := out[i*width : (i+1)*width]
+		switch width {
+		case 1:
+			p[0] = byte(s + 128)
+		case 2:
+			binary.LittleEndian.PutUint16(p, uint16(s))
+		case 3:
+			p[0], p[1], p[2] = byte(s), byte(s>>8), byte(s>>16)
+		default:
+			binary.LittleEndian.PutUint32(p, uint32(s))
+		}
+	}
+	_, err := w.Write(out)
+	return err
+}
+
+// Remix changes the number of channels. Downmixing to mono averages the
+// channels; upmixing from mono copies it to every channel. Other layouts are
+// not supported.
+func Remix(b *Buffer, channels int) (*Buffer, error) {
+	if channels == b.Channels {
+		return b, nil
+	}
+	out := &Buffer{SampleRate: b.SampleRate, Channels: channels, BitDepth: b.BitDepth}
+	frames := b.Frames()
+	out.Data = make([]float64, frames*channels)
+	switch {
+	case channels == 1:
+		for i := 0; i < frames; i++ {
+			sum := 0.0
+			for c := 0; c < b.Channels; c++ {
+				sum += b.Data[i*b.Channels+c]
+			}
+			out.Data[i] = sum / float64(b.Channels)
+		}
+	case b.Channels == 1:
+		for i := 0; i < frames; i++ {
+			for c := 0; c < channels; c++ {
+				out.Data[i*channels+c] = b.Data[i]
+			}
+		}
+	default:
+		return nil, errors.Errorf("cannot remix %d channels to %d", b.Channels, channels)
+	}
+	return out, nil
+}
@@ -0,0 +1,163 @@
+package audio
+
+import (
+	"bytes"
+	"github.com/pkg/errors"
+	"io"
+)
+
+type Codec string
+
+const (
+	CodecWAV   Codec = "wav"   // 线性 PCM
+	CodecMuLaw Codec = "mulaw" // G.711 µ-law，WAV 封装
+	CodecALaw  Codec = "alaw"  // G.711 A-law，WAV 封装
+	CodecFLAC  Codec = "flac"
+
+	// telephonyRate G.711 未指定采样率时使用的采样率
+	telephonyRate = 8000
+)
+
+// Target describes an output format. Zero fields keep the value of the source,
+// except for G.711 which defaults to 8 kHz mono.
+type Target struct {
+	Codec      Codec `json:"codec"`
+	SampleRate int   `json:"sampleRate,omitempty"`
+	Channels   int   `json:"channels,omitempty"`
+	BitDepth   int   `json:"bitDepth,omitempty"`
+}
+
+// Validate checks that the target can be produced.
+func (t Target) Validate() error {
+	switch t.Codec {
+	case CodecWAV:
+		switch t.BitDepth {
+		case 0, 8, 16, 24, 32:
+		default:
+			return errors.Errorf("wav does not support %d bits per sample", t.BitDepth)
+		}
+	case CodecMuLaw, CodecALaw:
+		if t.BitDepth != 0 && t.BitDepth != 8 {
+			return errors.Errorf("%s is always 8 bits per sample", t.Codec)
+		}
+	case CodecFLAC:
+		switch t.BitDepth {
+		case 0, 8, 16, 24:
+		default:
+			return errors.Errorf("flac does not support %d bits per sample", t.BitDepth)
+		}
+	default:
+		return errors.Errorf("unknown codec %q", t.Codec)
+	}
+	if t.SampleRate < 0 || t.SampleRate > 384000 {
+		return errors.Errorf("invalid sample rate %d", t.SampleRate)
+	}
+	if t.Channels < 0 || t.Channels > 8 {
+		return errors.Errorf("invalid channel count %d", t.Channels)
+	}
+	return nil
+}
+
+// ContentType returns the MIME type of files produced for t.
+func (t Target) ContentType() string {
+	if t.Codec == CodecFLAC {
+		return "audio/flac"
+	}
+	return "audio/wav"
+}
+
+// Ext returns the file extension, without dot, of files produced for t.
+func (t Target) Ext() string {
+	if t.Codec == CodecFLAC {
+		return "flac"
+	}
+	return "wav"
+}
+
+// Apply resamples and remixes b as requested by t.
+func (t Target) Apply(b *Buffer) (*Buffer, error) {
+	rate, channels := t.SampleRate, t.Channels
+	if t.Codec == CodecMuLaw || t.Codec == CodecALaw {
+		if rate == 0 {
+			rate = telephonyRate
+		}
+		if channels == 0 {
+			channels = 1
+		}
+	}
+	if channels != 0 {
+		var err error
+		if b, err = Remix(b, channels); err != nil {
+			return nil, err
+		}
+	}
+	if rate != 0 {
+		b = Resample(b, rate)
+	}
+	return b, nil
+}
+
+// Encode writes b, already shaped by Apply, in the codec of t.
+func (t Target) Encode(w io.Writer, b *Buffer) error {
+	bits := t.BitDepth
+	if bits == 0 {
+		bits = b.BitDepth
+	}
+	switch t.Codec {
+	case CodecMuLaw:
+		return WriteG711(w, b, FormatMuLaw)
+	case CodecALaw:
+		return WriteG711(w, b, FormatALaw)
+	case CodecFLAC:
+		if bits > 24 {
+			bits = 24
+		}
+		return WriteFLAC(w, b, bits)
+	default:
+		return WriteWAV(w, b, bits)
+	}
+}
+
+// Convert decodes the WAV stream r and writes it to w in the format t.
+func Convert(r io.Reader, w io.Writer, t Target) error {
+	if err := t.Validate(); err != nil {
+		return err
+	}
+	b, err := Decode(r)
+	if err != nil {
+		return err
+	}
+	if b, err = t.Apply(b); err != nil {
+		return err
+	}
+	return t.Encode(w, b)
+}
+
+// Conform rewrites the WAV file data in the format f, remixing, resampling
+// and requantizing it as needed, so that parts rendered by models of
+// different sample rates can be joined. Data already in f is returned as is.
+func Conform(data []byte, f Format) ([]byte, error) {
+	format, _, err := ReadHeader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	if format == f {
+		return data, nil
+	}
+	if f.AudioFormat != FormatPCM {
+		return nil, errors.Wrapf(ErrFormatMismatch, "cannot convert %+v to %+v", format, f)
+	}
+	b, err := Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	if b, err = Remix(b, int(f.Channels)); err != nil {
+		return nil, err
+	}
+	b = Resample(b, int(f.SampleRate))
+	buf := &bytes.Buffer{}
+	if err := WriteWAV(buf, b, int(f.BitsPerSample)); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
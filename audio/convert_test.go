@@ -0,0 +1,32 @@
+package audio
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+func TestConform(t *testing.T) {
+	stereo48k := Format{AudioFormat: FormatPCM, Channels: 2, SampleRate: 48000, BitsPerSample: 24}
+	part := wav(t, stereo48k, 4800, 1, 0)
+	out, err := Conform(part, mono16k)
+	if err != nil {
+		t.Fatal(err)
+	}
+	format, size, err := ReadHeader(bytes.NewReader(out))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 100ms 的 48kHz 立体声变成 100ms 的 16kHz 单声道
+	if format != mono16k || size != 1600*2 {
+		t.Fatalf("conformed to %+v with %d bytes", format, size)
+	}
+
+	if same, err := Conform(part, stereo48k); err != nil || !bytes.Equal(same, part) {
+		t.Fatalf("part in the target format was rewritten: %v", err)
+	}
+	alaw := Format{AudioFormat: FormatALaw, Channels: 1, SampleRate: 8000, BitsPerSample: 8}
+	if _, err := Conform(part, alaw); !errors.Is(err, ErrFormatMismatch) {
+		t.Fatalf("conform to A-law: %v", err)
+	}
+}
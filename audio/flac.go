@@ -0,0 +1,357 @@
+package audio
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/binary"
+	"github.com/pkg/errors"
+	"io"
+)
+
+// flacBlockSize 每帧的采样数
+const flacBlockSize = 4096
+
+// bitWriter packs bits MSB first.
+type bitWriter struct {
+	buf   bytes.Buffer
+	acc   uint64
+	nbits uint
+}
+
+func (w *bitWriter) write(v uint64, n uint) {
+	for n > 0 {
+		take := n
+		if take > 32 {
+			take = 32
+		}
+		n -= take
+		w.acc = w.acc<<take | (v>>n)&(1<<take-1)
+		w.nbits += take
+		for w.nbits >= 8 {
+			w.nbits -= 8
+			w.buf.WriteByte(byte(w.acc >> w.nbits))
+		}
+		w.acc &= 1<<w.nbits - 1
+	}
+}
+
+func (w *bitWriter) writeSigned(v int64, n uint) {
+	w.write(uint64(v)&(1<<n-1), n)
+}
+
+// writeUnary writes q zero bits followed by a one.
+func (w *bitWriter) writeUnary(q uint64) {
+	for q >= 32 {
+		w.write(0, 32)
+		q -= 32
+	}
+	w.write(1, uint(q)+1)
+}
+
+// align pads with zero bits to the next byte boundary.
+func (w *bitWriter) align() {
+	if w.nbits > 0 {
+		w.write(0, 8-w.nbits)
+	}
+}
+
+func (w *bitWriter) bytes() []byte {
+	return w.buf.Bytes()
+}
+
+// WriteFLAC encodes b as a FLAC stream with bits per sample (8, 16 or 24).
+// Every channel is coded independently with the best fixed predictor of
+// order 0 to 4 and partitioned Rice residuals.
+func WriteFLAC(w io.Writer, b *Buffer, bits int) error {
+	switch bits {
+	case 8, 16, 24:
+	default:
+		return errors.Wrapf(ErrBadFormat, "flac with %d bits per sample", bits)
+	}
+	if b.Channels < 1 || b.Channels > 8 {
+		return errors.Wrapf(ErrBadFormat, "flac with %d channels", b.Channels)
+	}
+	frames := b.Frames()
+	samples := make([][]int64, b.Channels)
+	for c := range samples {
+		samples[c] = make([]int64, frames)
+	}
+	digest := md5.New()
+	raw := make([]byte, 4)
+	width := bits / 8
+	for i, v := range b.Data {
+		s := quantize(v, bits)
+		samples[i%b.Channels][i/b.Channels] = int64(s)
+		binary.LittleEndian.PutUint32(raw, uint32(s))
+		digest.Write(raw[:width])
+	}
+
+	// STREAMINFO
+	info := &bitWriter{}
+	info.write(flacBlockSize, 16)
+	info.write(flacBlockSize, 16)
+	info.write(0, 24) // 最小/最大帧长未知
+	info.write(0, 24)
+	info.write(uint64(b.SampleRate), 20)
+	info.write(uint64(b.Channels-1), 3)
+	info.write(uint64(bits-1), 5)
+	info.write(uint64(frames), 36)
+	head := append([]byte("fLaC"), 0x80, 0, 0, 34) // 最后一个元数据块，类型 0，长度 34
+	head = append(head, info.bytes()...)
+	head = append(head, digest.Sum(nil)...)
+	if _, err := w.Write(head); err != nil {
+		return err
+	}
+
+	for start, n := 0, 0; start < frames; start, n = start+flacBlockSize, n+1 {
+		end := start + flacBlockSize
+		if end > frames {
+			end = frames
+		}
+		frame := &bitWriter{}
+		writeFrameHeader(frame, n, end-start, b.Channels)
+		for c := range samples {
+			writeSubframe(frame, samples[c][start:end], uint(bits))
+		}
+		frame.align()
+		data := frame.bytes()
+		crc := crc16(data)
+		data = append(data, byte(crc>>8), byte(crc))
+		if _, err := w.Write(data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func writeFrameHeader(w *bitWriter, number, blockSize, channels int) {
+	w.write(0x3FFE, 14) // 同步码
+	w.write(0, 1)
+	w.write(0, 1) // 固定块大小
+	w.write(0x7, 4)
+	w.write(0, 4) // 采样率见 STREAMINFO
+	w.write(uint64(channels-1), 4)
+	w.write(0, 3) // 位深见 STREAMINFO
+	w.write(0, 1)
+	writeUTF8(w, uint64(number))
+	w.write(uint64(blockSize-1), 16)
+	w.write(uint64(crc8(w.bytes())), 8)
+}
+
+// writeUTF8 writes v in the extended UTF-8 coding FLAC uses for frame numbers.
+func writeUTF8(w *bitWriter, v uint64) {
+	if v < 0x80 {
+		w.write(v, 8)
+		return
+	}
+	n := 2
+	for v >= 1<<(5*n+1) {
+		n++
+	}
+	w.write((0xFF<<(8-n))&0xFF|v>>(6*(n-1)), 8)
+	for i := n - 2; i >= 0; i-- {
+		w.write(0x80|(v>>(6*i))&0x3F, 8)
+	}
+}
+
+var fixedCoefficients = [][]int64{
+	{},
+	{1},
+	{2, -1},
+	{3, -3, 1},
+	{4, -6, 4, -1},
+}
+
+func writeSubframe(w *bitWriter, x []int64, bits uint) {
+	constant := true
+	for _, v := range x {
+		if v != x[0] {
+			constant = false
+			break
+		}
+	}
+	if constant {
+		w.write(0, 8) // CONSTANT
+		w.writeSigned(x[0], bits)
+		return
+	}
+
+	bestOrder, bestCost := -1, uint64(len(x))*uint64(bits) // 不低于 VERBATIM
+	var bestResidual []int64
+	var bestParams []uint
+	for order := 0; order <= 4 && order < len(x); order++ {
+		residual := fixedResidual(x, order)
+		params, cost := riceParams(residual, len(x), order)
+		cost += uint64(order) * uint64(bits)
+		if cost < bestCost {
+			bestOrder, bestCost, bestResidual, bestParams = order, cost, residual, params
+		}
+	}
+	if bestOrder < 0 {
+		w.write(0x02, 8) // VERBATIM
+		for _, v := range x {
+			w.writeSigned(v, bits)
+		}
+		return
+	}
+	w.write(uint64(0x08|bestOrder)<<1, 8) // FIXED
+	for _, v := range x[:bestOrder] {
+		w.writeSigned(v, bits)
+	}
+	writeResidual(w, bestResidual, bestParams, len(x), bestOrder)
+}
+
+func fixedResidual(x []int64, order int) []int64 {
+	coef := fixedCoefficients[order]
+	residual := make([]int64, len(x)-order)
+	for i := order; i < len(x); i++ {
+		pred := int64(0)
+		for j, c := range coef {
+			pred += c * x[i-1-j]
+		}
+		residual[i-order] = x[i] - pred
+	}
+	return residual
+}
+
+func zigzag(v int64) uint64 {
+	return uint64(v<<1) ^ uint64(v>>63)
+}
+
+// riceCost returns the number of bits of the residuals coded with parameter k.
+func riceCost(residual []int64, k uint) uint64 {
+	cost := uint64(len(residual)) * uint64(k+1)
+	for _, r := range residual {
+		cost += zigzag(r) >> k
+	}
+	return cost
+}
+
+// riceParams chooses the partition order and the Rice parameter of every
+// partition, returning the parameters and the total residual cost in bits.
+func riceParams(residual []int64, blockSize, order int) ([]uint, uint64) {
+	var best []uint
+	bestCost := ^uint64(0)
+	for porder := 0; porder <= 8; porder++ {
+		parts := 1 << porder
+		if blockSize%parts != 0 || blockSize/parts <= order {
+			break
+		}
+		params := make([]uint, parts)
+		cost := uint64(6) // 编码方式 + 分区阶数
+		pos := 0
+		for p := 0; p < parts; p++ {
+			n := blockSize / parts
+			if p == 0 {
+				n -= order
+			}
+			k, c := bestRice(residual[pos : pos+n])
+			params[p] = k
+			cost += 4 + c
+			pos += n
+		}
+		if cost < bestCost {
+			best, bestCost = params, cost
+		}
+	}
+	return best, bestCost
+}
+
+// bestRice estimates the Rice parameter from the mean and refines it with the
+// exact cost of its neighbours.
+func bestRice(residual []int64) (uint, uint64) {
+	sum := uint64(0)
+	for _, r := range residual {
+		sum += zigzag(r)
+	}
+	k := uint(0)
+	if n := uint64(len(residual)); n > 0 {
+		for k < 14 && n<<(k+1) <= sum {
+			k++
+		}
+	}
+	bestK, bestCost := k, riceCost(residual, k)
+	for _, c := range []int{int(k) - 1, int(k) + 1} {
+		if c < 0 || c > 14 {
+			continue
+		}
+		if cost := riceCost(residual, uint(c)); cost < bestCost {
+			bestK, bestCost = uint(c), cost
+		}
+	}
+	return bestK, bestCost
+}
+
+func writeResidual(w *bitWriter, residual []int64, params []uint, blockSize, order int) {
+	porder := 0
+	for 1<<porder < len(params) {
+		porder++
+	}
+	w.write(0, 2) // 4 位 Rice 参数
+	w.write(uint64(porder), 4)
+	pos := 0
+	for p, k := range params {
+		n := blockSize / len(params)
+		if p == 0 {
+			n -= order
+		}
+		w.write(uint64(k), 4)
+		for _, r := range residual[pos : pos+n] {
+			u := zigzag(r)
+			w.writeUnary(u >> k)
+			if k > 0 {
+				w.write(u&(1<<k-1), k)
+			}
+		}
+		pos += n
+	}
+}
+
+func crc8(data []byte) byte {
+	crc := byte(0)
+	for _, b := range data {
+		crc ^= b
+		for i := 0; i < 8; i++ {
+			if crc&0x80 != 0 {
+				crc = crc<<1 ^ 0x07
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc
+}
+
+func crc16(data []byte) uint16 {
+	crc := uint16(0)
+	for _, b := range data {
+		crc ^= uint16(b) << 8
+		for i := 0; i < 8; i++ {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ 0x8005
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc
+}
+
+// ReadFLACHeader reads the STREAMINFO block at the start of a FLAC stream and
+// returns the format with the total number of frames (0 when unknown).
+func ReadFLACHeader(r io.Reader) (Format, uint64, error) {
+	var f Format
+	var h [42]byte
+	if _, err := io.ReadFull(r, h[:]); err != nil {
+		return f, 0, errors.Wrap(err, "read streaminfo")
+	}
+	if string(h[0:4]) != "fLaC" || h[4]&0x7F != 0 {
+		return f, 0, errors.New("not a FLAC stream")
+	}
+	v := binary.BigEndian.Uint64(h[18:26])
+	f.AudioFormat = FormatPCM
+	f.SampleRate = uint32(v >> 44)
+	f.Channels = uint16(v>>41&0x7) + 1
+	f.BitsPerSample = uint16(v>>36&0x1F) + 1
+	return f, v & (1<<36 - 1), nil
+}
@@ -0,0 +1,50 @@
+package audio
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/binary"
+	"math"
+	"testing"
+)
+
+func TestWriteFLAC(t *testing.T) {
+	b := &Buffer{SampleRate: 44100, Channels: 2}
+	frames := flacBlockSize + 1000 // 两帧，最后一帧不满
+	for i := 0; i < frames; i++ {
+		v := 0.5 * math.Sin(2*math.Pi*440*float64(i)/44100)
+		b.Data = append(b.Data, v, -v)
+	}
+	buf := &bytes.Buffer{}
+	if err := WriteFLAC(buf, b, 16); err != nil {
+		t.Fatal(err)
+	}
+	data := buf.Bytes()
+	format, total, err := ReadFLACHeader(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := Format{AudioFormat: FormatPCM, Channels: 2, SampleRate: 44100, BitsPerSample: 16}
+	if format != want || total != uint64(frames) {
+		t.Fatalf("streaminfo %+v with %d frames", format, total)
+	}
+	// STREAMINFO 中的 MD5 是交错的小端 PCM 的摘要
+	raw := make([]byte, 2*len(b.Data))
+	for i, v := range b.Data {
+		binary.LittleEndian.PutUint16(raw[2*i:], uint16(quantize(v, 16)))
+	}
+	if sum := md5.Sum(raw); !bytes.Equal(data[26:42], sum[:]) {
+		t.Fatalf("streaminfo md5 %x, want %x", data[26:42], sum)
+	}
+	// 第一帧紧跟在元数据之后，以同步码开头，压缩后小于原始数据
+	if data[42] != 0xFF || data[43]&0xFE != 0xF8 {
+		t.Fatalf("frame starts with %x", data[42:44])
+	}
+	if len(data) >= len(raw) {
+		t.Fatalf("%d bytes of FLAC for %d bytes of PCM", len(data), len(raw))
+	}
+
+	if err := WriteFLAC(buf, b, 32); err == nil {
+		t.Error("32-bit FLAC written")
+	}
+}
@@ -0,0 +1,142 @@
+package audio
+
+import (
+	"encoding/binary"
+	"github.com/pkg/errors"
+	"io"
+)
+
+const (
+	FormatALaw  uint16 = 6
+	FormatMuLaw uint16 = 7
+
+	g711Bias = 0x84
+	g711Clip = 8159
+)
+
+var (
+	mulawSegEnd = [8]int{0x3F, 0x7F, 0xFF, 0x1FF, 0x3FF, 0x7FF, 0xFFF, 0x1FFF}
+	alawSegEnd  = [8]int{0x1F, 0x3F, 0x7F, 0xFF, 0x1FF, 0x3FF, 0x7FF, 0xFFF}
+)
+
+func segment(v int, ends *[8]int) int {
+	for i, end := range ends {
+		if v <= end {
+			return i
+		}
+	}
+	return len(ends)
+}
+
+// linearToMulaw encodes a 16-bit sample with the ITU-T G.711 µ-law.
+func linearToMulaw(pcm int16) byte {
+	v := int(pcm) >> 2
+	mask := 0xFF
+	if v < 0 {
+		v = -v
+		mask = 0x7F
+	}
+	if v > g711Clip {
+		v = g711Clip
+	}
+	v += g711Bias >> 2
+	seg := segment(v, &mulawSegEnd)
+	if seg >= 8 {
+		return byte(0x7F ^ mask)
+	}
+	return byte((seg<<4 | (v>>(seg+1))&0x0F) ^ mask)
+}
+
+func mulawToLinear(u byte) int16 {
+	u = ^u
+	t := (int(u&0x0F) << 3) + g711Bias
+	t <<= (u & 0x70) >> 4
+	if u&0x80 != 0 {
+		return int16(g711Bias - t)
+	}
+	return int16(t - g711Bias)
+}
+
+// linearToAlaw encodes a 16-bit sample with the ITU-T G.711 A-law.
+func linearToAlaw(pcm int16) byte {
+	v := int(pcm) >> 3
+	mask := 0xD5
+	if v < 0 {
+		mask = 0x55
+		v = -v - 1
+	}
+	seg := segment(v, &alawSegEnd)
+	if seg >= 8 {
+		return byte(0x7F ^ mask)
+	}
+	a := seg << 4
+	if seg < 2 {
+		a |= (v >> 1) & 0x0F
+	} else {
+		a |= (v >> seg) & 0x0F
+	}
+	return byte(a ^ mask)
+}
+
+func alawToLinear(a byte) int16 {
+	a ^= 0x55
+	t := int(a&0x0F) << 4
+	seg := int(a&0x70) >> 4
+	switch seg {
+	case 0:
+		t += 8
+	case 1:
+		t += 0x108
+	default:
+		t += 0x108
+		t <<= seg - 1
+	}
+	if a&0x80 != 0 {
+		return int16(t)
+	}
+	return int16(-t)
+}
+
+// WriteG711 encodes b as a µ-law (FormatMuLaw) or A-law (FormatALaw) WAV
+// file, with the fact chunk required for non-PCM formats.
+func WriteG711(w io.Writer, b *Buffer, audioFormat uint16) error {
+	encode := linearToMulaw
+	switch audioFormat {
+	case FormatMuLaw:
+	case FormatALaw:
+		encode = linearToAlaw
+	default:
+		return errors.Wrapf(ErrBadFormat, "audio format %d is not G.711", audioFormat)
+	}
+	data := make([]byte, len(b.Data))
+	for i, v := range b.Data {
+		data[i] = encode(int16(quantize(v, 16)))
+	}
+	pad := len(data) % 2
+	var h [58]byte
+	copy(h[0:4], "RIFF")
+	binary.LittleEndian.PutUint32(h[4:8], uint32(50+len(data)+pad))
+	copy(h[8:12], "WAVE")
+	copy(h[12:16], "fmt ")
+	binary.LittleEndian.PutUint32(h[16:20], 18)
+	binary.LittleEndian.PutUint16(h[20:22], audioFormat)
+	binary.LittleEndian.PutUint16(h[22:24], uint16(b.Channels))
+	binary.LittleEndian.PutUint32(h[24:28], uint32(b.SampleRate))
+	binary.LittleEndian.PutUint32(h[28:32], uint32(b.SampleRate*b.Channels))
+	binary.LittleEndian.PutUint16(h[32:34], uint16(b.Channels))
+	binary.LittleEndian.PutUint16(h[34:36], 8)
+	// h[36:38] cbSize = 0
+	copy(h[38:42], "fact")
+	binary.LittleEndian.PutUint32(h[42:46], 4)
+	binary.LittleEndian.PutUint32(h[46:50], uint32(b.Frames()))
+	copy(h[50:54], "data")
+	binary.LittleEndian.PutUint32(h[54:58], uint32(len(data)))
+	if _, err := w.Write(h[:]); err != nil {
+		return err
+	}
+	if pad > 0 {
+		data = append(data, 0)
+	}
+	_, err := w.Write(data)
+	return err
+}
@@ -0,0 +1,84 @@
+package audio
+
+import (
+	"bytes"
+	"math"
+	"testing"
+)
+
+func TestG711(t *testing.T) {
+	// ITU-T G.711 参考值
+	for _, c := range []struct {
+		pcm   int16
+		mulaw byte
+		alaw  byte
+	}{
+		{0, 0xFF, 0xD5},
+		{32767, 0x80, 0xAA},
+		{-32768, 0x00, 0x2A},
+		{1000, 0xCE, 0xFA},
+		{-1000, 0x4E, 0x7A},
+	} {
+		if got := linearToMulaw(c.pcm); got != c.mulaw {
+			t.Errorf("µ-law(%d) = %#x, want %#x", c.pcm, got, c.mulaw)
+		}
+		if got := linearToAlaw(c.pcm); got != c.alaw {
+			t.Errorf("A-law(%d) = %#x, want %#x", c.pcm, got, c.alaw)
+		}
+	}
+	for _, c := range []struct {
+		code        byte
+		mulaw, alaw int16
+	}{
+		{0x80, 32124, 5504},
+		{0x00, -32124, -5504},
+		{0xFF, 0, 848},
+		{0xAA, 5372, 32256},
+		{0x2A, -5372, -32256},
+		{0xD5, 716, 8},
+		{0x55, -716, -8},
+	} {
+		if got := mulawToLinear(c.code); got != c.mulaw {
+			t.Errorf("µ-law decode %#x = %d, want %d", c.code, got, c.mulaw)
+		}
+		if got := alawToLinear(c.code); got != c.alaw {
+			t.Errorf("A-law decode %#x = %d, want %d", c.code, got, c.alaw)
+		}
+	}
+	// 每个码字解码后再编码得到原码字，µ-law 的负零除外
+	for i := 0; i < 256; i++ {
+		code := byte(i)
+		if got := linearToAlaw(alawToLinear(code)); got != code {
+			t.Errorf("A-law %#x round trips to %#x", code, got)
+		}
+		if code == 0x7F {
+			continue
+		}
+		if got := linearToMulaw(mulawToLinear(code)); got != code {
+			t.Errorf("µ-law %#x round trips to %#x", code, got)
+		}
+	}
+}
+
+func TestWriteG711(t *testing.T) {
+	b := &Buffer{SampleRate: 8000, Channels: 1, Data: []float64{0, 0.5, -0.5}}
+	buf := &bytes.Buffer{}
+	if err := WriteG711(buf, b, FormatALaw); err != nil {
+		t.Fatal(err)
+	}
+	decoded, err := Decode(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decoded.SampleRate != 8000 || decoded.Frames() != 3 {
+		t.Fatalf("decoded %d frames at %d Hz", decoded.Frames(), decoded.SampleRate)
+	}
+	for i, v := range b.Data {
+		if math.Abs(decoded.Data[i]-v) > 0.02 {
+			t.Errorf("sample %d = %f, want %f", i, decoded.Data[i], v)
+		}
+	}
+	if err := WriteG711(buf, b, FormatPCM); err == nil {
+		t.Error("PCM written as G.711")
+	}
+}
@@ -0,0 +1,153 @@
+package audio
+
+import (
+	"github.com/pkg/errors"
+	"io"
+	"math"
+	"time"
+)
+
+var ErrFormatMismatch = errors.New("wav formats differ")
+
+// Joiner concatenates WAV streams of the same format into one WAV file,
+// inserting silence between them. The header is written with an unknown size
+// first and fixed by Close.
+type Joiner struct {
+	w        io.WriteSeeker
+	silence  time.Duration
+	format   Format
+	size     int64 // 已写入的 data 字节数
+	parts    int
+	pending  time.Duration // Silence 要求的静音，代替下一个间隔
+	explicit bool
+	lastPart [2]int64 // 最后一段音频在 data 中的起止字节
+}
+
+func NewJoiner(w io.WriteSeeker, silence time.Duration) *Joiner {
+	return &Joiner{w: w, silence: silence}
+}
+
+// Format returns the format of the joined stream, valid after the first Append.
+func (j *Joiner) Format() Format {
+	return j.format
+}
+
+// Duration returns the length of the audio appended so far.
+func (j *Joiner) Duration() time.Duration {
+	if j.parts == 0 {
+		return 0
+	}
+	return time.Duration(j.size * int64(time.Second) / int64(j.format.ByteRate()))
+}
+
+// Last returns where the audio of the last appended part starts and ends,
+// silence before it excluded.
+func (j *Joiner) Last() (start, end time.Duration) {
+	if j.parts == 0 {
+		return 0, 0
+	}
+	rate := int64(j.format.ByteRate())
+	return time.Duration(j.lastPart[0] * int64(time.Second) / rate), time.Duration(j.lastPart[1] * int64(time.Second) / rate)
+}
+
+// Append validates the RIFF header of r and appends its samples. Every part
+// must have the format of the first one.
+func (j *Joiner) Append(r io.Reader) error {
+	format, dataSize, err := ReadHeader(r)
+	if err != nil {
+		return err
+	}
+	if j.parts == 0 {
+		j.format = format
+		if err := WriteHeader(j.w, format, UnknownSize); err != nil {
+			return err
+		}
+	} else if format != j.format {
+		return errors.Wrapf(ErrFormatMismatch, "part %d is %+v, expected %+v", j.parts+1, format, j.format)
+	}
+	if err := j.writeGap(); err != nil {
+		return err
+	}
+	j.lastPart[0] = j.size
+	var n int64
+	if dataSize == UnknownSize {
+		n, err = io.Copy(j.w, r)
+	} else {
+		n, err = io.CopyN(j.w, r, int64(dataSize))
+		if errors.Is(err, io.EOF) {
+			err = errors.Errorf("part %d: data chunk truncated at %d of %d bytes", j.parts+1, n, dataSize)
+		}
+	}
+	j.size += n
+	j.lastPart[1] = j.size
+	j.parts++
+	if err != nil {
+		return err
+	}
+	if n%int64(format.BlockAlign()) != 0 {
+		return errors.Errorf("part %d: data size %d is not a multiple of the frame size", j.parts, n)
+	}
+	if j.size+36 > math.MaxUint32-1 {
+		return errors.New("joined wav exceeds 4GB")
+	}
+	return nil
+}
+
+// Silence replaces the gap before the next part with d; repeated calls add
+// up. Before the first part it becomes leading silence, after the last one
+// Close writes it as trailing silence.
+func (j *Joiner) Silence(d time.Duration) {
+	j.pending += d
+	j.explicit = true
+}
+
+// writeGap writes the silence due before the next part: the one asked for
+// with Silence, else the default gap between two parts.
+func (j *Joiner) writeGap() error {
+	d := j.silence
+	if j.explicit {
+		d = j.pending
+	} else if j.parts == 0 {
+		d = 0
+	}
+	j.pending, j.explicit = 0, false
+	return j.writeSilence(d)
+}
+
+func (j *Joiner) writeSilence(d time.Duration) error {
+	frames := int64(d.Seconds() * float64(j.format.SampleRate))
+	if frames <= 0 {
+		return nil
+	}
+	buf := make([]byte, frames*int64(j.format.BlockAlign()))
+	if j.format.AudioFormat == FormatPCM && j.format.BitsPerSample == 8 {
+		// 8 位 PCM 是无符号数，静音为 128
+		for i := range buf {
+			buf[i] = 0x80
+		}
+	}
+	n, err := j.w.Write(buf)
+	j.size += int64(n)
+	return err
+}
+
+// Close rewrites the header with the final sizes. It does not close the
+// underlying writer.
+func (j *Joiner) Close() error {
+	if j.parts == 0 {
+		return errors.New("nothing to join")
+	}
+	if j.explicit {
+		if err := j.writeGap(); err != nil {
+			return err
+		}
+	}
+	if _, err := j.w.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	if err := WriteHeader(j.w, j.format, uint32(j.size)); err != nil {
+		return err
+	}
+	_, err := j.w.Seek(0, io.SeekEnd)
+	return err
+}
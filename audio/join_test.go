@@ -0,0 +1,96 @@
+package audio
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+var mono16k = Format{AudioFormat: FormatPCM, Channels: 1, SampleRate: 16000, BitsPerSample: 16}
+
+// wav returns a WAV file of frames frames of value v in format f, with the
+// data size declared as size (or the real size when size is 0).
+func wav(t *testing.T, f Format, frames int, v byte, size uint32) []byte {
+	t.Helper()
+	data := bytes.Repeat([]byte{v}, frames*f.BlockAlign())
+	if size == 0 {
+		size = uint32(len(data))
+	}
+	buf := &bytes.Buffer{}
+	if err := WriteHeader(buf, f, size); err != nil {
+		t.Fatal(err)
+	}
+	buf.Write(data)
+	return buf.Bytes()
+}
+
+func newJoinerFile(t *testing.T, silence time.Duration) (*Joiner, *os.File) {
+	t.Helper()
+	f, err := os.Create(filepath.Join(t.TempDir(), "joined.wav"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { f.Close() })
+	return NewJoiner(f, silence), f
+}
+
+func TestJoinerInsertsSilence(t *testing.T) {
+	j, f := newJoinerFile(t, 100*time.Millisecond)
+	if err := j.Append(bytes.NewReader(wav(t, mono16k, 1600, 1, 0))); err != nil {
+		t.Fatal(err)
+	}
+	// 流式输出的 WAV 长度未知，读到结尾为止
+	if err := j.Append(bytes.NewReader(wav(t, mono16k, 3200, 2, UnknownSize))); err != nil {
+		t.Fatal(err)
+	}
+	if start, end := j.Last(); start != 200*time.Millisecond || end != 400*time.Millisecond {
+		t.Fatalf("last part at %s-%s", start, end)
+	}
+	j.Silence(50 * time.Millisecond)
+	if err := j.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if j.Duration() != 450*time.Millisecond {
+		t.Fatalf("duration %s", j.Duration())
+	}
+
+	f.Seek(0, 0)
+	b, err := Decode(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b.Frames() != 7200 {
+		t.Fatalf("%d frames", b.Frames())
+	}
+	for i, want := range map[int]bool{0: true, 1599: true, 1600: false, 3199: false, 3200: true, 6399: true, 6400: false, 7199: false} {
+		if got := b.Data[i] != 0; got != want {
+			t.Errorf("frame %d audible = %v", i, got)
+		}
+	}
+}
+
+func TestJoinerRejectsBadParts(t *testing.T) {
+	j, _ := newJoinerFile(t, 0)
+	if err := j.Append(bytes.NewReader([]byte("not a wav file at all, really"))); err == nil {
+		t.Fatal("garbage accepted")
+	}
+	if err := j.Close(); err == nil {
+		t.Fatal("closed without parts")
+	}
+
+	j, _ = newJoinerFile(t, 0)
+	if err := j.Append(bytes.NewReader(wav(t, mono16k, 10, 1, 0))); err != nil {
+		t.Fatal(err)
+	}
+	stereo := mono16k
+	stereo.Channels = 2
+	if err := j.Append(bytes.NewReader(wav(t, stereo, 10, 1, 0))); !errors.Is(err, ErrFormatMismatch) {
+		t.Fatalf("stereo after mono: %v", err)
+	}
+	if err := j.Append(bytes.NewReader(wav(t, mono16k, 10, 1, 100))); err == nil {
+		t.Fatal("truncated data chunk accepted")
+	}
+}
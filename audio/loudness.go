@@ -0,0 +1,141 @@
+package audio
+
+import "math"
+
+const (
+	loudnessBlock     = 0.4 // 门限块长度(s)
+	loudnessStep      = 0.1 // 块间隔(s)，即 75% 重叠
+	absoluteGate      = -70.0
+	relativeGateDelta = -10.0
+)
+
+// biquad is a second order IIR filter in direct form I.
+type biquad struct {
+	b0, b1, b2, a1, a2 float64
+	x1, x2, y1, y2     float64
+}
+
+func (f *biquad) process(x float64) float64 {
+	y := f.b0*x + f.b1*f.x1 + f.b2*f.x2 - f.a1*f.y1 - f.a2*f.y2
+	f.x2, f.x1 = f.x1, x
+	f.y2, f.y1 = f.y1, y
+	return y
+}
+
+// kWeighting returns the two stages of the ITU-R BS.1770 K-weighting filter
+// designed for rate: a high shelf modelling the head and a high-pass. The
+// design reproduces the coefficients the standard gives for 48kHz.
+func kWeighting(rate int) (*biquad, *biquad) {
+	fs := float64(rate)
+
+	const shelfGain, shelfQ, shelfFreq = 3.999843853973347, 0.7071752369554196, 1681.974450955533
+	k := math.Tan(math.Pi * shelfFreq / fs)
+	vh := math.Pow(10, shelfGain/20)
+	vb := math.Pow(vh, 0.4996667741545416)
+	a0 := 1 + k/shelfQ + k*k
+	shelf := &biquad{
+		b0: (vh + vb*k/shelfQ + k*k) / a0,
+		b1: 2 * (k*k - vh) / a0,
+		b2: (vh - vb*k/shelfQ + k*k) / a0,
+		a1: 2 * (k*k - 1) / a0,
+		a2: (1 - k/shelfQ + k*k) / a0,
+	}
+
+	// 标准中的高通滤波器分子为 1, -2, 1，不做归一化
+	const passQ, passFreq = 0.5003270373238773, 38.13547087602444
+	k = math.Tan(math.Pi * passFreq / fs)
+	a0 = 1 + k/passQ + k*k
+	pass := &biquad{
+		b0: 1,
+		b1: -2,
+		b2: 1,
+		a1: 2 * (k*k - 1) / a0,
+		a2: (1 - k/passQ + k*k) / a0,
+	}
+	return shelf, pass
+}
+
+// Loudness measures the integrated loudness of b in LUFS as specified by
+// ITU-R BS.1770-4 / EBU R128, with all channels weighted 1 (mono and stereo).
+// Silence yields -Inf.
+func Loudness(b *Buffer) float64 {
+	frames := b.Frames()
+	if frames == 0 {
+		return math.Inf(-1)
+	}
+	// 每个声道 K 加权后的平方值
+	power := make([]float64, frames)
+	for c := 0; c < b.Channels; c++ {
+		shelf, pass := kWeighting(b.SampleRate)
+		for i := 0; i < frames; i++ {
+			y := pass.process(shelf.process(b.Data[i*b.Channels+c]))
+			power[i] += y * y
+		}
+	}
+
+	block := int(loudnessBlock * float64(b.SampleRate))
+	step := int(loudnessStep * float64(b.SampleRate))
+	var blocks []float64
+	if frames < block {
+		// 不足一个门限块时整体作为一块
+		block = frames
+	}
+	// 前缀和便于求每块的均值
+	prefix := make([]float64, frames+1)
+	for i, p := range power {
+		prefix[i+1] = prefix[i] + p
+	}
+	for start := 0; start+block <= frames; start += step {
+		blocks = append(blocks, (prefix[start+block]-prefix[start])/float64(block))
+	}
+
+	gated := func(threshold float64) (float64, int) {
+		sum, n := 0.0, 0
+		for _, z := range blocks {
+			if blockLoudness(z) > threshold {
+				sum += z
+				n++
+			}
+		}
+		return sum, n
+	}
+	sum, n := gated(absoluteGate)
+	if n == 0 {
+		return math.Inf(-1)
+	}
+	relative := blockLoudness(sum/float64(n)) + relativeGateDelta
+	sum, n = gated(math.Max(absoluteGate, relative))
+	if n == 0 {
+		return math.Inf(-1)
+	}
+	return blockLoudness(sum / float64(n))
+}
+
+func blockLoudness(z float64) float64 {
+	if z <= 0 {
+		return math.Inf(-1)
+	}
+	return -0.691 + 10*math.Log10(z)
+}
+
+// Peak returns the sample peak of b in dBFS.
+func Peak(b *Buffer) float64 {
+	peak := 0.0
+	for _, v := range b.Data {
+		peak = math.Max(peak, math.Abs(v))
+	}
+	return AmpToDB(peak)
+}
+
+// DBToAmp converts decibels to a linear amplitude factor.
+func DBToAmp(db float64) float64 {
+	return math.Pow(10, db/20)
+}
+
+// AmpToDB converts a linear amplitude to decibels.
+func AmpToDB(amp float64) float64 {
+	if amp <= 0 {
+		return math.Inf(-1)
+	}
+	return 20 * math.Log10(amp)
+}
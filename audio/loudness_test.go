@@ -0,0 +1,51 @@
+package audio
+
+import (
+	"math"
+	"testing"
+)
+
+// tone appends seconds of a 997 Hz sine at db dBFS on every channel of b.
+func tone(b *Buffer, db, seconds float64) {
+	amp := DBToAmp(db)
+	start := b.Frames()
+	for i := 0; i < int(seconds*float64(b.SampleRate)); i++ {
+		v := amp * math.Sin(2*math.Pi*997*float64(start+i)/float64(b.SampleRate))
+		for c := 0; c < b.Channels; c++ {
+			b.Data = append(b.Data, v)
+		}
+	}
+}
+
+func TestLoudness(t *testing.T) {
+	// EBU Tech 3341 的 1 到 3 号用例
+	for _, c := range []struct {
+		parts [][2]float64 // dBFS, 秒
+		want  float64
+	}{
+		{[][2]float64{{-23, 20}}, -23},
+		{[][2]float64{{-33, 20}}, -33},
+		// 比整体低 10 LU 以上的部分被相对门限排除
+		{[][2]float64{{-36, 10}, {-23, 60}, {-36, 10}}, -23},
+	} {
+		for _, rate := range []int{48000, 32000} {
+			b := &Buffer{SampleRate: rate, Channels: 2}
+			for _, part := range c.parts {
+				tone(b, part[0], part[1])
+			}
+			if got := Loudness(b); math.Abs(got-c.want) > 0.1 {
+				t.Errorf("%v at %d Hz: %.2f LUFS, want %.1f", c.parts, rate, got, c.want)
+			}
+		}
+	}
+	// 单声道少 3 LU
+	mono := &Buffer{SampleRate: 48000, Channels: 1}
+	tone(mono, -20, 5)
+	if got := Loudness(mono); math.Abs(got+23.01) > 0.1 {
+		t.Errorf("mono -20 dBFS tone: %.2f LUFS", got)
+	}
+	silent := &Buffer{SampleRate: 48000, Channels: 1, Data: make([]float64, 48000)}
+	if got := Loudness(silent); !math.IsInf(got, -1) {
+		t.Errorf("silence: %f LUFS", got)
+	}
+}
@@ -0,0 +1,149 @@
+package audio
+
+import (
+	"math"
+	"time"
+)
+
+// Gain scales b by db decibels in place.
+func Gain(b *Buffer, db float64) {
+	g := DBToAmp(db)
+	for i := range b.Data {
+		b.Data[i] *= g
+	}
+}
+
+// Limit keeps the sample peak of b under ceilingDB dBFS in place. The gain is
+// reduced ahead of each peak over lookahead, so that it never changes
+// abruptly, and recovers with the time constant release.
+func Limit(b *Buffer, ceilingDB float64, lookahead, release time.Duration) {
+	frames := b.Frames()
+	if frames == 0 {
+		return
+	}
+	ceiling := DBToAmp(ceilingDB)
+	// 每帧需要的增益
+	need := make([]float64, frames)
+	for i := 0; i < frames; i++ {
+		peak := 0.0
+		for c := 0; c < b.Channels; c++ {
+			peak = math.Max(peak, math.Abs(b.Data[i*b.Channels+c]))
+		}
+		need[i] = 1
+		if peak > ceiling {
+			need[i] = ceiling / peak
+		}
+	}
+	ahead := int(lookahead.Seconds() * float64(b.SampleRate))
+	if ahead < 1 {
+		ahead = 1
+	}
+
+	// 向前看 ahead 帧的滑动最小值（单调队列）
+	minAhead := make([]float64, frames)
+	var queue []int
+	for i := frames - 1; i >= 0; i-- {
+		for len(queue) > 0 && need[queue[len(queue)-1]] >= need[i] {
+			queue = queue[:len(queue)-1]
+		}
+		queue = append(queue, i)
+		if queue[0] > i+ahead {
+			queue = queue[1:]
+		}
+		minAhead[i] = need[queue[0]]
+	}
+
+	// 对滑动最小值做 ahead 帧的平均，使增益在峰值前平滑下降且到峰值时不超过所需值
+	smooth := make([]float64, frames)
+	sum := float64(ahead) // 开头之前视为增益 1
+	window := make([]float64, ahead)
+	for i := range window {
+		window[i] = 1
+	}
+	for i := 0; i < frames; i++ {
+		sum += minAhead[i] - window[i%ahead]
+		window[i%ahead] = minAhead[i]
+		smooth[i] = sum / float64(ahead)
+	}
+
+	coef := 1.0
+	if release > 0 {
+		coef = 1 - math.Exp(-1/(release.Seconds()*float64(b.SampleRate)))
+	}
+	gain := 1.0
+	for i := 0; i < frames; i++ {
+		if smooth[i] < gain {
+			gain = smooth[i]
+		} else {
+			gain += (smooth[i] - gain) * coef
+		}
+		// 浮点误差可能让平均值略高于所需增益
+		g := math.Min(gain, need[i])
+		for c := 0; c < b.Channels; c++ {
+			b.Data[i*b.Channels+c] *= g
+		}
+	}
+}
+
+// TrimSilence removes the leading and trailing frames whose level stays below
+// thresholdDB dBFS on every channel, keeping pad of silence on each side.
+// Audio that is silent throughout is left untouched.
+func TrimSilence(b *Buffer, thresholdDB float64, pad time.Duration) {
+	frames := b.Frames()
+	threshold := DBToAmp(thresholdDB)
+	loud := func(i int) bool {
+		for c := 0; c < b.Channels; c++ {
+			if math.Abs(b.Data[i*b.Channels+c]) > threshold {
+				return true
+			}
+		}
+		return false
+	}
+	first := 0
+	for first < frames && !loud(first) {
+		first++
+	}
+	if first == frames {
+		return
+	}
+	last := frames - 1
+	for last > first && !loud(last) {
+		last--
+	}
+	keep := int(pad.Seconds() * float64(b.SampleRate))
+	first = max(first-keep, 0)
+	last = min(last+keep, frames-1)
+	b.Data = b.Data[first*b.Channels : (last+1)*b.Channels]
+}
+
+// Fade applies raised-cosine fades of the given lengths to the start and the
+// end of b in place. Each fade is limited to half of the audio.
+func Fade(b *Buffer, in, out time.Duration) {
+	frames := b.Frames()
+	fade := func(d time.Duration, at func(i int) int) {
+		n := min(int(d.Seconds()*float64(b.SampleRate)), frames/2)
+		for i := 0; i < n; i++ {
+			g := 0.5 - 0.5*math.Cos(math.Pi*float64(i)/float64(n))
+			frame := at(i)
+			for c := 0; c < b.Channels; c++ {
+				b.Data[frame*b.Channels+c] *= g
+			}
+		}
+	}
+	fade(in, func(i int) int { return i })
+	fade(out, func(i int) int { return frames - 1 - i })
+}
+
+func min(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func max(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,62 @@
+package audio
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestLimit(t *testing.T) {
+	for _, ceiling := range []float64{-1, -6, -20} {
+		b := &Buffer{SampleRate: 48000, Channels: 2}
+		tone(b, -30, 0.5)
+		tone(b, 0, 0.5)
+		tone(b, -30, 0.5)
+		Limit(b, ceiling, 5*time.Millisecond, 50*time.Millisecond)
+		if peak := Peak(b); peak > ceiling+1e-9 {
+			t.Errorf("ceiling %v dBFS: peak %f", ceiling, peak)
+		}
+		// 限制器在峰值之前的 5ms 内开始压低增益，之前的部分不受影响
+		quiet := &Buffer{SampleRate: 48000, Channels: 2, Data: b.Data[:2*(24000-480)]}
+		if peak := Peak(quiet); math.Abs(peak+30) > 0.01 {
+			t.Errorf("ceiling %v dBFS: quiet part at %f", ceiling, peak)
+		}
+	}
+}
+
+func TestTrimSilence(t *testing.T) {
+	b := &Buffer{SampleRate: 16000, Channels: 1, Data: make([]float64, 16000)}
+	tone(b, -20, 1)
+	b.Data = append(b.Data, make([]float64, 16000)...)
+	TrimSilence(b, -50, 50*time.Millisecond)
+	// 正弦的过零点也低于门限，长度允许一个周期的误差
+	if d := b.Duration(); d < 1090*time.Millisecond || d > 1100*time.Millisecond {
+		t.Fatalf("trimmed to %s", d)
+	}
+
+	silent := &Buffer{SampleRate: 16000, Channels: 1, Data: make([]float64, 1600)}
+	TrimSilence(silent, -50, 0)
+	if silent.Frames() != 1600 {
+		t.Fatalf("silence trimmed to %d frames", silent.Frames())
+	}
+}
+
+func TestFade(t *testing.T) {
+	b := &Buffer{SampleRate: 1000, Channels: 2, Data: make([]float64, 2*1000)}
+	for i := range b.Data {
+		b.Data[i] = 1
+	}
+	Fade(b, 100*time.Millisecond, 200*time.Millisecond)
+	for _, c := range []struct {
+		frame int
+		want  float64
+	}{
+		{0, 0}, {50, 0.5}, {100, 1}, {500, 1}, {899, 0.5}, {999, 0},
+	} {
+		for ch := 0; ch < 2; ch++ {
+			if got := b.Data[2*c.frame+ch]; math.Abs(got-c.want) > 0.01 {
+				t.Errorf("frame %d channel %d: %f, want %f", c.frame, ch, got, c.want)
+			}
+		}
+	}
+}
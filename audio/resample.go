@@ -0,0 +1,67 @@
+package audio
+
+import "math"
+
+// resampleZeroCrossings 是插值核每侧的过零点数，越大越接近理想低通
+const resampleZeroCrossings = 16
+
+// Resample converts b to rate with a windowed-sinc interpolator. When
+// downsampling the kernel is widened so that it also acts as the anti-alias
+// low-pass filter.
+func Resample(b *Buffer, rate int) *Buffer {
+	if rate == b.SampleRate || b.Frames() == 0 {
+		return b
+	}
+	ratio := float64(rate) / float64(b.SampleRate)
+	scale := math.Min(1, ratio) // 截止频率相对输入奈奎斯特频率的比例
+	half := float64(resampleZeroCrossings) / scale
+	frames := b.Frames()
+	outFrames := int(math.Round(float64(frames) * ratio))
+	out := &Buffer{SampleRate: rate, Channels: b.Channels, BitDepth: b.BitDepth, Data: make([]float64, outFrames*b.Channels)}
+
+	weights := make([]float64, 0, int(2*half)+2)
+	for i := 0; i < outFrames; i++ {
+		t := float64(i) / ratio
+		first := int(math.Ceil(t - half))
+		last := int(math.Floor(t + half))
+		weights = weights[:0]
+		sum := 0.0
+		for k := first; k <= last; k++ {
+			x := t - float64(k)
+			w := scale * sinc(scale*x) * blackman(x/half)
+			weights = append(weights, w)
+			sum += w
+		}
+		if sum == 0 {
+			continue
+		}
+		for c := 0; c < b.Channels; c++ {
+			acc := 0.0
+			for j, w := range weights {
+				k := first + j
+				if k < 0 || k >= frames {
+					continue
+				}
+				acc += w * b.Data[k*b.Channels+c]
+			}
+			// 按权重和归一化，避免直流增益随相位抖动
+			out.Data[i*b.Channels+c] = acc / sum
+		}
+	}
+	return out
+}
+
+func sinc(x float64) float64 {
+	if x == 0 {
+		return 1
+	}
+	return math.Sin(math.Pi*x) / (math.Pi * x)
+}
+
+// blackman is the Blackman window over [-1, 1].
+func blackman(x float64) float64 {
+	if x <= -1 || x >= 1 {
+		return 0
+	}
+	return 0.42 + 0.5*math.Cos(math.Pi*x) + 0.08*math.Cos(2*math.Pi*x)
+}
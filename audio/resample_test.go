@@ -0,0 +1,34 @@
+package audio
+
+import (
+	"math"
+	"testing"
+)
+
+func TestResample(t *testing.T) {
+	b := &Buffer{SampleRate: 32000, Channels: 2, Data: make([]float64, 2*32000)}
+	for i := 0; i < 32000; i++ {
+		b.Data[2*i] = 0.5 * math.Sin(2*math.Pi*1000*float64(i)/32000)
+		b.Data[2*i+1] = 0.25 // 直流
+	}
+	for _, rate := range []int{48000, 16000, 8000} {
+		out := Resample(b, rate)
+		if out.SampleRate != rate || out.Channels != 2 || out.Frames() != rate || out.Duration() != b.Duration() {
+			t.Fatalf("%d Hz: %d frames at %d Hz", rate, out.Frames(), out.SampleRate)
+		}
+		// 远离两端的地方 1kHz 正弦的幅度和直流都保持不变
+		peak := 0.0
+		for i := rate / 4; i < rate*3/4; i++ {
+			peak = math.Max(peak, math.Abs(out.Data[2*i]))
+			if dc := out.Data[2*i+1]; math.Abs(dc-0.25) > 1e-3 {
+				t.Fatalf("%d Hz: dc %f at frame %d", rate, dc, i)
+			}
+		}
+		if math.Abs(peak-0.5) > 0.01 {
+			t.Errorf("%d Hz: peak %f", rate, peak)
+		}
+	}
+	if same := Resample(b, 32000); same != b {
+		t.Error("resampled to its own rate")
+	}
+}
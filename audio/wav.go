@@ -0,0 +1,141 @@
+package audio
+
+import (
+	"encoding/binary"
+	"github.com/pkg/errors"
+	"io"
+)
+
+const (
+	FormatPCM   uint16 = 1
+	FormatFloat uint16 = 3
+
+	// UnknownSize 流式输出时 RIFF/data 长度未知，按惯例写 0xFFFFFFFF
+	UnknownSize uint32 = 0xFFFFFFFF
+)
+
+var (
+	ErrNotRIFF   = errors.New("not a RIFF/WAVE stream")
+	ErrNoFormat  = errors.New("missing fmt chunk before data chunk")
+	ErrBadFormat = errors.New("unsupported wav format")
+)
+
+// Format describes the sample layout of a WAV stream.
+type Format struct {
+	AudioFormat   uint16 `json:"audioFormat"`
+	Channels      uint16 `json:"channels"`
+	SampleRate    uint32 `json:"sampleRate"`
+	BitsPerSample uint16 `json:"bitsPerSample"`
+}
+
+// BlockAlign returns the size in bytes of one frame (one sample of every channel).
+func (f Format) BlockAlign() int {
+	return int(f.Channels) * int(f.BitsPerSample) / 8
+}
+
+// ByteRate returns the number of bytes per second of audio.
+func (f Format) ByteRate() int {
+	return int(f.SampleRate) * f.BlockAlign()
+}
+
+func (f Format) validate() error {
+	if f.Channels == 0 || f.SampleRate == 0 {
+		return errors.Wrap(ErrBadFormat, "zero channels or sample rate")
+	}
+	switch f.AudioFormat {
+	case FormatPCM:
+		switch f.BitsPerSample {
+		case 8, 16, 24, 32:
+			return nil
+		}
+	case FormatFloat:
+		if f.BitsPerSample == 32 {
+			return nil
+		}
+	case FormatMuLaw, FormatALaw:
+		if f.BitsPerSample == 8 {
+			return nil
+		}
+	default:
+		return errors.Wrapf(ErrBadFormat, "audio format %d", f.AudioFormat)
+	}
+	return errors.Wrapf(ErrBadFormat, "%d bits per sample for audio format %d", f.BitsPerSample, f.AudioFormat)
+}
+
+// ReadHeader consumes r up to the first byte of the data chunk and returns the
+// format together with the declared data size (UnknownSize for streams).
+func ReadHeader(r io.Reader) (Format, uint32, error) {
+	var f Format
+	var riff [12]byte
+	if _, err := io.ReadFull(r, riff[:]); err != nil {
+		return f, 0, errors.Wrap(err, "read riff header")
+	}
+	if string(riff[0:4]) != "RIFF" || string(riff[8:12]) != "WAVE" {
+		return f, 0, ErrNotRIFF
+	}
+	hasFormat := false
+	for {
+		var chunk [8]byte
+		if _, err := io.ReadFull(r, chunk[:]); err != nil {
+			return f, 0, errors.Wrap(err, "read chunk header")
+		}
+		id := string(chunk[0:4])
+		size := binary.LittleEndian.Uint32(chunk[4:8])
+		switch id {
+		case "fmt ":
+			if size < 16 {
+				return f, 0, errors.Wrapf(ErrBadFormat, "fmt chunk of %d bytes", size)
+			}
+			body := make([]byte, size+size%2)
+			if _, err := io.ReadFull(r, body); err != nil {
+				return f, 0, errors.Wrap(err, "read fmt chunk")
+			}
+			f.AudioFormat = binary.LittleEndian.Uint16(body[0:2])
+			f.Channels = binary.LittleEndian.Uint16(body[2:4])
+			f.SampleRate = binary.LittleEndian.Uint32(body[4:8])
+			f.BitsPerSample = binary.LittleEndian.Uint16(body[14:16])
+			// WAVE_FORMAT_EXTENSIBLE，子格式 GUID 的前两个字节即真实格式
+			if f.AudioFormat == 0xFFFE && size >= 26 {
+				f.AudioFormat = binary.LittleEndian.Uint16(body[24:26])
+			}
+			if err := f.validate(); err != nil {
+				return f, 0, err
+			}
+			hasFormat = true
+		case "data":
+			if !hasFormat {
+				return f, 0, ErrNoFormat
+			}
+			return f, size, nil
+		default:
+			if _, err := io.CopyN(io.Discard, r, int64(size+size%2)); err != nil {
+				return f, 0, errors.Wrapf(err, "skip %q chunk", id)
+			}
+		}
+	}
+}
+
+// WriteHeader writes a canonical 44 byte header. Pass UnknownSize as dataSize
+// when the length is not known in advance.
+func WriteHeader(w io.Writer, f Format, dataSize uint32) error {
+	riffSize := UnknownSize
+	if dataSize != UnknownSize {
+		riffSize = 36 + dataSize
+	}
+	var h [44]byte
+	copy(h[0:4], "RIFF")
+	binary.LittleEndian.PutUint32(h[4:8], riffSize)
+	copy(h[8:12], "WAVE")
+	copy(h[12:16], "fmt ")
+	binary.LittleEndian.PutUint32(h[16:20], 16)
+	binary.LittleEndian.PutUint16(h[20:22], f.AudioFormat)
+	binary.LittleEndian.PutUint16(h[22:24], f.Channels)
+	binary.LittleEndian.PutUint32(h[24:28], f.SampleRate)
+	binary.LittleEndian.PutUint32(h[28:32], uint32(f.ByteRate()))
+	binary.LittleEndian.PutUint16(h[32:34], uint16(f.BlockAlign()))
+	binary.LittleEndian.PutUint16(h[34:36], f.BitsPerSample)
+	copy(h[36:40], "data")
+	binary.LittleEndian.PutUint32(h[40:44], dataSize)
+	_, err := w.Write(h[:])
+	return err
+}
@@ -0,0 +1,77 @@
+package backend
+
+import (
+	"context"
+	"errors"
+	"io"
+)
+
+// Backend is a TTS engine. Implementations hold a single loaded model at a
+// time, callers are expected to serialize LoadModel and synthesis calls.
+type Backend interface {
+	// Name identifies the backend instance in logs, e.g. its address.
+	Name() string
+	// LoadModel switches the engine to model.
+	LoadModel(ctx context.Context, model Model) error
+	// Synthesize returns the complete WAV file for req.
+	Synthesize(ctx context.Context, req *Request) ([]byte, error)
+	// Stream returns a WAV stream whose header carries an unknown length,
+	// followed by PCM data as the engine produces it.
+	Stream(ctx context.Context, req *Request) (io.ReadCloser, error)
+	// Health returns nil when the engine is reachable.
+	Health(ctx context.Context) error
+}
+
+type Model struct {
+	Name       string
+	GptPath    string
+	SovitsPath string
+}
+
+type Request struct {
+	Text             string
+	Lang             string
+	RefAudioPath     string
+	AuxRefAudioPaths []string
+	PromptText       string
+	PromptLang       string
+	Params           Params
+}
+
+// Params are the resolved inference parameters of a request.
+type Params struct {
+	TopK              int
+	TopP              float64
+	Temperature       float64
+	TextSplitMethod   string
+	BatchSize         int
+	BatchThreshold    float64
+	SplitBucket       bool
+	SpeedFactor       float64
+	Seed              int64
+	ParallelInfer     bool
+	RepetitionPenalty float64
+}
+
+// permanentError marks failures that will not succeed on retry, e.g. the
+// engine rejecting the request.
+type permanentError struct {
+	err error
+}
+
+func (e *permanentError) Error() string { return e.err.Error() }
+func (e *permanentError) Unwrap() error { return e.err }
+
+// Permanent wraps err so IsPermanent reports true for it.
+func Permanent(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &permanentError{err: err}
+}
+
+// IsPermanent reports whether err was marked by Permanent.
+func IsPermanent(err error) bool {
+	var p *permanentError
+	return errors.As(err, &p)
+}
@@ -0,0 +1,153 @@
+package fake
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"github.com/pkg/errors"
+	"hash/fnv"
+	"io"
+	"math"
+	"sync"
+	"time"
+	"ttsapi/audio"
+	"ttsapi/backend"
+)
+
+const (
+	SampleRate = 32000
+
+	runeDuration = 80 * time.Millisecond // 每个字符对应的音频时长
+	minDuration  = 200 * time.Millisecond
+	chunkSamples = SampleRate / 10 // 流式输出每 100ms 一块
+	amplitude    = 0.3
+)
+
+// Format is the audio format produced by the fake backend.
+var Format = audio.Format{
+	AudioFormat:   audio.FormatPCM,
+	Channels:      1,
+	SampleRate:    SampleRate,
+	BitsPerSample: 16,
+}
+
+// Backend is an in-process engine that renders a sine tone whose pitch is
+// derived from the loaded model and the text, and whose length grows with the
+// text. The same input always yields the same bytes.
+type Backend struct {
+	// Latency is added before every synthesis, to mimic a real engine.
+	Latency time.Duration
+
+	mu    sync.Mutex
+	model string
+	loads int
+}
+
+var _ backend.Backend = (*Backend)(nil)
+
+func New() *Backend {
+	return &Backend{}
+}
+
+func (b *Backend) Name() string {
+	return "fake"
+}
+
+func (b *Backend) LoadModel(ctx context.Context, model backend.Model) error {
+	if model.Name == "" {
+		return backend.Permanent(errors.New("empty model name"))
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.model = model.Name
+	b.loads++
+	return nil
+}
+
+// Loads returns how many times LoadModel has been called.
+func (b *Backend) Loads() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.loads
+}
+
+func (b *Backend) Synthesize(ctx context.Context, req *backend.Request) ([]byte, error) {
+	samples, err := b.render(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	buf := &bytes.Buffer{}
+	if err := audio.WriteHeader(buf, Format, uint32(len(samples)*2)); err != nil {
+		return nil, err
+	}
+	if err := binary.Write(buf, binary.LittleEndian, samples); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (b *Backend) Stream(ctx context.Context, req *backend.Request) (io.ReadCloser, error) {
+	samples, err := b.render(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	r, w := io.Pipe()
+	go func() {
+		err := audio.WriteHeader(w, Format, audio.UnknownSize)
+		for i := 0; err == nil && i < len(samples); i += chunkSamples {
+			end := i + chunkSamples
+			if end > len(samples) {
+				end = len(samples)
+			}
+			if err = ctx.Err(); err == nil {
+				err = binary.Write(w, binary.LittleEndian, samples[i:end])
+			}
+		}
+		w.CloseWithError(err)
+	}()
+	return r, nil
+}
+
+func (b *Backend) Health(ctx context.Context) error {
+	return nil
+}
+
+func (b *Backend) render(ctx context.Context, req *backend.Request) ([]int16, error) {
+	b.mu.Lock()
+	model := b.model
+	b.mu.Unlock()
+	if model == "" {
+		return nil, errors.New("no model loaded")
+	}
+	if req.Text == "" {
+		return nil, backend.Permanent(errors.New("empty text"))
+	}
+	if b.Latency > 0 {
+		select {
+		case <-time.After(b.Latency):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+
+	h := fnv.New32a()
+	h.Write([]byte(model))
+	h.Write([]byte{0})
+	h.Write([]byte(req.Text))
+	freq := 220 + float64(h.Sum32()%660) // 220Hz ~ 880Hz
+
+	speed := req.Params.SpeedFactor
+	if speed <= 0 {
+		speed = 1
+	}
+	duration := time.Duration(float64(len([]rune(req.Text))*int(runeDuration)) / speed)
+	if duration < minDuration {
+		duration = minDuration
+	}
+	n := int(duration.Seconds() * SampleRate)
+	samples := make([]int16, n)
+	for i := range samples {
+		samples[i] = int16(amplitude * math.MaxInt16 * math.Sin(2*math.Pi*freq*float64(i)/SampleRate))
+	}
+	return samples, nil
+}
@@ -0,0 +1,167 @@
+package gptsovits
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/pkg/errors"
+	"io"
+	"net/http"
+	"net/url"
+	"time"
+	"ttsapi/backend"
+	"ttsapi/logger"
+)
+
+const loadTimeout = 5 * time.Second
+
+// Client drives a GPT-SoVITS api_v2 server.
+type Client struct {
+	addr   string
+	client *http.Client
+}
+
+var _ backend.Backend = (*Client)(nil)
+
+// New returns a client for the api_v2 server listening at addr.
+func New(addr string) *Client {
+	return &Client{addr: addr, client: &http.Client{}}
+}
+
+func (c *Client) Name() string {
+	return c.addr
+}
+
+func (c *Client) LoadModel(ctx context.Context, model backend.Model) error {
+	if err := c.setWeights(ctx, "set_gpt_weights", model.GptPath); err != nil {
+		return errors.Wrap(err, "set gpt model failed")
+	}
+	if err := c.setWeights(ctx, "set_sovits_weights", model.SovitsPath); err != nil {
+		return errors.Wrap(err, "set sovits model failed")
+	}
+	logger.Infof(ctx, "%s model changed to %s", c.addr, model.Name)
+	return nil
+}
+
+func (c *Client) setWeights(ctx context.Context, endpoint, weightsPath string) error {
+	ctx, cancel := context.WithTimeout(ctx, loadTimeout)
+	defer cancel()
+	baseUrl, err := url.Parse(c.addr)
+	if err != nil {
+		return err
+	}
+	baseUrl.Path = endpoint
+	query := url.Values{}
+	query.Add("weights_path", weightsPath)
+	baseUrl.RawQuery = query.Encode()
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, baseUrl.String(), nil)
+	if err != nil {
+		return err
+	}
+	res, err := c.client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return statusError(res)
+	}
+	return nil
+}
+
+func (c *Client) Synthesize(ctx context.Context, req *backend.Request) ([]byte, error) {
+	resp, err := c.tts(ctx, req, false)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	return io.ReadAll(resp.Body)
+}
+
+func (c *Client) Stream(ctx context.Context, req *backend.Request) (io.ReadCloser, error) {
+	resp, err := c.tts(ctx, req, true)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+// Health succeeds when the server answers HTTP at all; api_v2 has no
+// dedicated health endpoint, so a 404 on / still means it is up.
+func (c *Client) Health(ctx context.Context) error {
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, c.addr, nil)
+	if err != nil {
+		return err
+	}
+	res, err := c.client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode >= http.StatusInternalServerError {
+		return errors.New("unhealthy: " + res.Status)
+	}
+	return nil
+}
+
+// tts posts req to /tts. Non-200 responses are turned into errors.
+func (c *Client) tts(ctx context.Context, req *backend.Request, streaming bool) (*http.Response, error) {
+	aux := req.AuxRefAudioPaths
+	if aux == nil {
+		aux = []string{}
+	}
+	p := req.Params
+	reqBody, err := json.Marshal(map[string]interface{}{
+		"text":                req.Text,
+		"text_lang":           req.Lang,
+		"ref_audio_path":      req.RefAudioPath,
+		"aux_ref_audio_paths": aux,
+		"prompt_text":         req.PromptText,
+		"prompt_lang":         req.PromptLang,
+		"top_k":               p.TopK,
+		"top_p":               p.TopP,
+		"temperature":         p.Temperature,
+		"text_split_method":   p.TextSplitMethod,
+		"batch_size":          p.BatchSize,
+		"batch_threshold":     p.BatchThreshold,
+		"split_bucket":        p.SplitBucket,
+		"speed_factor":        p.SpeedFactor,
+		"seed":                p.Seed,
+		"parallel_infer":      p.ParallelInfer,
+		"repetition_penalty":  p.RepetitionPenalty,
+		"media_type":          "wav",
+		"return_fragment":     streaming,
+		"streaming_mode":      streaming,
+	})
+	if err != nil {
+		return nil, err
+	}
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, fmt.Sprintf("%s/tts", c.addr), bytes.NewBuffer(reqBody))
+	if err != nil {
+		return nil, err
+	}
+	request.Header.Set("Content-Type", "application/json")
+	resp, err := c.client.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		resBody, _ := io.ReadAll(resp.Body)
+		logger.Errorf(ctx, "response status code %d body %s", resp.StatusCode, string(resBody))
+		return nil, statusError(resp)
+	}
+	return resp, nil
+}
+
+// statusError classifies a non-200 response: 4xx means the request itself is
+// bad, everything else may be transient.
+func statusError(resp *http.Response) error {
+	err := errors.New("bad status code " + resp.Status)
+	if resp.StatusCode >= 400 && resp.StatusCode < 500 &&
+		resp.StatusCode != http.StatusRequestTimeout && resp.StatusCode != http.StatusTooManyRequests {
+		return backend.Permanent(err)
+	}
+	return err
+}
@@ -8,6 +8,7 @@ import (
 	"time"
 	"ttsapi/config"
 	"ttsapi/logger"
+	"ttsapi/storage/blob"
 	"ttsapi/storage/gorm"
 	rds "ttsapi/storage/redis"
 	"ttsapi/utils/exit"
@@ -30,6 +31,12 @@ func preRun(cmd *cobra.Command, args []string) {
 	defer cancel()
 
 	conf := config.Get()
+	if conf.Server == nil {
+		panic(fmt.Errorf("config invalid: server is missing"))
+	}
+	if err := conf.Server.Validate(); err != nil {
+		panic(fmt.Errorf("config invalid: %s", err.Error()))
+	}
 	// TODO Mongo初始化
 	if conf.Resources != nil && len(conf.Resources.Storage.Mysql) > 0 {
 		if err := gorm.Init(ctx, conf.Resources.Storage.Mysql, gorm.DBTypeMysql); err != nil {
@@ -47,5 +54,12 @@ func preRun(cmd *cobra.Command, args []string) {
 			panic(fmt.Errorf("redis init error: %s", err.Error()))
 		}
 	}
+	var blobCfg *blob.Config
+	if conf.Resources != nil && conf.Resources.Storage != nil {
+		blobCfg = conf.Resources.Storage.Blob
+	}
+	if err := blob.Init(ctx, blobCfg, conf.Server.OutputAudioPath); err != nil {
+		panic(fmt.Errorf("blob store init error: %s", err.Error()))
+	}
 	go exit.HouseKeeping()
 }
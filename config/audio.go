@@ -0,0 +1,26 @@
+package config
+
+import "time"
+
+// Audio 合成结果的处理方式
+type Audio struct {
+	MaxSegmentLength int           `mapstructure:"max_segment_length"` // 长文本按句切分后每段的最大字符数，默认 100
+	SegmentSilence   time.Duration `mapstructure:"segment_silence"`    // 拼接时段与段之间插入的静音，默认 300ms
+	Normalize        *Normalize    `mapstructure:"normalize"`          // 文本规范化的全局规则
+	DialogueGap      time.Duration `mapstructure:"dialogue_gap"`       // 对白中同一角色连续两句之间的静音，默认 400ms
+	DialogueTurnGap  time.Duration `mapstructure:"dialogue_turn_gap"`  // 对白中换人说话时的静音，默认 700ms
+}
+
+// Normalize 文本规范化：把数字、日期、金额、单位、符号展开成读法后再合成
+type Normalize struct {
+	Rules   []NormalizeRule `mapstructure:"rules"`   // 自定义规则，在内置规则之前按顺序执行
+	Disable []string        `mapstructure:"disable"` // 关闭的内置规则，如 phone、fraction
+}
+
+// NormalizeRule 用正则替换实现的自定义规则
+type NormalizeRule struct {
+	Name    string `mapstructure:"name"`
+	Lang    string `mapstructure:"lang"`    // zh、yue、ja、en、ko，为空时不限语言
+	Pattern string `mapstructure:"pattern"` // Go 正则表达式
+	Replace string `mapstructure:"replace"` // 替换模板，可以用 $1、${name} 引用分组
+}
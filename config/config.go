@@ -5,4 +5,5 @@ var globalConfig = new(Config)
 type Config struct {
 	Server    *Server   `mapstructure:"server,omitempty"`
 	Resources *Resource `mapstructure:"resources"`
+	Audio     *Audio    `mapstructure:"audio"`
 }
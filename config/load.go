@@ -10,6 +10,7 @@ type Hook = mapstructure.DecodeHookFunc
 
 var defaultHooks = []Hook{
 	NewLoggerHook(),
+	mapstructure.StringToTimeDurationHookFunc(),
 }
 
 func Load(path string) (*Config, error) {
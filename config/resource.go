@@ -1,11 +1,53 @@
 package config
 
-import "ttsapi/storage"
+import (
+	"time"
+	"ttsapi/storage"
+)
 
 type Resource struct {
-	Storage *storage.Storage `mapstructure:"storage"`
-	Queue   *Queue           `mapstructure:"queue"`
+	Storage   *storage.Storage `mapstructure:"storage"`
+	Queue     *Queue           `mapstructure:"queue"`
+	Webhook   *Webhook         `mapstructure:"webhook"`
+	Retention *Retention       `mapstructure:"retention"`
+	Cache     *Cache           `mapstructure:"cache"`
 }
 
 type Queue struct {
+	MaxAttempts int           `mapstructure:"max_attempts"` // 包含第一次执行，默认 3
+	BackoffBase time.Duration `mapstructure:"backoff_base"` // 第一次重试前的等待时间，之后每次翻倍，默认 5s
+	BackoffMax  time.Duration `mapstructure:"backoff_max"`  // 单次等待上限，默认 5m
+
+	WorkerID          string        `mapstructure:"worker_id"`          // 为空时自动生成；固定后重启可立即恢复上次未完成的任务
+	VisibilityTimeout time.Duration `mapstructure:"visibility_timeout"` // 单个任务的最长执行时间，超时后重新入队，默认 10m
+	HeartbeatInterval time.Duration `mapstructure:"heartbeat_interval"` // 默认 10s，心跳 3 个周期未更新视为 worker 已退出
+	RecoveryInterval  time.Duration `mapstructure:"recovery_interval"`  // 检查孤儿任务的周期，默认 30s
+
+	MaxBatch     int           `mapstructure:"max_batch"`     // 同一后端连续执行同一模型的任务数上限，默认 16
+	MaxWait      time.Duration `mapstructure:"max_wait"`      // 任务最长等待时间，超过后无视模型亲和优先执行，默认 1m
+	PollInterval time.Duration `mapstructure:"poll_interval"` // 队列为空时的轮询间隔，默认 500ms
+}
+
+type Webhook struct {
+	MaxAttempts int           `mapstructure:"max_attempts"` // 单次回调最多投递次数，默认 8
+	BackoffBase time.Duration `mapstructure:"backoff_base"` // 第一次重试前的等待时间，之后每次翻倍，默认 10s
+	BackoffMax  time.Duration `mapstructure:"backoff_max"`  // 单次等待上限，默认 1h
+	Timeout     time.Duration `mapstructure:"timeout"`      // 单次请求超时，默认 10s
+
+	AllowPrivate bool `mapstructure:"allow_private"` // 允许回调到回环、内网和链路本地地址，仅用于内网部署和测试
+}
+
+// Retention 结果文件和任务记录的保留策略，可在 api_keys 中按调用方覆盖。负数表示永久保留
+type Retention struct {
+	Results     time.Duration `mapstructure:"results"`      // 结果文件在任务结束后保留多久，默认 168h
+	Tasks       time.Duration `mapstructure:"tasks"`        // 任务记录在任务结束后保留多久，默认 720h
+	Interval    time.Duration `mapstructure:"interval"`     // 清理周期，默认 1h
+	OrphanGrace time.Duration `mapstructure:"orphan_grace"` // 没有任务引用的文件至少存在多久才会被清理，默认 1h
+	DryRun      bool          `mapstructure:"dry_run"`      // 只报告将要删除的内容，不实际删除
+}
+
+// Cache 相同请求（模型、文本、语言、参数、输出格式都相同）复用已合成的结果
+type Cache struct {
+	Enabled   bool  `mapstructure:"enabled"`
+	MaxSizeMB int64 `mapstructure:"max_size_mb"` // 缓存文件总大小上限，超过后淘汰最久未使用的结果，默认 1024
 }
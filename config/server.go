@@ -1,14 +1,75 @@
 package config
 
-import "ttsapi/logger"
+import (
+	"fmt"
+	"time"
+	"ttsapi/logger"
+)
 
 type Server struct {
 	Port              string          `mapstructure:"port"`
 	TTSAddress        string          `mapstructure:"tts_address"`
+	TTSAddresses      []string        `mapstructure:"tts_addresses"` // 多个后端实例，为空时使用 tts_address
+	TTSBackend        string          `mapstructure:"tts_backend"`   // gptsovits(默认) 或 fake(生成测试音, 无需 GPU)
 	GPTWeightsPath    string          `mapstructure:"gpt_weights_path"`
 	SoVITSWeightsPath string          `mapstructure:"sovits_weights_path"`
 	ReferAudioPath    string          `mapstructure:"refer_audio_path"`
+	ModelsPath        string          `mapstructure:"models_path"` // 模型清单目录，每个模型一个 YAML 或 JSON 文件，优先于按文件名约定找到的同名模型
 	OutputAudioPath   string          `mapstructure:"output_audio_path"`
+	ScratchPath       string          `mapstructure:"scratch_path"` // 合成和转换过程中的临时文件目录，默认为系统临时目录
 	Authorization     string          `mapstructure:"authorization"`
+	WebhookSecret     string          `mapstructure:"webhook_secret"`    // authorization 对应的回调签名密钥
+	APIKeys           []APIKey        `mapstructure:"api_keys"`          // 除 authorization 外的其他访问密钥
+	PublicURL         string          `mapstructure:"public_url"`        // 对外访问地址（含 /v1），用于生成回调中的下载链接
+	WebSocketOrigins  []string        `mapstructure:"websocket_origins"` // 允许发起 WebSocket 会话的页面 Origin，* 表示不限制，为空时只允许同源；不带 Origin 的非浏览器客户端不受限制
 	Log               *logger.Options `mapstructure:"log"`
+
+	ModelWatch          *ModelWatch   `mapstructure:"model_watch"`           // 监听模型目录，文件变化后自动重新加载
+	HealthCheckInterval time.Duration `mapstructure:"health_check_interval"` // 后端健康检查周期，默认 10s
+	UnhealthyThreshold  int           `mapstructure:"unhealthy_threshold"`   // 连续失败多少次后摘除后端，默认 3
+}
+
+// ReservedKeyName 是 authorization 对应的调用方名称，api_keys 不能使用
+const ReservedKeyName = "default"
+
+// Validate checks the settings that have no default to fall back on.
+func (s *Server) Validate() error {
+	switch s.TTSBackend {
+	case "", "gptsovits", "fake":
+	default:
+		return fmt.Errorf("unknown tts_backend %q, expected gptsovits or fake", s.TTSBackend)
+	}
+	// 任务归属、回调签名和保留期限都按名称查找调用方，名称必须唯一
+	names := make(map[string]bool, len(s.APIKeys))
+	for i, key := range s.APIKeys {
+		switch {
+		case key.Name == "":
+			return fmt.Errorf("api_keys[%d] has no name", i)
+		case key.Name == ReservedKeyName:
+			return fmt.Errorf("api_keys[%d]: name %q is reserved for authorization", i, key.Name)
+		case names[key.Name]:
+			return fmt.Errorf("api_keys[%d]: name %q is used by another key", i, key.Name)
+		}
+		names[key.Name] = true
+	}
+	return nil
+}
+
+// ModelWatch 监听 gpt_weights_path、sovits_weights_path、refer_audio_path 和 models_path
+type ModelWatch struct {
+	Disabled bool          `mapstructure:"disabled"`
+	Debounce time.Duration `mapstructure:"debounce"` // 最后一次变化之后等待多久再加载，默认 2s
+}
+
+// APIKey 一个调用方的访问密钥
+type APIKey struct {
+	Key           string `mapstructure:"key"`            // Authorization 头的值
+	Name          string `mapstructure:"name"`           // 调用方名称，记录在任务中
+	WebhookSecret string `mapstructure:"webhook_secret"` // 回调签名密钥
+	Admin         bool   `mapstructure:"admin"`          // 可以调用 /admin 接口，访问所有调用方的任务；authorization 总是管理员
+
+	ResultRetention time.Duration `mapstructure:"result_retention"` // 覆盖 retention.results
+	TaskRetention   time.Duration `mapstructure:"task_retention"`   // 覆盖 retention.tasks
+
+	Normalize *Normalize `mapstructure:"normalize"` // 该调用方的文本规范化规则，先于 audio.normalize 执行，关闭的内置规则取并集
 }
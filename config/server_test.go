@@ -0,0 +1,21 @@
+package config
+
+import "testing"
+
+func TestServerValidateKeyNames(t *testing.T) {
+	cases := []struct {
+		keys []APIKey
+		ok   bool
+	}{
+		{[]APIKey{{Key: "a", Name: "alice"}, {Key: "b", Name: "bob"}}, true},
+		{[]APIKey{{Key: "a"}}, false},
+		{[]APIKey{{Key: "a", Name: ReservedKeyName}}, false},
+		{[]APIKey{{Key: "a", Name: "alice"}, {Key: "b", Name: "alice"}}, false},
+	}
+	for _, c := range cases {
+		err := (&Server{APIKeys: c.keys}).Validate()
+		if (err == nil) != c.ok {
+			t.Errorf("Validate(%+v) = %v", c.keys, err)
+		}
+	}
+}
@@ -0,0 +1,133 @@
+package handler
+
+import (
+	"context"
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"strings"
+	"ttsapi/config"
+	"ttsapi/server/httpserver/middles"
+)
+
+// defaultKeyName 是 server.authorization 对应的调用方名称
+const defaultKeyName = config.ReservedKeyName
+
+// callerKey 保存在 gin.Context 中的当前调用方
+const callerKey = "ttsapi.caller"
+
+// WebSocket 握手可以在 Sec-WebSocket-Protocol 中携带密钥：["ttsapi", "authorization.<key>"]，服务端只回应 ttsapi
+const (
+	wsProtocol     = "ttsapi"
+	wsAuthProtocol = "authorization."
+)
+
+// CredentialQueryParams 可能携带凭据的查询参数，不写入访问日志
+var CredentialQueryParams = []string{"authorization"}
+
+// lookupKey returns the API key whose value is authorization, or nil.
+func lookupKey(authorization string) *config.APIKey {
+	if authorization == "" {
+		return nil
+	}
+	server := config.Get().Server
+	if authorization == server.Authorization {
+		return defaultKey()
+	}
+	for i := range server.APIKeys {
+		if server.APIKeys[i].Key == authorization {
+			return &server.APIKeys[i]
+		}
+	}
+	return nil
+}
+
+// keyByName returns the API key called name, or nil.
+func keyByName(name string) *config.APIKey {
+	server := config.Get().Server
+	if name == defaultKeyName {
+		return defaultKey()
+	}
+	for i := range server.APIKeys {
+		if server.APIKeys[i].Name == name {
+			return &server.APIKeys[i]
+		}
+	}
+	return nil
+}
+
+// defaultKey returns the key configured as server.authorization, which is
+// an admin key.
+func defaultKey() *config.APIKey {
+	server := config.Get().Server
+	return &config.APIKey{Key: server.Authorization, Name: defaultKeyName, WebhookSecret: server.WebhookSecret, Admin: true}
+}
+
+// caller returns the API key of the request behind ctx, which is either the
+// *gin.Context or a context created by httpserver.NewHandlerFuncFrom.
+func caller(ctx context.Context) *config.APIKey {
+	if c, ok := ctx.Value(middles.GinContextKey).(*gin.Context); ok {
+		ctx = c
+	}
+	key, _ := ctx.Value(callerKey).(*config.APIKey)
+	if key == nil {
+		return &config.APIKey{Name: defaultKeyName, Admin: true}
+	}
+	return key
+}
+
+// owns reports whether key may access a task or batch created by owner.
+// Admin keys may access all of them. Records written before owners were kept
+// belong to the default key.
+func owns(key *config.APIKey, owner string) bool {
+	if owner == "" {
+		owner = defaultKeyName
+	}
+	return key.Admin || key.Name == owner
+}
+
+// authorize 校验 Authorization 头。浏览器无法为 WebSocket 握手设置请求头，此时允许用
+// Sec-WebSocket-Protocol 或 authorization 参数代替。
+func (handler *TTShHandler) authorize(ctx *gin.Context) {
+	authorization := ctx.Request.Header.Get("Authorization")
+	if authorization == "" && ctx.IsWebsocket() {
+		authorization = wsProtocolKey(ctx.Request)
+		if authorization == "" {
+			authorization = ctx.Query("authorization")
+		}
+	}
+	key := lookupKey(authorization)
+	if key == nil {
+		ctx.AbortWithStatusJSON(
+			http.StatusUnauthorized,
+			gin.H{"error": "Unauthorized"},
+		)
+		return
+	}
+	ctx.Set(callerKey, key)
+	ctx.Next()
+}
+
+// requireAdmin 只允许管理员密钥访问 /admin 下的接口和 /loadModels，须在 authorize 之后执行
+func (handler *TTShHandler) requireAdmin(ctx *gin.Context) {
+	if !caller(ctx).Admin {
+		ctx.AbortWithStatusJSON(
+			http.StatusForbidden,
+			gin.H{"error": "Forbidden"},
+		)
+		return
+	}
+	ctx.Next()
+}
+
+// wsProtocolKey returns the key a WebSocket handshake carries as an
+// authorization.<key> subprotocol, or "".
+func wsProtocolKey(r *http.Request) string {
+	for _, header := range r.Header.Values("Sec-WebSocket-Protocol") {
+		for _, protocol := range strings.Split(header, ",") {
+			if protocol = strings.TrimSpace(protocol); strings.HasPrefix(protocol, wsAuthProtocol) {
+				return protocol[len(wsAuthProtocol):]
+			}
+		}
+	}
+	return ""
+}
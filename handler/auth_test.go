@@ -0,0 +1,76 @@
+package handler
+
+import (
+	"context"
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"ttsapi/config"
+)
+
+func TestAdminScope(t *testing.T) {
+	env := newTestEnv(t, func(cfg *config.Config) {
+		cfg.Server.APIKeys = []config.APIKey{{Key: "user-key", Name: "user"}, {Key: "ops-key", Name: "ops", Admin: true}}
+	})
+	router := gin.New()
+	router.Use(env.handler.authorize)
+	router.GET("/taskStatus", func(ctx *gin.Context) { ctx.Status(http.StatusOK) })
+	router.Group("/admin", env.handler.requireAdmin).GET("/scheduler", func(ctx *gin.Context) { ctx.Status(http.StatusOK) })
+
+	for _, c := range []struct {
+		key, path string
+		code      int
+	}{
+		{"secret", "/admin/scheduler", http.StatusOK},
+		{"ops-key", "/admin/scheduler", http.StatusOK},
+		{"user-key", "/admin/scheduler", http.StatusForbidden},
+		{"user-key", "/taskStatus", http.StatusOK},
+		{"", "/admin/scheduler", http.StatusUnauthorized},
+	} {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodGet, c.path, nil)
+		r.Header.Set("Authorization", c.key)
+		router.ServeHTTP(w, r)
+		if w.Code != c.code {
+			t.Errorf("%s with %q: %d, want %d", c.path, c.key, w.Code, c.code)
+		}
+	}
+
+	// 管理员可以查看其他调用方的任务
+	user := context.WithValue(env.ctx, callerKey, keyByName("user"))
+	rsp, err := env.handler.NewTask(user, &NewTaskReq{Model: testModel, TextReq: TextReq{Text: "你好。", Lang: "zh"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ops := context.WithValue(env.ctx, callerKey, keyByName("ops"))
+	if _, err := env.handler.TaskStatus(ops, &TaskStatusReq{Id: rsp.Id}); err != nil {
+		t.Fatalf("admin key: %s", err)
+	}
+	if _, err := env.handler.TaskStatus(env.ctx, &TaskStatusReq{Id: rsp.Id}); err != nil {
+		t.Fatalf("default key: %s", err)
+	}
+}
+
+func TestLoadModelsIsAdminOnly(t *testing.T) {
+	env := newTestEnv(t, func(cfg *config.Config) {
+		cfg.Server.APIKeys = []config.APIKey{{Key: "user-key", Name: "user"}}
+	})
+	router := gin.New()
+	env.handler.routes(router.Group("/v1"))
+	for _, c := range []struct {
+		key  string
+		code int
+	}{
+		{"user-key", http.StatusForbidden},
+		{"secret", http.StatusOK},
+	} {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodGet, "/v1/loadModels", nil)
+		r.Header.Set("Authorization", c.key)
+		router.ServeHTTP(w, r)
+		if w.Code != c.code {
+			t.Errorf("/loadModels with %q: %d, want %d", c.key, w.Code, c.code)
+		}
+	}
+}
@@ -0,0 +1,326 @@
+package handler
+
+import (
+	"archive/zip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"github.com/gomodule/redigo/redis"
+	"github.com/google/uuid"
+	"github.com/pkg/errors"
+	"io"
+	"net/http"
+	"path"
+	"strings"
+	"ttsapi/audio"
+	"ttsapi/logger"
+	"ttsapi/server/httpserver/middles/status"
+	"ttsapi/storage/blob"
+	rds "ttsapi/storage/redis"
+)
+
+const (
+	batchKeyPrefix = "ttsapi:batch:"
+	maxBatchItems  = 1000
+)
+
+func batchKey(id string) string {
+	return batchKeyPrefix + id
+}
+
+type BatchItemReq struct {
+	Model string `json:"model"`
+	TextReq
+	Params *InferParams  `json:"params"`
+	Format *audio.Target `json:"format"`
+	Post   *PostProcess  `json:"postProcess"`
+	Ref    string        `json:"ref"` // 调用方自定义的引用，原样返回
+}
+
+type NewBatchReq struct {
+	Items    []BatchItemReq `json:"items"`
+	Callback string         `json:"callbackUrl"` // 可选，每个任务结束后各回调一次
+	NoCache  bool           `json:"noCache"`     // 不使用也不写入结果缓存
+}
+
+type BatchItem struct {
+	Id  string `json:"id"`
+	Ref string `json:"ref,omitempty"`
+}
+
+type NewBatchResp struct {
+	Id    string      `json:"id"`
+	Items []BatchItem `json:"items"`
+}
+
+// batchInfo is the record stored under ttsapi:batch:<id>.
+type batchInfo struct {
+	Id        string      `json:"id"`
+	Owner     string      `json:"owner,omitempty"`
+	Items     []BatchItem `json:"items"`
+	CreatedAt int64       `json:"createdAt"`
+}
+
+// NewBatch validates every item and enqueues all of them in one transaction:
+// either the whole batch is queued or nothing is.
+func (handler *TTShHandler) NewBatch(ctx context.Context, req *NewBatchReq) (*NewBatchResp, error) {
+	if len(req.Items) == 0 {
+		return nil, &status.Status{Code: http.StatusBadRequest, Message: "items is empty"}
+	}
+	if len(req.Items) > maxBatchItems {
+		return nil, &status.Status{Code: http.StatusBadRequest, Message: fmt.Sprintf("at most %d items per batch", maxBatchItems)}
+	}
+	key := caller(ctx)
+	if req.Callback != "" {
+		if err := handler.checkCallback(ctx, key, req.Callback); err != nil {
+			return nil, &status.Status{Code: http.StatusBadRequest, Message: err.Error()}
+		}
+	}
+
+	batch := &batchInfo{Id: uuid.New().String(), Owner: key.Name, CreatedAt: nowMilli()}
+	conn := rds.Get()
+	defer conn.Close()
+	var cmds []command
+	for i, item := range req.Items {
+		t, err := handler.newTask(key, item.Model, item.TextReq, item.Params)
+		if err != nil {
+			return nil, &status.Status{Code: status.GetCode(err), Message: fmt.Sprintf("items[%d]: %s", i, err)}
+		}
+		// 回调属于整个批次，已在上面检查过
+		if err := handler.setOutput(ctx, key, t, item.Format, item.Post, ""); err != nil {
+			return nil, &status.Status{Code: status.GetCode(err), Message: fmt.Sprintf("items[%d]: %s", i, err)}
+		}
+		t.Callback, t.Batch, t.Ref = req.Callback, batch.Id, item.Ref
+		if !req.NoCache {
+			handler.setCacheKey(ctx, t)
+		}
+		c, hit := []command(nil), false
+		if t.CacheKey != "" {
+			c, hit, err = cachedTaskCommands(ctx, conn, t)
+		}
+		if err == nil && !hit {
+			// 同一批次内按提交顺序执行
+			c, err = newTaskCommands(t, batch.CreatedAt+int64(i))
+		}
+		if err != nil {
+			return nil, &status.Status{Code: http.StatusInternalServerError, Message: err.Error()}
+		}
+		cmds = append(cmds, c...)
+		batch.Items = append(batch.Items, BatchItem{Id: t.Id, Ref: item.Ref})
+	}
+	js, err := json.Marshal(batch)
+	if err != nil {
+		return nil, &status.Status{Code: http.StatusInternalServerError, Message: err.Error()}
+	}
+	cmds = append([]command{cmd("SET", batchKey(batch.Id), js)}, cmds...)
+	if err := execCommands(cmds); err != nil {
+		return nil, &status.Status{Code: http.StatusInternalServerError, Message: err.Error()}
+	}
+	logger.Infof(ctx, "batch %s queued with %d tasks", batch.Id, len(batch.Items))
+	return &NewBatchResp{Id: batch.Id, Items: batch.Items}, nil
+}
+
+func getBatch(conn redis.Conn, id string) (*batchInfo, error) {
+	data, err := redis.Bytes(conn.Do("GET", batchKey(id)))
+	if err != nil {
+		if errors.Is(err, redis.ErrNil) {
+			return nil, &status.Status{Code: http.StatusNotFound, Message: "batch not found"}
+		}
+		return nil, &status.Status{Code: http.StatusInternalServerError, Message: err.Error()}
+	}
+	batch := &batchInfo{}
+	if err := json.Unmarshal(data, batch); err != nil {
+		return nil, &status.Status{Code: http.StatusInternalServerError, Message: err.Error()}
+	}
+	return batch, nil
+}
+
+// getOwnedBatch is getBatch for the batches of the caller of ctx.
+func getOwnedBatch(ctx context.Context, conn redis.Conn, id string) (*batchInfo, error) {
+	batch, err := getBatch(conn, id)
+	if err != nil {
+		return nil, err
+	}
+	if !owns(caller(ctx), batch.Owner) {
+		return nil, &status.Status{Code: http.StatusNotFound, Message: "batch not found"}
+	}
+	return batch, nil
+}
+
+// batchTasks loads the records of all items of batch, in item order. Missing
+// records are returned as nil.
+func (handler *TTShHandler) batchTasks(ctx context.Context, conn redis.Conn, batch *batchInfo) ([]*taskInfo, error) {
+	keys := make([]interface{}, len(batch.Items))
+	for i, item := range batch.Items {
+		keys[i] = taskKey(item.Id)
+	}
+	values, err := redis.ByteSlices(conn.Do("MGET", keys...))
+	if err != nil {
+		return nil, err
+	}
+	infos := make([]*taskInfo, len(values))
+	for i, data := range values {
+		if data == nil {
+			continue
+		}
+		info := &taskInfo{}
+		if err := json.Unmarshal(data, info); err != nil {
+			logger.Warnf(ctx, "bad record of task %s: %s", batch.Items[i].Id, err)
+			continue
+		}
+		if info.State == stateSucceeded {
+			// 顺便把结果已被清理的任务标记为 expired
+			if _, err := statResult(ctx, info.File); errors.Is(err, blob.ErrNotFound) {
+				if info, err = handler.loadTaskInfo(ctx, info.Id); err != nil {
+					continue
+				}
+			}
+		}
+		infos[i] = info
+	}
+	return infos, nil
+}
+
+type BatchStatusReq struct {
+	Id string `form:"id"`
+}
+
+type BatchItemStatus struct {
+	Id    string    `json:"id"`
+	Ref   string    `json:"ref,omitempty"`
+	State taskState `json:"state"`
+	Error string    `json:"error,omitempty"`
+}
+
+type BatchStatusResp struct {
+	Id        string            `json:"id"`
+	Total     int               `json:"total"`
+	Counts    map[taskState]int `json:"counts"`
+	Done      bool              `json:"done"` // 所有任务都已结束
+	CreatedAt int64             `json:"createdAt"`
+	Items     []BatchItemStatus `json:"items"`
+}
+
+func (handler *TTShHandler) BatchStatus(ctx context.Context, req *BatchStatusReq) (*BatchStatusResp, error) {
+	conn := rds.Get()
+	defer conn.Close()
+	batch, err := getOwnedBatch(ctx, conn, req.Id)
+	if err != nil {
+		return nil, err
+	}
+	infos, err := handler.batchTasks(ctx, conn, batch)
+	if err != nil {
+		return nil, &status.Status{Code: http.StatusInternalServerError, Message: err.Error()}
+	}
+	rsp := &BatchStatusResp{
+		Id:        batch.Id,
+		Total:     len(batch.Items),
+		Counts:    map[taskState]int{},
+		Done:      true,
+		CreatedAt: batch.CreatedAt,
+		Items:     make([]BatchItemStatus, len(batch.Items)),
+	}
+	for i, item := range batch.Items {
+		s := BatchItemStatus{Id: item.Id, Ref: item.Ref, State: stateExpired}
+		if info := infos[i]; info != nil {
+			s.State, s.Error = info.State, info.Error
+		}
+		rsp.Counts[s.State]++
+		rsp.Done = rsp.Done && s.State.terminal()
+		rsp.Items[i] = s
+	}
+	return rsp, nil
+}
+
+// batchFileName returns the name of item i inside the result archive.
+func batchFileName(i int, item BatchItem, ext string) string {
+	name := item.Ref
+	if name == "" {
+		name = item.Id
+	}
+	name = strings.Map(func(r rune) rune {
+		if r == '/' || r == '\\' || r < ' ' {
+			return '_'
+		}
+		return r
+	}, name)
+	return fmt.Sprintf("%04d-%s.%s", i+1, name, ext)
+}
+
+// BatchResult downloads all results of a batch as one zip archive, with a
+// manifest.json describing every item. Until every task has finished it
+// answers 409 unless partial=true is given.
+func (handler *TTShHandler) BatchResult(ctx *gin.Context) {
+	conn := rds.Get()
+	defer conn.Close()
+	batch, err := getOwnedBatch(ctx, conn, ctx.Query("id"))
+	if err != nil {
+		ctx.JSON(status.GetCode(err), gin.H{"code": status.GetCode(err), "message": err.Error()})
+		return
+	}
+	infos, err := handler.batchTasks(ctx, conn, batch)
+	if err != nil {
+		ctx.JSON(http.StatusInternalServerError, gin.H{"code": http.StatusInternalServerError, "message": err.Error()})
+		return
+	}
+	manifest := make([]gin.H, len(batch.Items))
+	for i, item := range batch.Items {
+		entry := gin.H{"id": item.Id, "ref": item.Ref, "state": stateExpired}
+		if info := infos[i]; info != nil {
+			entry["state"] = info.State
+			if info.Error != "" {
+				entry["error"] = info.Error
+			}
+			if !info.State.terminal() && ctx.Query("partial") != "true" {
+				ctx.JSON(http.StatusConflict, gin.H{"code": http.StatusConflict, "message": "batch is not finished"})
+				return
+			}
+			if info.State == stateSucceeded {
+				entry["file"] = batchFileName(i, item, path.Ext(resultFile(info))[1:])
+			}
+		}
+		manifest[i] = entry
+	}
+
+	ctx.Header("Content-Type", "application/zip")
+	ctx.Header("Content-Disposition", fmt.Sprintf(`attachment; filename="batch-%s.zip"`, batch.Id))
+	ctx.Status(http.StatusOK)
+	zw := zip.NewWriter(ctx.Writer)
+	for i, item := range batch.Items {
+		if infos[i] == nil || infos[i].State != stateSucceeded {
+			continue
+		}
+		file := resultFile(infos[i])
+		if err := addZipFile(ctx, zw, batchFileName(i, item, path.Ext(file)[1:]), file); err != nil {
+			// 已经开始输出，只能中断连接
+			logger.Errorf(ctx, "write batch %s result %s: %s", batch.Id, item.Id, err)
+			return
+		}
+	}
+	w, err := zw.Create("manifest.json")
+	if err == nil {
+		err = json.NewEncoder(w).Encode(manifest)
+	}
+	if err == nil {
+		err = zw.Close()
+	}
+	if err != nil {
+		logger.Errorf(ctx, "write batch %s manifest: %s", batch.Id, err)
+	}
+}
+
+func addZipFile(ctx context.Context, zw *zip.Writer, name, file string) error {
+	f, _, err := openResult(ctx, file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	// 音频基本无法压缩，直接存储
+	w, err := zw.CreateHeader(&zip.FileHeader{Name: name, Method: zip.Store})
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(w, f)
+	return err
+}
@@ -0,0 +1,116 @@
+package handler
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"github.com/gin-gonic/gin"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"ttsapi/server/httpserver/middles/status"
+)
+
+func batchItem(text, ref string) BatchItemReq {
+	return BatchItemReq{Model: testModel, TextReq: TextReq{Text: text, Lang: "zh"}, Ref: ref}
+}
+
+// batchResult downloads the archive of batch id and returns the status code
+// with the files in the archive.
+func (e *testEnv) batchResult(id string, partial bool) (int, map[string][]byte) {
+	e.t.Helper()
+	w := httptest.NewRecorder()
+	ctx, _ := gin.CreateTestContext(w)
+	query := "/batchResult?id=" + id
+	if partial {
+		query += "&partial=true"
+	}
+	ctx.Request = httptest.NewRequest(http.MethodGet, query, nil)
+	e.handler.BatchResult(ctx)
+	if w.Code != http.StatusOK {
+		return w.Code, nil
+	}
+	zr, err := zip.NewReader(bytes.NewReader(w.Body.Bytes()), int64(w.Body.Len()))
+	if err != nil {
+		e.t.Fatal(err)
+	}
+	files := map[string][]byte{}
+	for _, f := range zr.File {
+		r, err := f.Open()
+		if err != nil {
+			e.t.Fatal(err)
+		}
+		files[f.Name], err = io.ReadAll(r)
+		r.Close()
+		if err != nil {
+			e.t.Fatal(err)
+		}
+	}
+	return w.Code, files
+}
+
+func TestNewBatchIsAllOrNothing(t *testing.T) {
+	env := newTestEnv(t, nil)
+	items := []BatchItemReq{batchItem("你好。", "a"), batchItem("再见。", "b"), {Model: "nobody", TextReq: TextReq{Text: "你好。"}}}
+	_, err := env.handler.NewBatch(env.ctx, &NewBatchReq{Items: items})
+	if status.GetCode(err) != http.StatusBadRequest || !strings.HasPrefix(err.Error(), "items[2]:") {
+		t.Fatalf("batch with a bad item: %v", err)
+	}
+	for _, key := range env.redis.Keys() {
+		if strings.HasPrefix(key, taskKeyPrefix) || strings.HasPrefix(key, batchKeyPrefix) {
+			t.Errorf("%s stored for a rejected batch", key)
+		}
+	}
+	if queued := env.zset(modelQueue(testModel)); len(queued) != 0 {
+		t.Fatalf("model queue = %v", queued)
+	}
+}
+
+func TestBatchResult(t *testing.T) {
+	env := newTestEnv(t, nil)
+	rsp, err := env.handler.NewBatch(env.ctx, &NewBatchReq{Items: []BatchItemReq{batchItem("你好。", "greeting"), batchItem("再见。", "")}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rsp.Items) != 2 || rsp.Items[0].Ref != "greeting" {
+		t.Fatalf("batch items = %+v", rsp.Items)
+	}
+	// 同一批次按提交顺序执行
+	if id, err := env.run(); err != nil || id != rsp.Items[0].Id {
+		t.Fatalf("ran %s first: %v", id, err)
+	}
+
+	s, err := env.handler.BatchStatus(env.ctx, &BatchStatusReq{Id: rsp.Id})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Total != 2 || s.Done || s.Counts[stateSucceeded] != 1 || s.Counts[stateQueued] != 1 {
+		t.Fatalf("status = %+v", s)
+	}
+	if code, _ := env.batchResult(rsp.Id, false); code != http.StatusConflict {
+		t.Fatalf("unfinished batch: %d", code)
+	}
+	code, files := env.batchResult(rsp.Id, true)
+	if code != http.StatusOK || len(files) != 2 || files["0001-greeting.wav"] == nil {
+		t.Fatalf("partial result %d: %d files", code, len(files))
+	}
+	var manifest []map[string]string
+	if err := json.Unmarshal(files["manifest.json"], &manifest); err != nil {
+		t.Fatal(err)
+	}
+	if len(manifest) != 2 || manifest[0]["file"] != "0001-greeting.wav" || manifest[0]["state"] != string(stateSucceeded) ||
+		manifest[1]["state"] != string(stateQueued) || manifest[1]["file"] != "" || manifest[1]["id"] != rsp.Items[1].Id {
+		t.Fatalf("manifest = %v", manifest)
+	}
+
+	env.run()
+	if s, err = env.handler.BatchStatus(env.ctx, &BatchStatusReq{Id: rsp.Id}); err != nil || !s.Done {
+		t.Fatalf("status = %+v, %v", s, err)
+	}
+	code, files = env.batchResult(rsp.Id, false)
+	if second := "0002-" + rsp.Items[1].Id + ".wav"; code != http.StatusOK || len(files) != 3 || files[second] == nil {
+		t.Fatalf("result %d: %d files", code, len(files))
+	}
+}
@@ -0,0 +1,670 @@
+package handler
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"github.com/gomodule/redigo/redis"
+	"github.com/pkg/errors"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+	"ttsapi/audio"
+	"ttsapi/config"
+	"ttsapi/logger"
+	"ttsapi/server/httpserver/middles/status"
+	"ttsapi/storage/blob"
+	rds "ttsapi/storage/redis"
+)
+
+const (
+	cacheEntryPrefix    = "ttsapi:cache:entry:"     // 缓存条目，key 为请求内容的摘要
+	cacheLRU            = "ttsapi:cache:lru"        // zset，score 为最近一次使用的时间(ms)
+	cacheSize           = "ttsapi:cache:size"       // 缓存文件的总字节数
+	cacheModelPrefix    = "ttsapi:cache:model:"     // 每个模型的缓存条目集合，用于按模型清除
+	cacheStats          = "ttsapi:cache:stats"      // hash，命中统计
+	cacheInflightPrefix = "ttsapi:cache:inflight:"  // 摘要 -> 正在合成该内容的任务
+	followersPrefix     = "ttsapi:cache:followers:" // 任务 -> 等待它结果的相同任务
+
+	// cacheBlobPrefix 缓存结果在 blob 存储中的 key 前缀，文件归缓存所有，由 LRU 淘汰。
+	// 文件名为 <摘要>-<生成它的任务>，相同内容的任务同时结束时不会互相覆盖
+	cacheBlobPrefix = "cache/"
+
+	defaultCacheMaxSize = 1024 << 20
+	inflightTTL         = 24 * time.Hour
+)
+
+// storeEntryScript records a cache entry unless it already exists.
+var storeEntryScript = redis.NewScript(4, `
+if not redis.call('SET', KEYS[1], ARGV[1], 'NX') then
+	return 0
+end
+redis.call('ZADD', KEYS[2], ARGV[3], ARGV[2])
+redis.call('INCRBY', KEYS[3], ARGV[4])
+redis.call('SADD', KEYS[4], ARGV[2])
+return 1
+`)
+
+// removeEntryScript drops a cache entry with its bookkeeping and returns it,
+// so that exactly one caller deletes its files.
+var removeEntryScript = redis.NewScript(4, `
+local e = redis.call('GET', KEYS[1])
+if not e then
+	return false
+end
+local entry = cjson.decode(e)
+redis.call('DEL', KEYS[1])
+redis.call('ZREM', KEYS[2], ARGV[1])
+redis.call('DECRBY', KEYS[3], entry.size)
+redis.call('SREM', KEYS[4] .. entry.model, ARGV[1])
+return e
+`)
+
+// clearInflightScript removes the in-flight marker if it still names ARGV[1].
+var clearInflightScript = redis.NewScript(1, `
+if redis.call('GET', KEYS[1]) == ARGV[1] then
+	return redis.call('DEL', KEYS[1])
+end
+return 0
+`)
+
+func cacheEntryKey(key string) string {
+	return cacheEntryPrefix + key
+}
+
+func cacheInflightKey(key string) string {
+	return cacheInflightPrefix + key
+}
+
+func followersKey(id string) string {
+	return followersPrefix + id
+}
+
+type cacheOptions struct {
+	enabled bool
+	maxSize int64
+}
+
+func newCacheOptions(cfg *config.Cache) cacheOptions {
+	opts := cacheOptions{maxSize: defaultCacheMaxSize}
+	if cfg == nil {
+		return opts
+	}
+	opts.enabled = cfg.Enabled
+	if cfg.MaxSizeMB > 0 {
+		opts.maxSize = cfg.MaxSizeMB << 20
+	}
+	return opts
+}
+
+// cacheEntry is a synthesized result that identical requests reuse.
+type cacheEntry struct {
+	Key       string       `json:"key"`
+	Model     string       `json:"model"`
+	File      string       `json:"file"`
+	Output    string       `json:"output,omitempty"`
+	Size      int64        `json:"size"`
+	Params    *InferParams `json:"params"` // 实际使用的参数，包括随机生成的 seed
+	Loudness  *Loudness    `json:"loudness,omitempty"`
+	Segments  int          `json:"segments,omitempty"`
+	TaskId    string       `json:"taskId"` // 生成该结果的任务
+	CreatedAt int64        `json:"createdAt"`
+}
+
+// fileDigest is the hash of a file, valid while its size and mtime are unchanged.
+type fileDigest struct {
+	size    int64
+	modTime time.Time
+	sum     string
+}
+
+// digests memoizes the hashes of model files; hashing weights takes seconds.
+type digests struct {
+	mu    sync.Mutex
+	files map[string]fileDigest
+}
+
+func (d *digests) file(path string) (string, error) {
+	stat, err := os.Stat(path)
+	if err != nil {
+		return "", err
+	}
+	d.mu.Lock()
+	cached, ok := d.files[path]
+	d.mu.Unlock()
+	if ok && cached.size == stat.Size() && cached.modTime.Equal(stat.ModTime()) {
+		return cached.sum, nil
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	sum := hex.EncodeToString(h.Sum(nil))
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.files == nil {
+		d.files = make(map[string]fileDigest)
+	}
+	d.files[path] = fileDigest{size: stat.Size(), modTime: stat.ModTime(), sum: sum}
+	return sum, nil
+}
+
+// model returns a digest identifying the weights and reference of model.
+func (d *digests) model(model pair) (string, error) {
+	h := sha256.New()
+	h.Write([]byte(model.Name + "\x00" + model.ReferText + "\x00" + model.ReferLang + "\x00"))
+	for _, path := range append([]string{model.GptPath, model.SovitsPath, model.ReferenceAudioPath}, model.AuxRefAudioPaths...) {
+		sum, err := d.file(path)
+		if err != nil {
+			return "", err
+		}
+		h.Write([]byte(sum))
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// warm hashes the files of models in the background so that the first
+// request for each model does not pay for it.
+func (d *digests) warm(models map[string]pair) {
+	for _, model := range models {
+		if _, err := d.model(model); err != nil {
+			logger.Warnf(context.Background(), "hash model %s: %s", model.Name, err)
+		}
+	}
+}
+
+// cacheKey returns the digest of everything that determines the result of t,
+// or "" when caching is disabled. A seed that was picked at random is left
+// out: any seed satisfies such a request.
+func (handler *TTShHandler) cacheKey(t *task) (string, error) {
+	if !handler.cache.enabled {
+		return "", nil
+	}
+	model, err := handler.digests.model(t.Model)
+	if err != nil {
+		return "", err
+	}
+	params := *t.Params
+	if t.SeedAuto {
+		params.Seed = nil
+	}
+	plan, err := handler.planDigest(t)
+	if err != nil {
+		return "", err
+	}
+	// 按发给后端的分段计算，空白和换行都会影响合成结果
+	var segments []string
+	for _, s := range handler.steps(t) {
+		if s.pause == nil {
+			segments = append(segments, s.text)
+		}
+	}
+	data, err := json.Marshal(struct {
+		Model       string        `json:"model"`
+		Segments    []string      `json:"segments"`
+		Lang        string        `json:"lang"`
+		Params      InferParams   `json:"params"`
+		Plan        []planItem    `json:"plan,omitempty"`
+		Format      *audio.Target `json:"format,omitempty"`
+		PostProcess *PostProcess  `json:"postProcess,omitempty"`
+	}{model, segments, t.Lang, params, plan, t.Format, t.PostProcess})
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// lookupCache returns the entry for key, or nil on a miss. An entry whose file
+// has disappeared is dropped.
+func lookupCache(ctx context.Context, conn redis.Conn, key string) (*cacheEntry, error) {
+	data, err := redis.Bytes(conn.Do("GET", cacheEntryKey(key)))
+	if errors.Is(err, redis.ErrNil) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	entry := &cacheEntry{}
+	if err := json.Unmarshal(data, entry); err != nil {
+		return nil, err
+	}
+	if _, err := statResult(ctx, entry.File); err != nil {
+		logger.Warnf(ctx, "drop cache entry %s: %s", key, err)
+		removeCacheEntry(ctx, conn, key)
+		return nil, nil
+	}
+	return entry, nil
+}
+
+// cachedTaskCommands looks t up in the cache. On a hit it copies the cached
+// result for t and returns the commands that store t as already succeeded
+// with the copy; the entry itself may be evicted at any time.
+func cachedTaskCommands(ctx context.Context, conn redis.Conn, t *task) ([]command, bool, error) {
+	entry, err := lookupCache(ctx, conn, t.CacheKey)
+	if err != nil || entry == nil {
+		return nil, false, err
+	}
+	file, output, err := copyResult(ctx, resultKey(t.Id, ""), t.Format, entry.File, entry.Output)
+	if errors.Is(err, blob.ErrNotFound) {
+		// 刚被淘汰，按未命中处理
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	now := nowMilli()
+	t.Params = entry.Params
+	js, err := json.Marshal(taskInfo{
+		task:         *t,
+		State:        stateSucceeded,
+		File:         file,
+		Output:       output,
+		Loudness:     entry.Loudness,
+		Segments:     entry.Segments,
+		SegmentsDone: entry.Segments,
+		Cached:       true,
+		CreatedAt:    now,
+		FinishedAt:   now,
+		UpdatedAt:    now,
+	})
+	if err != nil {
+		return nil, false, err
+	}
+	cmds := []command{
+		cmd("SET", taskKey(t.Id), js),
+		cmd("ZADD", cacheLRU, now, t.CacheKey),
+		cmd("HINCRBY", cacheStats, "hits", 1),
+		cmd("HINCRBY", cacheStats, "hits:"+t.Model.Name, 1),
+	}
+	if t.Callback != "" {
+		cmds = append(cmds, cmd("ZADD", webhookSet, now, t.Id))
+	}
+	return cmds, true, nil
+}
+
+// missCommands are added to the enqueue of a task that was not in the cache:
+// the task becomes the one identical requests attach to, unless another
+// identical task already is.
+func missCommands(t *task) []command {
+	if t.CacheKey == "" {
+		return nil
+	}
+	return []command{
+		cmd("SET", cacheInflightKey(t.CacheKey), t.Id, "NX", "PX", inflightTTL.Milliseconds()),
+		cmd("HINCRBY", cacheStats, "misses", 1),
+		cmd("HINCRBY", cacheStats, "misses:"+t.Model.Name, 1),
+	}
+}
+
+// enqueueOrAttach stores t as waiting for an identical task that is queued or
+// running and returns that task's ID. When there is none it queues t as the
+// task identical requests attach to and returns "".
+func enqueueOrAttach(ctx context.Context, t *task) (string, error) {
+	conn := rds.Get()
+	defer conn.Close()
+	inflight := cacheInflightKey(t.CacheKey)
+	for {
+		// 两个相同的任务同时提交时只有一个入队，另一个重试后等待它
+		if _, err := conn.Do("WATCH", inflight); err != nil {
+			return "", err
+		}
+		leaderId, err := redis.String(conn.Do("GET", inflight))
+		if err != nil && !errors.Is(err, redis.ErrNil) {
+			conn.Do("UNWATCH")
+			return "", err
+		}
+		var cmds []command
+		if err == nil {
+			// 结果写入前领头任务的记录不能变，否则它结束时看不到新加入的任务
+			if _, err := conn.Do("WATCH", taskKey(leaderId)); err != nil {
+				return "", err
+			}
+			leader, err := loadTask(conn, leaderId)
+			if err != nil && !errors.Is(err, errTaskNotFound) {
+				conn.Do("UNWATCH")
+				return "", err
+			}
+			if err == nil && !leader.State.terminal() && leader.Leader == "" {
+				t.Leader = leaderId
+				now := nowMilli()
+				js, err := json.Marshal(taskInfo{task: *t, State: stateQueued, CreatedAt: now, UpdatedAt: now})
+				if err != nil {
+					conn.Do("UNWATCH")
+					return "", err
+				}
+				cmds = []command{
+					cmd("SET", taskKey(t.Id), js),
+					cmd("RPUSH", followersKey(leaderId), t.Id),
+					cmd("HINCRBY", cacheStats, "attached", 1),
+				}
+			} else {
+				// 标记指向已结束的任务
+				cmds = []command{cmd("DEL", inflight)}
+			}
+		}
+		if t.Leader == "" {
+			c, err := newTaskCommands(t, nowMilli())
+			if err != nil {
+				conn.Do("UNWATCH")
+				return "", err
+			}
+			cmds = append(cmds, c...)
+		}
+		conn.Send("MULTI")
+		for _, c := range cmds {
+			conn.Send(c.name, c.args...)
+		}
+		res, err := conn.Do("EXEC")
+		if err != nil {
+			return "", err
+		}
+		if res != nil {
+			return t.Leader, nil
+		}
+		t.Leader = ""
+	}
+}
+
+// settleFollowers finishes the tasks attached to leader once it has ended:
+// they share a success, each with its own copy of the result, or a failure.
+// If the leader was cancelled the first follower still waiting is queued in
+// its place and takes over the others.
+func settleFollowers(ctx context.Context, leader *taskInfo) {
+	conn := rds.Get()
+	defer conn.Close()
+	if leader.CacheKey != "" {
+		clearInflightScript.Do(conn, cacheInflightKey(leader.CacheKey), leader.Id)
+	}
+	key := followersKey(leader.Id)
+	for {
+		id, err := redis.String(conn.Do("LPOP", key))
+		if err != nil {
+			if !errors.Is(err, redis.ErrNil) {
+				logger.Errorf(ctx, "settle followers of %s: %s", leader.Id, err)
+			}
+			return
+		}
+		var file, output string
+		switch leader.State {
+		case stateSucceeded:
+			file, output, err = copyResult(ctx, resultKey(id, ""), leader.Format, leader.File, leader.Output)
+			if err != nil {
+				// 没有结果可用，单独执行
+				logger.Warnf(ctx, "share result of %s with %s: %s", leader.Id, id, err)
+				promoteFollower(ctx, conn, id, "")
+				continue
+			}
+			_, err = transition(ctx, id, stateSucceeded, []taskState{stateQueued}, func(info *taskInfo) {
+				info.StartedAt = leader.StartedAt
+				info.File = file
+				info.Output = output
+				info.Loudness = leader.Loudness
+				info.Segments = leader.Segments
+				info.SegmentsDone = leader.SegmentsDone
+				info.Params = leader.Params
+			})
+		case stateFailed:
+			_, err = transition(ctx, id, stateFailed, []taskState{stateQueued}, func(info *taskInfo) {
+				info.Error = "identical task " + leader.Id + " failed: " + leader.Error
+			})
+		default:
+			if promoteFollower(ctx, conn, id, key) {
+				return
+			}
+			continue
+		}
+		if err != nil {
+			logger.Warnf(ctx, "settle follower %s of %s: %s", id, leader.Id, err)
+			deleteResults(ctx, file, output)
+		}
+	}
+}
+
+// promoteFollower queues follower id on its own and, unless followers is "",
+// hands it the remaining followers of its leader. It returns false if the
+// follower is not waiting any more.
+func promoteFollower(ctx context.Context, conn redis.Conn, id, followers string) bool {
+	_, err := updateTask(ctx, id, func(info *taskInfo) error {
+		if info.State != stateQueued {
+			return errors.Errorf("task %s is %s", id, info.State)
+		}
+		info.Leader = ""
+		return nil
+	})
+	if err != nil {
+		return false
+	}
+	info, err := loadTask(conn, id)
+	if err != nil {
+		return false
+	}
+	cmds := enqueueCommands(info.Model.Name, id, info.CreatedAt)
+	if info.CacheKey != "" {
+		cmds = append(cmds, cmd("SET", cacheInflightKey(info.CacheKey), id, "PX", inflightTTL.Milliseconds()))
+	}
+	if followers != "" {
+		if n, _ := redis.Int(conn.Do("EXISTS", followers)); n > 0 {
+			cmds = append(cmds, cmd("RENAME", followers, followersKey(id)))
+		}
+	}
+	if err := execCommands(cmds); err != nil {
+		logger.Errorf(ctx, "promote follower %s: %s", id, err)
+		return false
+	}
+	logger.Infof(ctx, "task %s queued in place of the task it waited for", id)
+	return true
+}
+
+// storeCache records a copy of the result of info as a cache entry and evicts
+// the least recently used entries beyond the size limit. The copy is written
+// under a name of its own first; if an identical task already recorded an
+// entry, the copy is dropped.
+func (handler *TTShHandler) storeCache(ctx context.Context, info *taskInfo) {
+	file, output, err := copyResult(ctx, cacheBlobPrefix+info.CacheKey+"-"+info.Id, info.Format, info.File, info.Output)
+	if err != nil {
+		logger.Errorf(ctx, "cache result of task %s: %s", info.Id, err)
+		return
+	}
+	entry := &cacheEntry{
+		Key:       info.CacheKey,
+		Model:     info.Model.Name,
+		File:      file,
+		Output:    output,
+		Params:    info.Params,
+		Loudness:  info.Loudness,
+		Segments:  info.Segments,
+		TaskId:    info.Id,
+		CreatedAt: nowMilli(),
+	}
+	for _, name := range []string{file, output} {
+		if name == "" {
+			continue
+		}
+		if stat, err := statResult(ctx, name); err == nil {
+			entry.Size += stat.Size
+		}
+	}
+	js, err := json.Marshal(entry)
+	if err != nil {
+		deleteResults(ctx, file, output)
+		return
+	}
+	conn := rds.Get()
+	defer conn.Close()
+	stored, err := redis.Bool(storeEntryScript.Do(conn, cacheEntryKey(entry.Key), cacheLRU, cacheSize, cacheModelPrefix+entry.Model,
+		js, entry.Key, entry.CreatedAt, entry.Size))
+	if err != nil || !stored {
+		if err != nil {
+			logger.Errorf(ctx, "store cache entry of task %s: %s", info.Id, err)
+		}
+		deleteResults(ctx, file, output)
+		return
+	}
+	handler.evictCache(ctx, conn)
+}
+
+// evictCache removes least recently used entries until the cache fits.
+func (handler *TTShHandler) evictCache(ctx context.Context, conn redis.Conn) {
+	for {
+		size, err := redis.Int64(conn.Do("GET", cacheSize))
+		if err != nil || size <= handler.cache.maxSize {
+			return
+		}
+		keys, err := redis.Strings(conn.Do("ZRANGE", cacheLRU, 0, 0))
+		if err != nil || len(keys) == 0 {
+			return
+		}
+		if entry := removeCacheEntry(ctx, conn, keys[0]); entry != nil {
+			conn.Do("HINCRBY", cacheStats, "evictions", 1)
+			logger.Infof(ctx, "evicted cache entry %s of model %s (%d bytes)", entry.Key, entry.Model, entry.Size)
+		} else {
+			// 条目已不存在，只剩 LRU 中的残留
+			conn.Do("ZREM", cacheLRU, keys[0])
+		}
+	}
+}
+
+// removeCacheEntry drops the entry for key and deletes its files.
+func removeCacheEntry(ctx context.Context, conn redis.Conn, key string) *cacheEntry {
+	data, err := redis.Bytes(removeEntryScript.Do(conn, cacheEntryKey(key), cacheLRU, cacheSize, cacheModelPrefix, key))
+	if err != nil {
+		return nil
+	}
+	entry := &cacheEntry{}
+	if err := json.Unmarshal(data, entry); err != nil {
+		return nil
+	}
+	deleteResults(ctx, entry.File, entry.Output)
+	return entry
+}
+
+// isCacheKey reports whether name is a blob owned by the cache.
+func isCacheKey(name string) bool {
+	return strings.HasPrefix(name, cacheBlobPrefix)
+}
+
+// cacheBlobKey returns the cache key a cache blob was stored for.
+func cacheBlobKey(name string) string {
+	key := strings.TrimPrefix(name, cacheBlobPrefix)
+	if i := strings.IndexAny(key, "-."); i >= 0 {
+		key = key[:i]
+	}
+	return key
+}
+
+// cacheEntryOwns reports whether the cache entry of key refers to the blob
+// name. Copies left by tasks that lost the race to record an entry do not
+// belong to it.
+func cacheEntryOwns(conn redis.Conn, key, name string) (bool, error) {
+	data, err := redis.Bytes(conn.Do("GET", cacheEntryKey(key)))
+	if errors.Is(err, redis.ErrNil) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	entry := &cacheEntry{}
+	if err := json.Unmarshal(data, entry); err != nil {
+		return false, err
+	}
+	return entry.File == name || entry.Output == name, nil
+}
+
+type CacheStat struct {
+	Hits     int64 `json:"hits"`
+	Misses   int64 `json:"misses"`
+	Attached int64 `json:"attached"`
+}
+
+type CacheResp struct {
+	Enabled   bool                 `json:"enabled"`
+	Entries   int                  `json:"entries"`
+	Size      int64                `json:"size"`
+	MaxSize   int64                `json:"maxSize"`
+	Evictions int64                `json:"evictions"`
+	HitRate   float64              `json:"hitRate"`
+	Total     CacheStat            `json:"total"`
+	ByModel   map[string]CacheStat `json:"byModel"`
+}
+
+// Cache reports the size of the cache and its hit statistics.
+func (handler *TTShHandler) Cache(ctx context.Context, req *struct{}) (*CacheResp, error) {
+	conn := rds.Get()
+	defer conn.Close()
+	stats, err := redis.Int64Map(conn.Do("HGETALL", cacheStats))
+	if err != nil {
+		return nil, &status.Status{Code: 500, Message: err.Error()}
+	}
+	rsp := &CacheResp{Enabled: handler.cache.enabled, MaxSize: handler.cache.maxSize, ByModel: map[string]CacheStat{}}
+	rsp.Entries, _ = redis.Int(conn.Do("ZCARD", cacheLRU))
+	rsp.Size, _ = redis.Int64(conn.Do("GET", cacheSize))
+	byModel := make(map[string]*CacheStat)
+	for field, n := range stats {
+		name, model, _ := strings.Cut(field, ":")
+		stat := &rsp.Total
+		if model != "" {
+			if byModel[model] == nil {
+				byModel[model] = &CacheStat{}
+			}
+			stat = byModel[model]
+		}
+		switch name {
+		case "hits":
+			stat.Hits = n
+		case "misses":
+			stat.Misses = n
+		case "attached":
+			stat.Attached = n
+		case "evictions":
+			rsp.Evictions = n
+		}
+	}
+	for model, stat := range byModel {
+		rsp.ByModel[model] = *stat
+	}
+	if lookups := rsp.Total.Hits + rsp.Total.Misses; lookups > 0 {
+		rsp.HitRate = float64(rsp.Total.Hits) / float64(lookups)
+	}
+	return rsp, nil
+}
+
+type PurgeCacheReq struct {
+	Model string `json:"model"`
+}
+
+type PurgeCacheResp struct {
+	Entries int   `json:"entries"`
+	Size    int64 `json:"size"`
+}
+
+// PurgeCache removes every cache entry of a model, e.g. after its weights
+// were retrained under the same name.
+func (handler *TTShHandler) PurgeCache(ctx context.Context, req *PurgeCacheReq) (*PurgeCacheResp, error) {
+	if req.Model == "" {
+		return nil, &status.Status{Code: 400, Message: "model is required"}
+	}
+	conn := rds.Get()
+	defer conn.Close()
+	keys, err := redis.Strings(conn.Do("SMEMBERS", cacheModelPrefix+req.Model))
+	if err != nil {
+		return nil, &status.Status{Code: 500, Message: err.Error()}
+	}
+	rsp := &PurgeCacheResp{}
+	for _, key := range keys {
+		if entry := removeCacheEntry(ctx, conn, key); entry != nil {
+			rsp.Entries++
+			rsp.Size += entry.Size
+		}
+	}
+	logger.Infof(ctx, "purged %d cache entries of model %s", rsp.Entries, req.Model)
+	return rsp, nil
+}
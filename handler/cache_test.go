@@ -0,0 +1,196 @@
+package handler
+
+import (
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+	"ttsapi/config"
+	"ttsapi/storage/blob"
+)
+
+func newCacheEnv(t *testing.T) *testEnv {
+	return newTestEnv(t, func(cfg *config.Config) {
+		cfg.Resources.Cache = &config.Cache{Enabled: true}
+	})
+}
+
+// cacheBlobs lists the files held by the cache.
+func (e *testEnv) cacheBlobs() []string {
+	e.t.Helper()
+	var keys []string
+	if err := blob.Get().List(e.ctx, cacheBlobPrefix, func(info *blob.Info) error {
+		keys = append(keys, info.Key)
+		return nil
+	}); err != nil {
+		e.t.Fatal(err)
+	}
+	return keys
+}
+
+func (e *testEnv) resultExists(name string) bool {
+	e.t.Helper()
+	_, err := statResult(e.ctx, name)
+	if err != nil && !errors.Is(err, blob.ErrNotFound) {
+		e.t.Fatal(err)
+	}
+	return err == nil
+}
+
+func TestCacheHitsOwnTheirResult(t *testing.T) {
+	env := newCacheEnv(t)
+	first := env.submit(testModel, "你好。")
+	env.run()
+	produced := env.task(first)
+	if produced.File != resultKey(first, ".wav") {
+		t.Fatalf("result stored as %s", produced.File)
+	}
+	if blobs := env.cacheBlobs(); len(blobs) != 1 || !strings.HasPrefix(blobs[0], cacheBlobPrefix+produced.CacheKey+"-"+first) {
+		t.Fatalf("cache blobs = %v", blobs)
+	}
+
+	rsp, err := env.handler.NewTask(env.ctx, &NewTaskReq{Model: testModel, TextReq: TextReq{Text: "你好。", Lang: "zh"}})
+	if err != nil || !rsp.Cached {
+		t.Fatalf("second request: %+v %v", rsp, err)
+	}
+	hit := env.task(rsp.Id)
+	if hit.State != stateSucceeded || hit.File != resultKey(rsp.Id, ".wav") || !env.resultExists(hit.File) {
+		t.Fatalf("cache hit is %s with %s", hit.State, hit.File)
+	}
+
+	// 清除缓存不影响已经拿到结果的任务
+	if purged, err := env.handler.PurgeCache(env.ctx, &PurgeCacheReq{Model: testModel}); err != nil || purged.Entries != 1 {
+		t.Fatalf("purge: %+v %v", purged, err)
+	}
+	if blobs := env.cacheBlobs(); len(blobs) != 0 {
+		t.Fatalf("cache blobs after purge = %v", blobs)
+	}
+	for _, id := range []string{first, rsp.Id} {
+		if info, err := env.handler.loadTaskInfo(env.ctx, id); err != nil || info.State != stateSucceeded {
+			t.Fatalf("task %s after purge: %+v %v", id, info, err)
+		}
+	}
+}
+
+func TestFollowersOwnTheirResult(t *testing.T) {
+	env := newCacheEnv(t)
+	leader := env.submit(testModel, "你好。")
+	rsp, err := env.handler.NewTask(env.ctx, &NewTaskReq{Model: testModel, TextReq: TextReq{Text: "你好。", Lang: "zh"}})
+	if err != nil || rsp.AttachedTo != leader {
+		t.Fatalf("identical request: %+v %v", rsp, err)
+	}
+	env.run()
+	follower := env.task(rsp.Id)
+	if follower.State != stateSucceeded || follower.File != resultKey(rsp.Id, ".wav") || !env.resultExists(follower.File) {
+		t.Fatalf("follower is %s with %s", follower.State, follower.File)
+	}
+	deleteResults(env.ctx, env.task(leader).File)
+	if !env.resultExists(follower.File) {
+		t.Fatal("follower lost its result with the leader's")
+	}
+}
+
+func TestLosingCacheStoreKeepsTheEntry(t *testing.T) {
+	env := newCacheEnv(t)
+	first := env.submit(testModel, "你好。")
+	env.run()
+	entry, err := lookupCache(env.ctx, env.conn(), env.task(first).CacheKey)
+	if err != nil || entry == nil {
+		t.Fatalf("entry: %+v %v", entry, err)
+	}
+
+	// 另一个相同内容的任务同时结束，它的副本不能覆盖已记录的结果
+	rival := *env.task(first)
+	rival.Id = "rival"
+	env.handler.storeCache(env.ctx, &rival)
+	if blobs := env.cacheBlobs(); len(blobs) != 1 || blobs[0] != entry.File {
+		t.Fatalf("cache blobs = %v, entry holds %s", blobs, entry.File)
+	}
+	if again, _ := lookupCache(env.ctx, env.conn(), entry.Key); again == nil || again.File != entry.File {
+		t.Fatalf("entry replaced by %+v", again)
+	}
+}
+
+func TestEvictionKeepsTaskResults(t *testing.T) {
+	env := newCacheEnv(t)
+	first := env.submit(testModel, "你好。")
+	env.run()
+	entry, _ := lookupCache(env.ctx, env.conn(), env.task(first).CacheKey)
+	env.handler.cache.maxSize = entry.Size
+
+	second := env.submit(testModel, "再见。")
+	env.run()
+	if blobs := env.cacheBlobs(); len(blobs) != 1 || !strings.Contains(blobs[0], second) {
+		t.Fatalf("cache blobs after eviction = %v", blobs)
+	}
+	if info, err := env.handler.loadTaskInfo(env.ctx, first); err != nil || info.State != stateSucceeded {
+		t.Fatalf("task of the evicted entry: %+v %v", info, err)
+	}
+}
+
+func TestCacheKeyFollowsWhatIsSynthesized(t *testing.T) {
+	env := newCacheEnv(t)
+	// 换行和空格发给后端的文本不同，不能互相等待
+	for _, text := range []string{"你好\n世界", "你好 世界"} {
+		rsp, err := env.handler.NewTask(env.ctx, &NewTaskReq{Model: testModel, TextReq: TextReq{Text: text, Lang: "zh"}})
+		if err != nil || rsp.AttachedTo != "" {
+			t.Fatalf("%q: %+v %v", text, rsp, err)
+		}
+	}
+}
+
+func TestIdenticalSubmissionsShareOneLeader(t *testing.T) {
+	env := newCacheEnv(t)
+	const n = 8
+	rsps := make(chan *NewTaskResp, n)
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			rsp, err := env.handler.NewTask(env.ctx, &NewTaskReq{Model: testModel, TextReq: TextReq{Text: "你好。", Lang: "zh"}})
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			rsps <- rsp
+		}()
+	}
+	wg.Wait()
+	close(rsps)
+	var leaders []string
+	attached := map[string]int{}
+	for rsp := range rsps {
+		if rsp.AttachedTo == "" {
+			leaders = append(leaders, rsp.Id)
+		} else {
+			attached[rsp.AttachedTo]++
+		}
+	}
+	if len(leaders) != 1 || attached[leaders[0]] != n-1 {
+		t.Fatalf("leaders %v, attached %v", leaders, attached)
+	}
+
+	// 批次中的相同任务单独执行，不取代领头任务
+	if _, err := env.handler.NewBatch(env.ctx, &NewBatchReq{Items: []BatchItemReq{{Model: testModel, TextReq: TextReq{Text: "你好。", Lang: "zh"}}}}); err != nil {
+		t.Fatal(err)
+	}
+	key := env.task(leaders[0]).CacheKey
+	if marker, err := env.redis.Get(cacheInflightKey(key)); err != nil || marker != leaders[0] {
+		t.Fatalf("in-flight marker = %q, %v", marker, err)
+	}
+}
+
+func TestStaleInflightMarkerIsReplaced(t *testing.T) {
+	env := newCacheEnv(t)
+	first := env.submit(testModel, "你好。")
+	key := env.task(first).CacheKey
+	env.redis.Set(cacheInflightKey(key), "00000000-0000-0000-0000-000000000000")
+	rsp, err := env.handler.NewTask(env.ctx, &NewTaskReq{Model: testModel, TextReq: TextReq{Text: "你好。", Lang: "zh"}})
+	if err != nil || rsp.AttachedTo != "" {
+		t.Fatalf("request after a stale marker: %+v %v", rsp, err)
+	}
+	if marker, _ := env.redis.Get(cacheInflightKey(key)); marker != rsp.Id {
+		t.Fatalf("in-flight marker = %q", marker)
+	}
+}
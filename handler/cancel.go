@@ -0,0 +1,111 @@
+package handler
+
+import (
+	"context"
+	"github.com/gomodule/redigo/redis"
+	"github.com/pkg/errors"
+	"net/http"
+	"sync"
+	"time"
+	"ttsapi/logger"
+	"ttsapi/server/httpserver/middles/status"
+	rds "ttsapi/storage/redis"
+)
+
+// cancelChannel 广播被取消的运行中任务，执行该任务的实例收到后中止后端请求
+const cancelChannel = "ttsapi:cancel"
+
+// runningTasks holds the cancel functions of the tasks executing in this process.
+type runningTasks struct {
+	mu      sync.Mutex
+	cancels map[string]context.CancelFunc
+}
+
+func (r *runningTasks) add(id string, cancel context.CancelFunc) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.cancels == nil {
+		r.cancels = make(map[string]context.CancelFunc)
+	}
+	r.cancels[id] = cancel
+}
+
+func (r *runningTasks) remove(id string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.cancels, id)
+}
+
+// cancel aborts id if it runs in this process.
+func (r *runningTasks) cancel(id string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	cancel, ok := r.cancels[id]
+	if ok {
+		cancel()
+	}
+	return ok
+}
+
+// listenCancels receives cancellations published by any instance and aborts
+// the matching local tasks.
+func (handler *TTShHandler) listenCancels(ctx context.Context) {
+	for ctx.Err() == nil {
+		if err := handler.subscribeCancels(ctx); err != nil {
+			logger.Errorf(ctx, "cancel subscription err: %s", err)
+			time.Sleep(time.Second)
+		}
+	}
+}
+
+func (handler *TTShHandler) subscribeCancels(ctx context.Context) error {
+	psc := redis.PubSubConn{Conn: rds.Get()}
+	defer psc.Close()
+	if err := psc.Subscribe(cancelChannel); err != nil {
+		return err
+	}
+	for {
+		switch msg := psc.ReceiveWithTimeout(0).(type) {
+		case redis.Message:
+			id := string(msg.Data)
+			if handler.running.cancel(id) {
+				logger.Infof(ctx, "cancelling running task %s", id)
+			}
+		case error:
+			return msg
+		}
+	}
+}
+
+type CancelTaskReq struct {
+	Id string `json:"id"`
+}
+
+// CancelTask withdraws a task. A queued task is removed from its queue (or
+// from the retry schedule) and skipped by the worker. A running task is
+// marked cancelled right away; the instance executing it aborts the backend
+// request and discards the partial output.
+func (handler *TTShHandler) CancelTask(ctx context.Context, req *CancelTaskReq) (*TaskStatusResp, error) {
+	info, err := handler.ownedTaskInfo(ctx, req.Id)
+	if err != nil {
+		return nil, err
+	}
+	// 模型不会变，可以在事务外确定队列
+	cmds := []command{
+		cmd("ZREM", modelQueue(info.Model.Name), req.Id),
+		cmd("ZREM", delayedList, req.Id),
+		cmd("ZREM", inflightSet, req.Id),
+		cmd("PUBLISH", cancelChannel, req.Id),
+	}
+	_, err = transition(ctx, req.Id, stateCancelled, []taskState{stateQueued, stateRunning}, func(info *taskInfo) {
+		info.NextAttemptAt = 0
+	}, cmds...)
+	if err != nil {
+		if errors.Is(err, errTaskNotFound) {
+			return nil, &status.Status{Code: http.StatusNotFound, Message: "task not found"}
+		}
+		return nil, &status.Status{Code: http.StatusConflict, Message: err.Error()}
+	}
+	logger.Infof(ctx, "task %s cancelled while %s", req.Id, info.State)
+	return handler.TaskStatus(ctx, &TaskStatusReq{Id: req.Id})
+}
@@ -0,0 +1,102 @@
+package handler
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+	"ttsapi/server/httpserver/middles/status"
+)
+
+func TestCancelQueuedTask(t *testing.T) {
+	env := newTestEnv(t, nil)
+	id := env.submit(testModel, "你好。")
+	rsp, err := env.handler.CancelTask(env.ctx, &CancelTaskReq{Id: id})
+	if err != nil || rsp.State != stateCancelled {
+		t.Fatalf("cancel: %+v, %v", rsp, err)
+	}
+	if queued := env.zset(modelQueue(testModel)); len(queued) != 0 {
+		t.Fatalf("model queue = %v", queued)
+	}
+	if err := env.handler.dispatch(env.ctx); err != nil {
+		t.Fatal(err)
+	}
+	for _, in := range env.handler.pool.instances {
+		select {
+		case leased := <-in.tasks:
+			t.Fatalf("cancelled task dispatched: %s", leased)
+		default:
+		}
+	}
+}
+
+func TestCancelRunningTask(t *testing.T) {
+	env := newTestEnv(t, nil)
+	env.backend.Latency = time.Minute
+	ctx, cancel := context.WithCancel(env.ctx)
+	defer cancel()
+	go env.handler.subscribeCancels(ctx)
+	for env.redis.PubSubNumSub(cancelChannel)[cancelChannel] == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	id := env.submit(testModel, "你好。")
+	in, leased := env.lease()
+	done := make(chan error, 1)
+	go func() {
+		done <- env.handler.execute(env.ctx, in, leased)
+		env.handler.pool.done(in)
+	}()
+	for !env.handler.running.has(id) {
+		time.Sleep(time.Millisecond)
+	}
+
+	// 取消通过 pub/sub 送到执行任务的实例，中止后端请求
+	rsp, err := env.handler.CancelTask(env.ctx, &CancelTaskReq{Id: id})
+	if err != nil || rsp.State != stateCancelled {
+		t.Fatalf("cancel: %+v, %v", rsp, err)
+	}
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("execute: %s", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("running task not aborted")
+	}
+	info := env.task(id)
+	if info.State != stateCancelled || info.File != "" {
+		t.Fatalf("task is %s with %q", info.State, info.File)
+	}
+	if processing := env.list(processingList("test-worker")); len(processing) != 0 {
+		t.Fatalf("processing list = %v", processing)
+	}
+	if inflight := env.zset(inflightSet); len(inflight) != 0 {
+		t.Fatalf("inflight set = %v", inflight)
+	}
+}
+
+func TestCancelFinishedTask(t *testing.T) {
+	env := newTestEnv(t, nil)
+	id := env.submit(testModel, "你好。")
+	if _, err := env.run(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := env.handler.CancelTask(env.ctx, &CancelTaskReq{Id: id}); status.GetCode(err) != http.StatusConflict {
+		t.Fatalf("cancel a finished task: %v", err)
+	}
+	if info := env.task(id); info.State != stateSucceeded || info.File == "" {
+		t.Fatalf("task is %s with %q", info.State, info.File)
+	}
+	if _, err := env.handler.CancelTask(env.ctx, &CancelTaskReq{Id: "00000000-0000-0000-0000-000000000000"}); status.GetCode(err) != http.StatusNotFound {
+		t.Fatalf("cancel an unknown task: %v", err)
+	}
+}
+
+// has reports whether id is executing in this process.
+func (r *runningTasks) has(id string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	_, ok := r.cancels[id]
+	return ok
+}
@@ -0,0 +1,296 @@
+package handler
+
+import (
+	"context"
+	"fmt"
+	"github.com/google/uuid"
+	"sort"
+	"strings"
+	"time"
+	"ttsapi/audio"
+	"ttsapi/config"
+	"ttsapi/server/httpserver/middles/status"
+	"unicode/utf8"
+)
+
+const (
+	defaultDialogueGap     = 400 * time.Millisecond
+	defaultDialogueTurnGap = 700 * time.Millisecond
+	maxDialogueLines       = 1000
+)
+
+type dialogueOptions struct {
+	gap     time.Duration
+	turnGap time.Duration
+}
+
+func newDialogueOptions(cfg *config.Audio) dialogueOptions {
+	opts := dialogueOptions{gap: defaultDialogueGap, turnGap: defaultDialogueTurnGap}
+	if cfg == nil {
+		return opts
+	}
+	// 允许配置为 0 表示不插入静音，负数使用默认值
+	if cfg.DialogueGap >= 0 {
+		opts.gap = cfg.DialogueGap
+	}
+	if cfg.DialogueTurnGap >= 0 {
+		opts.turnGap = cfg.DialogueTurnGap
+	}
+	return opts
+}
+
+// dialogueLine is one line of a dialogue script.
+type dialogueLine struct {
+	Line    int    `json:"line"` // 在脚本中的行号
+	Speaker string `json:"speaker"`
+	Model   string `json:"model"`
+	Text    string `json:"text"` // 原文，未规范化
+}
+
+// LineTiming is where one line of a dialogue is heard in the result.
+type LineTiming struct {
+	Line    int    `json:"line"` // 在脚本中的行号
+	Speaker string `json:"speaker"`
+	Model   string `json:"model"`
+	Text    string `json:"text"`
+	StartMs int64  `json:"startMs"`
+	EndMs   int64  `json:"endMs"`
+}
+
+// Manifest is the timing of every line of a dialogue result.
+type Manifest struct {
+	DurationMs int64        `json:"durationMs"`
+	Lines      []LineTiming `json:"lines"`
+}
+
+// parseScript reads a "Speaker: text" script. Blank lines and lines starting
+// with # are skipped; every other line needs a speaker of speakers.
+func parseScript(script string, speakers map[string]string) ([]dialogueLine, error) {
+	var lines []dialogueLine
+	for i, raw := range strings.Split(script, "\n") {
+		line := strings.TrimSpace(raw)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		sep := strings.IndexAny(line, ":：")
+		if sep < 0 {
+			return nil, fmt.Errorf("script line %d: expected \"speaker: text\"", i+1)
+		}
+		speaker := strings.TrimSpace(line[:sep])
+		_, size := utf8.DecodeRuneInString(line[sep:])
+		text := strings.TrimSpace(line[sep+size:])
+		model, ok := speakers[speaker]
+		if !ok {
+			return nil, fmt.Errorf("script line %d: unknown speaker %q", i+1, speaker)
+		}
+		if text == "" {
+			return nil, fmt.Errorf("script line %d: %s has nothing to say", i+1, speaker)
+		}
+		lines = append(lines, dialogueLine{Line: i + 1, Speaker: speaker, Model: model, Text: text})
+	}
+	if len(lines) == 0 {
+		return nil, fmt.Errorf("script has no lines")
+	}
+	if len(lines) > maxDialogueLines {
+		return nil, fmt.Errorf("at most %d lines per script", maxDialogueLines)
+	}
+	return lines, nil
+}
+
+type NewDialogueReq struct {
+	Script    string            `json:"script"`    // 每行 "角色: 台词"，# 开头的行为注释
+	Speakers  map[string]string `json:"speakers"`  // 角色 -> 模型
+	Lang      string            `json:"lang"`      // 可选，GPT-SoVITS 的 text_lang，为空时逐段识别
+	Raw       bool              `json:"raw"`       // 可选，不做文本规范化
+	Params    *InferParams      `json:"params"`    // 可选，覆盖各模型的默认参数
+	GapMs     *int              `json:"gapMs"`     // 可选，同一角色连续两句之间的静音
+	TurnGapMs *int              `json:"turnGapMs"` // 可选，换人说话时的静音
+	Format    *audio.Target     `json:"format"`
+	Post      *PostProcess      `json:"postProcess"` // 可选，不支持 trimSilence
+	Callback  string            `json:"callbackUrl"`
+}
+
+type NewDialogueResp struct {
+	Id     string       `json:"id"`
+	Lines  int          `json:"lines"`
+	Params *InferParams `json:"params"` // 第一句所用模型的参数
+}
+
+// NewDialogue queues a dialogue script as one task. Every line is read by
+// the model of its speaker; the worker synthesizes the lines grouped by model
+// and joins them in script order, with gapMs between two lines of the same
+// speaker and turnGapMs when the speaker changes. The timing of every line is
+// returned by DialogueManifest once the task has succeeded.
+func (handler *TTShHandler) NewDialogue(ctx context.Context, req *NewDialogueReq) (*NewDialogueResp, error) {
+	if req.Lang != "" && !textLangs[req.Lang] {
+		return nil, &status.Status{Code: 400, Message: fmt.Sprintf("unknown lang %q", req.Lang)}
+	}
+	models := handler.models()
+	speakers := make([]string, 0, len(req.Speakers))
+	for speaker := range req.Speakers {
+		speakers = append(speakers, speaker)
+	}
+	sort.Strings(speakers)
+	for _, speaker := range speakers {
+		if _, ok := models[req.Speakers[speaker]]; !ok {
+			return nil, &status.Status{Code: 400, Message: fmt.Sprintf("speaker %s: model %q not found", speaker, req.Speakers[speaker])}
+		}
+	}
+	lines, err := parseScript(req.Script, req.Speakers)
+	if err != nil {
+		return nil, &status.Status{Code: 400, Message: err.Error()}
+	}
+	gap, turnGap := handler.dialogue.gap, handler.dialogue.turnGap
+	if req.GapMs != nil {
+		gap = time.Duration(*req.GapMs) * time.Millisecond
+	}
+	if req.TurnGapMs != nil {
+		turnGap = time.Duration(*req.TurnGapMs) * time.Millisecond
+	}
+	if gap < 0 || gap > maxGap || turnGap < 0 || turnGap > maxGap {
+		return nil, &status.Status{Code: 400, Message: fmt.Sprintf("gaps must be between 0 and %s", maxGap)}
+	}
+
+	key := caller(ctx)
+	first := models[lines[0].Model]
+	params, err := resolveInferParams(first.Params, req.Params)
+	if err != nil {
+		return nil, &status.Status{Code: 400, Message: err.Error()}
+	}
+	if first, err = selectReference(first, params); err != nil {
+		return nil, &status.Status{Code: 400, Message: err.Error()}
+	}
+	paramsOf := map[string]*InferParams{first.Name: params}
+	modelOf := map[string]pair{first.Name: first}
+	plan := make([]planItem, 0, 2*len(lines))
+	texts := make([]string, 0, len(lines))
+	for i, line := range lines {
+		if i > 0 {
+			pause := gap
+			if line.Speaker != lines[i-1].Speaker {
+				pause = turnGap
+			}
+			plan = append(plan, planItem{Break: true, Pause: pause})
+		}
+		spoken := line.Text
+		if !req.Raw {
+			spoken, _ = handler.normalize(key.Name, line.Text, req.Lang)
+		}
+		item := planItem{Text: spoken, Line: i + 1}
+		if line.Model != first.Name {
+			model, ok := modelOf[line.Model]
+			if !ok {
+				model = models[line.Model]
+				if paramsOf[model.Name], err = resolveInferParams(model.Params, req.Params); err == nil {
+					model, err = selectReference(model, paramsOf[model.Name])
+				}
+				if err != nil {
+					return nil, &status.Status{Code: 400, Message: fmt.Sprintf("speaker %s: %s", line.Speaker, err)}
+				}
+				modelOf[model.Name] = model
+			}
+			item.Model, item.Params = &model, paramsOf[model.Name]
+		}
+		plan = append(plan, item)
+		texts = append(texts, spoken)
+	}
+	content := strings.Join(texts, "\n")
+	textLang, detection, err := resolveLang(content, req.Lang)
+	if err != nil {
+		return nil, err
+	}
+	t := &task{
+		Id:           uuid.New().String(),
+		Model:        first,
+		Params:       params,
+		SeedAuto:     seedAuto(first.Params, req.Params),
+		Content:      content,
+		Lang:         textLang,
+		LangExplicit: req.Lang != "",
+		Language:     detection,
+		Owner:        key.Name,
+		Original:     req.Script,
+		Plan:         plan,
+		Lines:        lines,
+	}
+
+	if req.Post != nil && req.Post.TrimSilence != nil {
+		return nil, &status.Status{Code: 400, Message: "trimSilence would shift the line timings of a dialogue"}
+	}
+	if err := handler.setOutput(ctx, key, t, req.Format, req.Post, req.Callback); err != nil {
+		return nil, err
+	}
+	if t.PostProcess != nil {
+		// 模型配置的裁剪同样会打乱时间轴
+		t.PostProcess.TrimSilence = nil
+		if t.PostProcess.empty() {
+			t.PostProcess = nil
+		}
+	}
+	// 结果缓存不保存时间轴，对白任务不走缓存
+	if err := enqueueTask(ctx, t); err != nil {
+		return nil, &status.Status{Code: 500, Message: err.Error()}
+	}
+	return &NewDialogueResp{Id: t.Id, Lines: len(lines), Params: params}, nil
+}
+
+// maxGap 台词之间静音的上限
+const maxGap = 10 * time.Second
+
+// dialogueManifest collects the timing of every line of t from the spans of
+// its steps, or returns nil when t is not a dialogue.
+func dialogueManifest(t *task, steps []step, spans []span, duration time.Duration) *Manifest {
+	if len(t.Lines) == 0 {
+		return nil
+	}
+	m := &Manifest{DurationMs: duration.Milliseconds(), Lines: make([]LineTiming, len(t.Lines))}
+	for i, line := range t.Lines {
+		m.Lines[i] = LineTiming{Line: line.Line, Speaker: line.Speaker, Model: line.Model, Text: line.Text, StartMs: -1}
+	}
+	for i, s := range steps {
+		if s.line == 0 {
+			continue
+		}
+		timing := &m.Lines[s.line-1]
+		if timing.StartMs < 0 {
+			timing.StartMs = spans[i].start.Milliseconds()
+		}
+		timing.EndMs = spans[i].end.Milliseconds()
+	}
+	// 规范化后为空的台词没有声音，放在上一句结束处
+	for i := range m.Lines {
+		if m.Lines[i].StartMs < 0 {
+			m.Lines[i].StartMs = 0
+			if i > 0 {
+				m.Lines[i].StartMs = m.Lines[i-1].EndMs
+			}
+			m.Lines[i].EndMs = m.Lines[i].StartMs
+		}
+	}
+	return m
+}
+
+type DialogueManifestReq struct {
+	Id string `json:"id"`
+}
+
+type DialogueManifestResp struct {
+	Id    string    `json:"id"`
+	State taskState `json:"state"`
+	*Manifest
+}
+
+// DialogueManifest returns the timing of every line of a succeeded dialogue.
+func (handler *TTShHandler) DialogueManifest(ctx context.Context, req *DialogueManifestReq) (*DialogueManifestResp, error) {
+	info, err := handler.ownedTaskInfo(ctx, req.Id)
+	if err != nil {
+		return nil, err
+	}
+	if len(info.Lines) == 0 {
+		return nil, &status.Status{Code: 400, Message: "task is not a dialogue"}
+	}
+	if info.State != stateSucceeded || info.Manifest == nil {
+		return nil, &status.Status{Code: 409, Message: fmt.Sprintf("task is %s", info.State)}
+	}
+	return &DialogueManifestResp{Id: info.Id, State: info.State, Manifest: info.Manifest}, nil
+}
@@ -0,0 +1,41 @@
+package handler
+
+import (
+	"testing"
+	"ttsapi/backend/fake"
+)
+
+func TestDialogueJoinsModelsOfDifferentRates(t *testing.T) {
+	env := newTestEnv(t, nil, "alice", "bob")
+	env.backend.rates = map[string]uint32{"bob": 48000}
+	zero := 0
+	rsp, err := env.handler.NewDialogue(env.ctx, &NewDialogueReq{
+		Script:    "A: 你好。\nB: 早上好。\nA: 再见。",
+		Speakers:  map[string]string{"A": "alice", "B": "bob"},
+		Lang:      "all_zh",
+		GapMs:     &zero,
+		TurnGapMs: &zero,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := env.run(); err != nil {
+		t.Fatal(err)
+	}
+	info := env.task(rsp.Id)
+	if info.State != stateSucceeded {
+		t.Fatalf("task is %s: %s", info.State, info.Error)
+	}
+	// 48kHz 的台词按第一句的 32kHz 拼接，时长不变
+	audioInfo, err := readAudioInfo(env.ctx, resultFile(info))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if audioInfo.SampleRate != fake.SampleRate || audioInfo.DurationMs != 10*80 {
+		t.Fatalf("joined result is %dHz, %dms", audioInfo.SampleRate, audioInfo.DurationMs)
+	}
+	lines := info.Manifest.Lines
+	if len(lines) != 3 || lines[1].StartMs != 240 || lines[1].EndMs != 560 {
+		t.Fatalf("manifest = %+v", info.Manifest)
+	}
+}
@@ -0,0 +1,244 @@
+package handler
+
+import (
+	"bytes"
+	"context"
+	"github.com/alicebob/miniredis/v2"
+	"github.com/gomodule/redigo/redis"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+	"ttsapi/audio"
+	"ttsapi/backend"
+	"ttsapi/backend/fake"
+	"ttsapi/config"
+	"ttsapi/storage/blob"
+	rds "ttsapi/storage/redis"
+)
+
+const testModel = "alice"
+
+// testEnv is a handler wired to an in-memory Redis, a local blob store and
+// the fake backend. Nothing runs in the background: tests drive dispatch and
+// execution themselves.
+type testEnv struct {
+	t       *testing.T
+	ctx     context.Context
+	handler *TTShHandler
+	redis   *miniredis.Miniredis
+	backend *flakyBackend
+	dir     string
+}
+
+// flakyBackend is the fake backend with failures that tests switch on.
+type flakyBackend struct {
+	*fake.Backend
+	mu    sync.Mutex
+	err   error
+	langs []string // 每次合成请求的 text_lang
+	model string
+	rates map[string]uint32 // 按模型改变输出的采样率
+}
+
+func (b *flakyBackend) LoadModel(ctx context.Context, model backend.Model) error {
+	b.mu.Lock()
+	b.model = model.Name
+	b.mu.Unlock()
+	return b.Backend.LoadModel(ctx, model)
+}
+
+func (b *flakyBackend) fail(err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.err = err
+}
+
+func (b *flakyBackend) Synthesize(ctx context.Context, req *backend.Request) ([]byte, error) {
+	b.mu.Lock()
+	err := b.err
+	b.langs = append(b.langs, req.Lang)
+	rate := b.rates[b.model]
+	b.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	wav, err := b.Backend.Synthesize(ctx, req)
+	if err != nil || rate == 0 {
+		return wav, err
+	}
+	format := fake.Format
+	format.SampleRate = rate
+	return audio.Conform(wav, format)
+}
+
+// newTestEnv starts a handler whose configuration has gone through edit, with
+// one convention model per name (testModel when none are given).
+func newTestEnv(t *testing.T, edit func(cfg *config.Config), models ...string) *testEnv {
+	t.Helper()
+	mr := miniredis.RunT(t)
+	ctx := context.Background()
+	if err := rds.Init(ctx, mr.Addr()); err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	paths := map[string]string{}
+	for _, name := range []string{"gpt", "sovits", "refer", "output", "scratch", "models"} {
+		paths[name] = filepath.Join(dir, name)
+		if err := os.MkdirAll(paths[name], 0o755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(models) == 0 {
+		models = []string{testModel}
+	}
+	for _, name := range models {
+		writeFile(t, filepath.Join(paths["gpt"], name+".ckpt"), nil)
+		writeFile(t, filepath.Join(paths["sovits"], name+".pth"), nil)
+		writeFile(t, filepath.Join(paths["refer"], name+"-你好-zh.wav"), silentWav(t, 4*time.Second))
+	}
+
+	cfg := &config.Config{
+		Server: &config.Server{
+			TTSBackend:        "fake",
+			GPTWeightsPath:    paths["gpt"],
+			SoVITSWeightsPath: paths["sovits"],
+			ReferAudioPath:    paths["refer"],
+			OutputAudioPath:   paths["output"],
+			ScratchPath:       paths["scratch"],
+			Authorization:     "secret",
+			ModelWatch:        &config.ModelWatch{Disabled: true},
+		},
+		Resources: &config.Resource{
+			Queue: &config.Queue{
+				WorkerID:    "test-worker",
+				MaxAttempts: 2,
+				BackoffBase: time.Millisecond,
+				BackoffMax:  time.Millisecond,
+			},
+			Cache: &config.Cache{},
+		},
+		Audio: &config.Audio{DialogueGap: -1, DialogueTurnGap: -1},
+	}
+	if edit != nil {
+		edit(cfg)
+	}
+	previous := *config.Get()
+	*config.Get() = *cfg
+	t.Cleanup(func() { *config.Get() = previous })
+	if err := blob.Init(ctx, nil, paths["output"]); err != nil {
+		t.Fatal(err)
+	}
+
+	handler := &TTShHandler{}
+	if err := handler.setup(cfg); err != nil {
+		t.Fatal(err)
+	}
+	flaky := &flakyBackend{Backend: fake.New()}
+	handler.pool.instances[0].backend = flaky
+	handler.loadModels(reloadStartup)
+	if len(handler.models()) != len(models) {
+		t.Fatalf("loaded %d models, want %d: %+v", len(handler.models()), len(models), handler.registry.Load().report)
+	}
+	return &testEnv{t: t, ctx: ctx, handler: handler, redis: mr, backend: flaky, dir: dir}
+}
+
+func writeFile(t *testing.T, name string, data []byte) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(name), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(name, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// silentWav returns a WAV file of d of silence in the fake backend's format.
+func silentWav(t *testing.T, d time.Duration) []byte {
+	t.Helper()
+	size := uint32(d.Seconds()*fake.SampleRate) * 2
+	buf := &bytes.Buffer{}
+	if err := audio.WriteHeader(buf, fake.Format, size); err != nil {
+		t.Fatal(err)
+	}
+	buf.Write(make([]byte, size))
+	return buf.Bytes()
+}
+
+// submit queues text for model and returns the task ID.
+func (e *testEnv) submit(model, text string) string {
+	e.t.Helper()
+	rsp, err := e.handler.NewTask(e.ctx, &NewTaskReq{Model: model, TextReq: TextReq{Text: text, Lang: "zh"}})
+	if err != nil {
+		e.t.Fatalf("NewTask: %s", err)
+	}
+	return rsp.Id
+}
+
+// lease dispatches one task and returns the backend it was given to.
+func (e *testEnv) lease() (*instance, string) {
+	e.t.Helper()
+	if err := e.handler.dispatch(e.ctx); err != nil {
+		e.t.Fatalf("dispatch: %s", err)
+	}
+	for _, in := range e.handler.pool.instances {
+		select {
+		case id := <-in.tasks:
+			return in, id
+		default:
+		}
+	}
+	e.t.Fatal("nothing was dispatched")
+	return nil, ""
+}
+
+// run leases the next task and executes it, returning the task ID and the
+// error execute reported.
+func (e *testEnv) run() (string, error) {
+	e.t.Helper()
+	in, id := e.lease()
+	err := e.handler.execute(e.ctx, in, id)
+	e.handler.pool.done(in)
+	return id, err
+}
+
+// conn returns a Redis connection closed with the test.
+func (e *testEnv) conn() redis.Conn {
+	conn := rds.Get()
+	e.t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+func (e *testEnv) task(id string) *taskInfo {
+	e.t.Helper()
+	info, err := getTask(e.ctx, id)
+	if err != nil {
+		e.t.Fatalf("load task %s: %s", id, err)
+	}
+	return info
+}
+
+func (e *testEnv) list(key string) []string {
+	e.t.Helper()
+	if !e.redis.Exists(key) {
+		return nil
+	}
+	values, err := e.redis.List(key)
+	if err != nil {
+		e.t.Fatal(err)
+	}
+	return values
+}
+
+func (e *testEnv) zset(key string) []string {
+	e.t.Helper()
+	if !e.redis.Exists(key) {
+		return nil
+	}
+	members, err := e.redis.ZMembers(key)
+	if err != nil {
+		e.t.Fatal(err)
+	}
+	return members
+}
@@ -0,0 +1,168 @@
+package handler
+
+import (
+	"bytes"
+	"github.com/gin-gonic/gin"
+	"github.com/pkg/errors"
+	"mime"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"ttsapi/audio"
+	"ttsapi/backend"
+	"ttsapi/logger"
+)
+
+// acceptCodecs 支持通过 Accept 头请求的格式
+var acceptCodecs = map[string]audio.Codec{
+	"audio/wav":       audio.CodecWAV,
+	"audio/wave":      audio.CodecWAV,
+	"audio/x-wav":     audio.CodecWAV,
+	"audio/vnd.wave":  audio.CodecWAV,
+	"audio/flac":      audio.CodecFLAC,
+	"audio/x-flac":    audio.CodecFLAC,
+	"audio/basic":     audio.CodecMuLaw,
+	"audio/pcmu":      audio.CodecMuLaw,
+	"audio/pcma":      audio.CodecALaw,
+	"audio/x-mulaw":   audio.CodecMuLaw,
+	"audio/x-alaw":    audio.CodecALaw,
+	"audio/x-pcmu":    audio.CodecMuLaw,
+	"audio/x-pcma":    audio.CodecALaw,
+	"audio/g711-ulaw": audio.CodecMuLaw,
+	"audio/g711-alaw": audio.CodecALaw,
+}
+
+// checkFormat validates an output format submitted with a task.
+func checkFormat(f *audio.Target) error {
+	if f == nil {
+		return nil
+	}
+	if f.Codec == "" {
+		f.Codec = audio.CodecWAV
+	}
+	return f.Validate()
+}
+
+// isIdentity reports whether f asks for the backend WAV unchanged.
+func isIdentity(f *audio.Target) bool {
+	return f == nil || *f == audio.Target{Codec: audio.CodecWAV}
+}
+
+// convertOutput converts the WAV result of t into the output format of the
+// task and returns the path of the converted file, or "" when the task has no
+// format of its own.
+func convertOutput(t *task, file string) (string, error) {
+	if isIdentity(t.Format) {
+		return "", nil
+	}
+	src, err := os.Open(file)
+	if err != nil {
+		return "", err
+	}
+	defer src.Close()
+	output := outputName(strings.TrimSuffix(file, ".wav"), t.Format)
+	dst, err := os.Create(output)
+	if err != nil {
+		return "", err
+	}
+	defer dst.Close()
+	if err := audio.Convert(src, dst, *t.Format); err != nil {
+		os.Remove(output)
+		// 同样的输入会得到同样的错误，不必重试
+		return "", backend.Permanent(errors.Wrap(err, "convert output"))
+	}
+	return output, nil
+}
+
+// outputName appends the suffix of format f to base. A result that is still
+// WAV keeps the codec in its name, as in x.mulaw.wav.
+func outputName(base string, f *audio.Target) string {
+	name := base + "." + string(f.Codec)
+	if f.Ext() != string(f.Codec) {
+		name += "." + f.Ext()
+	}
+	return name
+}
+
+// requestedFormat reads the format asked for by a /getResult request: the
+// format, sampleRate, channels and bitDepth query parameters, or else the
+// Accept header. It returns nil when the request does not ask for a format.
+func requestedFormat(ctx *gin.Context) (*audio.Target, error) {
+	f := &audio.Target{Codec: audio.Codec(ctx.Query("format"))}
+	for name, field := range map[string]*int{
+		"sampleRate": &f.SampleRate,
+		"channels":   &f.Channels,
+		"bitDepth":   &f.BitDepth,
+	} {
+		if v := ctx.Query(name); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil {
+				return nil, errors.Errorf("invalid %s %q", name, v)
+			}
+			*field = n
+		}
+	}
+	if f.Codec == "" {
+		for _, accept := range strings.Split(ctx.GetHeader("Accept"), ",") {
+			mediaType, _, err := mime.ParseMediaType(strings.TrimSpace(accept))
+			if err != nil {
+				continue
+			}
+			if codec, ok := acceptCodecs[mediaType]; ok {
+				f.Codec = codec
+				break
+			}
+		}
+	}
+	if f.Codec == "" {
+		if f.SampleRate == 0 && f.Channels == 0 && f.BitDepth == 0 {
+			return nil, nil
+		}
+		f.Codec = audio.CodecWAV
+	}
+	return f, f.Validate()
+}
+
+// serveResult writes the result of info in the requested format, converting
+// the backend WAV on the fly when no stored file matches.
+func (handler *TTShHandler) serveResult(ctx *gin.Context, info *taskInfo) {
+	target, err := requestedFormat(ctx)
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"code": http.StatusBadRequest, "message": err.Error()})
+		return
+	}
+	switch {
+	case target == nil && info.Output != "":
+		handler.sendResult(ctx, info.Output, info.Format.ContentType())
+		return
+	case isIdentity(target):
+		handler.sendResult(ctx, info.File, "audio/wav")
+		return
+	case info.Output != "" && info.Format != nil && *info.Format == *target:
+		handler.sendResult(ctx, info.Output, target.ContentType())
+		return
+	}
+
+	src, _, err := openResult(ctx, info.File)
+	if err != nil {
+		ctx.JSON(http.StatusInternalServerError, gin.H{"code": http.StatusInternalServerError, "message": err.Error()})
+		return
+	}
+	defer src.Close()
+	buf := &bytes.Buffer{}
+	if err := audio.Convert(src, buf, *target); err != nil {
+		logger.Errorf(ctx, "convert result of task %s to %+v: %s", info.Id, *target, err)
+		ctx.JSON(http.StatusUnprocessableEntity, gin.H{"code": http.StatusUnprocessableEntity, "message": err.Error()})
+		return
+	}
+	ctx.Data(http.StatusOK, target.ContentType(), buf.Bytes())
+}
+
+// resultFile returns the file a plain download of info serves.
+func resultFile(info *taskInfo) string {
+	if info.Output != "" {
+		return info.Output
+	}
+	return info.File
+}
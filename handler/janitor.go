@@ -0,0 +1,551 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/gomodule/redigo/redis"
+	"github.com/google/uuid"
+	"github.com/pkg/errors"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+	"ttsapi/config"
+	"ttsapi/logger"
+	"ttsapi/server/httpserver/middles/status"
+	"ttsapi/storage/blob"
+	rds "ttsapi/storage/redis"
+)
+
+const (
+	janitorLock    = "ttsapi:janitor:lock"    // 每个周期只有一个实例执行定时清理
+	janitorRunning = "ttsapi:janitor:running" // 正在执行的清理，定时和手动触发的清理互斥
+	janitorReport  = "ttsapi:janitor:report"  // 最近一次清理的报告
+
+	// 报告中逐项列出的删除和错误数量上限，超出部分只计数
+	janitorReportRemovals = 1000
+	janitorReportErrors   = 100
+
+	// legacyKeyPattern 旧版本以任务 ID 为 key 保存结果路径，没有过期时间
+	legacyKeyPattern = "????????-????-????-????-????????????"
+
+	defaultResultRetention = 7 * 24 * time.Hour
+	defaultTaskRetention   = 30 * 24 * time.Hour
+	defaultJanitorInterval = time.Hour
+	defaultOrphanGrace     = time.Hour
+	scanCount              = 500
+)
+
+// legacyFile 旧版本写在 output_audio_path 下的结果文件名，如 1700000000-model.wav
+var legacyFile = regexp.MustCompile(`^\d+-.+\.(wav|flac)$`)
+
+// retentionPolicy says how long after a task finished its result file and its
+// record are kept. Zero or less keeps them forever.
+type retentionPolicy struct {
+	results time.Duration
+	tasks   time.Duration
+}
+
+type janitorOptions struct {
+	defaults    retentionPolicy
+	interval    time.Duration
+	orphanGrace time.Duration
+	dryRun      bool
+	legacyDir   string // 旧版本结果文件所在目录
+}
+
+func newJanitorOptions(cfg *config.Retention, legacyDir string) janitorOptions {
+	opts := janitorOptions{
+		defaults:    retentionPolicy{results: defaultResultRetention, tasks: defaultTaskRetention},
+		interval:    defaultJanitorInterval,
+		orphanGrace: defaultOrphanGrace,
+		legacyDir:   legacyDir,
+	}
+	if cfg == nil {
+		return opts
+	}
+	if cfg.Results != 0 {
+		opts.defaults.results = cfg.Results
+	}
+	if cfg.Tasks != 0 {
+		opts.defaults.tasks = cfg.Tasks
+	}
+	if cfg.Interval > 0 {
+		opts.interval = cfg.Interval
+	}
+	if cfg.OrphanGrace > 0 {
+		opts.orphanGrace = cfg.OrphanGrace
+	}
+	opts.dryRun = cfg.DryRun
+	return opts
+}
+
+// policy returns the retention of the tasks submitted by owner.
+func (o janitorOptions) policy(owner string) retentionPolicy {
+	p := o.defaults
+	if key := keyByName(owner); key != nil {
+		if key.ResultRetention != 0 {
+			p.results = key.ResultRetention
+		}
+		if key.TaskRetention != 0 {
+			p.tasks = key.TaskRetention
+		}
+	}
+	return p
+}
+
+func expired(retention time.Duration, finishedAt, now int64) bool {
+	return retention > 0 && finishedAt > 0 && now-finishedAt > retention.Milliseconds()
+}
+
+// Removal is one thing the janitor removed, or would remove in a dry run.
+type Removal struct {
+	Kind   string   `json:"kind"` // result, task, missing, batch, legacy, orphan
+	Id     string   `json:"id,omitempty"`
+	Owner  string   `json:"owner,omitempty"`
+	Files  []string `json:"files,omitempty"`
+	Size   int64    `json:"size,omitempty"`
+	Reason string   `json:"reason"`
+}
+
+type JanitorReport struct {
+	DryRun     bool      `json:"dryRun"`
+	StartedAt  int64     `json:"startedAt"`
+	FinishedAt int64     `json:"finishedAt"`
+	Tasks      int       `json:"tasks"` // 检查过的任务数
+	Removals   []Removal `json:"removals"`
+	Removed    int       `json:"removed"` // 删除的总数，Removals 最多列出 janitorReportRemovals 项
+	Freed      int64     `json:"freed"`   // 删除（或将删除）的文件字节数
+	Errors     []string  `json:"errors,omitempty"`
+	Failed     int       `json:"failed,omitempty"` // 错误总数，Errors 最多列出 janitorReportErrors 项
+	Truncated  bool      `json:"truncated,omitempty"`
+}
+
+func (r *JanitorReport) add(removal Removal) {
+	r.Removed++
+	r.Freed += removal.Size
+	if len(r.Removals) < janitorReportRemovals {
+		r.Removals = append(r.Removals, removal)
+	} else {
+		r.Truncated = true
+	}
+}
+
+func (r *JanitorReport) fail(err error) {
+	r.Failed++
+	if len(r.Errors) < janitorReportErrors {
+		r.Errors = append(r.Errors, err.Error())
+	} else {
+		r.Truncated = true
+	}
+}
+
+// sweep is the state of one janitor run.
+type sweep struct {
+	*JanitorReport
+	ctx        context.Context
+	conn       redis.Conn
+	opts       janitorOptions
+	now        int64
+	referenced map[string]bool // 仍被任务引用的结果
+	live       map[string]bool // 未结束的任务，它们的结果可能还没写入记录
+}
+
+// janitorLoop runs a sweep every interval on whichever instance takes the lock.
+func (handler *TTShHandler) janitorLoop(ctx context.Context) {
+	ticker := time.NewTicker(handler.janitor.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		ok, err := acquireJanitorLock(handler.queue.workerID, handler.janitor.interval)
+		if err != nil {
+			logger.Errorf(ctx, "janitor lock err: %s", err)
+			continue
+		}
+		if !ok {
+			continue
+		}
+		report, err := handler.runSweep(ctx, handler.janitor.dryRun)
+		if err != nil {
+			logger.Warnf(ctx, "janitor skipped: %s", err)
+			continue
+		}
+		logger.Infof(ctx, "janitor checked %d tasks, removed %d items (%d bytes), dry run %v, %d errors",
+			report.Tasks, report.Removed, report.Freed, report.DryRun, report.Failed)
+	}
+}
+
+// errSweepRunning 另一个清理正在执行
+var errSweepRunning = errors.New("a janitor sweep is already running")
+
+// releaseLockScript deletes KEYS[1] if it still holds the token ARGV[1].
+var releaseLockScript = redis.NewScript(1, `
+if redis.call('GET', KEYS[1]) == ARGV[1] then
+	return redis.call('DEL', KEYS[1])
+end
+return 0
+`)
+
+// runSweep runs a sweep unless one is already running on any instance, in
+// which case it returns errSweepRunning.
+func (handler *TTShHandler) runSweep(ctx context.Context, dryRun bool) (*JanitorReport, error) {
+	conn := rds.Get()
+	defer conn.Close()
+	token := uuid.New().String()
+	// 实例在清理中途退出时，锁在一个周期后过期
+	_, err := redis.String(conn.Do("SET", janitorRunning, token, "NX", "PX", handler.janitor.interval.Milliseconds()))
+	if errors.Is(err, redis.ErrNil) {
+		return nil, errSweepRunning
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer releaseLockScript.Do(conn, janitorRunning, token)
+	return handler.sweep(ctx, dryRun), nil
+}
+
+func acquireJanitorLock(worker string, ttl time.Duration) (bool, error) {
+	conn := rds.Get()
+	defer conn.Close()
+	// 锁在一个周期后自动过期，不需要释放，也避免多个实例在同一周期重复清理
+	_, err := redis.String(conn.Do("SET", janitorLock, worker, "NX", "PX", ttl.Milliseconds()))
+	if errors.Is(err, redis.ErrNil) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// sweep removes results and records past their retention, marks tasks whose
+// result disappeared as expired and deletes result files no task refers to.
+// With dryRun nothing is changed and the report lists what would be removed.
+func (handler *TTShHandler) sweep(ctx context.Context, dryRun bool) *JanitorReport {
+	conn := rds.Get()
+	defer conn.Close()
+	s := &sweep{
+		JanitorReport: &JanitorReport{DryRun: dryRun, StartedAt: nowMilli(), Removals: []Removal{}},
+		ctx:           ctx,
+		conn:          conn,
+		opts:          handler.janitor,
+		now:           nowMilli(),
+		referenced:    make(map[string]bool),
+		live:          make(map[string]bool),
+	}
+	// 先检查所有记录，得到仍被引用的文件，才能判断哪些文件是孤儿
+	if err := scanKeys(conn, taskKeyPrefix+"*", func(key string) error {
+		s.task(strings.TrimPrefix(key, taskKeyPrefix))
+		return nil
+	}); err != nil {
+		s.fail(errors.Wrap(err, "scan tasks"))
+	}
+	if err := scanKeys(conn, legacyKeyPattern, func(key string) error {
+		s.legacyKey(key)
+		return nil
+	}); err != nil {
+		s.fail(errors.Wrap(err, "scan legacy keys"))
+	}
+	if err := scanKeys(conn, batchKeyPrefix+"*", func(key string) error {
+		s.batch(strings.TrimPrefix(key, batchKeyPrefix))
+		return nil
+	}); err != nil {
+		s.fail(errors.Wrap(err, "scan batches"))
+	}
+	if s.Failed == 0 {
+		// 扫描不完整时无法确定文件是否被引用，不清理孤儿
+		s.orphans()
+		s.legacyFiles()
+	}
+	s.FinishedAt = nowMilli()
+	if data, err := json.Marshal(s.JanitorReport); err == nil {
+		conn.Do("SET", janitorReport, data)
+	}
+	return s.JanitorReport
+}
+
+func (s *sweep) task(id string) {
+	info, err := loadTask(s.conn, id)
+	if err != nil {
+		if !errors.Is(err, errTaskNotFound) {
+			s.fail(errors.Wrapf(err, "load task %s", id))
+		}
+		return
+	}
+	s.Tasks++
+	if !info.State.terminal() {
+		s.live[id] = true
+		if info.CacheKey != "" {
+			s.live[info.CacheKey] = true
+		}
+		return
+	}
+	policy := s.opts.policy(info.Owner)
+	finished := info.FinishedAt
+	if finished == 0 {
+		finished = info.UpdatedAt
+	}
+	files := resultFiles(info)
+	if expired(policy.tasks, finished, s.now) {
+		removal := Removal{Kind: "task", Id: id, Owner: info.Owner, Reason: "task retention elapsed"}
+		s.removeFiles(&removal, files)
+		s.del(&removal,
+			cmd("DEL", taskKey(id), webhookLogPrefix+id),
+			cmd("ZREM", webhookSet, id),
+			cmd("HDEL", webhookAttempts, id),
+			cmd("LREM", deadLetterList, 0, id),
+		)
+		return
+	}
+	if info.State != stateSucceeded {
+		// 其他结束状态没有有效结果，残留的文件作为孤儿清理
+		return
+	}
+	if expired(policy.results, finished, s.now) {
+		removal := Removal{Kind: "result", Id: id, Owner: info.Owner, Reason: "result retention elapsed"}
+		s.removeFiles(&removal, files)
+		s.expire(&removal)
+		return
+	}
+	if _, err := statResult(s.ctx, info.File); errors.Is(err, blob.ErrNotFound) {
+		removal := Removal{Kind: "missing", Id: id, Owner: info.Owner, Reason: "result file is missing"}
+		s.removeFiles(&removal, files[1:])
+		s.expire(&removal)
+		return
+	} else if err != nil {
+		s.fail(errors.Wrapf(err, "stat result of %s", id))
+	}
+	for _, file := range files {
+		s.referenced[referenceName(file)] = true
+	}
+}
+
+// expire moves the succeeded task of removal to expired.
+func (s *sweep) expire(removal *Removal) {
+	s.add(*removal)
+	if s.DryRun {
+		return
+	}
+	if _, err := transition(s.ctx, removal.Id, stateExpired, []taskState{stateSucceeded}, func(info *taskInfo) {
+		info.File = ""
+		info.Output = ""
+	}); err != nil {
+		s.fail(errors.Wrapf(err, "expire task %s", removal.Id))
+	}
+}
+
+// del records removal and runs cmds unless this is a dry run.
+func (s *sweep) del(removal *Removal, cmds ...command) {
+	s.add(*removal)
+	if s.DryRun {
+		return
+	}
+	if err := execCommands(cmds); err != nil {
+		s.fail(errors.Wrapf(err, "remove %s %s", removal.Kind, removal.Id))
+	}
+}
+
+// removeFiles deletes files, adding them and their size to removal.
+func (s *sweep) removeFiles(removal *Removal, files []string) {
+	for _, file := range files {
+		// 缓存的文件由缓存按 LRU 淘汰
+		if file == "" || isCacheKey(file) {
+			continue
+		}
+		info, err := statResult(s.ctx, file)
+		if errors.Is(err, blob.ErrNotFound) {
+			continue
+		}
+		if err == nil {
+			removal.Size += info.Size
+		}
+		removal.Files = append(removal.Files, file)
+		if !s.DryRun {
+			deleteResults(s.ctx, file)
+		}
+	}
+}
+
+// legacyKey handles a result pointer written by older versions: it is dropped
+// together with its file once the default result retention has passed, or
+// right away when the file is gone. Keys whose value is not a result file in
+// output_audio_path belong to someone else and are left alone.
+func (s *sweep) legacyKey(key string) {
+	file, err := redis.String(s.conn.Do("GET", key))
+	if err != nil {
+		// 不是字符串的同名 key 与本服务无关
+		return
+	}
+	if !inDir(s.opts.legacyDir, file) || !legacyFile.MatchString(filepath.Base(file)) {
+		return
+	}
+	info, err := statResult(s.ctx, file)
+	removal := Removal{Kind: "legacy", Id: key}
+	switch {
+	case errors.Is(err, blob.ErrNotFound):
+		removal.Reason = "result file is missing"
+	case err != nil:
+		s.fail(errors.Wrapf(err, "stat legacy result %s", file))
+		return
+	case expired(s.opts.defaults.results, info.ModTime.UnixMilli(), s.now):
+		removal.Reason = "result retention elapsed"
+		s.removeFiles(&removal, []string{file})
+	default:
+		s.referenced[referenceName(file)] = true
+		return
+	}
+	s.del(&removal, cmd("DEL", key))
+}
+
+// batch removes a batch record once the task retention of its owner passed.
+func (s *sweep) batch(id string) {
+	batch, err := getBatch(s.conn, id)
+	if err != nil {
+		return
+	}
+	if expired(s.opts.policy(batch.Owner).tasks, batch.CreatedAt, s.now) {
+		s.del(&Removal{Kind: "batch", Id: id, Owner: batch.Owner, Reason: "task retention elapsed"}, cmd("DEL", batchKey(id)))
+	}
+}
+
+// orphans deletes stored results that no task refers to, and cache files
+// that have no cache entry.
+func (s *sweep) orphans() {
+	for _, prefix := range []string{resultPrefix, cacheBlobPrefix} {
+		err := blob.Get().List(s.ctx, prefix, func(info *blob.Info) error {
+			id := strings.TrimPrefix(info.Key, prefix)
+			if i := strings.IndexByte(id, '.'); i >= 0 {
+				id = id[:i]
+			}
+			if prefix == cacheBlobPrefix {
+				id = cacheBlobKey(info.Key)
+				if owned, err := cacheEntryOwns(s.conn, id, info.Key); err != nil || owned {
+					return err
+				}
+			}
+			s.orphan(info, id)
+			return nil
+		})
+		if err != nil {
+			s.fail(errors.Wrapf(err, "list %s", prefix))
+		}
+	}
+}
+
+// legacyFiles deletes the result files of older versions that no task or
+// legacy key refers to.
+func (s *sweep) legacyFiles() {
+	if s.opts.legacyDir == "" {
+		return
+	}
+	entries, err := os.ReadDir(s.opts.legacyDir)
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			s.fail(errors.Wrap(err, "read output directory"))
+		}
+		return
+	}
+	for _, entry := range entries {
+		if entry.IsDir() || !legacyFile.MatchString(entry.Name()) {
+			continue
+		}
+		stat, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		name := filepath.Join(s.opts.legacyDir, entry.Name())
+		s.orphan(&blob.Info{Key: name, Size: stat.Size(), ModTime: stat.ModTime()}, "")
+	}
+}
+
+func (s *sweep) orphan(info *blob.Info, id string) {
+	if s.referenced[referenceName(info.Key)] || s.live[id] {
+		return
+	}
+	// 刚上传、还没写入任务记录的结果不算孤儿
+	if s.now-info.ModTime.UnixMilli() < s.opts.orphanGrace.Milliseconds() {
+		return
+	}
+	s.add(Removal{Kind: "orphan", Id: id, Files: []string{info.Key}, Size: info.Size, Reason: "no task refers to the file"})
+	if !s.DryRun {
+		deleteResults(s.ctx, info.Key)
+	}
+}
+
+// resultFiles returns the stored files of info, the WAV first.
+func resultFiles(info *taskInfo) []string {
+	return []string{info.File, info.Output}
+}
+
+// referenceName normalizes a stored result name so that legacy paths written
+// in different forms compare equal.
+func referenceName(name string) string {
+	if isResultKey(name) {
+		return name
+	}
+	return filepath.Clean(name)
+}
+
+// scanKeys calls fn for every key matching pattern, using SCAN.
+func scanKeys(conn redis.Conn, pattern string, fn func(key string) error) error {
+	cursor := "0"
+	for {
+		values, err := redis.Values(conn.Do("SCAN", cursor, "MATCH", pattern, "COUNT", scanCount))
+		if err != nil {
+			return err
+		}
+		if len(values) != 2 {
+			return errors.New("unexpected SCAN reply")
+		}
+		if cursor, err = redis.String(values[0], nil); err != nil {
+			return err
+		}
+		keys, err := redis.Strings(values[1], nil)
+		if err != nil {
+			return err
+		}
+		for _, key := range keys {
+			if err := fn(key); err != nil {
+				return err
+			}
+		}
+		if cursor == "0" {
+			return nil
+		}
+	}
+}
+
+type RunJanitorReq struct {
+	DryRun *bool `json:"dryRun"` // 为空时使用 retention.dry_run
+}
+
+// RunJanitor runs a sweep right away and returns its report. It answers 409
+// while another sweep is running.
+func (handler *TTShHandler) RunJanitor(ctx context.Context, req *RunJanitorReq) (*JanitorReport, error) {
+	dryRun := handler.janitor.dryRun
+	if req.DryRun != nil {
+		dryRun = *req.DryRun
+	}
+	report, err := handler.runSweep(ctx, dryRun)
+	if err != nil {
+		if errors.Is(err, errSweepRunning) {
+			return nil, &status.Status{Code: 409, Message: err.Error()}
+		}
+		return nil, &status.Status{Code: 500, Message: err.Error()}
+	}
+	return report, nil
+}
+
+// Janitor returns the report of the last sweep of any instance.
+func (handler *TTShHandler) Janitor(ctx context.Context, req *struct{}) (*JanitorReport, error) {
+	report := &JanitorReport{}
+	if err := rds.GetStruct(ctx, janitorReport, report); err != nil {
+		if errors.Is(err, redis.ErrNil) {
+			return nil, &status.Status{Code: 404, Message: "janitor has not run yet"}
+		}
+		return nil, &status.Status{Code: 500, Message: err.Error()}
+	}
+	return report, nil
+}
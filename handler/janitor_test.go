@@ -0,0 +1,127 @@
+package handler
+
+import (
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+	"ttsapi/config"
+	"ttsapi/server/httpserver/middles/status"
+	"ttsapi/storage/blob"
+)
+
+func TestJanitorExpiresOldResults(t *testing.T) {
+	env := newTestEnv(t, func(cfg *config.Config) {
+		cfg.Resources.Retention = &config.Retention{Results: time.Hour, Tasks: 48 * time.Hour}
+	})
+	old, fresh := env.submit(testModel, "你好。"), env.submit(testModel, "再见。")
+	env.run()
+	env.run()
+	if _, err := updateTask(env.ctx, old, func(info *taskInfo) error {
+		info.FinishedAt = nowMilli() - 2*time.Hour.Milliseconds()
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	file := env.task(old).File
+
+	report, err := env.handler.RunJanitor(env.ctx, &RunJanitorReq{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Tasks != 2 || report.Removed != 1 || report.Removals[0].Id != old || report.Freed == 0 {
+		t.Fatalf("report = %+v", report)
+	}
+	if _, err := statResult(env.ctx, file); !errors.Is(err, blob.ErrNotFound) {
+		t.Fatalf("expired result still stored: %v", err)
+	}
+	if info := env.task(old); info.State != stateExpired {
+		t.Fatalf("old task is %s", info.State)
+	}
+	if info := env.task(fresh); info.State != stateSucceeded {
+		t.Fatalf("fresh task is %s", info.State)
+	}
+	if stored, err := env.handler.Janitor(env.ctx, nil); err != nil || stored.Removed != 1 {
+		t.Fatalf("stored report = %+v, %v", stored, err)
+	}
+}
+
+func TestRunJanitorWhileSweeping(t *testing.T) {
+	env := newTestEnv(t, nil)
+	env.redis.Set(janitorRunning, "another-instance")
+	if _, err := env.handler.RunJanitor(env.ctx, &RunJanitorReq{}); status.GetCode(err) != http.StatusConflict {
+		t.Fatalf("run during a sweep: %v", err)
+	}
+	env.redis.Del(janitorRunning)
+	if _, err := env.handler.RunJanitor(env.ctx, &RunJanitorReq{}); err != nil {
+		t.Fatal(err)
+	}
+	if env.redis.Exists(janitorRunning) {
+		t.Fatal("sweep lock not released")
+	}
+}
+
+func TestJanitorReportIsCapped(t *testing.T) {
+	report := &JanitorReport{}
+	for i := 0; i < janitorReportRemovals+10; i++ {
+		report.add(Removal{Kind: "orphan", Size: 1})
+	}
+	for i := 0; i < janitorReportErrors+10; i++ {
+		report.fail(errors.New("boom"))
+	}
+	if len(report.Removals) != janitorReportRemovals || report.Removed != janitorReportRemovals+10 || report.Freed != janitorReportRemovals+10 {
+		t.Fatalf("%d removals listed, %d counted, %d bytes", len(report.Removals), report.Removed, report.Freed)
+	}
+	if len(report.Errors) != janitorReportErrors || report.Failed != janitorReportErrors+10 || !report.Truncated {
+		t.Fatalf("%d errors listed, %d counted, truncated %v", len(report.Errors), report.Failed, report.Truncated)
+	}
+}
+
+func TestJanitorOnlyTouchesLegacyResults(t *testing.T) {
+	env := newTestEnv(t, nil)
+	old := time.Now().Add(-30 * 24 * time.Hour)
+	legacy := filepath.Join(env.dir, "output", "1700000000-alice.wav")
+	outside := filepath.Join(env.dir, "scratch", "1700000000-alice.wav")
+	unrelated := filepath.Join(env.dir, "output", "notes.txt")
+	for _, name := range []string{legacy, outside, unrelated} {
+		writeFile(t, name, []byte("data"))
+		if err := os.Chtimes(name, old, old); err != nil {
+			t.Fatal(err)
+		}
+	}
+	keys := map[string]string{
+		"00000000-0000-0000-0000-000000000001": legacy,
+		"00000000-0000-0000-0000-000000000002": outside,
+		"00000000-0000-0000-0000-000000000003": unrelated,
+		"00000000-0000-0000-0000-000000000004": "some value",
+	}
+	for key, value := range keys {
+		env.redis.Set(key, value)
+	}
+
+	report, err := env.handler.RunJanitor(env.ctx, &RunJanitorReq{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Removed != 1 || report.Removals[0].Kind != "legacy" || report.Removals[0].Id != "00000000-0000-0000-0000-000000000001" {
+		t.Fatalf("report = %+v", report)
+	}
+	if isFile(legacy) {
+		t.Error("expired legacy result kept")
+	}
+	for key, value := range keys {
+		if key == "00000000-0000-0000-0000-000000000001" {
+			continue
+		}
+		if got, err := env.redis.Get(key); err != nil || got != value {
+			t.Errorf("%s = %q, %v", key, got, err)
+		}
+	}
+	for _, name := range []string{outside, unrelated} {
+		if !isFile(name) {
+			t.Errorf("%s removed", name)
+		}
+	}
+}
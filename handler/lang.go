@@ -0,0 +1,101 @@
+package handler
+
+import (
+	"context"
+	"fmt"
+	"ttsapi/server/httpserver/middles/status"
+	"ttsapi/text"
+)
+
+// textLangs GPT-SoVITS 的 text_lang 取值，调用方可以直接指定
+var textLangs = map[string]bool{
+	"all_zh":   true, // 全中文
+	"all_yue":  true, // 全粤语
+	"en":       true, // 全英文
+	"all_ja":   true, // 全日文
+	"all_ko":   true, // 全韩文
+	"zh":       true, // 中英混合
+	"yue":      true, // 粤英混合
+	"ja":       true, // 日英混合
+	"ko":       true, // 韩英混合
+	"auto":     true, // 多语种混合，由后端切分
+	"auto_yue": true, // 多语种混合（含粤语）
+}
+
+// textLang picks the backend text_lang for a detected text: all_<lang> for
+// a single language, <lang> for one language mixed with English and auto for
+// anything else.
+func textLang(d *text.Detection) string {
+	switch {
+	case len(d.Langs) == 1 && d.Langs[0] == text.LangEn:
+		return "en"
+	case len(d.Langs) == 1:
+		return "all_" + d.Langs[0]
+	case len(d.Langs) == 2 && d.Has(text.LangEn):
+		for _, lang := range d.Langs {
+			if lang != text.LangEn {
+				return lang
+			}
+		}
+	case d.Has(text.LangYue):
+		return "auto_yue"
+	}
+	return "auto"
+}
+
+// resolveLang detects the languages of content and returns the text_lang to
+// use: lang when the caller gave one, else the detected one.
+func resolveLang(content, lang string) (string, *text.Detection, error) {
+	detection := text.Detect(content)
+	if lang == "" {
+		return textLang(detection), detection, nil
+	}
+	if !textLangs[lang] {
+		return "", nil, &status.Status{Code: 400, Message: fmt.Sprintf("unknown lang %q", lang)}
+	}
+	return lang, detection, nil
+}
+
+// segmentLang returns the text_lang for step s of t. A language marked up
+// with xml:lang wins, since detection cannot tell kanji from hanzi nor
+// Cantonese from Mandarin. Detected languages are re-detected per segment,
+// so that a Japanese paragraph in a Chinese text is read as Japanese.
+func segmentLang(t *task, s step) string {
+	if s.lang != "" {
+		return markedLang(s.lang, s.text)
+	}
+	if t.LangExplicit {
+		return t.Lang
+	}
+	return textLang(text.Detect(s.text))
+}
+
+// markedLang returns the text_lang for segment marked up as lang: mixed with
+// English when the segment has English words, else lang alone.
+func markedLang(lang, segment string) string {
+	if lang == text.LangEn {
+		return "en"
+	}
+	if text.Detect(segment).Has(text.LangEn) {
+		return lang
+	}
+	return "all_" + lang
+}
+
+type DetectLangReq struct {
+	Text string `json:"text"`
+}
+
+type DetectLangResp struct {
+	Lang string `json:"lang"` // 自动识别时使用的 text_lang
+	*text.Detection
+}
+
+// DetectLang previews the language segmentation NewTask would store.
+func (handler *TTShHandler) DetectLang(ctx context.Context, req *DetectLangReq) (*DetectLangResp, error) {
+	lang, detection, err := resolveLang(req.Text, "")
+	if err != nil {
+		return nil, err
+	}
+	return &DetectLangResp{Lang: lang, Detection: detection}, nil
+}
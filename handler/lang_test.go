@@ -0,0 +1,62 @@
+package handler
+
+import (
+	"net/http"
+	"testing"
+	"ttsapi/server/httpserver/middles/status"
+	"ttsapi/text"
+)
+
+func TestTextLang(t *testing.T) {
+	for _, c := range []struct {
+		in, want string
+	}{
+		{"你好，世界。", "all_zh"},
+		{"佢哋喺度。", "all_yue"},
+		{"東京に行きます。", "all_ja"},
+		{"안녕하세요.", "all_ko"},
+		{"Hello, world.", "en"},
+		{"123", "all_zh"},
+		{"我用iPhone拍照。", "zh"},
+		{"佢用iPhone。", "yue"},
+		{"Tokyoに行きます。", "ja"},
+		{"Hello 안녕하세요", "ko"},
+		{"你好。東京に行きます。", "auto"},
+		{"你好。佢喺度。", "auto_yue"},
+		{"你好 안녕 hello", "auto"},
+	} {
+		lang, _, err := resolveLang(c.in, "")
+		if err != nil || lang != c.want {
+			t.Errorf("resolveLang(%q) = %q, %v, want %q", c.in, lang, err, c.want)
+		}
+	}
+	if lang, _, err := resolveLang("你好", "all_ja"); err != nil || lang != "all_ja" {
+		t.Errorf("explicit lang: %q, %v", lang, err)
+	}
+	if _, _, err := resolveLang("你好", "fr"); status.GetCode(err) != http.StatusBadRequest {
+		t.Errorf("unknown lang: %v", err)
+	}
+}
+
+func TestSegmentLang(t *testing.T) {
+	detected := &task{Lang: "auto"}
+	explicit := &task{Lang: "zh", LangExplicit: true}
+	for _, c := range []struct {
+		t    *task
+		s    step
+		want string
+	}{
+		// 自动识别时每段重新识别
+		{detected, step{text: "東京に行きます。"}, "all_ja"},
+		{detected, step{text: "你好。"}, "all_zh"},
+		{explicit, step{text: "東京に行きます。"}, "zh"},
+		// xml:lang 优先于调用方指定的语言
+		{explicit, step{text: "東京", lang: text.LangJa}, "all_ja"},
+		{explicit, step{text: "東京 Tower", lang: text.LangJa}, "ja"},
+		{explicit, step{text: "hello", lang: text.LangEn}, "en"},
+	} {
+		if got := segmentLang(c.t, c.s); got != c.want {
+			t.Errorf("segmentLang(%+v, %q) = %q, want %q", c.t.Lang, c.s.text, got, c.want)
+		}
+	}
+}
@@ -0,0 +1,474 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"gopkg.in/yaml.v3"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"ttsapi/logger"
+	"ttsapi/server/httpserver/middles/status"
+)
+
+const (
+	modelFilesDir = "files"  // models_path 下保存上传模型文件的目录，每个模型一个子目录
+	modelTrashDir = ".trash" // 已删除模型的清单，保留一段时间后连同文件一起清理
+	// deletedModelRetention 删除的模型文件保留的时间，已提交的任务仍按原路径读取它们
+	deletedModelRetention = 24 * time.Hour
+)
+
+var modelNamePattern = regexp.MustCompile(`^[\p{L}\p{N}_][\p{L}\p{N}_.\-]*$`)
+
+// managedModel returns the manifest of a loaded or disabled model, or an
+// error for models that are not described by one.
+func (handler *TTShHandler) managedModel(name string) (pair, error) {
+	set := handler.registry.Load()
+	model, ok := pair{}, false
+	if set != nil {
+		if model, ok = set.models[name]; !ok {
+			model, ok = set.disabled[name]
+		}
+	}
+	if !ok {
+		return pair{}, &status.Status{Code: http.StatusNotFound, Message: "model not found"}
+	}
+	if model.Manifest == "" {
+		return pair{}, &status.Status{Code: 400, Message: fmt.Sprintf("model %s is found by file names, describe it in a manifest to manage it", name)}
+	}
+	return model, nil
+}
+
+// commitManifest validates m as the manifest file and, when it has no errors,
+// replaces file with it and reloads the models. The issues of m are returned
+// either way.
+func (handler *TTShHandler) commitManifest(ctx context.Context, file string, m *modelManifest) ([]ModelIssue, error) {
+	base := filepath.Base(file)
+	if m.Name == "" {
+		m.Name = base[:len(base)-len(filepath.Ext(base))]
+	}
+	data, err := encodeManifest(file, m)
+	if err != nil {
+		return nil, &status.Status{Code: 500, Message: err.Error()}
+	}
+	// 先写到同目录下的临时文件校验，以 . 开头的文件不会被当作清单扫描
+	tmp := filepath.Join(filepath.Dir(file), ".check-"+base)
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return nil, &status.Status{Code: 500, Message: err.Error()}
+	}
+	report := &ModelReport{}
+	_, ok := handler.readManifest(tmp, report)
+	os.Remove(tmp)
+	for i := range report.Issues {
+		report.Issues[i].Source = file
+	}
+	if !ok {
+		return report.Issues, &status.Status{Code: 400, Message: issuesMessage(report.Issues)}
+	}
+	if err := writeFileAtomic(file, data); err != nil {
+		return nil, &status.Status{Code: 500, Message: err.Error()}
+	}
+	handler.reloadModels(ctx, reloadManage)
+	return report.Issues, nil
+}
+
+// encodeManifest renders m in the format the extension of file calls for.
+func encodeManifest(file string, m *modelManifest) ([]byte, error) {
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	if ext := filepath.Ext(file); ext != ".yaml" && ext != ".yml" {
+		return append(data, '\n'), nil
+	}
+	var doc interface{}
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return nil, err
+	}
+	return yaml.Marshal(doc)
+}
+
+func issuesMessage(issues []ModelIssue) string {
+	var msgs []string
+	for _, issue := range issues {
+		if issue.Level == "error" {
+			msgs = append(msgs, issue.Message)
+		}
+	}
+	return strings.Join(msgs, "; ")
+}
+
+// purgeTrash removes the manifests deleted more than deletedModelRetention
+// ago together with the files uploaded for them.
+func (handler *TTShHandler) purgeTrash(ctx context.Context) {
+	trash := filepath.Join(handler.modelsPath, modelTrashDir)
+	entries, err := os.ReadDir(trash)
+	if err != nil {
+		return
+	}
+	deadline := time.Now().Add(-deletedModelRetention).UnixMilli()
+	files := filepath.Join(handler.modelsPath, modelFilesDir)
+	for _, entry := range entries {
+		// <删除时间>-<清单文件名>
+		deletedAt, err := strconv.ParseInt(strings.SplitN(entry.Name(), "-", 2)[0], 10, 64)
+		if err != nil || deletedAt >= deadline {
+			continue
+		}
+		file := filepath.Join(trash, entry.Name())
+		var m modelManifest
+		if err := decodeManifest(file, &m); err == nil && filepath.IsAbs(m.GptWeights) {
+			if dir := filepath.Dir(m.GptWeights); filepath.Dir(dir) == files {
+				os.RemoveAll(dir)
+			}
+		}
+		os.Remove(file)
+		logger.Infof(ctx, "purged deleted model %s", entry.Name())
+	}
+}
+
+// ManagedModel 管理接口中的模型
+type ManagedModel struct {
+	pair
+	Enabled bool `json:"enabled"`
+	Managed bool `json:"managed"` // 由清单描述，可以通过接口修改
+}
+
+type ListModelsResp struct {
+	Models []ManagedModel `json:"models"`
+}
+
+// ListModels lists the loaded and the disabled models.
+func (handler *TTShHandler) ListModels(ctx context.Context, req *struct{}) (*ListModelsResp, error) {
+	resp := &ListModelsResp{Models: []ManagedModel{}}
+	set := handler.registry.Load()
+	if set == nil {
+		return resp, nil
+	}
+	for _, model := range set.models {
+		resp.Models = append(resp.Models, ManagedModel{pair: model, Enabled: true, Managed: model.Manifest != ""})
+	}
+	for _, model := range set.disabled {
+		resp.Models = append(resp.Models, ManagedModel{pair: model, Managed: true})
+	}
+	sort.Slice(resp.Models, func(i, j int) bool { return resp.Models[i].Name < resp.Models[j].Name })
+	return resp, nil
+}
+
+type ModelReferenceReq struct {
+	Name    string `json:"name"`   // 只有一条参考时可以为空
+	Upload  string `json:"upload"` // 参考音频的上传 ID
+	Text    string `json:"text"`
+	Lang    string `json:"lang"`
+	Default bool   `json:"default"`
+}
+
+type CreateModelReq struct {
+	Name          string              `json:"name"`
+	DisplayName   string              `json:"displayName"`
+	Tags          []string            `json:"tags"`
+	GptWeights    string              `json:"gptWeights"`    // GPT 权重的上传 ID
+	SovitsWeights string              `json:"sovitsWeights"` // SoVITS 权重的上传 ID
+	References    []ModelReferenceReq `json:"references"`
+	AuxReferences []string            `json:"auxReferences"` // 辅助参考音频的上传 ID
+	Params        *InferParams        `json:"params"`
+	PostProcess   *PostProcess        `json:"postProcess"`
+	Disabled      bool                `json:"disabled"`
+}
+
+type ModelManageResp struct {
+	Model  ManagedModel `json:"model"`
+	Issues []ModelIssue `json:"issues"` // 校验清单时的警告
+}
+
+// CreateModel adds a model from completed uploads. The files are moved into
+// a directory of their own under models_path and a manifest is written for
+// them; the models are reloaded once the manifest passes validation.
+func (handler *TTShHandler) CreateModel(ctx context.Context, req *CreateModelReq) (*ModelManageResp, error) {
+	if err := handler.checkModelsPath(); err != nil {
+		return nil, err
+	}
+	if !modelNamePattern.MatchString(req.Name) {
+		return nil, &status.Status{Code: 400, Message: "name must start with a letter, digit or _ and contain only letters, digits, _, . and -"}
+	}
+	handler.manageMu.Lock()
+	defer handler.manageMu.Unlock()
+	handler.purgeTrash(ctx)
+	if set := handler.registry.Load(); set != nil {
+		_, loaded := set.models[req.Name]
+		_, disabled := set.disabled[req.Name]
+		if loaded || disabled {
+			return nil, &status.Status{Code: http.StatusConflict, Message: fmt.Sprintf("model %s already exists", req.Name)}
+		}
+	}
+	file := filepath.Join(handler.modelsPath, req.Name+".json")
+	if _, err := os.Stat(file); err == nil {
+		return nil, &status.Status{Code: http.StatusConflict, Message: fmt.Sprintf("manifest %s already exists", file)}
+	}
+
+	// 依次取出上传的文件，任何一步失败都把已移动的文件放回去，调用方可以修正请求后重试
+	dir := filepath.Join(handler.modelsPath, modelFilesDir, fmt.Sprintf("%s-%d", req.Name, nowMilli()))
+	var moved [][2]string
+	rollback := func() {
+		for _, m := range moved {
+			os.Rename(m[1], m[0])
+		}
+		os.RemoveAll(dir)
+	}
+	claimed := make(map[string]bool)
+	defer func() {
+		for id := range claimed {
+			handler.uploads.release(id)
+		}
+	}()
+	take := func(field, id, sub string) (string, error) {
+		if claimed[id] {
+			return "", &status.Status{Code: 400, Message: fmt.Sprintf("%s: upload %s is used twice", field, id)}
+		}
+		u, err := handler.loadUpload(id)
+		if err != nil {
+			return "", &status.Status{Code: status.GetCode(err), Message: fmt.Sprintf("%s: %s", field, err)}
+		}
+		if !u.Complete {
+			return "", &status.Status{Code: 400, Message: fmt.Sprintf("%s: upload %s has %d of %d bytes", field, id, u.Offset, u.Size)}
+		}
+		if !handler.uploads.claim(id) {
+			return "", &status.Status{Code: http.StatusConflict, Message: fmt.Sprintf("%s: upload %s is busy", field, id)}
+		}
+		claimed[id] = true
+		target := filepath.Join(dir, sub, u.Filename)
+		if _, err := os.Stat(target); err == nil {
+			return "", &status.Status{Code: 400, Message: fmt.Sprintf("%s: another file is named %s", field, u.Filename)}
+		}
+		if err := os.MkdirAll(filepath.Dir(target), 0o755); err != nil {
+			return "", &status.Status{Code: 500, Message: err.Error()}
+		}
+		if err := os.Rename(handler.uploadPart(id), target); err != nil {
+			return "", &status.Status{Code: 500, Message: err.Error()}
+		}
+		moved = append(moved, [2]string{handler.uploadPart(id), target})
+		return target, nil
+	}
+
+	m := &modelManifest{
+		Name:        req.Name,
+		DisplayName: req.DisplayName,
+		Tags:        req.Tags,
+		Params:      req.Params,
+		PostProcess: req.PostProcess,
+		Disabled:    req.Disabled,
+	}
+	var err error
+	if m.GptWeights, err = take("gptWeights", req.GptWeights, ""); err != nil {
+		rollback()
+		return nil, err
+	}
+	if m.SovitsWeights, err = take("sovitsWeights", req.SovitsWeights, ""); err != nil {
+		rollback()
+		return nil, err
+	}
+	for i, r := range req.References {
+		ref := manifestReference{Name: r.Name, Text: r.Text, Lang: r.Lang, Default: r.Default}
+		if ref.Audio, err = take(fmt.Sprintf("references[%d]", i), r.Upload, "refs"); err != nil {
+			rollback()
+			return nil, err
+		}
+		m.References = append(m.References, ref)
+	}
+	for i, id := range req.AuxReferences {
+		aux, err := take(fmt.Sprintf("auxReferences[%d]", i), id, "aux")
+		if err != nil {
+			rollback()
+			return nil, err
+		}
+		m.AuxReferences = append(m.AuxReferences, aux)
+	}
+	issues, err := handler.commitManifest(ctx, file, m)
+	if err != nil {
+		rollback()
+		return nil, err
+	}
+	for id := range claimed {
+		handler.removeUpload(id)
+	}
+	logger.Infof(ctx, "model %s created by %s", req.Name, caller(ctx).Name)
+	return handler.manageResp(req.Name, issues)
+}
+
+type UpdateModelReq struct {
+	Name             string               `json:"name"`
+	DisplayName      *string              `json:"displayName"`
+	Tags             *[]string            `json:"tags"`
+	Params           *InferParams         `json:"params"`      // 整体替换，{} 清空
+	PostProcess      *PostProcess         `json:"postProcess"` // 整体替换，{} 清空
+	References       []ReferenceUpdateReq `json:"references"`
+	DefaultReference *string              `json:"defaultReference"`
+}
+
+type ReferenceUpdateReq struct {
+	Name string  `json:"name"`
+	Text *string `json:"text"`
+	Lang *string `json:"lang"`
+}
+
+// UpdateModel changes the metadata in the manifest of a model. Fields left
+// out are kept; the weights and audio files cannot be changed here.
+func (handler *TTShHandler) UpdateModel(ctx context.Context, req *UpdateModelReq) (*ModelManageResp, error) {
+	if err := handler.checkModelsPath(); err != nil {
+		return nil, err
+	}
+	handler.manageMu.Lock()
+	defer handler.manageMu.Unlock()
+	model, err := handler.managedModel(req.Name)
+	if err != nil {
+		return nil, err
+	}
+	m := &modelManifest{}
+	if err := decodeManifest(model.Manifest, m); err != nil {
+		return nil, &status.Status{Code: 500, Message: err.Error()}
+	}
+	if req.DisplayName != nil {
+		m.DisplayName = *req.DisplayName
+	}
+	if req.Tags != nil {
+		m.Tags = *req.Tags
+	}
+	if req.Params != nil {
+		m.Params = req.Params
+		if *req.Params == (InferParams{}) {
+			m.Params = nil
+		}
+	}
+	if req.PostProcess != nil {
+		m.PostProcess = req.PostProcess
+		if *req.PostProcess == (PostProcess{}) {
+			m.PostProcess = nil
+		}
+	}
+	for _, update := range req.References {
+		ref := manifestRef(m, update.Name)
+		if ref == nil {
+			return nil, &status.Status{Code: 400, Message: fmt.Sprintf("model %s has no reference %q", req.Name, update.Name)}
+		}
+		if update.Text != nil {
+			ref.Text = *update.Text
+		}
+		if update.Lang != nil {
+			ref.Lang = *update.Lang
+		}
+	}
+	if req.DefaultReference != nil {
+		if manifestRef(m, *req.DefaultReference) == nil {
+			return nil, &status.Status{Code: 400, Message: fmt.Sprintf("model %s has no reference %q", req.Name, *req.DefaultReference)}
+		}
+		for i := range m.References {
+			m.References[i].Default = false
+		}
+		manifestRef(m, *req.DefaultReference).Default = true
+	}
+	issues, err := handler.commitManifest(ctx, model.Manifest, m)
+	if err != nil {
+		return nil, err
+	}
+	return handler.manageResp(req.Name, issues)
+}
+
+// manifestRef returns the reference of m called name; an unnamed single
+// reference is called defaultReference.
+func manifestRef(m *modelManifest, name string) *manifestReference {
+	for i := range m.References {
+		refName := m.References[i].Name
+		if refName == "" && len(m.References) == 1 {
+			refName = defaultReference
+		}
+		if refName == name {
+			return &m.References[i]
+		}
+	}
+	return nil
+}
+
+type ModelNameReq struct {
+	Name string `json:"name"`
+}
+
+// DisableModel stops new tasks for a model. Tasks already submitted still
+// run, they carry the paths of the model files.
+func (handler *TTShHandler) DisableModel(ctx context.Context, req *ModelNameReq) (*ModelManageResp, error) {
+	return handler.setDisabled(ctx, req.Name, true)
+}
+
+// EnableModel makes a disabled model available again.
+func (handler *TTShHandler) EnableModel(ctx context.Context, req *ModelNameReq) (*ModelManageResp, error) {
+	return handler.setDisabled(ctx, req.Name, false)
+}
+
+func (handler *TTShHandler) setDisabled(ctx context.Context, name string, disabled bool) (*ModelManageResp, error) {
+	if err := handler.checkModelsPath(); err != nil {
+		return nil, err
+	}
+	handler.manageMu.Lock()
+	defer handler.manageMu.Unlock()
+	model, err := handler.managedModel(name)
+	if err != nil {
+		return nil, err
+	}
+	m := &modelManifest{}
+	if err := decodeManifest(model.Manifest, m); err != nil {
+		return nil, &status.Status{Code: 500, Message: err.Error()}
+	}
+	m.Disabled = disabled
+	issues, err := handler.commitManifest(ctx, model.Manifest, m)
+	if err != nil {
+		return nil, err
+	}
+	return handler.manageResp(name, issues)
+}
+
+// DeleteModel removes a model from the registry. Its manifest goes to the
+// trash and the uploaded files stay for deletedModelRetention so that
+// submitted tasks can still read them.
+func (handler *TTShHandler) DeleteModel(ctx context.Context, req *ModelNameReq) (*ModelManageResp, error) {
+	if err := handler.checkModelsPath(); err != nil {
+		return nil, err
+	}
+	handler.manageMu.Lock()
+	defer handler.manageMu.Unlock()
+	model, err := handler.managedModel(req.Name)
+	if err != nil {
+		return nil, err
+	}
+	trash := filepath.Join(handler.modelsPath, modelTrashDir)
+	if err := os.MkdirAll(trash, 0o755); err != nil {
+		return nil, &status.Status{Code: 500, Message: err.Error()}
+	}
+	if err := os.Rename(model.Manifest, filepath.Join(trash, fmt.Sprintf("%d-%s", nowMilli(), filepath.Base(model.Manifest)))); err != nil {
+		return nil, &status.Status{Code: 500, Message: err.Error()}
+	}
+	handler.reloadModels(ctx, reloadManage)
+	handler.purgeTrash(ctx)
+	logger.Infof(ctx, "model %s deleted by %s", req.Name, caller(ctx).Name)
+	return &ModelManageResp{Model: ManagedModel{pair: model, Managed: true}, Issues: []ModelIssue{}}, nil
+}
+
+// manageResp describes model name as it is after a change.
+func (handler *TTShHandler) manageResp(name string, issues []ModelIssue) (*ModelManageResp, error) {
+	if issues == nil {
+		issues = []ModelIssue{}
+	}
+	resp := &ModelManageResp{Issues: issues}
+	set := handler.registry.Load()
+	if model, ok := set.models[name]; ok {
+		resp.Model = ManagedModel{pair: model, Enabled: true, Managed: true}
+	} else if model, ok := set.disabled[name]; ok {
+		resp.Model = ManagedModel{pair: model, Managed: true}
+	} else {
+		return nil, &status.Status{Code: 500, Message: fmt.Sprintf("model %s was not loaded, see the model report", name)}
+	}
+	return resp, nil
+}
@@ -0,0 +1,119 @@
+package handler
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"ttsapi/config"
+	"ttsapi/server/httpserver/middles/status"
+	"ttsapi/text"
+)
+
+// normalizers holds the text normalizer of every caller. Callers without
+// rules of their own share the global one.
+type normalizers struct {
+	global  *text.Normalizer
+	callers map[string]*text.Normalizer
+}
+
+// newNormalizers compiles the global rules and those of every key. A rule
+// that does not compile is a configuration error.
+func newNormalizers(audioCfg *config.Audio, keys []config.APIKey) (normalizers, error) {
+	var global *config.Normalize
+	if audioCfg != nil {
+		global = audioCfg.Normalize
+	}
+	n := normalizers{callers: make(map[string]*text.Normalizer)}
+	var err error
+	if n.global, err = buildNormalizer(nil, global); err != nil {
+		return n, fmt.Errorf("audio.normalize: %w", err)
+	}
+	for i, key := range keys {
+		if key.Normalize == nil {
+			continue
+		}
+		normalizer, err := buildNormalizer(key.Normalize, global)
+		if err != nil {
+			return n, fmt.Errorf("api_keys[%d].normalize: %w", i, err)
+		}
+		n.callers[key.Name] = normalizer
+	}
+	return n, nil
+}
+
+// buildNormalizer compiles the caller rules followed by the global ones.
+func buildNormalizer(own, global *config.Normalize) (*text.Normalizer, error) {
+	var rules []text.Rule
+	var disable []string
+	for _, cfg := range []*config.Normalize{own, global} {
+		if cfg == nil {
+			continue
+		}
+		for i, r := range cfg.Rules {
+			name := r.Name
+			if name == "" {
+				name = fmt.Sprintf("rules[%d]", i)
+			}
+			rule, err := text.ReplaceRule(name, r.Lang, r.Pattern, r.Replace)
+			if err != nil {
+				return nil, err
+			}
+			rules = append(rules, rule)
+		}
+		disable = append(disable, cfg.Disable...)
+	}
+	return text.NewNormalizer(rules, disable)
+}
+
+func (n normalizers) get(owner string) *text.Normalizer {
+	if normalizer, ok := n.callers[owner]; ok {
+		return normalizer
+	}
+	return n.global
+}
+
+// normLang returns the language an explicit text_lang fixes for the whole
+// text, or "" for mixed-language codes, whose parts are normalised by the
+// language around them.
+func normLang(lang string) string {
+	switch lang {
+	case "en":
+		return text.LangEn
+	case "all_zh", "all_yue", "all_ja", "all_ko":
+		return strings.TrimPrefix(lang, "all_")
+	}
+	return ""
+}
+
+// normalize rewrites content into its spoken form with the rules of owner.
+func (handler *TTShHandler) normalize(owner, content, lang string) (string, []text.Change) {
+	return handler.normalizers.get(owner).Normalize(content, normLang(lang))
+}
+
+type NormalizeReq struct {
+	Text string `json:"text"`
+	Lang string `json:"lang"` // 可选，GPT-SoVITS 的 text_lang，为空时按上下文判断
+}
+
+type NormalizeResp struct {
+	Text    string        `json:"text"`
+	Lang    string        `json:"lang"` // 规范化后的文本使用的 text_lang
+	Changes []text.Change `json:"changes"`
+}
+
+// Normalize previews the text NewTask would synthesize, with the rules of
+// the caller, without synthesizing it.
+func (handler *TTShHandler) Normalize(ctx context.Context, req *NormalizeReq) (*NormalizeResp, error) {
+	if req.Lang != "" && !textLangs[req.Lang] {
+		return nil, &status.Status{Code: 400, Message: fmt.Sprintf("unknown lang %q", req.Lang)}
+	}
+	normalized, changes := handler.normalize(caller(ctx).Name, req.Text, req.Lang)
+	lang, _, err := resolveLang(normalized, req.Lang)
+	if err != nil {
+		return nil, err
+	}
+	if changes == nil {
+		changes = []text.Change{}
+	}
+	return &NormalizeResp{Text: normalized, Lang: lang, Changes: changes}, nil
+}
@@ -0,0 +1,27 @@
+package handler
+
+import (
+	"strings"
+	"testing"
+	"ttsapi/config"
+)
+
+func TestNormalizeRulesMustCompile(t *testing.T) {
+	bad := &config.Normalize{Rules: []config.NormalizeRule{{Name: "broken", Pattern: "("}}}
+	if _, err := newNormalizers(&config.Audio{Normalize: bad}, nil); err == nil || !strings.HasPrefix(err.Error(), "audio.normalize") {
+		t.Errorf("bad global rule: %v", err)
+	}
+	keys := []config.APIKey{{Key: "k", Name: "user", Normalize: bad}}
+	if _, err := newNormalizers(nil, keys); err == nil || !strings.HasPrefix(err.Error(), "api_keys[0].normalize") {
+		t.Errorf("bad key rule: %v", err)
+	}
+	keys[0].Normalize = &config.Normalize{Disable: []string{"nope"}}
+	if _, err := newNormalizers(nil, keys); err == nil {
+		t.Error("unknown built-in rule accepted")
+	}
+	keys[0].Normalize = &config.Normalize{Disable: []string{"fraction"}}
+	n, err := newNormalizers(nil, keys)
+	if err != nil || n.get("user") == n.global {
+		t.Errorf("valid rules: %v", err)
+	}
+}
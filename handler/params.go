@@ -0,0 +1,208 @@
+package handler
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"os"
+	"ttsapi/backend"
+)
+
+// speedFactor 的取值范围
+const (
+	minSpeedFactor = 0.5
+	maxSpeedFactor = 2
+)
+
+// InferParams GPT-SoVITS 推理参数。字段为 nil 表示沿用上一级（模型默认值 -> 全局默认值）。
+type InferParams struct {
+	TopK              *int     `json:"topK,omitempty"`
+	TopP              *float64 `json:"topP,omitempty"`
+	Temperature       *float64 `json:"temperature,omitempty"`
+	TextSplitMethod   *string  `json:"textSplitMethod,omitempty"`
+	BatchSize         *int     `json:"batchSize,omitempty"`
+	BatchThreshold    *float64 `json:"batchThreshold,omitempty"`
+	SplitBucket       *bool    `json:"splitBucket,omitempty"`
+	SpeedFactor       *float64 `json:"speedFactor,omitempty"`
+	Seed              *int64   `json:"seed,omitempty"`
+	ParallelInfer     *bool    `json:"parallelInfer,omitempty"`
+	RepetitionPenalty *float64 `json:"repetitionPenalty,omitempty"`
+	Reference         *string  `json:"reference,omitempty"` // 模型清单中参考音频的名称，为空时使用默认参考
+}
+
+var textSplitMethods = map[string]bool{
+	"cut0": true, // 不切
+	"cut1": true, // 凑四句一切
+	"cut2": true, // 凑50字一切
+	"cut3": true, // 按中文句号切
+	"cut4": true, // 按英文句号切
+	"cut5": true, // 按标点符号切
+}
+
+// defaultInferParams returns the values that used to be hard-coded in process.
+func defaultInferParams() *InferParams {
+	return &InferParams{
+		TopK:              intPtr(5),
+		TopP:              floatPtr(1),
+		Temperature:       floatPtr(1),
+		TextSplitMethod:   stringPtr("cut0"),
+		BatchSize:         intPtr(1),
+		BatchThreshold:    floatPtr(0.75),
+		SplitBucket:       boolPtr(true),
+		SpeedFactor:       floatPtr(1.0),
+		Seed:              int64Ptr(-1),
+		ParallelInfer:     boolPtr(true),
+		RepetitionPenalty: floatPtr(1.35),
+	}
+}
+
+// merge returns a copy of p with every non-nil field of over applied on top.
+func (p *InferParams) merge(over *InferParams) *InferParams {
+	ret := *p
+	if over == nil {
+		return &ret
+	}
+	if over.TopK != nil {
+		ret.TopK = over.TopK
+	}
+	if over.TopP != nil {
+		ret.TopP = over.TopP
+	}
+	if over.Temperature != nil {
+		ret.Temperature = over.Temperature
+	}
+	if over.TextSplitMethod != nil {
+		ret.TextSplitMethod = over.TextSplitMethod
+	}
+	if over.BatchSize != nil {
+		ret.BatchSize = over.BatchSize
+	}
+	if over.BatchThreshold != nil {
+		ret.BatchThreshold = over.BatchThreshold
+	}
+	if over.SplitBucket != nil {
+		ret.SplitBucket = over.SplitBucket
+	}
+	if over.SpeedFactor != nil {
+		ret.SpeedFactor = over.SpeedFactor
+	}
+	if over.Seed != nil {
+		ret.Seed = over.Seed
+	}
+	if over.ParallelInfer != nil {
+		ret.ParallelInfer = over.ParallelInfer
+	}
+	if over.RepetitionPenalty != nil {
+		ret.RepetitionPenalty = over.RepetitionPenalty
+	}
+	if over.Reference != nil {
+		ret.Reference = over.Reference
+	}
+	return &ret
+}
+
+// validate checks the fields that are set; nil fields are not checked.
+func (p *InferParams) validate() error {
+	if p == nil {
+		return nil
+	}
+	if p.TopK != nil && (*p.TopK < 1 || *p.TopK > 100) {
+		return fmt.Errorf("topK must be in [1, 100], got %d", *p.TopK)
+	}
+	if p.TopP != nil && (*p.TopP <= 0 || *p.TopP > 1) {
+		return fmt.Errorf("topP must be in (0, 1], got %v", *p.TopP)
+	}
+	if p.Temperature != nil && (*p.Temperature <= 0 || *p.Temperature > 2) {
+		return fmt.Errorf("temperature must be in (0, 2], got %v", *p.Temperature)
+	}
+	if p.TextSplitMethod != nil && !textSplitMethods[*p.TextSplitMethod] {
+		return fmt.Errorf("unknown textSplitMethod %q", *p.TextSplitMethod)
+	}
+	if p.BatchSize != nil && (*p.BatchSize < 1 || *p.BatchSize > 200) {
+		return fmt.Errorf("batchSize must be in [1, 200], got %d", *p.BatchSize)
+	}
+	if p.BatchThreshold != nil && (*p.BatchThreshold <= 0 || *p.BatchThreshold > 1) {
+		return fmt.Errorf("batchThreshold must be in (0, 1], got %v", *p.BatchThreshold)
+	}
+	if p.SpeedFactor != nil && (*p.SpeedFactor < minSpeedFactor || *p.SpeedFactor > maxSpeedFactor) {
+		return fmt.Errorf("speedFactor must be in [%v, %v], got %v", minSpeedFactor, maxSpeedFactor, *p.SpeedFactor)
+	}
+	if p.Seed != nil && (*p.Seed < -1 || *p.Seed > 1<<32-1) {
+		return fmt.Errorf("seed must be -1 or in [0, 4294967295], got %d", *p.Seed)
+	}
+	if p.RepetitionPenalty != nil && (*p.RepetitionPenalty < 0 || *p.RepetitionPenalty > 2) {
+		return fmt.Errorf("repetitionPenalty must be in [0, 2], got %v", *p.RepetitionPenalty)
+	}
+	return nil
+}
+
+// resolveInferParams layers the model defaults and the task overrides on top of
+// the global defaults. A seed of -1 is replaced by a concrete random seed so the
+// recorded parameters are enough to reproduce the result.
+func resolveInferParams(model, task *InferParams) (*InferParams, error) {
+	if err := task.validate(); err != nil {
+		return nil, err
+	}
+	params := defaultInferParams().merge(model).merge(task)
+	if err := params.validate(); err != nil {
+		return nil, err
+	}
+	if *params.Seed == -1 {
+		params.Seed = int64Ptr(rand.Int63n(1 << 32))
+	}
+	return params, nil
+}
+
+// seedAuto reports whether resolveInferParams picks the seed at random.
+func seedAuto(model, task *InferParams) bool {
+	return *defaultInferParams().merge(model).merge(task).Seed == -1
+}
+
+// backendParams converts resolved params for the backend.
+func (p *InferParams) backendParams() backend.Params {
+	return backend.Params{
+		TopK:              *p.TopK,
+		TopP:              *p.TopP,
+		Temperature:       *p.Temperature,
+		TextSplitMethod:   *p.TextSplitMethod,
+		BatchSize:         *p.BatchSize,
+		BatchThreshold:    *p.BatchThreshold,
+		SplitBucket:       *p.SplitBucket,
+		SpeedFactor:       *p.SpeedFactor,
+		Seed:              *p.Seed,
+		ParallelInfer:     *p.ParallelInfer,
+		RepetitionPenalty: *p.RepetitionPenalty,
+	}
+}
+
+func intPtr(v int) *int           { return &v }
+func int64Ptr(v int64) *int64     { return &v }
+func floatPtr(v float64) *float64 { return &v }
+func stringPtr(v string) *string  { return &v }
+func boolPtr(v bool) *bool        { return &v }
+
+// modelDefaults is the content of the <model>.json file stored next to the
+// reference audio: the inference params plus an optional post-processing chain.
+type modelDefaults struct {
+	InferParams
+	PostProcess *PostProcess `json:"postProcess"`
+}
+
+// readModelDefaults loads the model defaults stored next to the reference audio.
+func readModelDefaults(file string) (*modelDefaults, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	defaults := &modelDefaults{}
+	if err := json.Unmarshal(data, defaults); err != nil {
+		return nil, err
+	}
+	if err := defaults.InferParams.validate(); err != nil {
+		return nil, err
+	}
+	if err := defaults.PostProcess.validate(); err != nil {
+		return nil, err
+	}
+	return defaults, nil
+}
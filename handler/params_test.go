@@ -0,0 +1,88 @@
+package handler
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestResolveInferParams(t *testing.T) {
+	model := &InferParams{TopK: intPtr(10), SpeedFactor: floatPtr(0.9), Seed: int64Ptr(42), Reference: stringPtr("calm")}
+	for _, c := range []struct {
+		name        string
+		model, task *InferParams
+		want        func(p *InferParams) // 在全局默认值上改出期望值
+	}{
+		{"global defaults", nil, nil, nil},
+		{"model defaults", model, nil, func(p *InferParams) {
+			p.TopK, p.SpeedFactor, p.Seed, p.Reference = intPtr(10), floatPtr(0.9), int64Ptr(42), stringPtr("calm")
+		}},
+		{"task over model", model, &InferParams{TopK: intPtr(20), TextSplitMethod: stringPtr("cut5"), Reference: stringPtr("excited")}, func(p *InferParams) {
+			p.TopK, p.SpeedFactor, p.Seed, p.Reference = intPtr(20), floatPtr(0.9), int64Ptr(42), stringPtr("excited")
+			p.TextSplitMethod = stringPtr("cut5")
+		}},
+		{"task over global", nil, &InferParams{Temperature: floatPtr(0.5), SplitBucket: boolPtr(false), Seed: int64Ptr(0)}, func(p *InferParams) {
+			p.Temperature, p.SplitBucket, p.Seed = floatPtr(0.5), boolPtr(false), int64Ptr(0)
+		}},
+		// 任务可以覆盖模型中不合法的默认值
+		{"task fixes model", &InferParams{TopK: intPtr(0)}, &InferParams{TopK: intPtr(1)}, func(p *InferParams) {
+			p.TopK = intPtr(1)
+		}},
+	} {
+		got, err := resolveInferParams(c.model, c.task)
+		if err != nil {
+			t.Errorf("%s: %s", c.name, err)
+			continue
+		}
+		want := defaultInferParams()
+		if c.want != nil {
+			c.want(want)
+		}
+		if *want.Seed == -1 {
+			// -1 换成了具体的随机种子
+			if *got.Seed < 0 || *got.Seed >= 1<<32 {
+				t.Errorf("%s: random seed %d out of range", c.name, *got.Seed)
+			}
+			want.Seed = got.Seed
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%s:\n got %+v\nwant %+v", c.name, got.backendParams(), want.backendParams())
+		}
+	}
+	if *model.TopK != 10 || *model.Seed != 42 || *model.Reference != "calm" {
+		t.Errorf("model defaults were modified: %+v", model)
+	}
+
+	// 任务把模型的固定种子改回 -1 时重新随机
+	if !seedAuto(model, &InferParams{Seed: int64Ptr(-1)}) || seedAuto(model, nil) || !seedAuto(nil, nil) {
+		t.Error("seedAuto does not follow the merged seed")
+	}
+}
+
+func TestResolveInferParamsRejects(t *testing.T) {
+	for _, c := range []struct {
+		model, task *InferParams
+		err         string
+	}{
+		{nil, &InferParams{TopK: intPtr(0)}, "topK must be in [1, 100], got 0"},
+		{nil, &InferParams{TopP: floatPtr(0)}, "topP must be in (0, 1], got 0"},
+		{nil, &InferParams{Temperature: floatPtr(2.5)}, "temperature must be in (0, 2], got 2.5"},
+		{nil, &InferParams{TextSplitMethod: stringPtr("cut9")}, `unknown textSplitMethod "cut9"`},
+		{nil, &InferParams{BatchSize: intPtr(201)}, "batchSize must be in [1, 200], got 201"},
+		{nil, &InferParams{BatchThreshold: floatPtr(1.5)}, "batchThreshold must be in (0, 1], got 1.5"},
+		{nil, &InferParams{Seed: int64Ptr(-2)}, "seed must be -1 or in [0, 4294967295], got -2"},
+		{nil, &InferParams{Seed: int64Ptr(1 << 32)}, "seed must be -1 or in [0, 4294967295], got 4294967296"},
+		{nil, &InferParams{RepetitionPenalty: floatPtr(-0.1)}, "repetitionPenalty must be in [0, 2], got -0.1"},
+		// 任务中的错误即使模型给了合法的值也要报告
+		{&InferParams{TopK: intPtr(10)}, &InferParams{TopK: intPtr(101)}, "topK must be in [1, 100], got 101"},
+		// 模型中的错误没有被任务覆盖时同样报告
+		{&InferParams{Temperature: floatPtr(0)}, &InferParams{TopK: intPtr(10)}, "temperature must be in (0, 2], got 0"},
+	} {
+		if _, err := resolveInferParams(c.model, c.task); err == nil || err.Error() != c.err {
+			t.Errorf("model %+v, task %+v: error %v, want %q", c.model, c.task, err, c.err)
+		}
+	}
+	speed := &InferParams{SpeedFactor: floatPtr(maxSpeedFactor + 0.1)}
+	if _, err := resolveInferParams(nil, speed); err == nil {
+		t.Errorf("speedFactor %v was accepted", *speed.SpeedFactor)
+	}
+}
@@ -0,0 +1,302 @@
+package handler
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+	"ttsapi/backend"
+	"ttsapi/backend/fake"
+	"ttsapi/backend/gptsovits"
+	"ttsapi/logger"
+)
+
+const (
+	defaultHealthInterval     = 10 * time.Second
+	defaultUnhealthyThreshold = 3
+	healthTimeout             = 3 * time.Second
+
+	// instanceDepth 每个后端最多分配的队列任务数（1 个执行中 + 1 个预取）
+	instanceDepth = 2
+)
+
+// instance is one backend together with the model it has loaded. Only one
+// request may use the backend at a time; lock serializes them.
+type instance struct {
+	backend backend.Backend
+	lock    chan struct{}
+	tasks   chan string // 分配给该后端的队列任务，由该后端自己的 worker 执行
+
+	mu           sync.Mutex
+	currentModel string // 已加载的模型
+	nextModel    string // 最后一个已分配请求的模型，执行完已分配的请求后会加载它
+	batch        int    // 连续分配给 nextModel 的请求数
+	load         int    // 已分配（执行中 + 等待中）的请求数
+	healthy      bool
+	failures     int
+}
+
+// pool dispatches requests over the configured backends.
+type pool struct {
+	instances []*instance
+	changed   chan struct{} // 任一后端负载或健康状态变化时收到通知
+
+	healthInterval     time.Duration
+	unhealthyThreshold int
+
+	switches switchStats
+}
+
+// newBackend creates a TTS engine of the kind configured by server.tts_backend.
+// Unknown kinds are rejected by config validation at startup.
+func newBackend(kind, addr string) (backend.Backend, error) {
+	switch kind {
+	case "", "gptsovits":
+		return gptsovits.New(addr), nil
+	case "fake":
+		return fake.New(), nil
+	default:
+		return nil, fmt.Errorf("unknown tts backend %q", kind)
+	}
+}
+
+func newPool(kind string, addrs []string, healthInterval time.Duration, unhealthyThreshold int) (*pool, error) {
+	p := &pool{
+		changed:            make(chan struct{}, 1),
+		healthInterval:     defaultHealthInterval,
+		unhealthyThreshold: defaultUnhealthyThreshold,
+	}
+	if healthInterval > 0 {
+		p.healthInterval = healthInterval
+	}
+	if unhealthyThreshold > 0 {
+		p.unhealthyThreshold = unhealthyThreshold
+	}
+	if len(addrs) == 0 {
+		addrs = []string{""}
+	}
+	for _, addr := range addrs {
+		b, err := newBackend(kind, addr)
+		if err != nil {
+			return nil, err
+		}
+		p.instances = append(p.instances, &instance{
+			backend: b,
+			lock:    make(chan struct{}, 1),
+			tasks:   make(chan string, instanceDepth),
+			healthy: true,
+		})
+	}
+	return p, nil
+}
+
+func (p *pool) notify() {
+	select {
+	case p.changed <- struct{}{}:
+	default:
+	}
+}
+
+// reserve picks the least loaded healthy backend whose load is below maxLoad,
+// preferring, at equal load, one that has model loaded (or about to be). The
+// returned instance must be released with done. Returns nil if none qualifies.
+func (p *pool) reserve(model string, maxLoad int) *instance {
+	var best *instance
+	bestLoad, bestHasModel := 0, false
+	for _, in := range p.instances {
+		in.mu.Lock()
+		healthy, load, hasModel := in.healthy, in.load, in.nextModel == model
+		in.mu.Unlock()
+		if !healthy || load >= maxLoad {
+			continue
+		}
+		if best == nil || load < bestLoad || (load == bestLoad && hasModel && !bestHasModel) {
+			best, bestLoad, bestHasModel = in, load, hasModel
+		}
+	}
+	if best == nil {
+		return nil
+	}
+	p.assign(best, model)
+	return best
+}
+
+// assign books a request for model on in. It must be released with done.
+func (p *pool) assign(in *instance, model string) {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	in.load++
+	if in.nextModel == model {
+		in.batch++
+	} else {
+		in.nextModel = model
+		in.batch = 1
+	}
+}
+
+// available returns the healthy backends whose load is below maxLoad, least
+// loaded first.
+func (p *pool) available(maxLoad int) []*instance {
+	var ret []*instance
+	loads := make(map[*instance]int)
+	for _, in := range p.instances {
+		in.mu.Lock()
+		if in.healthy && in.load < maxLoad {
+			ret = append(ret, in)
+			loads[in] = in.load
+		}
+		in.mu.Unlock()
+	}
+	sort.SliceStable(ret, func(i, j int) bool { return loads[ret[i]] < loads[ret[j]] })
+	return ret
+}
+
+// reserveWait is reserve without a load limit that waits for a healthy backend.
+func (p *pool) reserveWait(ctx context.Context, model string) (*instance, error) {
+	for {
+		if in := p.reserve(model, int(^uint(0)>>1)); in != nil {
+			return in, nil
+		}
+		if err := p.wait(ctx); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// wait blocks until the load or health of some backend changes.
+func (p *pool) wait(ctx context.Context) error {
+	select {
+	case <-p.changed:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(time.Second):
+		return nil
+	}
+}
+
+func (p *pool) done(in *instance) {
+	in.mu.Lock()
+	in.load--
+	in.mu.Unlock()
+	p.notify()
+}
+
+// healthLoop probes every backend periodically. A backend is removed from
+// dispatch after unhealthyThreshold consecutive failures and re-admitted on
+// the first success.
+func (p *pool) healthLoop(ctx context.Context) {
+	ticker := time.NewTicker(p.healthInterval)
+	defer ticker.Stop()
+	for {
+		for _, in := range p.instances {
+			p.probe(ctx, in)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (p *pool) probe(ctx context.Context, in *instance) {
+	ctx, cancel := context.WithTimeout(ctx, healthTimeout)
+	defer cancel()
+	err := in.backend.Health(ctx)
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	if err == nil {
+		in.failures = 0
+		if !in.healthy {
+			in.healthy = true
+			// 后端可能重启过，已加载的模型未知
+			in.currentModel = ""
+			logger.Infof(ctx, "backend %s is healthy again", in.backend.Name())
+			p.notify()
+		}
+		return
+	}
+	in.failures++
+	if in.healthy && in.failures >= p.unhealthyThreshold {
+		in.healthy = false
+		logger.Errorf(ctx, "backend %s removed after %d failed health checks: %s", in.backend.Name(), in.failures, err)
+	}
+}
+
+// acquire 获取后端的使用权。后端同一时间只能加载一个模型，所有请求都需要串行。
+func (in *instance) acquire(ctx context.Context) error {
+	select {
+	case in.lock <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (in *instance) release() {
+	<-in.lock
+}
+
+// loadedModel returns the name of the model loaded in the backend of in.
+func (in *instance) loadedModel() string {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	return in.currentModel
+}
+
+// switchModel loads model into the backend of in unless it is already loaded.
+// The caller must hold the backend lock.
+func (p *pool) switchModel(ctx context.Context, in *instance, model pair) error {
+	in.mu.Lock()
+	current := in.currentModel
+	in.mu.Unlock()
+	if model.Name == current {
+		return nil
+	}
+	start := time.Now()
+	err := in.backend.LoadModel(ctx, backend.Model{
+		Name:       model.Name,
+		GptPath:    model.GptPath,
+		SovitsPath: model.SovitsPath,
+	})
+	p.switches.record(model.Name, time.Since(start), err)
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	if err != nil {
+		// 切换失败时后端状态未知，下次强制重新加载
+		in.currentModel = ""
+		return err
+	}
+	in.currentModel = model.Name
+	return nil
+}
+
+type BackendStatus struct {
+	Name         string `json:"name"`
+	Healthy      bool   `json:"healthy"`
+	Failures     int    `json:"failures"`
+	Load         int    `json:"load"`
+	CurrentModel string `json:"currentModel"`
+}
+
+type BackendsResp struct {
+	Backends []BackendStatus `json:"backends"`
+}
+
+func (handler *TTShHandler) Backends(ctx context.Context, req *struct{}) (*BackendsResp, error) {
+	rsp := &BackendsResp{Backends: []BackendStatus{}}
+	for _, in := range handler.pool.instances {
+		in.mu.Lock()
+		rsp.Backends = append(rsp.Backends, BackendStatus{
+			Name:         in.backend.Name(),
+			Healthy:      in.healthy,
+			Failures:     in.failures,
+			Load:         in.load,
+			CurrentModel: in.currentModel,
+		})
+		in.mu.Unlock()
+	}
+	return rsp, nil
+}
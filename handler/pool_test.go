@@ -0,0 +1,111 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"ttsapi/backend/fake"
+)
+
+// sickBackend is the fake backend with a health check that tests can fail.
+type sickBackend struct {
+	*fake.Backend
+	mu  sync.Mutex
+	err error
+}
+
+func (b *sickBackend) Health(ctx context.Context) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.err
+}
+
+func (b *sickBackend) set(err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.err = err
+}
+
+func newTestPool(t *testing.T, n, threshold int) (*pool, []*sickBackend) {
+	t.Helper()
+	addrs := make([]string, n)
+	p, err := newPool("fake", addrs, 0, threshold)
+	if err != nil {
+		t.Fatal(err)
+	}
+	backends := make([]*sickBackend, n)
+	for i, in := range p.instances {
+		backends[i] = &sickBackend{Backend: fake.New()}
+		in.backend = backends[i]
+	}
+	return p, backends
+}
+
+func TestUnhealthyBackendIsRemovedAndReadmitted(t *testing.T) {
+	p, backends := newTestPool(t, 2, 3)
+	ctx := context.Background()
+	sick := p.instances[0]
+	sick.currentModel = testModel
+	backends[0].set(errors.New("connection refused"))
+
+	for i := 1; i <= 3; i++ {
+		p.probe(ctx, sick)
+		if sick.healthy != (i < 3) || sick.failures != i {
+			t.Fatalf("after %d failures: healthy %v, %d failures counted", i, sick.healthy, sick.failures)
+		}
+	}
+	// 摘除后不再分配，即使另一个后端更忙
+	p.assign(p.instances[1], testModel)
+	p.assign(p.instances[1], testModel)
+	if in := p.reserve(testModel, 10); in != p.instances[1] {
+		t.Fatal("removed backend reserved")
+	}
+	if available := p.available(10); len(available) != 1 || available[0] != p.instances[1] {
+		t.Fatalf("%d backends available", len(available))
+	}
+
+	backends[0].set(nil)
+	p.probe(ctx, sick)
+	if !sick.healthy || sick.failures != 0 || sick.currentModel != "" {
+		t.Fatalf("readmitted backend: healthy %v, %d failures, model %q", sick.healthy, sick.failures, sick.currentModel)
+	}
+	select {
+	case <-p.changed:
+	default:
+		t.Fatal("readmission not notified")
+	}
+	if in := p.reserve(testModel, 10); in != sick {
+		t.Fatal("readmitted backend not reserved")
+	}
+}
+
+func TestReserveLeastLoaded(t *testing.T) {
+	p, _ := newTestPool(t, 3, 0)
+	a, b, c := p.instances[0], p.instances[1], p.instances[2]
+	p.assign(a, "bob")
+	p.assign(b, testModel)
+	p.assign(c, "bob")
+	p.assign(c, "bob")
+
+	// 负载相同时优先已经（或即将）加载该模型的后端
+	if in := p.reserve(testModel, 2); in != b {
+		t.Fatal("reserve ignored the loaded model")
+	}
+	if in := p.reserve(testModel, 2); in != a {
+		t.Fatal("reserve ignored the load")
+	}
+	if a.nextModel != testModel || a.batch != 1 || b.batch != 2 {
+		t.Fatalf("next models %q/%d and %q/%d", a.nextModel, a.batch, b.nextModel, b.batch)
+	}
+	if in := p.reserve(testModel, 2); in != nil {
+		t.Fatal("reserved a backend at its limit")
+	}
+	p.done(c)
+	if in := p.reserve("bob", 2); in != c {
+		t.Fatal("released backend not reserved")
+	}
+	if a.load != 2 || b.load != 2 || c.load != 2 {
+		t.Fatalf("loads %d %d %d", a.load, b.load, c.load)
+	}
+}
@@ -0,0 +1,184 @@
+package handler
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"time"
+	"ttsapi/audio"
+)
+
+const (
+	defaultTrimPad       = 50 * time.Millisecond
+	limiterLookahead     = 5 * time.Millisecond
+	limiterRelease       = 50 * time.Millisecond
+	defaultNormalizePeak = -1.0 // 只设置了响度时的峰值上限，EBU R128 建议 -1 dBTP
+	minLoudness          = -70.0
+)
+
+// PostProcess 合成结果的后处理链，按 裁剪静音 -> 响度归一化 -> 峰值限制 -> 淡入淡出 的顺序执行。
+// 字段为 nil 表示沿用模型的配置，模型也未配置则不做该项处理。
+type PostProcess struct {
+	Off         bool     `json:"off,omitempty"`         // 关闭模型配置的后处理
+	Loudness    *float64 `json:"loudness,omitempty"`    // 目标响度 LUFS，如 -16
+	PeakLimit   *float64 `json:"peakLimit,omitempty"`   // 峰值上限 dBFS，如 -1
+	TrimSilence *float64 `json:"trimSilence,omitempty"` // 首尾静音的阈值 dBFS，如 -50
+	TrimPadMs   *int     `json:"trimPadMs,omitempty"`   // 裁剪后首尾保留的静音，默认 50ms
+	FadeInMs    *int     `json:"fadeInMs,omitempty"`
+	FadeOutMs   *int     `json:"fadeOutMs,omitempty"`
+}
+
+// merge returns a copy of p with every non-nil field of over applied on top.
+func (p *PostProcess) merge(over *PostProcess) *PostProcess {
+	ret := PostProcess{}
+	if p != nil {
+		ret = *p
+	}
+	if over == nil {
+		return &ret
+	}
+	ret.Off = over.Off
+	if over.Loudness != nil {
+		ret.Loudness = over.Loudness
+	}
+	if over.PeakLimit != nil {
+		ret.PeakLimit = over.PeakLimit
+	}
+	if over.TrimSilence != nil {
+		ret.TrimSilence = over.TrimSilence
+	}
+	if over.TrimPadMs != nil {
+		ret.TrimPadMs = over.TrimPadMs
+	}
+	if over.FadeInMs != nil {
+		ret.FadeInMs = over.FadeInMs
+	}
+	if over.FadeOutMs != nil {
+		ret.FadeOutMs = over.FadeOutMs
+	}
+	return &ret
+}
+
+// validate checks the fields that are set; nil fields are not checked.
+func (p *PostProcess) validate() error {
+	if p == nil {
+		return nil
+	}
+	if p.Loudness != nil && (*p.Loudness < -60 || *p.Loudness > 0) {
+		return fmt.Errorf("loudness must be in [-60, 0] LUFS, got %v", *p.Loudness)
+	}
+	if p.PeakLimit != nil && (*p.PeakLimit < -30 || *p.PeakLimit > 0) {
+		return fmt.Errorf("peakLimit must be in [-30, 0] dBFS, got %v", *p.PeakLimit)
+	}
+	if p.TrimSilence != nil && (*p.TrimSilence < -100 || *p.TrimSilence > 0) {
+		return fmt.Errorf("trimSilence must be in [-100, 0] dBFS, got %v", *p.TrimSilence)
+	}
+	for name, ms := range map[string]*int{"trimPadMs": p.TrimPadMs, "fadeInMs": p.FadeInMs, "fadeOutMs": p.FadeOutMs} {
+		if ms != nil && (*ms < 0 || *ms > 10000) {
+			return fmt.Errorf("%s must be in [0, 10000], got %d", name, *ms)
+		}
+	}
+	return nil
+}
+
+// empty reports whether p does nothing.
+func (p *PostProcess) empty() bool {
+	return p == nil || p.Off || (p.Loudness == nil && p.PeakLimit == nil && p.TrimSilence == nil &&
+		(p.FadeInMs == nil || *p.FadeInMs == 0) && (p.FadeOutMs == nil || *p.FadeOutMs == 0))
+}
+
+// resolvePostProcess layers the task overrides on top of the model chain. It
+// returns nil when the resulting chain does nothing.
+func resolvePostProcess(model, task *PostProcess) (*PostProcess, error) {
+	if err := task.validate(); err != nil {
+		return nil, err
+	}
+	p := model.merge(task)
+	if p.empty() {
+		return nil, nil
+	}
+	return p, nil
+}
+
+// Loudness 结果的响度测量值
+type Loudness struct {
+	Input  float64 `json:"inputLufs"`  // 后处理前的综合响度
+	Output float64 `json:"outputLufs"` // 后处理后的综合响度
+	Peak   float64 `json:"peakDbfs"`   // 后处理后的采样峰值
+}
+
+// finite clamps the -Inf loudness of silence so that it can be encoded as JSON.
+func finite(v float64) float64 {
+	if math.IsInf(v, -1) || v < minLoudness {
+		return minLoudness
+	}
+	return math.Round(v*100) / 100
+}
+
+// postProcess applies the chain p to the WAV file in place and measures the
+// loudness before and after. With a nil chain the file is left alone and
+// nothing is measured.
+func postProcess(file string, p *PostProcess) (*Loudness, error) {
+	if p == nil {
+		return nil, nil
+	}
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	b, err := audio.Decode(f)
+	f.Close()
+	if err != nil {
+		return nil, err
+	}
+	stats := &Loudness{Input: finite(audio.Loudness(b))}
+
+	if p.TrimSilence != nil {
+		pad := defaultTrimPad
+		if p.TrimPadMs != nil {
+			pad = time.Duration(*p.TrimPadMs) * time.Millisecond
+		}
+		audio.TrimSilence(b, *p.TrimSilence, pad)
+	}
+	ceiling := p.PeakLimit
+	if p.Loudness != nil {
+		if measured := audio.Loudness(b); !math.IsInf(measured, -1) {
+			audio.Gain(b, *p.Loudness-measured)
+		}
+		if ceiling == nil {
+			ceiling = floatPtr(defaultNormalizePeak)
+		}
+	}
+	if ceiling != nil {
+		audio.Limit(b, *ceiling, limiterLookahead, limiterRelease)
+	}
+	var fadeIn, fadeOut time.Duration
+	if p.FadeInMs != nil {
+		fadeIn = time.Duration(*p.FadeInMs) * time.Millisecond
+	}
+	if p.FadeOutMs != nil {
+		fadeOut = time.Duration(*p.FadeOutMs) * time.Millisecond
+	}
+	audio.Fade(b, fadeIn, fadeOut)
+	stats.Output = finite(audio.Loudness(b))
+	stats.Peak = finite(audio.Peak(b))
+
+	// 写临时文件再替换，失败时不破坏原结果
+	tmp := file + ".tmp"
+	out, err := os.Create(tmp)
+	if err != nil {
+		return nil, err
+	}
+	err = audio.WriteWAV(out, b, b.BitDepth)
+	if e := out.Close(); err == nil {
+		err = e
+	}
+	if err == nil {
+		err = os.Rename(tmp, file)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return nil, err
+	}
+	return stats, nil
+}
@@ -0,0 +1,109 @@
+package handler
+
+import (
+	"bytes"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+	"ttsapi/audio"
+)
+
+// writeTone writes a WAV file of a 997 Hz sine at db dBFS between lead
+// seconds of silence on both sides.
+func writeTone(t *testing.T, db, seconds, lead float64) string {
+	t.Helper()
+	const rate = 32000
+	b := &audio.Buffer{SampleRate: rate, Channels: 1, BitDepth: 16, Data: make([]float64, int(lead*rate))}
+	for i := 0; i < int(seconds*rate); i++ {
+		b.Data = append(b.Data, audio.DBToAmp(db)*math.Sin(2*math.Pi*997*float64(i)/rate))
+	}
+	b.Data = append(b.Data, make([]float64, int(lead*rate))...)
+	buf := &bytes.Buffer{}
+	if err := audio.WriteWAV(buf, b, 16); err != nil {
+		t.Fatal(err)
+	}
+	name := filepath.Join(t.TempDir(), "result.wav")
+	writeFile(t, name, buf.Bytes())
+	return name
+}
+
+func readWav(t *testing.T, name string) *audio.Buffer {
+	t.Helper()
+	f, err := os.Open(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	b, err := audio.Decode(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func TestPostProcess(t *testing.T) {
+	file := writeTone(t, -30, 3, 1)
+	stats, err := postProcess(file, &PostProcess{
+		Loudness:    floatPtr(-16),
+		TrimSilence: floatPtr(-50),
+		FadeInMs:    intPtr(10),
+		FadeOutMs:   intPtr(10),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// -30 dBFS 的单声道正弦约为 -33 LUFS，与静音相接的门限块略低
+	if math.Abs(stats.Input+33) > 0.5 || math.Abs(stats.Output+16) > 0.2 || stats.Peak > -1 {
+		t.Fatalf("loudness %+v", stats)
+	}
+	b := readWav(t, file)
+	if d := b.Duration(); d < 3090*time.Millisecond || d > 3110*time.Millisecond {
+		t.Fatalf("trimmed to %s", d)
+	}
+	if b.Data[0] != 0 || b.Data[len(b.Data)-1] != 0 {
+		t.Fatalf("not faded: %f ... %f", b.Data[0], b.Data[len(b.Data)-1])
+	}
+	if got := audio.Loudness(b); math.Abs(got-stats.Output) > 0.1 {
+		t.Fatalf("stored file at %.2f LUFS, reported %.2f", got, stats.Output)
+	}
+}
+
+func TestPostProcessLimitsPeaks(t *testing.T) {
+	// 响度目标需要的增益使峰值超过 0 dBFS，由限制器压到上限
+	for _, c := range []struct {
+		peakLimit *float64
+		ceiling   float64
+	}{
+		{nil, defaultNormalizePeak},
+		{floatPtr(-6), -6},
+	} {
+		file := writeTone(t, -30, 2, 0)
+		stats, err := postProcess(file, &PostProcess{Loudness: floatPtr(-5), PeakLimit: c.peakLimit})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if stats.Peak > c.ceiling {
+			t.Errorf("ceiling %v: peak %v", c.ceiling, stats.Peak)
+		}
+		// 写入 16 位时允许一个量化步长
+		if peak := audio.Peak(readWav(t, file)); peak > c.ceiling+0.01 {
+			t.Errorf("ceiling %v: stored peak %v", c.ceiling, peak)
+		}
+	}
+}
+
+func TestPostProcessWithoutChain(t *testing.T) {
+	file := writeTone(t, -30, 1, 0)
+	before, err := os.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats, err := postProcess(file, nil); err != nil || stats != nil {
+		t.Fatalf("nil chain: %+v, %v", stats, err)
+	}
+	if after, err := os.ReadFile(file); err != nil || !bytes.Equal(before, after) {
+		t.Fatalf("file changed without a chain: %v", err)
+	}
+}
@@ -0,0 +1,314 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/gomodule/redigo/redis"
+	"github.com/google/uuid"
+	"github.com/pkg/errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+	"ttsapi/config"
+	"ttsapi/logger"
+	rds "ttsapi/storage/redis"
+)
+
+const (
+	processingPrefix = "ttsapi:processing:" // 每个 worker 一个 list，保存已取出、未完成的任务
+	inflightSet      = "ttsapi:tasks:inflight"
+	workerSet        = "ttsapi:workers"
+	workerKeyPrefix  = "ttsapi:worker:" // worker 心跳，过期即视为 worker 已退出
+	// legacyResultsMigrated 旧版本的 id -> 结果路径已全部转换为任务记录
+	legacyResultsMigrated = "ttsapi:migrated:results"
+
+	defaultVisibilityTimeout = 10 * time.Minute
+	defaultHeartbeatInterval = 10 * time.Second
+	defaultRecoveryInterval  = 30 * time.Second
+)
+
+var errWorkerLost = errors.New("worker lost while processing the task")
+
+type queueOptions struct {
+	workerID          string
+	visibilityTimeout time.Duration
+	heartbeatInterval time.Duration
+	recoveryInterval  time.Duration
+}
+
+func newQueueOptions(cfg *config.Queue) queueOptions {
+	opts := queueOptions{
+		visibilityTimeout: defaultVisibilityTimeout,
+		heartbeatInterval: defaultHeartbeatInterval,
+		recoveryInterval:  defaultRecoveryInterval,
+	}
+	if cfg != nil {
+		opts.workerID = cfg.WorkerID
+		if cfg.VisibilityTimeout > 0 {
+			opts.visibilityTimeout = cfg.VisibilityTimeout
+		}
+		if cfg.HeartbeatInterval > 0 {
+			opts.heartbeatInterval = cfg.HeartbeatInterval
+		}
+		if cfg.RecoveryInterval > 0 {
+			opts.recoveryInterval = cfg.RecoveryInterval
+		}
+	}
+	if opts.workerID == "" {
+		host, _ := os.Hostname()
+		opts.workerID = fmt.Sprintf("%s-%d-%s", host, os.Getpid(), uuid.New().String()[:8])
+	}
+	return opts
+}
+
+func processingList(workerID string) string {
+	return processingPrefix + workerID
+}
+
+func workerKey(workerID string) string {
+	return workerKeyPrefix + workerID
+}
+
+// heartbeat keeps the worker key alive so other instances do not recover our
+// in-flight tasks.
+func (handler *TTShHandler) heartbeat(ctx context.Context) {
+	ticker := time.NewTicker(handler.queue.heartbeatInterval)
+	defer ticker.Stop()
+	for {
+		if err := handler.beat(); err != nil {
+			logger.Errorf(ctx, "worker %s heartbeat err: %s", handler.queue.workerID, err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (handler *TTShHandler) beat() error {
+	conn := rds.Get()
+	defer conn.Close()
+	ttl := (3 * handler.queue.heartbeatInterval).Milliseconds()
+	conn.Send("MULTI")
+	conn.Send("SET", workerKey(handler.queue.workerID), nowMilli(), "PX", ttl)
+	conn.Send("SADD", workerSet, handler.queue.workerID)
+	_, err := conn.Do("EXEC")
+	return err
+}
+
+// retire removes the heartbeat so the remaining instances pick up our
+// in-flight tasks right away instead of waiting for the key to expire.
+func (handler *TTShHandler) retire() {
+	conn := rds.Get()
+	defer conn.Close()
+	conn.Do("DEL", workerKey(handler.queue.workerID))
+}
+
+// recoverLoop runs a recovery pass at startup and then periodically.
+func (handler *TTShHandler) recoverLoop(ctx context.Context) {
+	// 启动时自己的 processing list 里的任务一定来自上一次运行
+	handler.recoverWorker(ctx, handler.queue.workerID)
+	handler.migrateLegacyResults(ctx)
+	ticker := time.NewTicker(handler.queue.recoveryInterval)
+	defer ticker.Stop()
+	for {
+		if err := handler.recoverOrphans(ctx); err != nil {
+			logger.Errorf(ctx, "Recover orphaned tasks err: %s", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// recoverOrphans requeues the tasks of workers whose heartbeat has expired and
+// the in-flight tasks that exceeded the visibility timeout.
+func (handler *TTShHandler) recoverOrphans(ctx context.Context) error {
+	conn := rds.Get()
+	defer conn.Close()
+	workers, err := redis.Strings(conn.Do("SMEMBERS", workerSet))
+	if err != nil {
+		return err
+	}
+	for _, worker := range workers {
+		if worker == handler.queue.workerID {
+			continue
+		}
+		alive, err := redis.Bool(conn.Do("EXISTS", workerKey(worker)))
+		if err != nil {
+			return err
+		}
+		if alive {
+			continue
+		}
+		handler.recoverWorker(ctx, worker)
+		conn.Do("SREM", workerSet, worker)
+	}
+
+	handler.migrateLegacyQueue(ctx)
+
+	ids, err := redis.Strings(conn.Do("ZRANGEBYSCORE", inflightSet, "-inf", nowMilli()))
+	if err != nil {
+		return err
+	}
+	for _, id := range ids {
+		info, err := loadTask(conn, id)
+		if err != nil {
+			conn.Do("ZREM", inflightSet, id)
+			continue
+		}
+		if info.State != stateRunning {
+			conn.Do("ZREM", inflightSet, id)
+			continue
+		}
+		logger.Warnf(ctx, "task %s on worker %s exceeded visibility timeout", id, info.Worker)
+		handler.fail(ctx, info, errors.New("visibility timeout exceeded"), doneCommands(info.Worker, id)...)
+	}
+	return nil
+}
+
+// recoverWorker drains the processing list of a dead worker. Tasks that had
+// started count as a failed attempt; tasks that had not are simply requeued.
+func (handler *TTShHandler) recoverWorker(ctx context.Context, worker string) {
+	conn := rds.Get()
+	defer conn.Close()
+	for {
+		// RPOP 保证多个实例同时恢复时每个任务只被处理一次
+		id, err := redis.String(conn.Do("RPOP", processingList(worker)))
+		if err != nil {
+			if !errors.Is(err, redis.ErrNil) {
+				logger.Errorf(ctx, "recover worker %s err: %s", worker, err)
+			}
+			return
+		}
+		info, err := loadTask(conn, id)
+		if err != nil {
+			logger.Warnf(ctx, "drop orphaned task %s: %s", id, err)
+			continue
+		}
+		logger.Warnf(ctx, "recovering task %s from worker %s", id, worker)
+		switch info.State {
+		case stateRunning:
+			handler.fail(ctx, info, errWorkerLost, cmd("ZREM", inflightSet, id))
+		case stateQueued:
+			// 已取出但尚未开始，放回队首优先执行
+			if err := execCommands(enqueueCommands(info.Model.Name, id, 0)); err != nil {
+				logger.Errorf(ctx, "requeue task %s err: %s", id, err)
+			}
+		}
+	}
+}
+
+// doneCommands release a task from the worker's in-flight bookkeeping; they
+// run in the same transaction as the state change that ends the attempt.
+func doneCommands(worker, id string) []command {
+	return []command{
+		cmd("LREM", processingList(worker), 0, id),
+		cmd("ZREM", inflightSet, id),
+	}
+}
+
+// migrateLegacyQueue moves tasks left in the global list by older versions
+// onto the per-model queues.
+func (handler *TTShHandler) migrateLegacyQueue(ctx context.Context) {
+	conn := rds.Get()
+	defer conn.Close()
+	for {
+		data, err := redis.Bytes(conn.Do("RPOP", taskList))
+		if err != nil {
+			if !errors.Is(err, redis.ErrNil) {
+				logger.Errorf(ctx, "migrate legacy queue err: %s", err)
+			}
+			return
+		}
+		id := string(data)
+		// 更早的版本直接入队任务 JSON
+		if len(data) > 0 && data[0] == '{' {
+			if id, err = handler.adoptLegacyTask(ctx, data); err != nil {
+				logger.Errorf(ctx, "drop legacy task %s: %s", data, err)
+				continue
+			}
+		}
+		info, err := loadTask(conn, id)
+		if err != nil {
+			logger.Errorf(ctx, "drop legacy task %s: %s", id, err)
+			continue
+		}
+		if err := execCommands(enqueueCommands(info.Model.Name, id, info.CreatedAt)); err != nil {
+			logger.Errorf(ctx, "migrate legacy task %s err: %s", id, err)
+		}
+	}
+}
+
+// migrateLegacyResults turns the id -> result path keys written by older
+// versions into succeeded task records, so that task lookups never read a
+// client-supplied ID as a raw key. Paths outside output_audio_path are not
+// adopted. The pass runs until it has completed once.
+func (handler *TTShHandler) migrateLegacyResults(ctx context.Context) {
+	conn := rds.Get()
+	defer conn.Close()
+	if done, err := redis.Bool(conn.Do("EXISTS", legacyResultsMigrated)); err != nil || done {
+		return
+	}
+	migrated := 0
+	err := scanKeys(conn, "????????-????-????-????-????????????", func(key string) error {
+		if _, err := uuid.Parse(key); err != nil {
+			return nil
+		}
+		if kind, err := redis.String(conn.Do("TYPE", key)); err != nil || kind != "string" {
+			return err
+		}
+		file, err := redis.String(conn.Do("GET", key))
+		if err != nil {
+			return err
+		}
+		if !inDir(handler.janitor.legacyDir, file) {
+			logger.Warnf(ctx, "legacy result %s: %s is outside output_audio_path, not migrated", key, file)
+			return nil
+		}
+		at := nowMilli()
+		if stat, err := os.Stat(file); err == nil {
+			at = stat.ModTime().UnixMilli()
+		}
+		info := taskInfo{task: task{Id: key, Owner: defaultKeyName}, State: stateSucceeded, File: file, CreatedAt: at, FinishedAt: at, UpdatedAt: at}
+		js, err := json.Marshal(info)
+		if err != nil {
+			return err
+		}
+		if err := execCommands([]command{cmd("SET", taskKey(key), js, "NX"), cmd("DEL", key)}); err != nil {
+			return err
+		}
+		migrated++
+		return nil
+	})
+	if err != nil {
+		logger.Errorf(ctx, "migrate legacy results err: %s", err)
+		return
+	}
+	conn.Do("SET", legacyResultsMigrated, nowMilli())
+	if migrated > 0 {
+		logger.Infof(ctx, "migrated %d legacy results", migrated)
+	}
+}
+
+// inDir reports whether name lies inside dir.
+func inDir(dir, name string) bool {
+	if dir == "" {
+		return false
+	}
+	absDir, err := filepath.Abs(dir)
+	if err != nil {
+		return false
+	}
+	abs, err := filepath.Abs(name)
+	if err != nil {
+		return false
+	}
+	rel, err := filepath.Rel(absDir, abs)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) && rel != "."
+}
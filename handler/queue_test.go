@@ -0,0 +1,59 @@
+package handler
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestMigrateLegacyResults(t *testing.T) {
+	env := newTestEnv(t, nil)
+	inside := filepath.Join(env.dir, "output", "1700000000-alice.wav")
+	writeFile(t, inside, silentWav(t, 0))
+	const adopted, outside = "3b241101-e2bb-4255-8caf-4136c566a962", "6f1c2a54-5bd2-4b5e-9d1f-2c1d0f8d9e7a"
+	env.redis.Set(adopted, inside)
+	env.redis.Set(outside, "/etc/passwd")
+
+	env.handler.migrateLegacyResults(env.ctx)
+	info := env.task(adopted)
+	if info.State != stateSucceeded || info.File != inside || info.Owner != defaultKeyName {
+		t.Fatalf("migrated task: %s %q of %q", info.State, info.File, info.Owner)
+	}
+	if env.redis.Exists(adopted) {
+		t.Error("legacy key left behind")
+	}
+	if _, err := env.handler.loadTaskInfo(env.ctx, outside); err == nil {
+		t.Error("a result outside output_audio_path was adopted")
+	}
+	if !env.redis.Exists(legacyResultsMigrated) {
+		t.Error("migration not marked as done")
+	}
+}
+
+func TestLoadTaskInfoRejectsBadIds(t *testing.T) {
+	env := newTestEnv(t, nil)
+	env.redis.Set("ttsapi:workers-x", "/etc/passwd")
+	for _, id := range []string{"", "ttsapi:workers-x", "../../etc/passwd"} {
+		if _, err := env.handler.loadTaskInfo(env.ctx, id); err == nil {
+			t.Errorf("loadTaskInfo(%q) succeeded", id)
+		}
+	}
+}
+
+func TestInDir(t *testing.T) {
+	cases := []struct {
+		dir, name string
+		want      bool
+	}{
+		{"/data/out", "/data/out/a.wav", true},
+		{"/data/out", "/data/out/sub/a.wav", true},
+		{"/data/out", "/data/out", false},
+		{"/data/out", "/data/out/../secret", false},
+		{"/data/out", "/data/outside/a.wav", false},
+		{"", "/data/out/a.wav", false},
+	}
+	for _, c := range cases {
+		if got := inDir(c.dir, c.name); got != c.want {
+			t.Errorf("inDir(%q, %q) = %v", c.dir, c.name, got)
+		}
+	}
+}
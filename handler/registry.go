@@ -0,0 +1,499 @@
+package handler
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"gopkg.in/yaml.v3"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+	"ttsapi/audio"
+	"ttsapi/logger"
+)
+
+const (
+	defaultReference  = "default" // 按文件名约定加载的模型、以及清单中未命名的参考音频的名称
+	minReferenceAudio = 3 * time.Second
+	maxReferenceAudio = 10 * time.Second
+)
+
+// reference 模型的一条参考音频
+type reference struct {
+	Name      string `json:"name"`
+	AudioPath string `json:"audioPath"`
+	Text      string `json:"text"` // 参考音频的文本
+	Lang      string `json:"lang"` // 参考音频的语言
+}
+
+// modelManifest 模型清单，每个模型一个 YAML 或 JSON 文件。
+// 相对路径分别相对于 gpt_weights_path、sovits_weights_path、refer_audio_path。
+type modelManifest struct {
+	Name          string              `json:"name,omitempty"` // 为空时取清单的文件名
+	DisplayName   string              `json:"displayName,omitempty"`
+	Tags          []string            `json:"tags,omitempty"`
+	GptWeights    string              `json:"gptWeights"`
+	SovitsWeights string              `json:"sovitsWeights"`
+	References    []manifestReference `json:"references"`              // 第一条或 default 为 true 的一条是默认参考
+	AuxReferences []string            `json:"auxReferences,omitempty"` // 辅助参考音频，用于融合音色
+	Params        *InferParams        `json:"params,omitempty"`
+	PostProcess   *PostProcess        `json:"postProcess,omitempty"`
+	Disabled      bool                `json:"disabled,omitempty"` // 停用后不能再提交任务，已提交的任务照常执行
+}
+
+type manifestReference struct {
+	Name    string `json:"name,omitempty"` // 通过 params.reference 选择，只有一条时可以为空
+	Audio   string `json:"audio"`
+	Text    string `json:"text"`
+	Lang    string `json:"lang"`
+	Default bool   `json:"default,omitempty"`
+}
+
+// ModelIssue 加载模型时发现的问题
+type ModelIssue struct {
+	Level   string `json:"level"` // error：模型或文件未加载；warning：已加载，但可能影响合成
+	Source  string `json:"source"`
+	Model   string `json:"model,omitempty"`
+	Message string `json:"message"`
+}
+
+// ModelReport 一次加载模型的校验报告
+type ModelReport struct {
+	Models    int          `json:"models"`    // 可用的模型数
+	Manifests int          `json:"manifests"` // 其中来自清单的模型数
+	Issues    []ModelIssue `json:"issues"`
+	CheckedAt int64        `json:"checkedAt"`
+}
+
+func (r *ModelReport) errorf(source, model, format string, args ...interface{}) {
+	r.Issues = append(r.Issues, ModelIssue{Level: "error", Source: source, Model: model, Message: fmt.Sprintf(format, args...)})
+}
+
+func (r *ModelReport) warnf(source, model, format string, args ...interface{}) {
+	r.Issues = append(r.Issues, ModelIssue{Level: "warning", Source: source, Model: model, Message: fmt.Sprintf(format, args...)})
+}
+
+func (r *ModelReport) hasErrors() bool {
+	for _, issue := range r.Issues {
+		if issue.Level == "error" {
+			return true
+		}
+	}
+	return false
+}
+
+// modelRegistry 某一时刻的全部模型，整体替换，已取得的快照不会再被修改
+type modelRegistry struct {
+	models   map[string]pair // 可用的模型
+	disabled map[string]pair // 清单中已停用的模型
+	report   *ModelReport
+}
+
+// models returns the models that can be used right now.
+func (handler *TTShHandler) models() map[string]pair {
+	if set := handler.registry.Load(); set != nil {
+		return set.models
+	}
+	return nil
+}
+
+// reloadModels scans the models, swaps them in and announces the changes.
+// Unless the reload comes from a management request, a scan that finds
+// nothing but errors, such as an unmounted directory, leaves the models
+// loaded before in place. The caller must hold manageMu.
+func (handler *TTShHandler) reloadModels(ctx context.Context, trigger string) *ModelReport {
+	set := handler.scanModels()
+	logReport(ctx, set.report)
+	old := handler.registry.Load()
+	if trigger != reloadManage && old != nil && len(old.models) > 0 && len(set.models) == 0 && set.report.hasErrors() {
+		logger.Warnf(ctx, "No model loaded, keeping the %d loaded before", len(old.models))
+		set.models, set.disabled = old.models, old.disabled
+		set.report.Models = len(old.models)
+	}
+	handler.registry.Store(set)
+	logger.Infof(ctx, "Loaded %d models, %d from manifests", len(set.models), set.report.Manifests)
+	handler.announceReload(ctx, trigger, old, set)
+	if handler.cache.enabled {
+		go handler.digests.warm(set.models)
+	}
+	return set.report
+}
+
+// scanModels reads the models under the configured directories: the ones
+// named by the file conventions, then the manifests, which take precedence.
+// It does not touch the loaded models.
+func (handler *TTShHandler) scanModels() *modelRegistry {
+	report := &ModelReport{Issues: []ModelIssue{}, CheckedAt: nowMilli()}
+	var manifests map[string]pair
+	// 清单引用的参考音频不必符合文件名约定
+	used := make(map[string]bool)
+	if handler.modelsPath != "" {
+		manifests = handler.scanManifests(report)
+		for _, model := range manifests {
+			for _, ref := range model.References {
+				used[filepath.Clean(ref.AudioPath)] = true
+			}
+			for _, aux := range model.AuxRefAudioPaths {
+				used[filepath.Clean(aux)] = true
+			}
+		}
+	}
+	set := &modelRegistry{models: handler.scanConvention(report, used), disabled: make(map[string]pair), report: report}
+	for name, model := range manifests {
+		if _, ok := set.models[name]; ok {
+			report.warnf(model.Manifest, name, "manifest replaces the model found by file names")
+		}
+		if model.Disabled {
+			// 停用的清单同样挡住同名的约定模型
+			delete(set.models, name)
+			set.disabled[name] = model
+			continue
+		}
+		set.models[name] = model
+		report.Manifests++
+	}
+	report.Models = len(set.models)
+	return set
+}
+
+// scanConvention finds models by file names: <name>.ckpt and <name>.pth for
+// the weights, <name>-<text>-<lang>.wav for the reference audio and an
+// optional <name>.json for the default params. Audio files in used belong to
+// manifests and are skipped.
+func (handler *TTShHandler) scanConvention(report *ModelReport, used map[string]bool) map[string]pair {
+	models := make(map[string]pair)
+	gptWeights, err := os.ReadDir(handler.gptWeightsPath)
+	if err != nil {
+		report.errorf(handler.gptWeightsPath, "", "read gpt weights directory: %s", err)
+		return models
+	}
+	referenceAudios, err := os.ReadDir(handler.referAudioPath)
+	if err != nil {
+		report.errorf(handler.referAudioPath, "", "read reference audios directory: %s", err)
+		return models
+	}
+
+	audios := make(map[string][]string)
+	defaults := make(map[string]*modelDefaults)
+	for _, audio := range referenceAudios {
+		fileName := audio.Name()
+		if audio.IsDir() || used[filepath.Join(handler.referAudioPath, fileName)] {
+			continue
+		}
+		name := fileName[0 : len(fileName)-len(path.Ext(fileName))]
+		// name.json 为模型的默认推理参数
+		if path.Ext(fileName) == ".json" {
+			d, err := readModelDefaults(handler.referAudioPath + "/" + fileName)
+			if err != nil {
+				report.warnf(fileName, name, "invalid model params, using the global defaults: %s", err)
+				continue
+			}
+			defaults[name] = d
+			continue
+		}
+		res := strings.Split(name, "-")
+		if len(res) != 3 {
+			report.warnf(fileName, "", "reference audio is not named <model>-<text>-<lang>, describe it in a manifest instead")
+			continue
+		}
+		audios[res[0]] = []string{res[1], res[2]}
+	}
+
+	for _, weight := range gptWeights {
+		fileName := weight.Name()
+		ext := path.Ext(fileName)
+		name := fileName[0 : len(fileName)-len(ext)]
+		if _, err := os.Stat(fmt.Sprintf("%s/%s.pth", handler.soVITSWeightsPath, name)); err != nil {
+			report.errorf(fileName, name, "no sovits weights %s.pth", name)
+			continue
+		}
+
+		referInfo, ok := audios[name]
+		if !ok {
+			report.errorf(fileName, name, "no reference audio %s-<text>-<lang>.wav", name)
+			continue
+		}
+
+		var params *InferParams
+		var post *PostProcess
+		if d, ok := defaults[name]; ok {
+			params, post = &d.InferParams, d.PostProcess
+		}
+		ref := reference{
+			Name:      defaultReference,
+			AudioPath: fmt.Sprintf("%s/%s-%s-%s.wav", handler.referAudioPath, name, referInfo[0], referInfo[1]),
+			Text:      referInfo[0],
+			Lang:      referInfo[1],
+		}
+		models[name] = pair{
+			Name:               name,
+			GptPath:            handler.gptWeightsPath + "/" + fileName,
+			SovitsPath:         handler.soVITSWeightsPath + "/" + name + ".pth",
+			ReferenceAudioPath: ref.AudioPath,
+			ReferText:          ref.Text,
+			ReferLang:          ref.Lang,
+			Reference:          ref.Name,
+			References:         []reference{ref},
+			Params:             params,
+			PostProcess:        post,
+		}
+	}
+	return models
+}
+
+// scanManifests loads every *.yaml, *.yml and *.json manifest of the models
+// directory. A manifest with an error is reported and skipped as a whole.
+func (handler *TTShHandler) scanManifests(report *ModelReport) map[string]pair {
+	models := make(map[string]pair)
+	entries, err := os.ReadDir(handler.modelsPath)
+	if err != nil {
+		report.errorf(handler.modelsPath, "", "read models directory: %s", err)
+		return models
+	}
+	for _, entry := range entries {
+		switch path.Ext(entry.Name()) {
+		case ".yaml", ".yml", ".json":
+		default:
+			continue
+		}
+		if entry.IsDir() || strings.HasPrefix(entry.Name(), ".") {
+			continue
+		}
+		file := filepath.Join(handler.modelsPath, entry.Name())
+		model, ok := handler.readManifest(file, report)
+		if !ok {
+			continue
+		}
+		if other, ok := models[model.Name]; ok {
+			report.errorf(file, model.Name, "model already declared by %s", other.Manifest)
+			continue
+		}
+		models[model.Name] = model
+	}
+	return models
+}
+
+// readManifest parses and checks one manifest. Problems that make the model
+// unusable are reported as errors and the model is left out.
+func (handler *TTShHandler) readManifest(file string, report *ModelReport) (pair, bool) {
+	var m modelManifest
+	if err := decodeManifest(file, &m); err != nil {
+		report.errorf(file, "", "%s", err)
+		return pair{}, false
+	}
+	if m.Name == "" {
+		base := filepath.Base(file)
+		m.Name = base[:len(base)-len(filepath.Ext(base))]
+	}
+	issues := len(report.Issues)
+	fail := func(format string, args ...interface{}) {
+		report.errorf(file, m.Name, format, args...)
+	}
+	if strings.ContainsAny(m.Name, "/\\") {
+		fail("name must not contain path separators")
+	}
+	model := pair{
+		Name:        m.Name,
+		DisplayName: m.DisplayName,
+		Tags:        m.Tags,
+		Params:      m.Params,
+		PostProcess: m.PostProcess,
+		Manifest:    file,
+		Disabled:    m.Disabled,
+	}
+	if m.GptWeights == "" {
+		fail("gptWeights is required")
+	} else if model.GptPath = resolvePath(handler.gptWeightsPath, m.GptWeights); !isFile(model.GptPath) {
+		fail("gptWeights %s not found", model.GptPath)
+	}
+	if m.SovitsWeights == "" {
+		fail("sovitsWeights is required")
+	} else if model.SovitsPath = resolvePath(handler.soVITSWeightsPath, m.SovitsWeights); !isFile(model.SovitsPath) {
+		fail("sovitsWeights %s not found", model.SovitsPath)
+	}
+
+	if len(m.References) == 0 {
+		fail("at least one reference is required")
+	}
+	def := -1
+	seen := make(map[string]bool)
+	for i, r := range m.References {
+		field := fmt.Sprintf("references[%d]", i)
+		ref := reference{Name: r.Name, Text: r.Text, Lang: r.Lang}
+		if ref.Name == "" {
+			if len(m.References) > 1 {
+				fail("%s: name is required when there is more than one reference", field)
+			}
+			ref.Name = defaultReference
+		}
+		if seen[ref.Name] {
+			fail("%s: duplicate reference name %q", field, ref.Name)
+		}
+		seen[ref.Name] = true
+		if r.Audio == "" {
+			fail("%s: audio is required", field)
+		} else if ref.AudioPath = resolvePath(handler.referAudioPath, r.Audio); !isFile(ref.AudioPath) {
+			fail("%s: audio %s not found", field, ref.AudioPath)
+		} else if d, err := wavDuration(ref.AudioPath); err != nil {
+			report.warnf(file, m.Name, "%s: %s", field, err)
+		} else if d > 0 && (d < minReferenceAudio || d > maxReferenceAudio) {
+			report.warnf(file, m.Name, "%s: audio is %s long, GPT-SoVITS expects %s to %s", field, d.Round(time.Millisecond), minReferenceAudio, maxReferenceAudio)
+		}
+		if strings.TrimSpace(ref.Text) == "" {
+			fail("%s: text is required", field)
+		}
+		if !textLangs[ref.Lang] {
+			fail("%s: unknown lang %q", field, ref.Lang)
+		}
+		if r.Default {
+			if def >= 0 {
+				fail("%s: only one reference can be the default", field)
+			}
+			def = i
+		}
+		model.References = append(model.References, ref)
+	}
+	for i, aux := range m.AuxReferences {
+		auxPath := resolvePath(handler.referAudioPath, aux)
+		if !isFile(auxPath) {
+			fail("auxReferences[%d]: %s not found", i, auxPath)
+		}
+		model.AuxRefAudioPaths = append(model.AuxRefAudioPaths, auxPath)
+	}
+	if err := m.Params.validate(); err != nil {
+		fail("params: %s", err)
+	} else if m.Params != nil && m.Params.Reference != nil && !seen[*m.Params.Reference] {
+		fail("params: unknown reference %q", *m.Params.Reference)
+	}
+	if err := m.PostProcess.validate(); err != nil {
+		fail("postProcess: %s", err)
+	}
+	for _, issue := range report.Issues[issues:] {
+		if issue.Level == "error" {
+			return pair{}, false
+		}
+	}
+
+	if def < 0 {
+		def = 0
+	}
+	ref := model.References[def]
+	model.Reference, model.ReferenceAudioPath, model.ReferText, model.ReferLang = ref.Name, ref.AudioPath, ref.Text, ref.Lang
+	return model, true
+}
+
+// decodeManifest reads a JSON or YAML manifest into m. YAML goes through JSON
+// so that both accept the same keys; unknown keys are errors.
+func decodeManifest(file string, m *modelManifest) error {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	if ext := filepath.Ext(file); ext == ".yaml" || ext == ".yml" {
+		var doc interface{}
+		if err := yaml.Unmarshal(data, &doc); err != nil {
+			return err
+		}
+		if data, err = json.Marshal(doc); err != nil {
+			return err
+		}
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	return dec.Decode(m)
+}
+
+func resolvePath(dir, file string) string {
+	if filepath.IsAbs(file) {
+		return file
+	}
+	return filepath.Join(dir, file)
+}
+
+func isFile(file string) bool {
+	stat, err := os.Stat(file)
+	return err == nil && !stat.IsDir()
+}
+
+// wavDuration returns the length of a WAV file, or 0 for other formats and
+// streams of unknown length.
+func wavDuration(file string) (time.Duration, error) {
+	if !strings.EqualFold(filepath.Ext(file), ".wav") {
+		return 0, nil
+	}
+	f, err := os.Open(file)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	format, size, err := audio.ReadHeader(f)
+	if err != nil {
+		return 0, err
+	}
+	if size == audio.UnknownSize {
+		return 0, nil
+	}
+	return time.Duration(int64(size) * int64(time.Second) / int64(format.ByteRate())), nil
+}
+
+// logReport writes the issues of report to the log.
+func logReport(ctx context.Context, report *ModelReport) {
+	for _, issue := range report.Issues {
+		msg := issue.Source + ": " + issue.Message
+		if issue.Model != "" {
+			msg = "model " + issue.Model + ", " + msg
+		}
+		if issue.Level == "error" {
+			logger.Errorf(ctx, "%s", msg)
+		} else {
+			logger.Warnf(ctx, "%s", msg)
+		}
+	}
+}
+
+// withReference returns model reading with its reference audio called name.
+func (model pair) withReference(name string) (pair, error) {
+	for _, ref := range model.References {
+		if ref.Name == name {
+			model.Reference, model.ReferenceAudioPath, model.ReferText, model.ReferLang = ref.Name, ref.AudioPath, ref.Text, ref.Lang
+			return model, nil
+		}
+	}
+	names := make([]string, len(model.References))
+	for i, ref := range model.References {
+		names[i] = ref.Name
+	}
+	sort.Strings(names)
+	return model, fmt.Errorf("model %s has no reference %q, it has %s", model.Name, name, strings.Join(names, ", "))
+}
+
+// selectReference applies the reference chosen by resolved params to model.
+func selectReference(model pair, params *InferParams) (pair, error) {
+	if params == nil || params.Reference == nil || *params.Reference == model.Reference {
+		return model, nil
+	}
+	return model.withReference(*params.Reference)
+}
+
+type ModelReportResp struct {
+	Report *ModelReport `json:"report"`
+}
+
+// ModelReport returns the validation report of the last model load.
+func (handler *TTShHandler) ModelReport(ctx context.Context, req *struct{}) (*ModelReportResp, error) {
+	var report *ModelReport
+	if set := handler.registry.Load(); set != nil {
+		report = set.report
+	}
+	return &ModelReportResp{Report: report}, nil
+}
+
+// ValidateModels checks the model directories and manifests as LoadModels
+// would, without loading anything.
+func (handler *TTShHandler) ValidateModels(ctx context.Context, req *struct{}) (*ModelReportResp, error) {
+	return &ModelReportResp{Report: handler.scanModels().report}, nil
+}
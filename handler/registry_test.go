@@ -0,0 +1,216 @@
+package handler
+
+import (
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newManifestEnv returns an env with a models directory and the reference
+// audios the manifests below point at.
+func newManifestEnv(t *testing.T) *testEnv {
+	t.Helper()
+	env := newTestEnv(t, withModelsPath(t.TempDir()))
+	for _, name := range []string{"bob/calm.wav", "bob/excited.wav", "bob/aux.wav"} {
+		writeFile(t, filepath.Join(env.handler.referAudioPath, name), silentWav(t, 4*time.Second))
+	}
+	writeFile(t, filepath.Join(env.handler.referAudioPath, "bob/short.wav"), silentWav(t, time.Second))
+	return env
+}
+
+func (e *testEnv) writeManifest(name, data string) string {
+	e.t.Helper()
+	file := filepath.Join(e.handler.modelsPath, name)
+	writeFile(e.t, file, []byte(data))
+	return file
+}
+
+const bobYAML = `name: bob
+displayName: Bob
+tags: [male, zh]
+gptWeights: alice.ckpt
+sovitsWeights: alice.pth
+references:
+  - name: calm
+    audio: bob/calm.wav
+    text: 今天天气不错。
+    lang: zh
+  - name: excited
+    audio: bob/excited.wav
+    text: "Wow - that's amazing!"
+    lang: en
+    default: true
+auxReferences:
+  - bob/aux.wav
+params:
+  speedFactor: 1.2
+  reference: calm
+postProcess:
+  loudness: -16
+`
+
+const bobJSON = `{
+  "name": "bob",
+  "displayName": "Bob",
+  "tags": ["male", "zh"],
+  "gptWeights": "alice.ckpt",
+  "sovitsWeights": "alice.pth",
+  "references": [
+    {"name": "calm", "audio": "bob/calm.wav", "text": "今天天气不错。", "lang": "zh"},
+    {"name": "excited", "audio": "bob/excited.wav", "text": "Wow - that's amazing!", "lang": "en", "default": true}
+  ],
+  "auxReferences": ["bob/aux.wav"],
+  "params": {"speedFactor": 1.2, "reference": "calm"},
+  "postProcess": {"loudness": -16}
+}`
+
+func TestManifestYAMLMatchesJSON(t *testing.T) {
+	env := newManifestEnv(t)
+	var models []pair
+	for _, m := range []struct{ name, data string }{{"bob.yaml", bobYAML}, {"bob.json", bobJSON}} {
+		report := &ModelReport{}
+		model, ok := env.handler.readManifest(env.writeManifest(m.name, m.data), report)
+		if !ok || len(report.Issues) > 0 {
+			t.Fatalf("%s: %+v", m.name, report.Issues)
+		}
+		model.Manifest = ""
+		models = append(models, model)
+	}
+	if !reflect.DeepEqual(models[0], models[1]) {
+		t.Errorf("YAML %+v\nJSON %+v", models[0], models[1])
+	}
+
+	bob := models[0]
+	if bob.GptPath != filepath.Join(env.handler.gptWeightsPath, "alice.ckpt") || bob.SovitsPath != filepath.Join(env.handler.soVITSWeightsPath, "alice.pth") {
+		t.Errorf("weights %s, %s", bob.GptPath, bob.SovitsPath)
+	}
+	// default 为 true 的一条是默认参考
+	if bob.Reference != "excited" || bob.ReferLang != "en" || bob.ReferenceAudioPath != filepath.Join(env.handler.referAudioPath, "bob/excited.wav") {
+		t.Errorf("default reference %s %s %s", bob.Reference, bob.ReferLang, bob.ReferenceAudioPath)
+	}
+	if len(bob.References) != 2 || len(bob.AuxRefAudioPaths) != 1 || *bob.Params.SpeedFactor != 1.2 || *bob.PostProcess.Loudness != -16 {
+		t.Errorf("model %+v", bob)
+	}
+}
+
+func TestManifestRejectsUnknownKeys(t *testing.T) {
+	env := newManifestEnv(t)
+	for name, data := range map[string]string{
+		"top.yaml":    bobYAML + "speed: 1.2\n",
+		"nested.yaml": strings.Replace(bobYAML, "speedFactor", "speed_factor", 1),
+		"top.json":    strings.Replace(bobJSON, `"tags"`, `"labels"`, 1),
+	} {
+		report := &ModelReport{}
+		if _, ok := env.handler.readManifest(env.writeManifest(name, data), report); ok {
+			t.Errorf("%s was accepted", name)
+			continue
+		}
+		if len(report.Issues) != 1 || report.Issues[0].Level != "error" || !strings.Contains(report.Issues[0].Message, "unknown field") {
+			t.Errorf("%s: %+v", name, report.Issues)
+		}
+	}
+}
+
+func TestManifestDuplicateNames(t *testing.T) {
+	env := newManifestEnv(t)
+	first := env.writeManifest("a.yaml", bobYAML)
+	second := env.writeManifest("b.json", bobJSON)
+
+	set := env.handler.scanModels()
+	if set.models["bob"].Manifest != first {
+		t.Errorf("bob comes from %s, want the first manifest %s", set.models["bob"].Manifest, first)
+	}
+	want := ModelIssue{Level: "error", Source: second, Model: "bob", Message: "model already declared by " + first}
+	if len(set.report.Issues) != 1 || set.report.Issues[0] != want {
+		t.Errorf("issues %+v, want %+v", set.report.Issues, want)
+	}
+	if set.report.Models != 2 || set.report.Manifests != 1 {
+		t.Errorf("report counts %d models, %d manifests", set.report.Models, set.report.Manifests)
+	}
+}
+
+func TestManifestReplacesConventionModel(t *testing.T) {
+	env := newManifestEnv(t)
+	file := env.writeManifest("alice.yaml", strings.Replace(bobYAML, "name: bob", "name: "+testModel, 1))
+
+	set := env.handler.scanModels()
+	alice := set.models[testModel]
+	if alice.Manifest != file || alice.DisplayName != "Bob" || alice.Reference != "excited" {
+		t.Errorf("alice = %+v, want the manifest model", alice)
+	}
+	want := ModelIssue{Level: "warning", Source: file, Model: testModel, Message: "manifest replaces the model found by file names"}
+	if len(set.report.Issues) != 1 || set.report.Issues[0] != want {
+		t.Errorf("issues %+v, want %+v", set.report.Issues, want)
+	}
+	if set.report.Models != 1 || set.report.Manifests != 1 {
+		t.Errorf("report counts %d models, %d manifests", set.report.Models, set.report.Manifests)
+	}
+
+	// 停用的清单同样挡住同名的约定模型
+	env.writeManifest("alice.yaml", strings.Replace(bobYAML, "name: bob", "name: "+testModel+"\ndisabled: true", 1))
+	set = env.handler.scanModels()
+	if _, ok := set.models[testModel]; ok {
+		t.Error("disabled manifest left the convention model in place")
+	}
+	if _, ok := set.disabled[testModel]; !ok || set.report.Models != 0 || set.report.Manifests != 0 {
+		t.Errorf("disabled %v, report %+v", set.disabled, set.report)
+	}
+}
+
+func TestManifestReport(t *testing.T) {
+	env := newManifestEnv(t)
+	file := env.writeManifest("carol.yml", `gptWeights: missing.ckpt
+sovitsWeights: alice.pth
+references:
+  - name: calm
+    audio: bob/short.wav
+    text: 你好。
+    lang: zh
+    default: true
+  - name: calm
+    audio: bob/calm.wav
+    text: " "
+    lang: xx
+    default: true
+params:
+  reference: angry
+`)
+	report := &ModelReport{}
+	if _, ok := env.handler.readManifest(file, report); ok {
+		t.Fatal("a manifest with errors was accepted")
+	}
+	want := []ModelIssue{
+		{"error", file, "carol", "gptWeights " + filepath.Join(env.handler.gptWeightsPath, "missing.ckpt") + " not found"},
+		{"warning", file, "carol", "references[0]: audio is 1s long, GPT-SoVITS expects 3s to 10s"},
+		{"error", file, "carol", `references[1]: duplicate reference name "calm"`},
+		{"error", file, "carol", "references[1]: text is required"},
+		{"error", file, "carol", `references[1]: unknown lang "xx"`},
+		{"error", file, "carol", "references[1]: only one reference can be the default"},
+		{"error", file, "carol", `params: unknown reference "angry"`},
+	}
+	if !reflect.DeepEqual(report.Issues, want) {
+		t.Errorf("issues:\n%+v\nwant:\n%+v", report.Issues, want)
+	}
+
+	// 只有警告的清单照常加载，报告随模型一起返回
+	env.writeManifest("carol.yml", `gptWeights: alice.ckpt
+sovitsWeights: alice.pth
+references:
+  - audio: bob/short.wav
+    text: 你好。
+    lang: zh
+`)
+	set := env.handler.scanModels()
+	carol, ok := set.models["carol"]
+	if !ok || carol.Reference != defaultReference {
+		t.Fatalf("carol = %+v, issues %+v", carol, set.report.Issues)
+	}
+	if len(set.report.Issues) != 1 || set.report.Issues[0].Level != "warning" || set.report.hasErrors() {
+		t.Errorf("issues %+v", set.report.Issues)
+	}
+	if set.report.Models != 2 || set.report.Manifests != 1 || set.report.CheckedAt == 0 {
+		t.Errorf("report %+v", set.report)
+	}
+}
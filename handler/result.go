@@ -0,0 +1,177 @@
+package handler
+
+import (
+	"context"
+	"github.com/gin-gonic/gin"
+	"github.com/pkg/errors"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+	"ttsapi/audio"
+	"ttsapi/logger"
+	"ttsapi/storage/blob"
+)
+
+// resultPrefix 结果在 blob 存储中的 key 前缀。不以它开头的是旧版本写在本地的文件路径
+const resultPrefix = "results/"
+
+// resultKey returns the blob key of the result of id with the given suffix.
+func resultKey(id, suffix string) string {
+	return resultPrefix + id + suffix
+}
+
+// isResultKey reports whether name is a blob key rather than a legacy path.
+func isResultKey(name string) bool {
+	return strings.HasPrefix(name, resultPrefix) || isCacheKey(name)
+}
+
+// openResult opens a stored result, either a blob key or a legacy local path.
+func openResult(ctx context.Context, name string) (io.ReadCloser, *blob.Info, error) {
+	if isResultKey(name) {
+		return blob.Get().Get(ctx, name)
+	}
+	f, err := os.Open(name)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, nil, blob.ErrNotFound
+		}
+		return nil, nil, err
+	}
+	stat, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, nil, err
+	}
+	return f, &blob.Info{Key: name, Size: stat.Size(), ModTime: stat.ModTime()}, nil
+}
+
+// statResult reports whether a stored result exists; a missing result gives
+// blob.ErrNotFound.
+func statResult(ctx context.Context, name string) (*blob.Info, error) {
+	if isResultKey(name) {
+		return blob.Get().Stat(ctx, name)
+	}
+	stat, err := os.Stat(name)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, blob.ErrNotFound
+		}
+		return nil, err
+	}
+	return &blob.Info{Key: name, Size: stat.Size(), ModTime: stat.ModTime()}, nil
+}
+
+// deleteResults removes stored results, logging failures.
+func deleteResults(ctx context.Context, names ...string) {
+	for _, name := range names {
+		if name == "" {
+			continue
+		}
+		var err error
+		if isResultKey(name) {
+			err = blob.Get().Delete(ctx, name)
+		} else if err = os.Remove(name); errors.Is(err, os.ErrNotExist) {
+			err = nil
+		}
+		if err != nil {
+			logger.Warnf(ctx, "delete result %s: %s", name, err)
+		}
+	}
+}
+
+// storeResult uploads the local WAV file of t and its converted output, if
+// any, to the blob store and returns their keys. The keys belong to t alone:
+// the cache and identical tasks keep copies of their own.
+func storeResult(ctx context.Context, t *task, file, output string) (string, string, error) {
+	base := resultKey(t.Id, "")
+	fileKey := base + ".wav"
+	if err := uploadFile(ctx, fileKey, file, "audio/wav"); err != nil {
+		return "", "", errors.Wrap(err, "upload result")
+	}
+	if output == "" {
+		return fileKey, "", nil
+	}
+	outputKey := outputName(base, t.Format)
+	if err := uploadFile(ctx, outputKey, output, t.Format.ContentType()); err != nil {
+		deleteResults(ctx, fileKey)
+		return "", "", errors.Wrap(err, "upload output")
+	}
+	return fileKey, outputKey, nil
+}
+
+// copyResult stores a copy of a result and its converted output under base,
+// so that the copy outlives the task or cache entry it came from. The output
+// copy is named after format.
+func copyResult(ctx context.Context, base string, format *audio.Target, file, output string) (string, string, error) {
+	fileKey := base + ".wav"
+	if err := blob.Get().Copy(ctx, file, fileKey); err != nil {
+		return "", "", errors.Wrap(err, "copy result")
+	}
+	if output == "" {
+		return fileKey, "", nil
+	}
+	outputKey := outputName(base, format)
+	if err := blob.Get().Copy(ctx, output, outputKey); err != nil {
+		deleteResults(ctx, fileKey)
+		return "", "", errors.Wrap(err, "copy output")
+	}
+	return fileKey, outputKey, nil
+}
+
+func uploadFile(ctx context.Context, key, file, contentType string) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return blob.Get().Put(ctx, key, f, contentType)
+}
+
+// sendResult writes a stored result to the client, or redirects it to a
+// presigned URL when the store supports it and presign is enabled.
+func (handler *TTShHandler) sendResult(ctx *gin.Context, name, contentType string) {
+	if handler.presign && isResultKey(name) {
+		u, err := blob.Get().PresignGet(ctx, name, handler.presignExpiry)
+		if err == nil {
+			ctx.Redirect(http.StatusFound, u)
+			return
+		}
+		if !errors.Is(err, blob.ErrUnsupported) {
+			logger.Warnf(ctx, "presign %s: %s", name, err)
+		}
+	}
+	r, info, err := openResult(ctx, name)
+	if err != nil {
+		code := http.StatusInternalServerError
+		if errors.Is(err, blob.ErrNotFound) {
+			code = http.StatusGone
+		}
+		ctx.JSON(code, gin.H{"code": code, "message": err.Error()})
+		return
+	}
+	defer r.Close()
+	ctx.DataFromReader(http.StatusOK, info.Size, contentType, r, nil)
+}
+
+// scratchFile creates a local file for the output of t being produced.
+func (handler *TTShHandler) scratchFile(t *task) (*os.File, error) {
+	if err := os.MkdirAll(handler.scratchPath, 0o755); err != nil {
+		return nil, err
+	}
+	return os.CreateTemp(handler.scratchPath, t.Id+"-*.wav")
+}
+
+func defaultScratchPath() string {
+	return filepath.Join(os.TempDir(), "ttsapi")
+}
+
+// presignOptions reads the presign settings of the blob store.
+func presignOptions(cfg *blob.Config) (bool, time.Duration) {
+	if cfg == nil {
+		return false, 0
+	}
+	return cfg.Presign, cfg.PresignExpiry
+}
@@ -0,0 +1,240 @@
+package handler
+
+import (
+	"context"
+	"github.com/gomodule/redigo/redis"
+	"github.com/pkg/errors"
+	"math/rand"
+	"time"
+	"ttsapi/backend"
+	"ttsapi/config"
+	"ttsapi/logger"
+	"ttsapi/server/httpserver/middles/status"
+	rds "ttsapi/storage/redis"
+)
+
+const (
+	delayedList    = "ttsapi:tasks:delayed" // zset, score 为下一次执行的时间(ms)
+	deadLetterList = "ttsapi:tasks:dead"
+
+	defaultMaxAttempts = 3
+	defaultBackoffBase = 5 * time.Second
+	defaultBackoffMax  = 5 * time.Minute
+)
+
+// promoteScript moves due tasks from the delayed zset back onto the queue of
+// their model, which is read from the task record.
+var promoteScript = redis.NewScript(3, `
+local ids = redis.call('ZRANGEBYSCORE', KEYS[1], '-inf', ARGV[1], 'LIMIT', 0, 100)
+for _, id in ipairs(ids) do
+	redis.call('ZREM', KEYS[1], id)
+	local data = redis.call('GET', KEYS[2] .. id)
+	if data then
+		local model = cjson.decode(data)['model']['name']
+		redis.call('ZADD', KEYS[3] .. model, ARGV[1], id)
+		redis.call('SADD', ARGV[2], model)
+	end
+end
+return #ids
+`)
+
+type retryPolicy struct {
+	maxAttempts int
+	backoffBase time.Duration
+	backoffMax  time.Duration
+}
+
+func newRetryPolicy(cfg *config.Queue) retryPolicy {
+	policy := retryPolicy{
+		maxAttempts: defaultMaxAttempts,
+		backoffBase: defaultBackoffBase,
+		backoffMax:  defaultBackoffMax,
+	}
+	if cfg == nil {
+		return policy
+	}
+	if cfg.MaxAttempts > 0 {
+		policy.maxAttempts = cfg.MaxAttempts
+	}
+	if cfg.BackoffBase > 0 {
+		policy.backoffBase = cfg.BackoffBase
+	}
+	if cfg.BackoffMax > 0 {
+		policy.backoffMax = cfg.BackoffMax
+	}
+	return policy
+}
+
+// backoff returns the wait before the next attempt after `attempts` failures,
+// doubling each time with up to 10% jitter.
+func (p retryPolicy) backoff(attempts int) time.Duration {
+	delay := p.backoffBase
+	for i := 1; i < attempts && delay < p.backoffMax; i++ {
+		delay *= 2
+	}
+	if delay > p.backoffMax {
+		delay = p.backoffMax
+	}
+	return delay + time.Duration(rand.Int63n(int64(delay)/10+1))
+}
+
+// fail records a failed attempt: the task is either scheduled for a retry or
+// moved to the dead-letter list.
+// cmds are executed in the same transaction as the state change.
+func (handler *TTShHandler) fail(ctx context.Context, info *taskInfo, cause error, cmds ...command) {
+	if !backend.IsPermanent(cause) && info.Attempts < handler.retry.maxAttempts {
+		next := time.Now().Add(handler.retry.backoff(info.Attempts)).UnixMilli()
+		_, err := transition(ctx, info.Id, stateQueued, []taskState{stateRunning}, func(info *taskInfo) {
+			info.Error = cause.Error()
+			info.NextAttemptAt = next
+		}, append(cmds, cmd("ZADD", delayedList, next, info.Id))...)
+		if err != nil {
+			logger.Errorf(ctx, "schedule retry of task %s: %s", info.Id, err)
+		}
+		return
+	}
+	_, err := transition(ctx, info.Id, stateFailed, []taskState{stateRunning}, func(info *taskInfo) {
+		info.Error = cause.Error()
+		info.DeadLettered = true
+	}, append(cmds, cmd("LPUSH", deadLetterList, info.Id))...)
+	if err != nil {
+		logger.Errorf(ctx, "dead-letter task %s: %s", info.Id, err)
+	}
+}
+
+// promoteDelayed requeues the tasks whose backoff has elapsed.
+func promoteDelayed(ctx context.Context) error {
+	conn := rds.Get()
+	defer conn.Close()
+	n, err := redis.Int(promoteScript.Do(conn, delayedList, taskKeyPrefix, modelQueuePrefix, nowMilli(), modelSet))
+	if err != nil {
+		return err
+	}
+	if n > 0 {
+		logger.Infof(ctx, "requeued %d delayed tasks", n)
+	}
+	return nil
+}
+
+type DeadLettersReq struct {
+	Offset int `json:"offset" form:"offset"`
+	Limit  int `json:"limit" form:"limit"`
+}
+
+type DeadLettersResp struct {
+	Total int         `json:"total"`
+	Tasks []*taskInfo `json:"tasks"`
+}
+
+func (handler *TTShHandler) DeadLetters(ctx context.Context, req *DeadLettersReq) (*DeadLettersResp, error) {
+	if req.Limit <= 0 || req.Limit > 100 {
+		req.Limit = 20
+	}
+	conn := rds.Get()
+	defer conn.Close()
+	total, err := redis.Int(conn.Do("LLEN", deadLetterList))
+	if err != nil {
+		return nil, &status.Status{Code: 500, Message: err.Error()}
+	}
+	ids, err := redis.Strings(conn.Do("LRANGE", deadLetterList, req.Offset, req.Offset+req.Limit-1))
+	if err != nil {
+		return nil, &status.Status{Code: 500, Message: err.Error()}
+	}
+	rsp := &DeadLettersResp{Total: total, Tasks: []*taskInfo{}}
+	for _, id := range ids {
+		info, err := loadTask(conn, id)
+		if err != nil {
+			// 记录已丢失时仍然列出，方便 purge
+			info = &taskInfo{task: task{Id: id}, State: stateFailed, Error: err.Error(), DeadLettered: true}
+		}
+		rsp.Tasks = append(rsp.Tasks, info)
+	}
+	return rsp, nil
+}
+
+type DeadLetterOpReq struct {
+	Ids []string `json:"ids"`
+	All bool     `json:"all"`
+}
+
+type DeadLetterOpResp struct {
+	Ids []string `json:"ids"`
+}
+
+// deadLetterIds resolves the request into the dead-lettered IDs it refers to.
+func deadLetterIds(req *DeadLetterOpReq) ([]string, error) {
+	if !req.All {
+		if len(req.Ids) == 0 {
+			return nil, &status.Status{Code: 400, Message: "ids or all is required"}
+		}
+		return req.Ids, nil
+	}
+	conn := rds.Get()
+	defer conn.Close()
+	ids, err := redis.Strings(conn.Do("LRANGE", deadLetterList, 0, -1))
+	if err != nil {
+		return nil, &status.Status{Code: 500, Message: err.Error()}
+	}
+	return ids, nil
+}
+
+// RequeueDeadLetters puts dead-lettered tasks back on the queue with a fresh
+// attempt budget.
+func (handler *TTShHandler) RequeueDeadLetters(ctx context.Context, req *DeadLetterOpReq) (*DeadLetterOpResp, error) {
+	ids, err := deadLetterIds(req)
+	if err != nil {
+		return nil, err
+	}
+	rsp := &DeadLetterOpResp{Ids: []string{}}
+	for _, id := range ids {
+		info, err := getTask(ctx, id)
+		if err != nil {
+			logger.Warnf(ctx, "requeue dead letter %s: %s", id, err)
+			continue
+		}
+		cmds := append([]command{cmd("LREM", deadLetterList, 0, id)}, enqueueCommands(info.Model.Name, id, nowMilli())...)
+		_, err = updateTask(ctx, id, func(info *taskInfo) error {
+			if !info.DeadLettered {
+				return errors.Errorf("task %s is not dead-lettered", id)
+			}
+			info.State = stateQueued
+			info.DeadLettered = false
+			info.Attempts = 0
+			info.Error = ""
+			info.StartedAt = 0
+			info.FinishedAt = 0
+			return nil
+		}, cmds...)
+		if err != nil {
+			logger.Warnf(ctx, "requeue dead letter %s: %s", id, err)
+			continue
+		}
+		rsp.Ids = append(rsp.Ids, id)
+	}
+	return rsp, nil
+}
+
+// PurgeDeadLetters drops dead-lettered tasks together with their records.
+func (handler *TTShHandler) PurgeDeadLetters(ctx context.Context, req *DeadLetterOpReq) (*DeadLetterOpResp, error) {
+	ids, err := deadLetterIds(req)
+	if err != nil {
+		return nil, err
+	}
+	conn := rds.Get()
+	defer conn.Close()
+	rsp := &DeadLetterOpResp{Ids: []string{}}
+	for _, id := range ids {
+		removed, err := redis.Int(conn.Do("LREM", deadLetterList, 0, id))
+		if err != nil {
+			return nil, &status.Status{Code: 500, Message: err.Error()}
+		}
+		if removed == 0 {
+			continue
+		}
+		if _, err := conn.Do("DEL", taskKey(id)); err != nil {
+			return nil, &status.Status{Code: 500, Message: err.Error()}
+		}
+		rsp.Ids = append(rsp.Ids, id)
+	}
+	return rsp, nil
+}
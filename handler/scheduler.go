@@ -0,0 +1,272 @@
+package handler
+
+import (
+	"context"
+	"github.com/gomodule/redigo/redis"
+	"github.com/pkg/errors"
+	"sort"
+	"sync"
+	"time"
+	"ttsapi/config"
+	"ttsapi/logger"
+	"ttsapi/server/httpserver/middles/status"
+	rds "ttsapi/storage/redis"
+)
+
+const (
+	modelQueuePrefix = "ttsapi:queue:"       // 每个模型一个 zset，score 为入队时间(ms)，越小越先执行
+	modelSet         = "ttsapi:queue:models" // 有待执行任务的模型
+
+	defaultMaxBatch     = 16
+	defaultMaxWait      = time.Minute
+	defaultPollInterval = 500 * time.Millisecond
+)
+
+// popScript moves the oldest task of a model queue into the processing list.
+var popScript = redis.NewScript(3, `
+local r = redis.call('ZPOPMIN', KEYS[1])
+if redis.call('ZCARD', KEYS[1]) == 0 then
+	redis.call('SREM', KEYS[3], ARGV[1])
+end
+if #r == 0 then
+	return false
+end
+redis.call('LPUSH', KEYS[2], r[1])
+return r[1]
+`)
+
+func modelQueue(model string) string {
+	return modelQueuePrefix + model
+}
+
+// enqueueCommands put id on the queue of model. score is the enqueue time;
+// pass 0 to put the task in front of everything else.
+func enqueueCommands(model, id string, score int64) []command {
+	return []command{
+		cmd("ZADD", modelQueue(model), score, id),
+		cmd("SADD", modelSet, model),
+	}
+}
+
+type schedulerOptions struct {
+	maxBatch     int
+	maxWait      time.Duration
+	pollInterval time.Duration
+}
+
+func newSchedulerOptions(cfg *config.Queue) schedulerOptions {
+	opts := schedulerOptions{
+		maxBatch:     defaultMaxBatch,
+		maxWait:      defaultMaxWait,
+		pollInterval: defaultPollInterval,
+	}
+	if cfg == nil {
+		return opts
+	}
+	if cfg.MaxBatch > 0 {
+		opts.maxBatch = cfg.MaxBatch
+	}
+	if cfg.MaxWait > 0 {
+		opts.maxWait = cfg.MaxWait
+	}
+	if cfg.PollInterval > 0 {
+		opts.pollInterval = cfg.PollInterval
+	}
+	return opts
+}
+
+// backlog is the pending work of one model.
+type backlog struct {
+	Model   string `json:"model"`
+	Pending int    `json:"pending"`
+	Oldest  int64  `json:"oldest"` // 队首任务的入队时间(ms)
+}
+
+func loadBacklogs(conn redis.Conn) ([]backlog, error) {
+	models, err := redis.Strings(conn.Do("SMEMBERS", modelSet))
+	if err != nil {
+		return nil, err
+	}
+	backlogs := make([]backlog, 0, len(models))
+	for _, model := range models {
+		pending, err := redis.Int(conn.Do("ZCARD", modelQueue(model)))
+		if err != nil {
+			return nil, err
+		}
+		if pending == 0 {
+			continue
+		}
+		head, err := redis.Values(conn.Do("ZRANGE", modelQueue(model), 0, 0, "WITHSCORES"))
+		if err != nil {
+			return nil, err
+		}
+		if len(head) != 2 {
+			continue
+		}
+		oldest, err := redis.Int64(head[1], nil)
+		if err != nil {
+			return nil, err
+		}
+		backlogs = append(backlogs, backlog{Model: model, Pending: pending, Oldest: oldest})
+	}
+	// 按等待时间排序，等待最久的在前
+	sort.Slice(backlogs, func(i, j int) bool { return backlogs[i].Oldest < backlogs[j].Oldest })
+	return backlogs, nil
+}
+
+// chooseModel decides which model `in` should run next:
+//  1. a model whose oldest task has waited longer than maxWait (starvation bound);
+//  2. the model the backend already runs, until maxBatch tasks in a row;
+//  3. the longest waiting model that no other backend is working on;
+//  4. the longest waiting model.
+func (handler *TTShHandler) chooseModel(in *instance, backlogs []backlog, now int64) string {
+	if len(backlogs) == 0 {
+		return ""
+	}
+	if now-backlogs[0].Oldest > handler.scheduler.maxWait.Milliseconds() {
+		return backlogs[0].Model
+	}
+	in.mu.Lock()
+	current, batch := in.nextModel, in.batch
+	in.mu.Unlock()
+	for _, b := range backlogs {
+		if b.Model == current && (batch < handler.scheduler.maxBatch || len(backlogs) == 1) {
+			return current
+		}
+	}
+	busy := make(map[string]bool)
+	for _, other := range handler.pool.instances {
+		if other == in {
+			continue
+		}
+		other.mu.Lock()
+		if other.healthy {
+			busy[other.nextModel] = true
+		}
+		other.mu.Unlock()
+	}
+	for _, b := range backlogs {
+		if !busy[b.Model] && b.Model != current {
+			return b.Model
+		}
+	}
+	for _, b := range backlogs {
+		if b.Model != current {
+			return b.Model
+		}
+	}
+	return backlogs[0].Model
+}
+
+// dispatch hands queued tasks to every backend that has capacity, choosing
+// for each one the model to run with chooseModel. It waits a poll interval
+// when nothing could be dispatched.
+func (handler *TTShHandler) dispatch(ctx context.Context) error {
+	conn := rds.Get()
+	defer conn.Close()
+	processing := processingList(handler.queue.workerID)
+	dispatched := false
+	for _, in := range handler.pool.available(instanceDepth) {
+		backlogs, err := loadBacklogs(conn)
+		if err != nil {
+			return err
+		}
+		model := handler.chooseModel(in, backlogs, nowMilli())
+		if model == "" {
+			break
+		}
+		id, err := redis.String(popScript.Do(conn, modelQueue(model), processing, modelSet, model))
+		if err != nil {
+			if errors.Is(err, redis.ErrNil) {
+				continue
+			}
+			return err
+		}
+		handler.pool.assign(in, model)
+		in.tasks <- id
+		dispatched = true
+	}
+	if dispatched {
+		return nil
+	}
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-handler.pool.changed:
+	case <-time.After(handler.scheduler.pollInterval):
+	}
+	return nil
+}
+
+// switchStats counts model switches and their latency.
+type switchStats struct {
+	mu      sync.Mutex
+	total   SwitchStat
+	byModel map[string]*SwitchStat
+}
+
+type SwitchStat struct {
+	Switches     int   `json:"switches"`
+	Errors       int   `json:"errors"`
+	TotalMs      int64 `json:"totalMs"`
+	LastMs       int64 `json:"lastMs"`
+	MaxMs        int64 `json:"maxMs"`
+	AvgMs        int64 `json:"avgMs"`
+	LastSwitchAt int64 `json:"lastSwitchAt,omitempty"`
+}
+
+func (s *SwitchStat) add(d time.Duration, err error) {
+	ms := d.Milliseconds()
+	s.Switches++
+	if err != nil {
+		s.Errors++
+	}
+	s.TotalMs += ms
+	s.LastMs = ms
+	if ms > s.MaxMs {
+		s.MaxMs = ms
+	}
+	s.AvgMs = s.TotalMs / int64(s.Switches)
+	s.LastSwitchAt = nowMilli()
+}
+
+func (s *switchStats) record(model string, d time.Duration, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.byModel == nil {
+		s.byModel = make(map[string]*SwitchStat)
+	}
+	stat, ok := s.byModel[model]
+	if !ok {
+		stat = &SwitchStat{}
+		s.byModel[model] = stat
+	}
+	stat.add(d, err)
+	s.total.add(d, err)
+	if err == nil {
+		logger.Infof(context.Background(), "switched to model %s in %s", model, d)
+	}
+}
+
+type SchedulerResp struct {
+	Queues   []backlog             `json:"queues"`
+	Switches SwitchStat            `json:"switches"`
+	ByModel  map[string]SwitchStat `json:"byModel"`
+}
+
+func (handler *TTShHandler) Scheduler(ctx context.Context, req *struct{}) (*SchedulerResp, error) {
+	conn := rds.Get()
+	defer conn.Close()
+	backlogs, err := loadBacklogs(conn)
+	if err != nil {
+		return nil, &status.Status{Code: 500, Message: err.Error()}
+	}
+	stats := &handler.pool.switches
+	stats.mu.Lock()
+	defer stats.mu.Unlock()
+	rsp := &SchedulerResp{Queues: backlogs, Switches: stats.total, ByModel: map[string]SwitchStat{}}
+	for model, stat := range stats.byModel {
+		rsp.ByModel[model] = *stat
+	}
+	return rsp, nil
+}
@@ -0,0 +1,104 @@
+package handler
+
+import (
+	"github.com/gomodule/redigo/redis"
+	"testing"
+	"time"
+	"ttsapi/config"
+	rds "ttsapi/storage/redis"
+)
+
+func TestPopScript(t *testing.T) {
+	env := newTestEnv(t, nil)
+	conn := rds.Get()
+	defer conn.Close()
+	if err := execCommands(append(enqueueCommands("m", "second", 2), enqueueCommands("m", "first", 1)...)); err != nil {
+		t.Fatal(err)
+	}
+	pop := func() (string, error) {
+		return redis.String(popScript.Do(conn, modelQueue("m"), "processing", modelSet, "m"))
+	}
+
+	if id, err := pop(); err != nil || id != "first" {
+		t.Fatalf("first pop = %q, %v", id, err)
+	}
+	if pending, _ := env.redis.SIsMember(modelSet, "m"); !pending {
+		t.Fatal("model left the set while it still has tasks")
+	}
+	if id, err := pop(); err != nil || id != "second" {
+		t.Fatalf("second pop = %q, %v", id, err)
+	}
+	if env.redis.Exists(modelSet) {
+		t.Fatal("drained model still in the set")
+	}
+	if _, err := pop(); err != redis.ErrNil {
+		t.Fatalf("pop on an empty queue = %v", err)
+	}
+	if processing := env.list("processing"); len(processing) != 2 || processing[0] != "second" || processing[1] != "first" {
+		t.Fatalf("processing = %v", processing)
+	}
+}
+
+func TestPromoteScript(t *testing.T) {
+	env := newTestEnv(t, nil)
+	due := env.submit(testModel, "你好。")
+	later := env.submit(testModel, "再见。")
+	now := nowMilli()
+	// 模拟两次失败后的等待：一个已到期，一个未到期
+	if err := execCommands([]command{
+		cmd("DEL", modelQueue(testModel), modelSet),
+		cmd("ZADD", delayedList, now-10, due),
+		cmd("ZADD", delayedList, now+time.Hour.Milliseconds(), later),
+		cmd("ZADD", delayedList, now-10, "missing"),
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := promoteDelayed(env.ctx); err != nil {
+		t.Fatal(err)
+	}
+	if queued := env.zset(modelQueue(testModel)); len(queued) != 1 || queued[0] != due {
+		t.Fatalf("model queue = %v", queued)
+	}
+	if pending, _ := env.redis.SIsMember(modelSet, testModel); !pending {
+		t.Fatal("model not marked as pending")
+	}
+	// 记录已丢失的任务直接丢弃
+	if delayed := env.zset(delayedList); len(delayed) != 1 || delayed[0] != later {
+		t.Fatalf("delayed = %v", delayed)
+	}
+}
+
+func TestChooseModel(t *testing.T) {
+	handler := &TTShHandler{scheduler: newSchedulerOptions(&config.Queue{MaxBatch: 2, MaxWait: time.Minute})}
+	a, b := &instance{healthy: true}, &instance{healthy: true}
+	handler.pool = &pool{instances: []*instance{a, b}}
+	now := time.Now().UnixMilli()
+	waiting := func(model string, waited time.Duration) backlog {
+		return backlog{Model: model, Pending: 1, Oldest: now - waited.Milliseconds()}
+	}
+
+	cases := []struct {
+		name      string
+		current   string
+		batch     int
+		other     string
+		backlogs  []backlog
+		wantModel string
+	}{
+		{"empty", "", 0, "", nil, ""},
+		{"oldest first", "", 0, "", []backlog{waiting("x", 3*time.Second), waiting("y", time.Second)}, "x"},
+		{"affinity", "y", 1, "", []backlog{waiting("x", 3*time.Second), waiting("y", time.Second)}, "y"},
+		{"batch limit", "y", 2, "", []backlog{waiting("x", 3*time.Second), waiting("y", time.Second)}, "x"},
+		{"batch limit with a single model", "y", 5, "", []backlog{waiting("y", time.Second)}, "y"},
+		{"starvation", "y", 1, "", []backlog{waiting("x", 2*time.Minute), waiting("y", time.Second)}, "x"},
+		{"skip busy models", "", 0, "x", []backlog{waiting("x", 3*time.Second), waiting("y", time.Second)}, "y"},
+		{"all busy", "", 0, "x", []backlog{waiting("x", 3*time.Second)}, "x"},
+	}
+	for _, c := range cases {
+		a.nextModel, a.batch = c.current, c.batch
+		b.nextModel = c.other
+		if got := handler.chooseModel(a, c.backlogs, now); got != c.wantModel {
+			t.Errorf("%s: chose %q, want %q", c.name, got, c.wantModel)
+		}
+	}
+}
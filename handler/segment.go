@@ -0,0 +1,50 @@
+package handler
+
+import (
+	"context"
+	"github.com/pkg/errors"
+	"time"
+	"ttsapi/config"
+)
+
+const (
+	defaultMaxSegmentLength = 100
+	defaultSegmentSilence   = 300 * time.Millisecond
+)
+
+type segmentOptions struct {
+	maxLength int
+	silence   time.Duration
+}
+
+func newSegmentOptions(cfg *config.Audio) segmentOptions {
+	opts := segmentOptions{
+		maxLength: defaultMaxSegmentLength,
+		silence:   defaultSegmentSilence,
+	}
+	if cfg == nil {
+		return opts
+	}
+	if cfg.MaxSegmentLength > 0 {
+		opts.maxLength = cfg.MaxSegmentLength
+	}
+	// 允许配置为 0 表示不插入静音，负数使用默认值
+	if cfg.SegmentSilence >= 0 {
+		opts.silence = cfg.SegmentSilence
+	}
+	return opts
+}
+
+// reportProgress records that done of total segments of a running task have
+// been synthesized.
+func reportProgress(ctx context.Context, id string, done, total int) error {
+	_, err := updateTask(ctx, id, func(info *taskInfo) error {
+		if info.State != stateRunning {
+			return errors.Errorf("task %s is %s", id, info.State)
+		}
+		info.Segments = total
+		info.SegmentsDone = done
+		return nil
+	})
+	return err
+}
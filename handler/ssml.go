@@ -0,0 +1,199 @@
+package handler
+
+import (
+	"math"
+	"time"
+	"ttsapi/server/httpserver/middles/status"
+	"ttsapi/text"
+)
+
+// planItem is one step of an SSML task: text read by one model with its own
+// params, or a pause.
+type planItem struct {
+	Model  *pair         `json:"model,omitempty"`  // <voice> 选择的模型，为空时使用任务的模型
+	Params *InferParams  `json:"params,omitempty"` // 已合并 <prosody rate> 的参数，为空时使用任务的参数
+	Text   string        `json:"text,omitempty"`   // 已规范化
+	Lang   string        `json:"lang,omitempty"`   // xml:lang 指定的语言，为空时逐段识别
+	Break  bool          `json:"break,omitempty"`
+	Pause  time.Duration `json:"pause,omitempty"`
+	Line   int           `json:"line,omitempty"` // 对白任务中所属的台词，从 1 开始
+}
+
+// planSSML parses the SSML document of in into the plan of a task of model.
+// Voices name models; prosody rates scale the speedFactor of the params
+// their text is read with.
+func (handler *TTShHandler) planSSML(owner string, in TextReq, model pair, params, reqParams *InferParams) ([]planItem, error) {
+	models := handler.models()
+	items, err := text.ParseSSML(in.SSML, func(name string) bool {
+		_, ok := models[name]
+		return ok
+	})
+	if err != nil {
+		return nil, &status.Status{Code: 400, Message: err.Error()}
+	}
+	var normalizer *text.Normalizer
+	if !in.Raw {
+		normalizer = handler.normalizers.get(owner)
+	}
+	plan := make([]planItem, 0, len(items))
+	for _, item := range items {
+		if item.Break {
+			plan = append(plan, planItem{Break: true, Pause: item.Pause})
+			continue
+		}
+		lang := item.Lang
+		if item.Lang == "" {
+			item.Lang = normLang(in.Lang)
+		}
+		step := planItem{Text: item.Render(normalizer), Lang: lang}
+		if step.Text == "" {
+			continue
+		}
+		itemParams := params
+		if item.Voice != "" && item.Voice != model.Name {
+			voice := models[item.Voice]
+			if itemParams, err = resolveInferParams(voice.Params, reqParams); err != nil {
+				return nil, &status.Status{Code: 400, Message: err.Error()}
+			}
+			if voice, err = selectReference(voice, itemParams); err != nil {
+				return nil, &status.Status{Code: 400, Message: err.Error()}
+			}
+			step.Model = &voice
+		}
+		if item.Rate != 1 {
+			scaled := *itemParams
+			speed := math.Round(*itemParams.SpeedFactor*item.Rate*100) / 100
+			if speed < minSpeedFactor {
+				speed = minSpeedFactor
+			} else if speed > maxSpeedFactor {
+				speed = maxSpeedFactor
+			}
+			scaled.SpeedFactor = floatPtr(speed)
+			itemParams = &scaled
+		}
+		if itemParams != params {
+			step.Params = itemParams
+		}
+		plan = append(plan, step)
+	}
+	return plan, nil
+}
+
+// planText joins the text of a plan, for language detection and logs.
+func planText(plan []planItem) string {
+	var b []byte
+	for _, item := range plan {
+		if item.Break {
+			continue
+		}
+		if len(b) > 0 {
+			b = append(b, '\n')
+		}
+		b = append(b, item.Text...)
+	}
+	return string(b)
+}
+
+// step is one backend request of a task, or, when pause is set, the silence
+// before the next one.
+type step struct {
+	model  pair
+	params *InferParams
+	text   string
+	lang   string // xml:lang 指定的语言
+	pause  *time.Duration
+	line   int
+}
+
+func speechSteps(steps []step) int {
+	n := 0
+	for _, s := range steps {
+		if s.pause == nil {
+			n++
+		}
+	}
+	return n
+}
+
+// groupSteps returns the order in which to synthesize steps read by more
+// than one model: grouped by model, loaded first, then the others in the
+// order they first appear. It returns nil when all steps share one model.
+func groupSteps(steps []step, loaded string) []int {
+	var models []string
+	byModel := make(map[string][]int)
+	for i, s := range steps {
+		if s.pause != nil {
+			continue
+		}
+		if _, ok := byModel[s.model.Name]; !ok {
+			models = append(models, s.model.Name)
+		}
+		byModel[s.model.Name] = append(byModel[s.model.Name], i)
+	}
+	if len(models) <= 1 {
+		return nil
+	}
+	order := append([]int(nil), byModel[loaded]...)
+	for _, model := range models {
+		if model != loaded {
+			order = append(order, byModel[model]...)
+		}
+	}
+	return order
+}
+
+// steps lays out the backend requests of t: the segments of its text, or of
+// every item of its SSML plan.
+func (handler *TTShHandler) steps(t *task) []step {
+	if len(t.Plan) == 0 {
+		var steps []step
+		for _, segment := range text.Split(t.Content, handler.segment.maxLength) {
+			steps = append(steps, step{model: t.Model, params: t.Params, text: segment})
+		}
+		return steps
+	}
+	var steps []step
+	for _, item := range t.Plan {
+		if item.Break {
+			pause := item.Pause
+			steps = append(steps, step{pause: &pause})
+			continue
+		}
+		model, params := t.Model, t.Params
+		if item.Model != nil {
+			model = *item.Model
+		}
+		if item.Params != nil {
+			params = item.Params
+		}
+		for _, segment := range text.Split(item.Text, handler.segment.maxLength) {
+			steps = append(steps, step{model: model, params: params, text: segment, lang: item.Lang, line: item.Line})
+		}
+	}
+	return steps
+}
+
+// planDigest returns the plan of t as it enters the cache key: models by the
+// digest of their files and randomly picked seeds left out.
+func (handler *TTShHandler) planDigest(t *task) ([]planItem, error) {
+	if len(t.Plan) == 0 {
+		return nil, nil
+	}
+	plan := make([]planItem, len(t.Plan))
+	for i, item := range t.Plan {
+		if item.Model != nil {
+			digest, err := handler.digests.model(*item.Model)
+			if err != nil {
+				return nil, err
+			}
+			item.Model = &pair{Name: digest}
+		}
+		if item.Params != nil && t.SeedAuto {
+			params := *item.Params
+			params.Seed = nil
+			item.Params = &params
+		}
+		plan[i] = item
+	}
+	return plan, nil
+}
@@ -0,0 +1,113 @@
+package handler
+
+import (
+	"context"
+	"github.com/gin-gonic/gin"
+	"io"
+	"net/http"
+	"ttsapi/audio"
+	"ttsapi/logger"
+	"ttsapi/server/httpserver/middles/status"
+)
+
+const streamChunkSize = 8 * 1024
+
+type StreamReq struct {
+	Model string `json:"model"`
+	TextReq
+	Params *InferParams `json:"params"`
+}
+
+// Stream synthesizes the text synchronously and relays the audio as the backend
+// produces it: a WAV header with unknown length first, then raw PCM chunks.
+func (handler *TTShHandler) Stream(ctx *gin.Context) {
+	req := &StreamReq{}
+	if err := ctx.ShouldBindJSON(req); err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"code": http.StatusBadRequest, "message": err.Error()})
+		return
+	}
+	if req.SSML != "" {
+		ctx.JSON(http.StatusBadRequest, gin.H{"code": http.StatusBadRequest, "message": "ssml is not supported for streaming"})
+		return
+	}
+	t, err := handler.newTask(caller(ctx), req.Model, req.TextReq, req.Params)
+	if err != nil {
+		ctx.JSON(status.GetCode(err), gin.H{"code": status.GetCode(err), "message": err.Error()})
+		return
+	}
+
+	// 客户端断开后 Request.Context 会被取消，等待锁和后端请求都会随之中止
+	reqCtx := ctx.Request.Context()
+	started := false
+	err = handler.streamTask(reqCtx, t, func(format audio.Format) error {
+		ctx.Header("Content-Type", "audio/wav")
+		ctx.Header("X-Task-Id", t.Id)
+		ctx.Status(http.StatusOK)
+		started = true
+		return audio.WriteHeader(ctx.Writer, format, audio.UnknownSize)
+	}, func(chunk []byte) error {
+		if _, err := ctx.Writer.Write(chunk); err != nil {
+			return err
+		}
+		ctx.Writer.Flush()
+		return nil
+	})
+	if err == nil {
+		return
+	}
+	if reqCtx.Err() != nil {
+		logger.Infof(reqCtx, "stream %s cancelled by client", t.Id)
+		return
+	}
+	logger.Errorf(reqCtx, "stream %s failed: %s", t.Id, err)
+	// 已经开始输出音频时无法再改状态码，只能直接断开
+	if !started {
+		ctx.JSON(http.StatusBadGateway, gin.H{"code": http.StatusBadGateway, "message": err.Error()})
+	}
+}
+
+// streamTask runs t against the backend in streaming mode. onFormat is called
+// once with the backend audio format before the first onChunk call.
+func (handler *TTShHandler) streamTask(ctx context.Context, t *task, onFormat func(audio.Format) error, onChunk func([]byte) error) error {
+	in, err := handler.pool.reserveWait(ctx, t.Model.Name)
+	if err != nil {
+		return err
+	}
+	defer handler.pool.done(in)
+	if err := in.acquire(ctx); err != nil {
+		return err
+	}
+	defer in.release()
+
+	if err := handler.pool.switchModel(ctx, in, t.Model); err != nil {
+		return err
+	}
+	body, err := in.backend.Stream(ctx, t.request())
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+
+	format, _, err := audio.ReadHeader(body)
+	if err != nil {
+		return err
+	}
+	if err := onFormat(format); err != nil {
+		return err
+	}
+	buf := make([]byte, streamChunkSize)
+	for {
+		n, err := body.Read(buf)
+		if n > 0 {
+			if err := onChunk(buf[:n]); err != nil {
+				return err
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,92 @@
+package handler
+
+import (
+	"bytes"
+	"github.com/gin-gonic/gin"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"ttsapi/audio"
+	"ttsapi/backend/fake"
+)
+
+func TestStream(t *testing.T) {
+	env := newTestEnv(t, nil)
+	router := gin.New()
+	env.handler.routes(router.Group("/v1"))
+	server := httptest.NewServer(router)
+	t.Cleanup(server.Close)
+
+	post := func(body string) *http.Response {
+		t.Helper()
+		r, err := http.NewRequest(http.MethodPost, server.URL+"/v1/stream", strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.Header.Set("Authorization", "secret")
+		r.Header.Set("Content-Type", "application/json")
+		rsp, err := http.DefaultClient.Do(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { rsp.Body.Close() })
+		return rsp
+	}
+
+	text := "今天天气很好，我们一起去公园散步吧。"
+	rsp := post(`{"model":"` + testModel + `","text":"` + text + `","lang":"zh"}`)
+	if rsp.StatusCode != http.StatusOK {
+		t.Fatalf("status %d", rsp.StatusCode)
+	}
+	if got := rsp.Header.Get("Content-Type"); got != "audio/wav" {
+		t.Errorf("Content-Type %q", got)
+	}
+	if rsp.Header.Get("X-Task-Id") == "" {
+		t.Error("no X-Task-Id")
+	}
+	// 长度未知，只能分块传输
+	if rsp.ContentLength != -1 || len(rsp.TransferEncoding) != 1 || rsp.TransferEncoding[0] != "chunked" {
+		t.Errorf("Content-Length %d, Transfer-Encoding %v, want chunked", rsp.ContentLength, rsp.TransferEncoding)
+	}
+	format, size, err := audio.ReadHeader(rsp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if format != fake.Format || size != audio.UnknownSize {
+		t.Errorf("header %+v with size %#x, want %+v with UnknownSize", format, size, fake.Format)
+	}
+	pcm, err := io.ReadAll(rsp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 流式输出的 PCM 与一次性合成的结果相同
+	tk, err := env.handler.newTask(caller(env.ctx), testModel, TextReq{Text: text, Lang: "zh"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wav, err := env.backend.Synthesize(env.ctx, tk.request())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := wav[44:]; !bytes.Equal(pcm, want) {
+		t.Errorf("streamed %d bytes of PCM, want the %d synthesized", len(pcm), len(want))
+	}
+	if len(pcm) <= streamChunkSize {
+		t.Errorf("only %d bytes, the text should span several chunks", len(pcm))
+	}
+
+	for _, c := range []struct {
+		name, body string
+	}{
+		{"ssml", `{"model":"` + testModel + `","ssml":"<speak>你好</speak>"}`},
+		{"unknown model", `{"model":"nobody","text":"你好。"}`},
+		{"bad json", `{"model":`},
+	} {
+		if rsp := post(c.body); rsp.StatusCode != http.StatusBadRequest {
+			t.Errorf("%s: status %d, want 400", c.name, rsp.StatusCode)
+		}
+	}
+}
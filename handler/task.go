@@ -0,0 +1,241 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/gomodule/redigo/redis"
+	"github.com/pkg/errors"
+	"time"
+	"ttsapi/audio"
+	"ttsapi/backend"
+	rds "ttsapi/storage/redis"
+	"ttsapi/text"
+)
+
+const taskKeyPrefix = "ttsapi:task:"
+
+type taskState string
+
+const (
+	stateQueued    taskState = "queued"
+	stateRunning   taskState = "running"
+	stateSucceeded taskState = "succeeded"
+	stateFailed    taskState = "failed"
+	stateCancelled taskState = "cancelled"
+	stateExpired   taskState = "expired" // 结果文件已被清理
+)
+
+func (s taskState) terminal() bool {
+	switch s {
+	case stateSucceeded, stateFailed, stateCancelled, stateExpired:
+		return true
+	}
+	return false
+}
+
+// errTaskNotFound is returned when no record exists for the task ID.
+var errTaskNotFound = errors.New("task not found")
+
+type task struct {
+	Id      string       `json:"id"`
+	Model   pair         `json:"model"`
+	Content string       `json:"content"`
+	Lang    string       `json:"lang"`
+	Params  *InferParams `json:"params"`
+
+	Original string         `json:"original,omitempty"` // 规范化前的文本或 SSML 文档，与 Content 相同时为空
+	Plan     []planItem     `json:"plan,omitempty"`     // SSML 或对白的合成计划，为空时按 Content 合成
+	Lines    []dialogueLine `json:"lines,omitempty"`    // 对白脚本的台词
+
+	LangExplicit bool            `json:"langExplicit,omitempty"` // Lang 由调用方指定，不按段识别
+	Language     *text.Detection `json:"language,omitempty"`     // 提交时识别的语言分段
+
+	Owner    string `json:"owner,omitempty"`    // 提交任务的调用方
+	Callback string `json:"callback,omitempty"` // 任务结束后回调的地址
+	Batch    string `json:"batch,omitempty"`    // 所属批次
+	Ref      string `json:"ref,omitempty"`      // 调用方自定义的引用
+
+	Format      *audio.Target `json:"format,omitempty"`      // 结果的输出格式，为空时保留后端返回的 WAV
+	PostProcess *PostProcess  `json:"postProcess,omitempty"` // 已合并模型配置的后处理
+
+	SeedAuto bool   `json:"seedAuto,omitempty"` // seed 由服务随机生成，换一个 seed 的结果同样满足请求
+	CacheKey string `json:"cacheKey,omitempty"` // 结果缓存的摘要，为空表示不使用缓存
+	Leader   string `json:"leader,omitempty"`   // 等待其结果的相同任务
+}
+
+// request builds the backend request for t.
+func (t *task) request() *backend.Request {
+	return &backend.Request{
+		Text:             t.Content,
+		Lang:             t.Lang,
+		RefAudioPath:     t.Model.ReferenceAudioPath,
+		PromptText:       t.Model.ReferText,
+		PromptLang:       t.Model.ReferLang,
+		AuxRefAudioPaths: t.Model.AuxRefAudioPaths,
+		Params:           t.Params.backendParams(),
+	}
+}
+
+// taskInfo is the record stored under ttsapi:task:<id>; the queue only holds IDs.
+type taskInfo struct {
+	task
+	State         taskState `json:"state"`
+	Error         string    `json:"error,omitempty"`
+	File          string    `json:"file,omitempty"`
+	Output        string    `json:"output,omitempty"` // 按 Format 转换后的结果
+	Loudness      *Loudness `json:"loudness,omitempty"`
+	Manifest      *Manifest `json:"manifest,omitempty"` // 对白每句台词在结果中的时间
+	Worker        string    `json:"worker,omitempty"`   // 最近一次执行该任务的 worker
+	Attempts      int       `json:"attempts"`
+	NextAttemptAt int64     `json:"nextAttemptAt,omitempty"` // 等待重试时下一次执行的时间
+	Segments      int       `json:"segments,omitempty"`      // 长文本切分后的段数
+	SegmentsDone  int       `json:"segmentsDone,omitempty"`  // 已合成的段数
+	DeadLettered  bool      `json:"deadLettered,omitempty"`
+	Cached        bool      `json:"cached,omitempty"` // 结果直接取自缓存
+	CreatedAt     int64     `json:"createdAt"`
+	StartedAt     int64     `json:"startedAt,omitempty"`
+	FinishedAt    int64     `json:"finishedAt,omitempty"`
+	UpdatedAt     int64     `json:"updatedAt"`
+}
+
+// command is an extra redis command executed in the same MULTI as a record update.
+type command struct {
+	name string
+	args []interface{}
+}
+
+func cmd(name string, args ...interface{}) command {
+	return command{name: name, args: args}
+}
+
+// execCommands runs cmds in one MULTI/EXEC transaction.
+func execCommands(cmds []command) error {
+	conn := rds.Get()
+	defer conn.Close()
+	conn.Send("MULTI")
+	for _, c := range cmds {
+		conn.Send(c.name, c.args...)
+	}
+	_, err := conn.Do("EXEC")
+	return err
+}
+
+func taskKey(id string) string {
+	return taskKeyPrefix + id
+}
+
+func nowMilli() int64 {
+	return time.Now().UnixMilli()
+}
+
+func loadTask(conn redis.Conn, id string) (*taskInfo, error) {
+	data, err := redis.Bytes(conn.Do("GET", taskKey(id)))
+	if err != nil {
+		if errors.Is(err, redis.ErrNil) {
+			return nil, errTaskNotFound
+		}
+		return nil, err
+	}
+	info := &taskInfo{}
+	if err := json.Unmarshal(data, info); err != nil {
+		return nil, err
+	}
+	return info, nil
+}
+
+func getTask(ctx context.Context, id string) (*taskInfo, error) {
+	conn := rds.Get()
+	defer conn.Close()
+	return loadTask(conn, id)
+}
+
+// updateTask applies fn to the stored record atomically (WATCH/MULTI). If fn
+// returns an error the record is left untouched and the error is returned.
+// cmds are executed in the same transaction as the record update.
+func updateTask(ctx context.Context, id string, fn func(info *taskInfo) error, cmds ...command) (*taskInfo, error) {
+	conn := rds.Get()
+	defer conn.Close()
+	for {
+		if _, err := conn.Do("WATCH", taskKey(id)); err != nil {
+			return nil, err
+		}
+		info, err := loadTask(conn, id)
+		if err != nil {
+			conn.Do("UNWATCH")
+			return nil, err
+		}
+		prev := info.State
+		if err := fn(info); err != nil {
+			conn.Do("UNWATCH")
+			return info, err
+		}
+		info.UpdatedAt = nowMilli()
+		all := cmds
+		if info.Callback != "" && !prev.terminal() && info.State.terminal() {
+			// 任务结束，安排回调
+			all = append(append([]command{}, cmds...), cmd("ZADD", webhookSet, info.UpdatedAt, id))
+		}
+		data, err := json.Marshal(info)
+		if err != nil {
+			conn.Do("UNWATCH")
+			return nil, err
+		}
+		conn.Send("MULTI")
+		conn.Send("SET", taskKey(id), data)
+		for _, c := range all {
+			conn.Send(c.name, c.args...)
+		}
+		res, err := conn.Do("EXEC")
+		if err != nil {
+			return nil, err
+		}
+		// EXEC 返回 nil 表示记录在 WATCH 之后被修改过，重试
+		if res != nil {
+			if !prev.terminal() && info.State.terminal() {
+				settleFollowers(ctx, info)
+			}
+			return info, nil
+		}
+	}
+}
+
+// transition moves the task to state `to` if its current state is one of from.
+func transition(ctx context.Context, id string, to taskState, from []taskState, fn func(info *taskInfo), cmds ...command) (*taskInfo, error) {
+	return updateTask(ctx, id, func(info *taskInfo) error {
+		allowed := false
+		for _, s := range from {
+			if info.State == s {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			return errors.Errorf("task %s is %s, cannot become %s", id, info.State, to)
+		}
+		info.State = to
+		now := nowMilli()
+		switch {
+		case to == stateRunning:
+			info.StartedAt = now
+			info.Attempts++
+			info.NextAttemptAt = 0
+			info.SegmentsDone = 0
+		case to.terminal():
+			info.FinishedAt = now
+		}
+		if fn != nil {
+			fn(info)
+		}
+		return nil
+	}, cmds...)
+}
+
+// queuePosition returns the 1-based position of id in the queue of its model
+// (1 = next to run for that model), or 0 when it is not queued.
+func queuePosition(conn redis.Conn, model, id string) int {
+	rank, err := redis.Int(conn.Do("ZRANK", modelQueue(model), id))
+	if err != nil {
+		return 0
+	}
+	return rank + 1
+}
@@ -6,55 +6,88 @@ import (
 	"encoding/json"
 	"fmt"
 	"github.com/gin-gonic/gin"
-	"github.com/gomodule/redigo/redis"
 	"github.com/google/uuid"
 	"github.com/pkg/errors"
 	"io"
 	"net/http"
-	"net/url"
 	"os"
-	"path"
-	"strings"
+	"path/filepath"
+	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
+	"ttsapi/audio"
+	"ttsapi/backend"
 	"ttsapi/config"
 	"ttsapi/logger"
 	"ttsapi/server/httpserver"
 	"ttsapi/server/httpserver/middles/status"
+	"ttsapi/storage/blob"
 	rds "ttsapi/storage/redis"
-	"unicode"
+	"ttsapi/text"
+	"ttsapi/utils/exit"
 )
 
+// taskList 旧版本的全局队列，仅用于迁移升级前入队的任务
 const taskList = "ttsapi:tasks"
 
 type TTShHandler struct {
-	ttsAddr           string
+	pool              *pool
 	gptWeightsPath    string
 	soVITSWeightsPath string
-	weightPairs       map[string]pair
+	registry          atomic.Pointer[modelRegistry]
+	manageMu          sync.Mutex // 串行化模型的加载和管理操作
+	uploads           uploads
+	watch             watchOptions
+	modelEvents       modelEvents
 	referAudioPath    string
-	outputAudioPath   string
-	currentModel      string
-	mutex             sync.Mutex
+	modelsPath        string
+	scratchPath       string
+	presign           bool
+	presignExpiry     time.Duration
+	retry             retryPolicy
+	queue             queueOptions
+	scheduler         schedulerOptions
+	running           runningTasks
+	webhook           webhookOptions
+	segment           segmentOptions
+	janitor           janitorOptions
+	cache             cacheOptions
+	digests           digests
+	normalizers       normalizers
+	dialogue          dialogueOptions
 	base
 }
 
 func (handler *TTShHandler) Init(router *gin.RouterGroup) {
 	handler.logger = logger.WithField("handler", "TTShHandler")
 
-	cfg := config.Get()
-	handler.ttsAddr = cfg.Server.TTSAddress
-	handler.gptWeightsPath = cfg.Server.GPTWeightsPath
-	handler.soVITSWeightsPath = cfg.Server.SoVITSWeightsPath
-	handler.referAudioPath = cfg.Server.ReferAudioPath
-	handler.outputAudioPath = cfg.Server.OutputAudioPath
-	handler.loadModels()
-
+	if err := handler.setup(config.Get()); err != nil {
+		// config.Server.Validate 在启动时已经拒绝了未知的后端，这里是规范化规则等配置错误
+		panic(fmt.Errorf("tts handler init error: %s", err.Error()))
+	}
+	handler.loadModels(reloadStartup)
+
+	go handler.heartbeat(context.Background())
+	exit.Registry(func(os.Signal) { handler.retire() })
+	go handler.pool.healthLoop(context.Background())
+	go handler.listenCancels(context.Background())
+	go handler.listenModelReloads(context.Background())
+	go handler.watchModels(context.Background())
+	go handler.deliverLoop(context.Background())
+	go handler.janitorLoop(context.Background())
 	go func() {
 		ctx := context.Background()
-		logger.Infof(ctx, "task prossor started")
+		logger.Infof(ctx, "task prossor started, worker %s, %d backends", handler.queue.workerID, len(handler.pool.instances))
+		go handler.recoverLoop(ctx)
+		for _, in := range handler.pool.instances {
+			go handler.work(ctx, in)
+		}
 		for {
-			if err := handler.process(ctx); err != nil {
+			if err := promoteDelayed(ctx); err != nil {
+				logger.Errorf(ctx, "Promote delayed tasks err: %s", err)
+			}
+			if err := handler.dispatch(ctx); err != nil {
 				logger.Errorf(ctx, "Task process err: %s", err)
 				time.Sleep(5 * time.Second)
 			}
@@ -62,307 +95,558 @@ func (handler *TTShHandler) Init(router *gin.RouterGroup) {
 	}()
 
 	if router != nil {
-		router.Use(func(ctx *gin.Context) {
-			authorization := ctx.Request.Header.Get("Authorization")
-			if authorization == "" || authorization != config.Get().Server.Authorization {
-				ctx.AbortWithStatusJSON(
-					http.StatusUnauthorized,
-					gin.H{"error": "Unauthorized"},
-				)
-			}
-			ctx.Next()
-		})
-
-		router.GET("/getModels", httpserver.NewHandlerFuncFrom(handler.GetModels))
-		router.GET("/loadModels", httpserver.NewHandlerFuncFrom(handler.LoadModels))
-		router.POST("/newTask", httpserver.NewHandlerFuncFrom(handler.NewTask))
-		router.GET("/taskStatus", httpserver.NewHandlerFuncFrom(handler.TaskStatus))
-		router.GET("/getResult", handler.GetResult)
+		handler.routes(router)
 	}
 }
 
-func (handler *TTShHandler) loadModels() {
-	models := make(map[string]pair)
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
-	defer cancel()
-	gptWeights, err := os.ReadDir(handler.gptWeightsPath)
-	if err != nil {
-		logger.Warnf(ctx, "Error reading gpt weights directory %s", handler.gptWeightsPath)
-		return
-	}
+// routes registers the API of the handler on router.
+func (handler *TTShHandler) routes(router *gin.RouterGroup) {
+	router.Use(handler.authorize)
+
+	router.GET("/getModels", httpserver.NewHandlerFuncFrom(handler.GetModels))
+	// 重新加载会通知所有实例，报告中有服务器上的路径，只对管理员开放
+	router.GET("/loadModels", handler.requireAdmin, httpserver.NewHandlerFuncFrom(handler.LoadModels))
+	router.POST("/newTask", httpserver.NewHandlerFuncFrom(handler.NewTask))
+	router.GET("/taskStatus", httpserver.NewHandlerFuncFrom(handler.TaskStatus))
+	router.POST("/newDialogue", httpserver.NewHandlerFuncFrom(handler.NewDialogue))
+	router.GET("/dialogueManifest", httpserver.NewHandlerFuncFrom(handler.DialogueManifest))
+	router.POST("/detectLang", httpserver.NewHandlerFuncFrom(handler.DetectLang))
+	router.POST("/normalize", httpserver.NewHandlerFuncFrom(handler.Normalize))
+	router.POST("/cancelTask", httpserver.NewHandlerFuncFrom(handler.CancelTask))
+	router.GET("/webhookDeliveries", httpserver.NewHandlerFuncFrom(handler.WebhookDeliveries))
+	router.POST("/newBatch", httpserver.NewHandlerFuncFrom(handler.NewBatch))
+	router.GET("/batchStatus", httpserver.NewHandlerFuncFrom(handler.BatchStatus))
+	router.GET("/batchResult", handler.BatchResult)
+	router.GET("/getResult", handler.GetResult)
+	router.POST("/stream", handler.Stream)
+	router.GET("/ws", handler.WebSocket)
+
+	admin := router.Group("/admin", handler.requireAdmin)
+	admin.GET("/models", httpserver.NewHandlerFuncFrom(handler.ListModels))
+	admin.POST("/models", httpserver.NewHandlerFuncFrom(handler.CreateModel))
+	admin.POST("/models/update", httpserver.NewHandlerFuncFrom(handler.UpdateModel))
+	admin.POST("/models/disable", httpserver.NewHandlerFuncFrom(handler.DisableModel))
+	admin.POST("/models/enable", httpserver.NewHandlerFuncFrom(handler.EnableModel))
+	admin.POST("/models/delete", httpserver.NewHandlerFuncFrom(handler.DeleteModel))
+	admin.GET("/models/events", httpserver.NewHandlerFuncFrom(handler.ModelEvents))
+	admin.GET("/models/events/stream", handler.StreamModelEvents)
+	admin.GET("/models/report", httpserver.NewHandlerFuncFrom(handler.ModelReport))
+	admin.POST("/models/validate", httpserver.NewHandlerFuncFrom(handler.ValidateModels))
+	admin.POST("/uploads", httpserver.NewHandlerFuncFrom(handler.CreateUpload))
+	admin.GET("/uploads", httpserver.NewHandlerFuncFrom(handler.UploadStatus))
+	admin.PUT("/uploads/data", handler.UploadData)
+	admin.POST("/uploads/abort", httpserver.NewHandlerFuncFrom(handler.AbortUpload))
+	admin.GET("/backends", httpserver.NewHandlerFuncFrom(handler.Backends))
+	admin.GET("/scheduler", httpserver.NewHandlerFuncFrom(handler.Scheduler))
+	admin.GET("/deadLetters", httpserver.NewHandlerFuncFrom(handler.DeadLetters))
+	admin.POST("/deadLetters/requeue", httpserver.NewHandlerFuncFrom(handler.RequeueDeadLetters))
+	admin.POST("/deadLetters/purge", httpserver.NewHandlerFuncFrom(handler.PurgeDeadLetters))
+	admin.GET("/janitor", httpserver.NewHandlerFuncFrom(handler.Janitor))
+	admin.POST("/janitor/run", httpserver.NewHandlerFuncFrom(handler.RunJanitor))
+	admin.GET("/cache", httpserver.NewHandlerFuncFrom(handler.Cache))
+	admin.POST("/cache/purge", httpserver.NewHandlerFuncFrom(handler.PurgeCache))
+}
 
-	referenceAudios, err := os.ReadDir(handler.referAudioPath)
+// setup applies cfg to the handler without loading models or starting any
+// background loop.
+func (handler *TTShHandler) setup(cfg *config.Config) error {
+	addrs := cfg.Server.TTSAddresses
+	if len(addrs) == 0 && cfg.Server.TTSAddress != "" {
+		addrs = []string{cfg.Server.TTSAddress}
+	}
+	pool, err := newPool(cfg.Server.TTSBackend, addrs, cfg.Server.HealthCheckInterval, cfg.Server.UnhealthyThreshold)
 	if err != nil {
-		logger.Warnf(ctx, "Error reading reference audios directory %s", handler.referAudioPath)
-		return
+		return err
 	}
-
-	audios := make(map[string][]string)
-	for _, audio := range referenceAudios {
-		fileName := audio.Name()
-		name := fileName[0 : len(fileName)-len(path.Ext(fileName))]
-		res := strings.Split(name, "-")
-		if len(res) != 3 {
-			logger.Warnf(ctx, "Invalid reference audio %s", fileName)
-			continue
+	handler.pool = pool
+	handler.gptWeightsPath = cfg.Server.GPTWeightsPath
+	handler.soVITSWeightsPath = cfg.Server.SoVITSWeightsPath
+	handler.referAudioPath = cfg.Server.ReferAudioPath
+	handler.modelsPath = cfg.Server.ModelsPath
+	if handler.modelsPath != "" {
+		// 上传的模型文件以绝对路径写入清单，清单里的相对路径是相对清单所在目录的
+		if handler.modelsPath, err = filepath.Abs(handler.modelsPath); err != nil {
+			return err
 		}
-		audios[res[0]] = []string{res[1], res[2]}
 	}
+	handler.scratchPath = cfg.Server.ScratchPath
+	if handler.scratchPath == "" {
+		handler.scratchPath = defaultScratchPath()
+	}
+	if cfg.Resources != nil && cfg.Resources.Storage != nil {
+		handler.presign, handler.presignExpiry = presignOptions(cfg.Resources.Storage.Blob)
+	}
+	var queueCfg *config.Queue
+	if cfg.Resources != nil {
+		queueCfg = cfg.Resources.Queue
+	}
+	handler.retry = newRetryPolicy(queueCfg)
+	handler.queue = newQueueOptions(queueCfg)
+	handler.scheduler = newSchedulerOptions(queueCfg)
+	var webhookCfg *config.Webhook
+	if cfg.Resources != nil {
+		webhookCfg = cfg.Resources.Webhook
+	}
+	handler.webhook = newWebhookOptions(webhookCfg)
+	handler.segment = newSegmentOptions(cfg.Audio)
+	if handler.normalizers, err = newNormalizers(cfg.Audio, cfg.Server.APIKeys); err != nil {
+		return err
+	}
+	handler.dialogue = newDialogueOptions(cfg.Audio)
+	var retentionCfg *config.Retention
+	if cfg.Resources != nil {
+		retentionCfg = cfg.Resources.Retention
+	}
+	handler.janitor = newJanitorOptions(retentionCfg, cfg.Server.OutputAudioPath)
+	var cacheCfg *config.Cache
+	if cfg.Resources != nil {
+		cacheCfg = cfg.Resources.Cache
+	}
+	handler.cache = newCacheOptions(cacheCfg)
+	handler.watch = newWatchOptions(cfg.Server.ModelWatch)
+	return nil
+}
 
-	for _, weight := range gptWeights {
-		fileName := weight.Name()
-		ext := path.Ext(fileName)
-		name := fileName[0 : len(fileName)-len(ext)]
-		if _, err := os.Stat(fmt.Sprintf("%s/%s.pth", handler.soVITSWeightsPath, name)); err != nil {
-			logger.Warnf(ctx, "Error reading file %s", handler.soVITSWeightsPath)
-			continue
-		}
-
-		referInfo, ok := audios[name]
-		if !ok {
-			logger.Warnf(ctx, "Error get reference audio %s", name)
-			continue
-		}
+// loadModels scans the models and replaces the loaded ones.
+func (handler *TTShHandler) loadModels(trigger string) *ModelReport {
+	handler.manageMu.Lock()
+	defer handler.manageMu.Unlock()
+	return handler.reloadModels(context.Background(), trigger)
+}
 
-		models[name] = pair{
-			Name:               name,
-			GptPath:            handler.gptWeightsPath + "/" + fileName,
-			SovitsPath:         handler.soVITSWeightsPath + "/" + name + ".pth",
-			ReferenceAudioPath: fmt.Sprintf("%s/%s-%s-%s.wav", handler.referAudioPath, name, referInfo[0], referInfo[1]),
-			ReferText:          referInfo[0],
-			ReferLang:          referInfo[1],
+// work executes the tasks dispatched to one backend, one at a time.
+func (handler *TTShHandler) work(ctx context.Context, in *instance) {
+	for id := range in.tasks {
+		if err := handler.execute(ctx, in, id); err != nil {
+			logger.Errorf(ctx, "Task process err on %s: %s", in.backend.Name(), err)
 		}
+		handler.pool.done(in)
 	}
-	handler.weightPairs = models
-	logger.Infof(ctx, "Loaded %d models", len(models))
 }
 
-type task struct {
-	Id      string `json:"id"`
-	Model   pair   `json:"model"`
-	Content string `json:"content"`
-	Lang    string `json:"lang"`
-}
+func (handler *TTShHandler) execute(ctx context.Context, in *instance, id string) error {
+	conn := rds.Get()
+	defer conn.Close()
+	worker := handler.queue.workerID
+	processing := processingList(worker)
 
-func (handler *TTShHandler) setModels(model pair) error {
-	baseUrl, _ := url.Parse(handler.ttsAddr)
-	baseUrl.Path = "set_gpt_weights"
-	query := url.Values{}
-	query.Add("weights_path", model.GptPath)
-	baseUrl.RawQuery = query.Encode()
-	request, err := http.NewRequest(http.MethodGet, baseUrl.String(), nil)
+	deadline := time.Now().Add(handler.queue.visibilityTimeout)
+	info, err := transition(ctx, id, stateRunning, []taskState{stateQueued}, func(info *taskInfo) {
+		info.Worker = worker
+	}, cmd("ZADD", inflightSet, deadline.UnixMilli(), id))
 	if err != nil {
-		return err
+		// 已取消或记录丢失的任务直接跳过
+		logger.Warnf(ctx, "skip task %s: %s", id, err)
+		conn.Do("LREM", processing, 0, id)
+		return nil
 	}
-	res, err := (&http.Client{Timeout: 5 * time.Second}).Do(request)
-	if err != nil {
-		return err
+
+	runCtx, cancel := context.WithDeadline(ctx, deadline)
+	defer cancel()
+	handler.running.add(id, cancel)
+	defer handler.running.remove(id)
+	// 注册之前已被取消的任务不会收到通知，这里再确认一次
+	if current, err := loadTask(conn, id); err == nil && current.State == stateCancelled {
+		cancel()
+	}
+	file, manifest, err := handler.runTask(runCtx, in, &info.task)
+	output, fileKey, outputKey := "", "", ""
+	var loudness *Loudness
+	if err == nil {
+		// 后处理和格式转换不占用后端，都在本地临时文件上完成，最后上传
+		if loudness, err = postProcess(file, info.PostProcess); err == nil {
+			if output, err = convertOutput(&info.task, file); err == nil {
+				fileKey, outputKey, err = storeResult(runCtx, &info.task, file, output)
+			}
+		}
+		removeResult(file, output)
 	}
-	defer res.Body.Close()
-	if res.StatusCode != http.StatusOK {
-		return errors.New("set gpt model failed: " + res.Status)
+	if errors.Is(runCtx.Err(), context.Canceled) && ctx.Err() == nil {
+		// 被 CancelTask 中止，记录已经是 cancelled
+		deleteResults(ctx, fileKey, outputKey)
+		conn.Do("LREM", processing, 0, id)
+		logger.Infof(ctx, "task %s cancelled", id)
+		return nil
 	}
-
-	baseUrl, _ = url.Parse(handler.ttsAddr)
-	baseUrl.Path = "set_sovits_weights"
-	query = url.Values{}
-	query.Add("weights_path", model.SovitsPath)
-	baseUrl.RawQuery = query.Encode()
-	request, err = http.NewRequest(http.MethodGet, baseUrl.String(), nil)
 	if err != nil {
-		return err
+		handler.fail(ctx, info, err, doneCommands(worker, id)...)
+		if backend.IsPermanent(err) {
+			logger.Errorf(ctx, "task %s failed permanently: %s", id, err)
+			return nil
+		}
+		return errors.Wrapf(err, "task %s", id)
 	}
-	res1, err := (&http.Client{Timeout: 5 * time.Second}).Do(request)
+	done, err := transition(ctx, id, stateSucceeded, []taskState{stateRunning}, func(info *taskInfo) {
+		info.File = fileKey
+		info.Output = outputKey
+		info.Loudness = loudness
+		info.Manifest = manifest
+	}, doneCommands(worker, id)...)
 	if err != nil {
+		// 执行期间任务已被取消或被恢复流程接管，结果作废
+		deleteResults(ctx, fileKey, outputKey)
+		conn.Do("LREM", processing, 0, id)
 		return err
 	}
-	defer res1.Body.Close()
-	if res1.StatusCode != http.StatusOK {
-		return errors.New("set gpt model failed: " + res1.Status)
+	if done.CacheKey != "" {
+		handler.storeCache(ctx, done)
 	}
-	logger.Infof(context.Background(), "model changed to %s", model.Name)
 	return nil
 }
 
-func (handler *TTShHandler) process(ctx context.Context) error {
-	handler.mutex.Lock()
-	defer handler.mutex.Unlock()
-	conn := rds.Get()
-	defer conn.Close()
-	arr, err := redis.Values(conn.Do("BRPOP", taskList, 5))
-	if err != nil {
-		if errors.Is(err, redis.ErrNil) {
-			return nil
-		}
-		return err
+// runTask synthesizes t on in and writes the result into a scratch file.
+// Long text is split into segments that are synthesized one by one and joined
+// into a single WAV. For a dialogue it also returns the timing of every line.
+func (handler *TTShHandler) runTask(ctx context.Context, in *instance, t *task) (string, *Manifest, error) {
+	if err := in.acquire(ctx); err != nil {
+		return "", nil, err
 	}
-	if len(arr) != 2 {
-		return errors.New("bad values")
+	defer in.release()
+
+	logger.Infof(ctx, "now handling task %v on %s", t.Content, in.backend.Name())
+
+	steps := handler.steps(t)
+	if speechSteps(steps) == 0 {
+		return "", nil, backend.Permanent(errors.New("empty text"))
 	}
-	data, ok := arr[1].([]byte)
-	if !ok {
-		return errors.New("bad values")
+	file, err := handler.scratchFile(t)
+	if err != nil {
+		return "", nil, err
 	}
-	t := &task{}
-	if err := json.Unmarshal(data, t); err != nil {
-		return err
+	filePath := file.Name()
+	defer file.Close()
+	spans, duration, err := handler.synthesizeSegments(ctx, in, t, steps, file)
+	if err != nil {
+		// 不留下不完整的结果
+		os.Remove(filePath)
+		return "", nil, err
 	}
+	logger.Infof(ctx, " handling task %v finished", t.Content)
+	return filePath, dialogueManifest(t, steps, spans, duration), nil
+}
 
-	logger.Infof(ctx, "now handling task %v", t.Content)
+// span is where the audio of one step landed in the joined output.
+type span struct {
+	start, end time.Duration
+}
 
-	if t.Model.Name != handler.currentModel {
-		err := handler.setModels(t.Model)
+// synthesizeSegments synthesizes the steps of t and joins them into w in
+// order, returning where each step landed and the total length. Steps read
+// by more than one model are synthesized grouped by model, the one loaded on
+// in first, so that every model is switched to once; their audio waits in
+// scratch files until all of them are done.
+func (handler *TTShHandler) synthesizeSegments(ctx context.Context, in *instance, t *task, steps []step, w io.WriteSeeker) ([]span, time.Duration, error) {
+	total := speechSteps(steps)
+	if err := reportProgress(ctx, t.Id, 0, total); err != nil {
+		return nil, 0, err
+	}
+	var parts []string
+	if order := groupSteps(steps, in.loadedModel()); order != nil {
+		dir, err := os.MkdirTemp(handler.scratchPath, t.Id+"-parts-")
 		if err != nil {
-			return err
+			return nil, 0, err
+		}
+		defer os.RemoveAll(dir)
+		parts = make([]string, len(steps))
+		for done, i := range order {
+			wav, err := handler.synthesizeStep(ctx, in, t, steps[i])
+			if err != nil {
+				return nil, 0, errors.Wrapf(err, "segment %d/%d", done+1, total)
+			}
+			parts[i] = filepath.Join(dir, strconv.Itoa(i)+".wav")
+			if err := os.WriteFile(parts[i], wav, 0o644); err != nil {
+				return nil, 0, err
+			}
+			if err := reportProgress(ctx, t.Id, done+1, total); err != nil {
+				return nil, 0, err
+			}
 		}
-		handler.currentModel = t.Model.Name
-	}
-
-	reqBody, err := json.Marshal(map[string]interface{}{
-		"text":                t.Content,
-		"text_lang":           t.Lang,
-		"ref_audio_path":      t.Model.ReferenceAudioPath,
-		"aux_ref_audio_paths": []string{},
-		"prompt_text":         t.Model.ReferText,
-		"prompt_lang":         t.Model.ReferLang,
-		"top_k":               5,
-		"top_p":               1,
-		"temperature":         1,
-		"text_split_method":   "cut0",
-		"batch_size":          1,
-		"batch_threshold":     0.75,
-		"split_bucket":        true,
-		"return_fragment":     false,
-		"speed_factor":        1.0,
-		"streaming_mode":      false,
-		"seed":                -1,
-		"parallel_infer":      true,
-		"repetition_penalty":  1.35,
-	})
-	if err != nil {
-		return err
 	}
-	request, err := http.NewRequest(http.MethodPost, fmt.Sprintf("%s/tts", handler.ttsAddr), bytes.NewBuffer(reqBody))
-	if err != nil {
-		return err
+
+	joiner := audio.NewJoiner(w, handler.segment.silence)
+	spans := make([]span, len(steps))
+	done := 0
+	for i, s := range steps {
+		if s.pause != nil {
+			joiner.Silence(*s.pause)
+			continue
+		}
+		done++
+		var wav []byte
+		var err error
+		if parts != nil {
+			wav, err = os.ReadFile(parts[i])
+		} else {
+			wav, err = handler.synthesizeStep(ctx, in, t, s)
+		}
+		if err == nil && done > 1 {
+			// 不同模型的采样率可能不同，统一成第一段的格式
+			wav, err = audio.Conform(wav, joiner.Format())
+		}
+		if err == nil {
+			err = joiner.Append(bytes.NewReader(wav))
+		}
+		if err != nil {
+			return nil, 0, errors.Wrapf(err, "segment %d/%d", done, total)
+		}
+		spans[i].start, spans[i].end = joiner.Last()
+		if parts == nil {
+			if err := reportProgress(ctx, t.Id, done, total); err != nil {
+				return nil, 0, err
+			}
+		}
 	}
-	request.Header.Set("Content-Type", "application/json")
-	resp, err := (&http.Client{Timeout: 300 * time.Second}).Do(request)
-	if err != nil {
-		return err
+	if err := joiner.Close(); err != nil {
+		return nil, 0, err
 	}
-	defer resp.Body.Close()
-	if resp.StatusCode != http.StatusOK {
-		resBody, _ := io.ReadAll(resp.Body)
-		logger.Errorf(ctx, "response status code %d body %s", resp.StatusCode, string(resBody))
-		return errors.New("bad status code " + resp.Status)
+	return spans, joiner.Duration(), nil
+}
+
+// synthesizeStep synthesizes one step on in, switching to its model first.
+func (handler *TTShHandler) synthesizeStep(ctx context.Context, in *instance, t *task, s step) ([]byte, error) {
+	if err := handler.pool.switchModel(ctx, in, s.model); err != nil {
+		return nil, err
+	}
+	req := t.request()
+	req.Text = s.text
+	req.Lang = segmentLang(t, s)
+	req.RefAudioPath, req.PromptText, req.PromptLang = s.model.ReferenceAudioPath, s.model.ReferText, s.model.ReferLang
+	req.AuxRefAudioPaths = s.model.AuxRefAudioPaths
+	req.Params = s.params.backendParams()
+	return in.backend.Synthesize(ctx, req)
+}
+
+// adoptLegacyTask stores a record for a task that was queued as raw JSON.
+func (handler *TTShHandler) adoptLegacyTask(ctx context.Context, data []byte) (string, error) {
+	t := task{}
+	if err := json.Unmarshal(data, &t); err != nil {
+		return "", err
 	}
-	if respBody, err := io.ReadAll(resp.Body); err == nil {
-		filePath := fmt.Sprintf("%s/%d-%s.wav", handler.outputAudioPath, time.Now().Unix(), t.Model.Name)
-		file, err := os.Create(filePath)
+	if t.Params == nil {
+		params, err := resolveInferParams(t.Model.Params, nil)
 		if err != nil {
-			return err
+			return "", err
 		}
-		defer file.Close()
-		if _, err := file.Write(respBody); err != nil {
-			return err
-		}
-		rds.SetString(ctx, t.Id, filePath)
-	} else {
-		return err
+		t.Params = params
 	}
-	logger.Infof(ctx, " handling task %v finished", t.Content)
-	return nil
+	now := nowMilli()
+	info := &taskInfo{task: t, State: stateQueued, CreatedAt: now, UpdatedAt: now}
+	if err := rds.SetStruct(ctx, taskKey(t.Id), info); err != nil {
+		return "", err
+	}
+	return t.Id, nil
 }
 
 type pair struct {
-	Name               string `json:"name"`
-	GptPath            string `json:"gptPath"`
-	SovitsPath         string `json:"sovitsPath"`
-	ReferenceAudioPath string `json:"referenceAudioPath"`
-	ReferText          string `json:"referText"`
-	ReferLang          string `json:"referLang"`
+	Name               string       `json:"name"`
+	GptPath            string       `json:"gptPath"`
+	SovitsPath         string       `json:"sovitsPath"`
+	ReferenceAudioPath string       `json:"referenceAudioPath"`
+	ReferText          string       `json:"referText"`
+	ReferLang          string       `json:"referLang"`
+	Params             *InferParams `json:"params,omitempty"`
+	PostProcess        *PostProcess `json:"postProcess,omitempty"`
+
+	Reference        string      `json:"reference,omitempty"`        // ReferenceAudioPath 对应的参考音频名称
+	References       []reference `json:"references,omitempty"`       // 可以通过 params.reference 选择的参考音频
+	AuxRefAudioPaths []string    `json:"auxRefAudioPaths,omitempty"` // 辅助参考音频
+	DisplayName      string      `json:"displayName,omitempty"`
+	Tags             []string    `json:"tags,omitempty"`
+	Manifest         string      `json:"manifest,omitempty"` // 模型清单文件，按文件名约定加载时为空
+	Disabled         bool        `json:"disabled,omitempty"`
 }
 
 type ModelResp struct {
 	Models map[string]pair `json:"models"`
+	Report *ModelReport    `json:"report,omitempty"` // 仅 loadModels 返回
 }
 
 func (handler *TTShHandler) GetModels(ctx context.Context, req *struct{}) (*ModelResp, error) {
-	return &ModelResp{Models: handler.weightPairs}, nil
+	return &ModelResp{Models: handler.models()}, nil
 }
 
 func (handler *TTShHandler) LoadModels(ctx context.Context, req *struct{}) (*ModelResp, error) {
-	handler.loadModels()
-	return &ModelResp{Models: handler.weightPairs}, nil
+	report := handler.loadModels(reloadAPI)
+	return &ModelResp{Models: handler.models(), Report: report}, nil
+}
+
+// TextReq is the text of a synthesis request.
+type TextReq struct {
+	Text string `json:"text"`
+	SSML string `json:"ssml"` // 可选，代替 text 的 SSML 文档
+	Lang string `json:"lang"` // 可选，GPT-SoVITS 的 text_lang，为空时自动识别
+	Raw  bool   `json:"raw"`  // 可选，不做文本规范化，原样送给后端
 }
 
 type NewTaskReq struct {
 	Model string `json:"model"`
-	Text  string `json:"text"`
+	TextReq
+	Params   *InferParams  `json:"params"`
+	Format   *audio.Target `json:"format"`      // 可选，结果的输出格式
+	Post     *PostProcess  `json:"postProcess"` // 可选，覆盖模型配置的后处理
+	Callback string        `json:"callbackUrl"` // 可选，任务结束后 POST 结果到该地址
+	NoCache  bool          `json:"noCache"`     // 不使用也不写入结果缓存
 }
 
 type NewTaskResp struct {
-	Id string `json:"id"`
+	Id         string       `json:"id"`
+	Params     *InferParams `json:"params"`
+	Cached     bool         `json:"cached,omitempty"`     // 结果已取自缓存，任务已完成
+	AttachedTo string       `json:"attachedTo,omitempty"` // 等待该相同任务的结果，不会重复合成
 }
 
 func (handler *TTShHandler) NewTask(ctx context.Context, req *NewTaskReq) (rsp *NewTaskResp, err error) {
-	content := req.Text
-	hasEn, hasJa := false, false
-	for _, c := range content {
-		if unicode.Is(unicode.Hiragana, c) || unicode.Is(unicode.Katakana, c) {
-			hasJa = true
+	key := caller(ctx)
+	t, err := handler.newTask(key, req.Model, req.TextReq, req.Params)
+	if err != nil {
+		return nil, err
+	}
+	if err := handler.setOutput(ctx, key, t, req.Format, req.Post, req.Callback); err != nil {
+		return nil, err
+	}
+	if !req.NoCache {
+		handler.setCacheKey(ctx, t)
+	}
+	if t.CacheKey != "" {
+		conn := rds.Get()
+		cmds, hit, err := cachedTaskCommands(ctx, conn, t)
+		conn.Close()
+		if err == nil && hit {
+			err = execCommands(cmds)
 		}
-		if unicode.IsLetter(c) {
-			hasEn = true
+		if err != nil {
+			return nil, &status.Status{Code: 500, Message: err.Error()}
 		}
-		if hasEn && hasJa {
-			break
+		if hit {
+			return &NewTaskResp{Id: t.Id, Params: t.Params, Cached: true}, nil
 		}
+		leader, err := enqueueOrAttach(ctx, t)
+		if err != nil {
+			return nil, &status.Status{Code: 500, Message: err.Error()}
+		}
+		return &NewTaskResp{Id: t.Id, Params: t.Params, AttachedTo: leader}, nil
 	}
+	if err := enqueueTask(ctx, t); err != nil {
+		return nil, &status.Status{
+			Code:    500,
+			Message: err.Error(),
+		}
+	}
+	return &NewTaskResp{
+		Id:     t.Id,
+		Params: t.Params,
+	}, nil
+}
+
+// setCacheKey computes the cache key of t. Tasks whose key cannot be computed
+// run uncached.
+func (handler *TTShHandler) setCacheKey(ctx context.Context, t *task) {
+	key, err := handler.cacheKey(t)
+	if err != nil {
+		logger.Warnf(ctx, "cache key of task %s: %s", t.Id, err)
+		return
+	}
+	t.CacheKey = key
+}
+
+// enqueueTask stores the queued record and pushes the task ID in one transaction.
+func enqueueTask(ctx context.Context, t *task) error {
+	cmds, err := newTaskCommands(t, nowMilli())
+	if err != nil {
+		return err
+	}
+	return execCommands(cmds)
+}
 
-	id := uuid.New().String()
-	model, ok := handler.weightPairs[req.Model]
+// newTaskCommands returns the commands that store t as queued and enqueue it.
+func newTaskCommands(t *task, now int64) ([]command, error) {
+	js, err := json.Marshal(taskInfo{task: *t, State: stateQueued, CreatedAt: now, UpdatedAt: now})
+	if err != nil {
+		return nil, err
+	}
+	cmds := append([]command{cmd("SET", taskKey(t.Id), js)}, enqueueCommands(t.Model.Name, t.Id, now)...)
+	return append(cmds, missCommands(t)...), nil
+}
+
+// newTask validates the request fields and builds a task of key ready for
+// synthesis. The text, or the plan of an SSML document, is normalised with
+// the rules of key unless in.Raw, and its language detected when in.Lang is
+// empty.
+func (handler *TTShHandler) newTask(key *config.APIKey, modelName string, in TextReq, reqParams *InferParams) (*task, error) {
+	model, ok := handler.models()[modelName]
 	if !ok {
 		return nil, &status.Status{
 			Code:    400,
 			Message: "model not found",
 		}
 	}
-	js, err := json.Marshal(task{
-		Id:      id,
-		Model:   model,
-		Content: content,
-		Lang: func() string {
-			if hasEn && !hasJa {
-				return "zh" // 中英混合
-			}
-			if !hasEn && hasJa {
-				return "all_ja" // 全日文
-			}
-			if hasEn && hasJa {
-				return "auto" // 自动识别
-			}
-			return "all_zh" // 全中文
-		}(),
-	})
+	params, err := resolveInferParams(model.Params, reqParams)
 	if err != nil {
 		return nil, &status.Status{
-			Code:    500,
+			Code:    400,
 			Message: err.Error(),
 		}
 	}
-	conn := rds.Get()
-	_, err = conn.Do("LPUSH", taskList, js)
+	if model, err = selectReference(model, params); err != nil {
+		return nil, &status.Status{Code: 400, Message: err.Error()}
+	}
+	if in.Lang != "" && !textLangs[in.Lang] {
+		return nil, &status.Status{Code: 400, Message: fmt.Sprintf("unknown lang %q", in.Lang)}
+	}
+	content, original := in.Text, in.Text
+	var plan []planItem
+	if in.SSML != "" {
+		if in.Text != "" {
+			return nil, &status.Status{Code: 400, Message: "text and ssml are mutually exclusive"}
+		}
+		if plan, err = handler.planSSML(key.Name, in, model, params, reqParams); err != nil {
+			return nil, err
+		}
+		content, original = planText(plan), in.SSML
+	} else if !in.Raw {
+		content, _ = handler.normalize(key.Name, in.Text, in.Lang)
+	}
+	textLang, detection, err := resolveLang(content, in.Lang)
 	if err != nil {
-		return nil, &status.Status{
-			Code:    500,
-			Message: err.Error(),
+		return nil, err
+	}
+	t := &task{
+		Id:           uuid.New().String(),
+		Model:        model,
+		Params:       params,
+		SeedAuto:     seedAuto(model.Params, reqParams),
+		Content:      content,
+		Lang:         textLang,
+		LangExplicit: in.Lang != "",
+		Language:     detection,
+		Owner:        key.Name,
+		Plan:         plan,
+	}
+	if content != original {
+		t.Original = original
+	}
+	return t, nil
+}
+
+// setOutput validates what happens to the result of t: its output format,
+// the post-processing layered on the model's and the callback notified, if
+// any, and sets them on t.
+func (handler *TTShHandler) setOutput(ctx context.Context, key *config.APIKey, t *task, format *audio.Target, post *PostProcess, callback string) error {
+	if err := checkFormat(format); err != nil {
+		return &status.Status{Code: 400, Message: err.Error()}
+	}
+	t.Format = format
+	var err error
+	if t.PostProcess, err = resolvePostProcess(t.Model.PostProcess, post); err != nil {
+		return &status.Status{Code: 400, Message: err.Error()}
+	}
+	if callback != "" {
+		if err := handler.checkCallback(ctx, key, callback); err != nil {
+			return &status.Status{Code: 400, Message: err.Error()}
 		}
+		t.Callback = callback
 	}
-	return &NewTaskResp{
-		Id: id,
-	}, nil
+	return nil
 }
 
 type TaskStatusReq struct {
@@ -370,40 +654,127 @@ type TaskStatusReq struct {
 }
 
 type TaskStatusResp struct {
-	Status string `json:"status"`
+	Id            string          `json:"id"`
+	State         taskState       `json:"state"`
+	Model         string          `json:"model"`
+	Lang          string          `json:"lang"`
+	Batch         string          `json:"batch,omitempty"`
+	Ref           string          `json:"ref,omitempty"`
+	Error         string          `json:"error,omitempty"`
+	Position      int             `json:"position,omitempty"`
+	Attempts      int             `json:"attempts"`
+	NextAttemptAt int64           `json:"nextAttemptAt,omitempty"`
+	DeadLettered  bool            `json:"deadLettered,omitempty"`
+	Segments      int             `json:"segments,omitempty"`
+	SegmentsDone  int             `json:"segmentsDone,omitempty"`
+	Loudness      *Loudness       `json:"loudness,omitempty"`
+	Language      *text.Detection `json:"language,omitempty"`
+	Cached        bool            `json:"cached,omitempty"`
+	AttachedTo    string          `json:"attachedTo,omitempty"`
+	CreatedAt     int64           `json:"createdAt"`
+	StartedAt     int64           `json:"startedAt,omitempty"`
+	FinishedAt    int64           `json:"finishedAt,omitempty"`
+	UpdatedAt     int64           `json:"updatedAt"`
 }
 
 func (handler *TTShHandler) TaskStatus(ctx context.Context, req *TaskStatusReq) (*TaskStatusResp, error) {
-	_, err := rds.GetString(ctx, req.Id)
+	info, err := handler.ownedTaskInfo(ctx, req.Id)
 	if err != nil {
-		return nil, &status.Status{
-			Code:    500,
-			Message: "not finished",
+		return nil, err
+	}
+	rsp := &TaskStatusResp{
+		Id:            info.Id,
+		State:         info.State,
+		Model:         info.Model.Name,
+		Lang:          info.Lang,
+		Batch:         info.Batch,
+		Ref:           info.Ref,
+		Error:         info.Error,
+		Attempts:      info.Attempts,
+		NextAttemptAt: info.NextAttemptAt,
+		DeadLettered:  info.DeadLettered,
+		Segments:      info.Segments,
+		SegmentsDone:  info.SegmentsDone,
+		Loudness:      info.Loudness,
+		Language:      info.Language,
+		Cached:        info.Cached,
+		AttachedTo:    info.Leader,
+		CreatedAt:     info.CreatedAt,
+		StartedAt:     info.StartedAt,
+		FinishedAt:    info.FinishedAt,
+		UpdatedAt:     info.UpdatedAt,
+	}
+	if info.State == stateQueued && info.NextAttemptAt == 0 {
+		conn := rds.Get()
+		defer conn.Close()
+		rsp.Position = queuePosition(conn, info.Model.Name, info.Id)
+	}
+	return rsp, nil
+}
+
+// loadTaskInfo loads the record for id as an API error-aware lookup. A
+// succeeded task whose file has disappeared is moved to expired.
+func (handler *TTShHandler) loadTaskInfo(ctx context.Context, id string) (*taskInfo, error) {
+	if _, err := uuid.Parse(id); err != nil {
+		return nil, &status.Status{Code: http.StatusBadRequest, Message: "invalid task id"}
+	}
+	info, err := getTask(ctx, id)
+	if err != nil {
+		if errors.Is(err, errTaskNotFound) {
+			return nil, &status.Status{Code: http.StatusNotFound, Message: "task not found"}
+		}
+		return nil, &status.Status{Code: http.StatusInternalServerError, Message: err.Error()}
+	}
+	if info.State == stateSucceeded {
+		if _, err := statResult(ctx, info.File); errors.Is(err, blob.ErrNotFound) {
+			if expired, err := transition(ctx, id, stateExpired, []taskState{stateSucceeded}, nil); err == nil {
+				info = expired
+			}
 		}
 	}
-	return nil, &status.Status{Code: 200, Message: "finished"}
+	return info, nil
+}
+
+// ownedTaskInfo is loadTaskInfo for the tasks of the caller. Tasks submitted
+// with other keys are reported as not found.
+func (handler *TTShHandler) ownedTaskInfo(ctx context.Context, id string) (*taskInfo, error) {
+	info, err := handler.loadTaskInfo(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if !owns(caller(ctx), info.Owner) {
+		return nil, &status.Status{Code: http.StatusNotFound, Message: "task not found"}
+	}
+	return info, nil
 }
 
 func (handler *TTShHandler) GetResult(ctx *gin.Context) {
 	id := ctx.Query("id")
-	file, err := rds.GetString(ctx, id)
+	info, err := handler.ownedTaskInfo(ctx, id)
 	if err != nil {
-		ctx.JSON(500,
+		ctx.JSON(status.GetCode(err),
 			gin.H{
-				"code":    500,
-				"message": "wrong id",
+				"code":    status.GetCode(err),
+				"message": err.Error(),
 			})
 		return
 	}
-	_, err = os.Stat(file)
-	if err != nil {
-		ctx.JSON(500,
+	if info.State != stateSucceeded {
+		ctx.JSON(http.StatusConflict,
 			gin.H{
-				"code":    500,
-				"message": "open file error",
+				"code":    http.StatusConflict,
+				"message": "task is " + string(info.State),
 			})
 		return
 	}
-	ctx.File(file)
-	return
+	handler.serveResult(ctx, info)
+}
+
+// removeResult deletes local scratch files.
+func removeResult(files ...string) {
+	for _, file := range files {
+		if file != "" {
+			os.Remove(file)
+		}
+	}
 }
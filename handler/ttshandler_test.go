@@ -0,0 +1,201 @@
+package handler
+
+import (
+	"errors"
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+	"ttsapi/audio"
+	"ttsapi/backend"
+	"ttsapi/backend/fake"
+	"ttsapi/config"
+)
+
+func TestTaskSucceeds(t *testing.T) {
+	env := newTestEnv(t, nil)
+	id := env.submit(testModel, "你好，世界。")
+
+	info := env.task(id)
+	if info.State != stateQueued || info.Owner != defaultKeyName {
+		t.Fatalf("submitted task is %s of %q", info.State, info.Owner)
+	}
+	if queued := env.zset(modelQueue(testModel)); len(queued) != 1 || queued[0] != id {
+		t.Fatalf("model queue = %v", queued)
+	}
+
+	in, leased := env.lease()
+	if leased != id {
+		t.Fatalf("leased %s, want %s", leased, id)
+	}
+	if processing := env.list(processingList("test-worker")); len(processing) != 1 || processing[0] != id {
+		t.Fatalf("processing list = %v", processing)
+	}
+	if err := env.handler.execute(env.ctx, in, id); err != nil {
+		t.Fatal(err)
+	}
+	env.handler.pool.done(in)
+
+	info = env.task(id)
+	if info.State != stateSucceeded || info.Attempts != 1 || info.File == "" {
+		t.Fatalf("task is %s after %d attempts, file %q", info.State, info.Attempts, info.File)
+	}
+	if processing := env.list(processingList("test-worker")); len(processing) != 0 {
+		t.Fatalf("processing list not released: %v", processing)
+	}
+	if inflight := env.zset(inflightSet); len(inflight) != 0 {
+		t.Fatalf("inflight set not released: %v", inflight)
+	}
+
+	w := httptest.NewRecorder()
+	ctx, _ := gin.CreateTestContext(w)
+	ctx.Request = httptest.NewRequest(http.MethodGet, "/getResult?id="+id, nil)
+	env.handler.GetResult(ctx)
+	if w.Code != http.StatusOK {
+		t.Fatalf("getResult: %d %s", w.Code, w.Body)
+	}
+	format, _, err := audio.ReadHeader(w.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if format != fake.Format {
+		t.Fatalf("result format = %+v", format)
+	}
+}
+
+func TestTaskRetriesThenDeadLetters(t *testing.T) {
+	env := newTestEnv(t, nil)
+	env.backend.fail(errors.New("engine unavailable"))
+	id := env.submit(testModel, "你好。")
+
+	if _, err := env.run(); err == nil {
+		t.Fatal("execute reported no error")
+	}
+	info := env.task(id)
+	if info.State != stateQueued || info.Attempts != 1 || info.NextAttemptAt == 0 || info.Error == "" {
+		t.Fatalf("after the first failure: %s, %d attempts, next %d, error %q", info.State, info.Attempts, info.NextAttemptAt, info.Error)
+	}
+	if delayed := env.zset(delayedList); len(delayed) != 1 || delayed[0] != id {
+		t.Fatalf("delayed = %v", delayed)
+	}
+
+	time.Sleep(5 * time.Millisecond)
+	if err := promoteDelayed(env.ctx); err != nil {
+		t.Fatal(err)
+	}
+	if queued := env.zset(modelQueue(testModel)); len(queued) != 1 {
+		t.Fatalf("not requeued after the backoff: %v", queued)
+	}
+	if _, err := env.run(); err == nil {
+		t.Fatal("execute reported no error")
+	}
+	info = env.task(id)
+	if info.State != stateFailed || !info.DeadLettered || info.Attempts != 2 {
+		t.Fatalf("after the last attempt: %s, dead-lettered %v, %d attempts", info.State, info.DeadLettered, info.Attempts)
+	}
+	if dead := env.list(deadLetterList); len(dead) != 1 || dead[0] != id {
+		t.Fatalf("dead letters = %v", dead)
+	}
+
+	// 修复后人工重新入队
+	env.backend.fail(nil)
+	rsp, err := env.handler.RequeueDeadLetters(env.ctx, &DeadLetterOpReq{Ids: []string{id}})
+	if err != nil || len(rsp.Ids) != 1 {
+		t.Fatalf("requeue: %v %v", rsp, err)
+	}
+	if _, err := env.run(); err != nil {
+		t.Fatal(err)
+	}
+	if info = env.task(id); info.State != stateSucceeded || info.DeadLettered {
+		t.Fatalf("requeued task is %s, dead-lettered %v", info.State, info.DeadLettered)
+	}
+	if dead := env.list(deadLetterList); len(dead) != 0 {
+		t.Fatalf("dead letters = %v", dead)
+	}
+}
+
+func TestPermanentErrorSkipsRetries(t *testing.T) {
+	env := newTestEnv(t, nil)
+	env.backend.fail(backend.Permanent(errors.New("bad request")))
+	id := env.submit(testModel, "你好。")
+	env.run()
+	if info := env.task(id); info.State != stateFailed || !info.DeadLettered || info.Attempts != 1 {
+		t.Fatalf("task is %s, dead-lettered %v, %d attempts", info.State, info.DeadLettered, info.Attempts)
+	}
+}
+
+func TestLeaseRecovery(t *testing.T) {
+	env := newTestEnv(t, nil)
+
+	// 取出但未开始执行的任务放回队首
+	id := env.submit(testModel, "你好。")
+	env.lease()
+	env.handler.recoverWorker(env.ctx, "test-worker")
+	if info := env.task(id); info.State != stateQueued || info.Attempts != 0 {
+		t.Fatalf("unstarted task is %s after %d attempts", info.State, info.Attempts)
+	}
+	if queued := env.zset(modelQueue(testModel)); len(queued) != 1 || queued[0] != id {
+		t.Fatalf("model queue = %v", queued)
+	}
+
+	// 执行中的任务记一次失败
+	_, leased := env.lease()
+	if _, err := transition(env.ctx, leased, stateRunning, []taskState{stateQueued}, nil, cmd("ZADD", inflightSet, nowMilli()-1, leased)); err != nil {
+		t.Fatal(err)
+	}
+	if err := env.handler.recoverOrphans(env.ctx); err != nil {
+		t.Fatal(err)
+	}
+	info := env.task(id)
+	if info.State != stateQueued || info.Attempts != 1 || info.Error == "" {
+		t.Fatalf("timed out task is %s after %d attempts: %q", info.State, info.Attempts, info.Error)
+	}
+	if inflight := env.zset(inflightSet); len(inflight) != 0 {
+		t.Fatalf("inflight set = %v", inflight)
+	}
+}
+
+func TestLongTextIsSegmented(t *testing.T) {
+	env := newTestEnv(t, func(cfg *config.Config) {
+		cfg.Audio.MaxSegmentLength = 4
+		cfg.Audio.SegmentSilence = 100 * time.Millisecond
+	})
+	id := env.submit(testModel, "你好。世界好。再见。")
+	if _, err := env.run(); err != nil {
+		t.Fatal(err)
+	}
+	info := env.task(id)
+	if info.State != stateSucceeded || info.Segments != 3 || info.SegmentsDone != 3 {
+		t.Fatalf("task is %s with %d/%d segments", info.State, info.SegmentsDone, info.Segments)
+	}
+	// 三段共 10 个字符，段间两次静音
+	audioInfo, err := readAudioInfo(env.ctx, resultFile(info))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if audioInfo.DurationMs != 10*80+2*100 {
+		t.Fatalf("joined result is %dms", audioInfo.DurationMs)
+	}
+}
+
+func TestSSMLLangIsSentAsTextLang(t *testing.T) {
+	env := newTestEnv(t, nil)
+	ssml := `<speak>你好。<s xml:lang="ja">東京都</s><s xml:lang="yue">你好</s><s xml:lang="ja">東京 Tower</s></speak>`
+	rsp, err := env.handler.NewTask(env.ctx, &NewTaskReq{Model: testModel, TextReq: TextReq{SSML: ssml}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := env.run(); err != nil {
+		t.Fatal(err)
+	}
+	if info := env.task(rsp.Id); info.State != stateSucceeded {
+		t.Fatalf("task is %s", info.State)
+	}
+	// 只有汉字的日文和粤语按 xml:lang 读，不再被识别成中文
+	want := []string{"all_zh", "all_ja", "all_yue", "ja"}
+	if !reflect.DeepEqual(env.backend.langs, want) {
+		t.Fatalf("text_lang = %q, want %q", env.backend.langs, want)
+	}
+}
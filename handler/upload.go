@@ -0,0 +1,389 @@
+package handler
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/pkg/errors"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"sync"
+	"time"
+	"ttsapi/logger"
+	"ttsapi/server/httpserver/middles"
+	"ttsapi/server/httpserver/middles/status"
+)
+
+const (
+	uploadsDir      = ".uploads" // models_path 下保存未完成上传的目录
+	maxUploadSize   = 64 << 30
+	uploadRetention = 24 * time.Hour // 超过该时间没有写入的上传会被清理
+)
+
+var sha256Pattern = regexp.MustCompile(`^[0-9a-f]{64}$`)
+
+// upload 一次可续传的上传。数据写在 <id>.part，状态在 <id>.json，
+// Hash 是已写入数据的 SHA-256 中间状态，续传时不必重新读一遍文件。
+type upload struct {
+	Id        string `json:"id"`
+	Filename  string `json:"filename"`
+	Size      int64  `json:"size"`
+	Sha256    string `json:"sha256"`
+	Offset    int64  `json:"offset"`
+	Hash      []byte `json:"hash,omitempty"`
+	Complete  bool   `json:"complete"`
+	CreatedAt int64  `json:"createdAt"`
+	UpdatedAt int64  `json:"updatedAt"`
+}
+
+// uploads 上传的存储，同一上传同时只允许一个写入
+type uploads struct {
+	mu   sync.Mutex
+	busy map[string]bool
+}
+
+// claim marks id as being written, or reports that another request is.
+func (u *uploads) claim(id string) bool {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.busy == nil {
+		u.busy = make(map[string]bool)
+	}
+	if u.busy[id] {
+		return false
+	}
+	u.busy[id] = true
+	return true
+}
+
+func (u *uploads) release(id string) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	delete(u.busy, id)
+}
+
+func (handler *TTShHandler) uploadDir() string {
+	return filepath.Join(handler.modelsPath, uploadsDir)
+}
+
+func (handler *TTShHandler) uploadPart(id string) string {
+	return filepath.Join(handler.uploadDir(), id+".part")
+}
+
+// loadUpload reads the state of upload id.
+func (handler *TTShHandler) loadUpload(id string) (*upload, error) {
+	if _, err := uuid.Parse(id); err != nil {
+		return nil, &status.Status{Code: http.StatusNotFound, Message: "upload not found"}
+	}
+	data, err := os.ReadFile(filepath.Join(handler.uploadDir(), id+".json"))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, &status.Status{Code: http.StatusNotFound, Message: "upload not found"}
+	}
+	if err != nil {
+		return nil, err
+	}
+	u := &upload{}
+	if err := json.Unmarshal(data, u); err != nil {
+		return nil, err
+	}
+	return u, nil
+}
+
+// saveUpload replaces the state of u, atomically so that a crash leaves
+// either the old or the new one.
+func (handler *TTShHandler) saveUpload(u *upload) error {
+	u.UpdatedAt = nowMilli()
+	data, err := json.Marshal(u)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(filepath.Join(handler.uploadDir(), u.Id+".json"), data)
+}
+
+// removeUpload deletes the data and the state of upload id.
+func (handler *TTShHandler) removeUpload(id string) {
+	os.Remove(handler.uploadPart(id))
+	os.Remove(filepath.Join(handler.uploadDir(), id+".json"))
+}
+
+// purgeUploads removes uploads nobody wrote to for uploadRetention.
+func (handler *TTShHandler) purgeUploads(ctx context.Context) {
+	entries, err := os.ReadDir(handler.uploadDir())
+	if err != nil {
+		return
+	}
+	deadline := time.Now().Add(-uploadRetention).UnixMilli()
+	for _, entry := range entries {
+		if filepath.Ext(entry.Name()) != ".json" {
+			continue
+		}
+		id := entry.Name()[:len(entry.Name())-len(".json")]
+		u, err := handler.loadUpload(id)
+		if err != nil || u.UpdatedAt >= deadline || !handler.uploads.claim(id) {
+			continue
+		}
+		handler.removeUpload(id)
+		handler.uploads.release(id)
+		logger.Infof(ctx, "removed stale upload %s (%s)", id, u.Filename)
+	}
+}
+
+// writeFileAtomic writes data to a temporary file next to file and renames it
+// over file.
+func writeFileAtomic(file string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(file), "."+filepath.Base(file)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), file)
+}
+
+// checkModelsPath rejects management requests when there is no models
+// directory to keep the files in.
+func (handler *TTShHandler) checkModelsPath() error {
+	if handler.modelsPath == "" {
+		return &status.Status{Code: http.StatusNotImplemented, Message: "server.models_path is not configured"}
+	}
+	return nil
+}
+
+type CreateUploadReq struct {
+	Filename string `json:"filename"` // 保存到模型目录时使用的文件名，如 alice-e15.ckpt
+	Size     int64  `json:"size"`
+	Sha256   string `json:"sha256"` // 整个文件的 SHA-256，十六进制小写
+}
+
+type UploadResp struct {
+	Id        string `json:"id"`
+	Filename  string `json:"filename"`
+	Size      int64  `json:"size"`
+	Sha256    string `json:"sha256"`
+	Offset    int64  `json:"offset"`   // 已收到的字节数，续传从这里开始
+	Complete  bool   `json:"complete"` // 已收齐并通过校验，可以用于创建模型
+	CreatedAt int64  `json:"createdAt"`
+	UpdatedAt int64  `json:"updatedAt"`
+}
+
+func newUploadResp(u *upload) *UploadResp {
+	return &UploadResp{
+		Id:        u.Id,
+		Filename:  u.Filename,
+		Size:      u.Size,
+		Sha256:    u.Sha256,
+		Offset:    u.Offset,
+		Complete:  u.Complete,
+		CreatedAt: u.CreatedAt,
+		UpdatedAt: u.UpdatedAt,
+	}
+}
+
+// CreateUpload starts a resumable upload of one file. The data is sent with
+// UploadData, in as many requests as needed.
+func (handler *TTShHandler) CreateUpload(ctx context.Context, req *CreateUploadReq) (*UploadResp, error) {
+	if err := handler.checkModelsPath(); err != nil {
+		return nil, err
+	}
+	name := filepath.Base(req.Filename)
+	if req.Filename == "" || name != req.Filename || name == "." || name == ".." || name[0] == '.' {
+		return nil, &status.Status{Code: 400, Message: "filename must be a plain file name"}
+	}
+	if req.Size <= 0 || req.Size > maxUploadSize {
+		return nil, &status.Status{Code: 400, Message: fmt.Sprintf("size must be in [1, %d]", int64(maxUploadSize))}
+	}
+	if !sha256Pattern.MatchString(req.Sha256) {
+		return nil, &status.Status{Code: 400, Message: "sha256 must be 64 lowercase hex digits"}
+	}
+	handler.purgeUploads(ctx)
+	if err := os.MkdirAll(handler.uploadDir(), 0o755); err != nil {
+		return nil, &status.Status{Code: 500, Message: err.Error()}
+	}
+	now := nowMilli()
+	u := &upload{Id: uuid.New().String(), Filename: name, Size: req.Size, Sha256: req.Sha256, CreatedAt: now}
+	f, err := os.Create(handler.uploadPart(u.Id))
+	if err != nil {
+		return nil, &status.Status{Code: 500, Message: err.Error()}
+	}
+	f.Close()
+	if err := handler.saveUpload(u); err != nil {
+		handler.removeUpload(u.Id)
+		return nil, &status.Status{Code: 500, Message: err.Error()}
+	}
+	return newUploadResp(u), nil
+}
+
+type UploadReq struct {
+	Id string `json:"id" form:"id"`
+}
+
+// UploadStatus returns how much of an upload has arrived, for resuming it.
+func (handler *TTShHandler) UploadStatus(ctx context.Context, req *UploadReq) (*UploadResp, error) {
+	if err := handler.checkModelsPath(); err != nil {
+		return nil, err
+	}
+	u, err := handler.loadUpload(req.Id)
+	if err != nil {
+		return nil, err
+	}
+	return newUploadResp(u), nil
+}
+
+// AbortUpload deletes an upload and the data received so far.
+func (handler *TTShHandler) AbortUpload(ctx context.Context, req *UploadReq) (*UploadResp, error) {
+	if err := handler.checkModelsPath(); err != nil {
+		return nil, err
+	}
+	u, err := handler.loadUpload(req.Id)
+	if err != nil {
+		return nil, err
+	}
+	if !handler.uploads.claim(u.Id) {
+		return nil, &status.Status{Code: http.StatusConflict, Message: "upload is being written"}
+	}
+	defer handler.uploads.release(u.Id)
+	handler.removeUpload(u.Id)
+	return newUploadResp(u), nil
+}
+
+// UploadData appends the request body to an upload. The Upload-Offset header
+// must equal the offset the upload has reached; a request cut short keeps
+// what arrived, so the client asks UploadStatus for the offset and resumes
+// from there. The checksum is verified when the last byte arrives; on a
+// mismatch the upload is discarded.
+func (handler *TTShHandler) UploadData(ctx *gin.Context) {
+	fail := func(err error) {
+		ctx.JSON(status.GetCode(err), gin.H{"code": status.GetCode(err), "message": err.Error()})
+	}
+	if err := handler.checkModelsPath(); err != nil {
+		fail(err)
+		return
+	}
+	u, err := handler.loadUpload(ctx.Query("id"))
+	if err != nil {
+		fail(err)
+		return
+	}
+	offset, err := strconv.ParseInt(ctx.GetHeader("Upload-Offset"), 10, 64)
+	if err != nil {
+		fail(&status.Status{Code: 400, Message: "Upload-Offset header is required"})
+		return
+	}
+	if !handler.uploads.claim(u.Id) {
+		fail(&status.Status{Code: http.StatusConflict, Message: "upload is being written by another request"})
+		return
+	}
+	defer handler.uploads.release(u.Id)
+	// 取得写入权后重新读取，期间可能有别的请求写入过
+	if u, err = handler.loadUpload(u.Id); err != nil {
+		fail(err)
+		return
+	}
+	if u.Complete {
+		fail(&status.Status{Code: http.StatusConflict, Message: "upload is complete"})
+		return
+	}
+	if offset != u.Offset {
+		ctx.JSON(http.StatusConflict, gin.H{"code": http.StatusConflict, "message": fmt.Sprintf("upload is at offset %d", u.Offset), "offset": u.Offset})
+		return
+	}
+
+	n, err := handler.appendUpload(u, ctx.Request.Body)
+	if n > 0 {
+		u.Offset += n
+		if saveErr := handler.saveUpload(u); saveErr != nil && err == nil {
+			err = saveErr
+		}
+	}
+	if err != nil {
+		fail(err)
+		return
+	}
+	if u.Offset == u.Size {
+		if sum := hex.EncodeToString(u.sum()); sum != u.Sha256 {
+			handler.removeUpload(u.Id)
+			fail(&status.Status{Code: http.StatusUnprocessableEntity, Message: fmt.Sprintf("checksum mismatch: got %s, upload discarded", sum)})
+			return
+		}
+		u.Complete, u.Hash = true, nil
+		if err := handler.saveUpload(u); err != nil {
+			fail(&status.Status{Code: 500, Message: err.Error()})
+			return
+		}
+	}
+	ctx.JSON(http.StatusOK, middles.RespStruct{Code: 0, Data: newUploadResp(u)})
+}
+
+// appendUpload writes body at the offset of u and advances its hash state.
+// It returns the number of bytes kept, also when it fails part way.
+func (handler *TTShHandler) appendUpload(u *upload, body io.Reader) (int64, error) {
+	f, err := os.OpenFile(handler.uploadPart(u.Id), os.O_WRONLY, 0)
+	if err != nil {
+		return 0, &status.Status{Code: 500, Message: err.Error()}
+	}
+	defer f.Close()
+	// 上次写入后未及保存状态的数据作废
+	if err := f.Truncate(u.Offset); err != nil {
+		return 0, &status.Status{Code: 500, Message: err.Error()}
+	}
+	if _, err := f.Seek(u.Offset, io.SeekStart); err != nil {
+		return 0, &status.Status{Code: 500, Message: err.Error()}
+	}
+	h := sha256.New()
+	if len(u.Hash) > 0 {
+		if err := h.(encoding.BinaryUnmarshaler).UnmarshalBinary(u.Hash); err != nil {
+			return 0, &status.Status{Code: 500, Message: err.Error()}
+		}
+	}
+	remaining := u.Size - u.Offset
+	n, copyErr := io.Copy(io.MultiWriter(f, h), io.LimitReader(body, remaining))
+	if copyErr == nil && n == remaining {
+		// 多出来的数据说明 size 不对，已写入的部分保留
+		var extra [1]byte
+		if m, _ := body.Read(extra[:]); m > 0 {
+			copyErr = &status.Status{Code: 400, Message: fmt.Sprintf("body is longer than the %d bytes left", remaining)}
+		}
+	}
+	if err := f.Sync(); err != nil && copyErr == nil {
+		copyErr = err
+	}
+	if u.Hash, err = h.(encoding.BinaryMarshaler).MarshalBinary(); err != nil {
+		return 0, &status.Status{Code: 500, Message: err.Error()}
+	}
+	if copyErr != nil {
+		if _, ok := copyErr.(*status.Status); !ok {
+			copyErr = &status.Status{Code: 400, Message: fmt.Sprintf("read body: %s", copyErr)}
+		}
+	}
+	return n, copyErr
+}
+
+// sum returns the SHA-256 of the data received for u.
+func (u *upload) sum() []byte {
+	h := sha256.New()
+	if len(u.Hash) > 0 {
+		if err := h.(encoding.BinaryUnmarshaler).UnmarshalBinary(u.Hash); err != nil {
+			return nil
+		}
+	}
+	return h.Sum(nil)
+}
@@ -0,0 +1,155 @@
+package handler
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"github.com/gin-gonic/gin"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+	"ttsapi/config"
+	"ttsapi/server/httpserver/middles/status"
+)
+
+// newUpload starts an upload of data and returns its ID.
+func (e *testEnv) newUpload(filename string, data []byte) string {
+	e.t.Helper()
+	sum := sha256.Sum256(data)
+	rsp, err := e.handler.CreateUpload(e.ctx, &CreateUploadReq{Filename: filename, Size: int64(len(data)), Sha256: hex.EncodeToString(sum[:])})
+	if err != nil {
+		e.t.Fatalf("CreateUpload: %s", err)
+	}
+	return rsp.Id
+}
+
+// putUpload sends body as the data of upload id from offset and returns the
+// status code and the offset the upload reports.
+func (e *testEnv) putUpload(id string, offset int64, body io.Reader) (int, int64) {
+	e.t.Helper()
+	w := httptest.NewRecorder()
+	ctx, _ := gin.CreateTestContext(w)
+	ctx.Request = httptest.NewRequest(http.MethodPut, "/admin/uploads/data?id="+id, body)
+	ctx.Request.Header.Set("Upload-Offset", strconv.FormatInt(offset, 10))
+	e.handler.UploadData(ctx)
+	var rsp struct {
+		Offset int64 `json:"offset"`
+		Data   struct {
+			Offset int64 `json:"offset"`
+		} `json:"data"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &rsp); err != nil {
+		e.t.Fatalf("response %s: %s", w.Body, err)
+	}
+	return w.Code, rsp.Offset + rsp.Data.Offset
+}
+
+func withModelsPath(path string) func(cfg *config.Config) {
+	return func(cfg *config.Config) { cfg.Server.ModelsPath = path }
+}
+
+// cutReader returns the data of r and then fails, like a dropped connection.
+type cutReader struct {
+	r io.Reader
+}
+
+func (c cutReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	if err == io.EOF {
+		err = errors.New("connection reset")
+	}
+	return n, err
+}
+
+func TestUploadResumes(t *testing.T) {
+	env := newTestEnv(t, withModelsPath(t.TempDir()))
+	data := []byte("0123456789")
+	id := env.newUpload("alice.ckpt", data)
+
+	// 中断的请求保留已收到的数据
+	if code, offset := env.putUpload(id, 0, cutReader{strings.NewReader("0123")}); code != http.StatusBadRequest || offset != 0 {
+		t.Fatalf("cut request: %d at %d", code, offset)
+	}
+	u, err := env.handler.UploadStatus(env.ctx, &UploadReq{Id: id})
+	if err != nil || u.Offset != 4 || u.Complete {
+		t.Fatalf("status after the cut: %+v, %v", u, err)
+	}
+	if code, offset := env.putUpload(id, 0, strings.NewReader("0123")); code != http.StatusConflict || offset != 4 {
+		t.Fatalf("resume at a stale offset: %d at %d", code, offset)
+	}
+	if code, offset := env.putUpload(id, 4, strings.NewReader("456")); code != http.StatusOK || offset != 7 {
+		t.Fatalf("resume: %d at %d", code, offset)
+	}
+	if code, _ := env.putUpload(id, 7, strings.NewReader("789")); code != http.StatusOK {
+		t.Fatalf("last part: %d", code)
+	}
+	if u, err = env.handler.UploadStatus(env.ctx, &UploadReq{Id: id}); err != nil || !u.Complete {
+		t.Fatalf("status after the last part: %+v, %v", u, err)
+	}
+	got, err := os.ReadFile(env.handler.uploadPart(id))
+	if err != nil || string(got) != string(data) {
+		t.Fatalf("stored %q, %v", got, err)
+	}
+	if code, _ := env.putUpload(id, 10, strings.NewReader("x")); code != http.StatusConflict {
+		t.Fatalf("write to a complete upload: %d", code)
+	}
+}
+
+func TestUploadChecksumMismatch(t *testing.T) {
+	env := newTestEnv(t, withModelsPath(t.TempDir()))
+	id := env.newUpload("alice.ckpt", []byte("0123456789"))
+	if code, _ := env.putUpload(id, 0, strings.NewReader("01234")); code != http.StatusOK {
+		t.Fatalf("first part: %d", code)
+	}
+	if code, _ := env.putUpload(id, 5, strings.NewReader("x6789")); code != http.StatusUnprocessableEntity {
+		t.Fatalf("corrupt upload: %d", code)
+	}
+	if _, err := env.handler.UploadStatus(env.ctx, &UploadReq{Id: id}); status.GetCode(err) != http.StatusNotFound {
+		t.Fatalf("corrupt upload kept: %v", err)
+	}
+	if _, err := os.Stat(env.handler.uploadPart(id)); !os.IsNotExist(err) {
+		t.Fatalf("data of the corrupt upload kept: %v", err)
+	}
+}
+
+func TestCreateModelWithRelativeModelsPath(t *testing.T) {
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(wd) })
+	env := newTestEnv(t, withModelsPath("models"))
+
+	upload := func(filename string, data []byte) string {
+		id := env.newUpload(filename, data)
+		if code, _ := env.putUpload(id, 0, strings.NewReader(string(data))); code != http.StatusOK {
+			t.Fatalf("upload %s: %d", filename, code)
+		}
+		return id
+	}
+	rsp, err := env.handler.CreateModel(env.ctx, &CreateModelReq{
+		Name:          "bob",
+		GptWeights:    upload("bob.ckpt", []byte("gpt")),
+		SovitsWeights: upload("bob.pth", []byte("sovits")),
+		References:    []ModelReferenceReq{{Upload: upload("bob.wav", silentWav(t, 4*time.Second)), Text: "你好", Lang: "zh"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !rsp.Model.Enabled || !filepath.IsAbs(rsp.Model.GptPath) || !isFile(rsp.Model.GptPath) {
+		t.Fatalf("created %+v", rsp.Model)
+	}
+	if _, ok := env.handler.models()["bob"]; !ok {
+		t.Fatal("created model not loaded")
+	}
+}
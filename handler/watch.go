@@ -0,0 +1,377 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/fsnotify/fsnotify"
+	"github.com/gin-gonic/gin"
+	"github.com/gomodule/redigo/redis"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"ttsapi/config"
+	"ttsapi/logger"
+	rds "ttsapi/storage/redis"
+)
+
+const (
+	modelsChannel        = "ttsapi:models" // 某个实例重新加载了模型，消息为该实例的 worker ID
+	defaultModelDebounce = 2 * time.Second
+	modelEventHistory    = 100 // 保留的最近事件数，供订阅方补齐错过的事件
+)
+
+// 重新加载模型的原因
+const (
+	reloadStartup = "startup"
+	reloadAPI     = "api"    // 调用了 /loadModels
+	reloadWatch   = "watch"  // 模型目录中的文件有变化
+	reloadManage  = "manage" // 通过管理接口修改了模型
+	reloadRemote  = "remote" // 其他实例重新加载了模型
+)
+
+type watchOptions struct {
+	enabled  bool
+	debounce time.Duration
+}
+
+func newWatchOptions(cfg *config.ModelWatch) watchOptions {
+	opts := watchOptions{enabled: true, debounce: defaultModelDebounce}
+	if cfg == nil {
+		return opts
+	}
+	opts.enabled = !cfg.Disabled
+	if cfg.Debounce > 0 {
+		opts.debounce = cfg.Debounce
+	}
+	return opts
+}
+
+// ModelEvent 一次重新加载带来的模型变化，序号只在本实例内递增
+type ModelEvent struct {
+	Seq     int64    `json:"seq"`
+	Trigger string   `json:"trigger"`
+	Worker  string   `json:"worker"`
+	Added   []string `json:"added"`
+	Removed []string `json:"removed"` // 包括被停用的模型
+	Changed []string `json:"changed"`
+	At      int64    `json:"at"`
+}
+
+func (e *ModelEvent) empty() bool {
+	return len(e.Added) == 0 && len(e.Removed) == 0 && len(e.Changed) == 0
+}
+
+// modelEvents 模型变化事件的订阅者和最近的历史
+type modelEvents struct {
+	mu      sync.Mutex
+	seq     int64
+	history []ModelEvent
+	subs    map[chan ModelEvent]struct{}
+}
+
+// publish numbers ev and hands it to every subscriber. A subscriber that is
+// not keeping up misses the event rather than holding up the reload.
+func (e *modelEvents) publish(ev ModelEvent) ModelEvent {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.seq++
+	ev.Seq = e.seq
+	e.history = append(e.history, ev)
+	if len(e.history) > modelEventHistory {
+		e.history = e.history[len(e.history)-modelEventHistory:]
+	}
+	for ch := range e.subs {
+		select {
+		case ch <- ev:
+		default:
+		}
+	}
+	return ev
+}
+
+// subscribe returns the events after since and a channel of the ones to
+// come. cancel must be called when the subscriber is done.
+func (e *modelEvents) subscribe(since int64) (past []ModelEvent, events <-chan ModelEvent, cancel func()) {
+	ch := make(chan ModelEvent, 16)
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.subs == nil {
+		e.subs = make(map[chan ModelEvent]struct{})
+	}
+	e.subs[ch] = struct{}{}
+	return e.sinceLocked(since), ch, func() {
+		e.mu.Lock()
+		defer e.mu.Unlock()
+		delete(e.subs, ch)
+	}
+}
+
+func (e *modelEvents) since(seq int64) []ModelEvent {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.sinceLocked(seq)
+}
+
+func (e *modelEvents) sinceLocked(seq int64) []ModelEvent {
+	events := []ModelEvent{}
+	for _, ev := range e.history {
+		if ev.Seq > seq {
+			events = append(events, ev)
+		}
+	}
+	return events
+}
+
+// diffModels lists the models added, removed and changed from old to new.
+func diffModels(old, new map[string]pair) (added, removed, changed []string) {
+	added, removed, changed = []string{}, []string{}, []string{}
+	for name, model := range new {
+		before, ok := old[name]
+		if !ok {
+			added = append(added, name)
+		} else if !reflect.DeepEqual(before, model) {
+			changed = append(changed, name)
+		}
+	}
+	for name := range old {
+		if _, ok := new[name]; !ok {
+			removed = append(removed, name)
+		}
+	}
+	sort.Strings(added)
+	sort.Strings(removed)
+	sort.Strings(changed)
+	return
+}
+
+// announceReload logs and publishes what a reload changed and, for reloads
+// asked for by a request to this instance, asks the other instances to
+// reload too. Reloads after file changes are not passed on: every instance
+// watches its own directories, and passing them on would make instances
+// sharing the directories reload each other once per change.
+func (handler *TTShHandler) announceReload(ctx context.Context, trigger string, old, new *modelRegistry) {
+	var before map[string]pair
+	if old != nil {
+		before = old.models
+	}
+	ev := ModelEvent{Trigger: trigger, Worker: handler.queue.workerID, At: nowMilli()}
+	ev.Added, ev.Removed, ev.Changed = diffModels(before, new.models)
+	if !ev.empty() {
+		ev = handler.modelEvents.publish(ev)
+		logger.Infof(ctx, "models changed (%s): added %v, removed %v, changed %v", trigger, ev.Added, ev.Removed, ev.Changed)
+	}
+	switch trigger {
+	case reloadAPI, reloadManage:
+		conn := rds.Get()
+		defer conn.Close()
+		if _, err := conn.Do("PUBLISH", modelsChannel, handler.queue.workerID); err != nil {
+			logger.Warnf(ctx, "publish model reload: %s", err)
+		}
+	}
+}
+
+// listenModelReloads reloads the models whenever another instance did.
+func (handler *TTShHandler) listenModelReloads(ctx context.Context) {
+	for ctx.Err() == nil {
+		if err := handler.subscribeModelReloads(ctx); err != nil {
+			logger.Errorf(ctx, "model reload subscription err: %s", err)
+			time.Sleep(time.Second)
+		}
+	}
+}
+
+// subscribeModelReloads handles reload messages until the subscription fails
+// or ctx is done, in which case it returns nil.
+func (handler *TTShHandler) subscribeModelReloads(ctx context.Context) error {
+	psc := redis.PubSubConn{Conn: rds.Get()}
+	defer psc.Close()
+	if err := psc.Subscribe(modelsChannel); err != nil {
+		return err
+	}
+	// 退订让阻塞的 Receive 返回，Receive 和 Unsubscribe 可以在不同的 goroutine 中并发调用
+	done, stopped := make(chan struct{}), make(chan struct{})
+	defer func() {
+		close(done)
+		<-stopped
+	}()
+	go func() {
+		defer close(stopped)
+		select {
+		case <-ctx.Done():
+			psc.Unsubscribe(modelsChannel)
+		case <-done:
+		}
+	}()
+	for {
+		switch msg := psc.Receive().(type) {
+		case redis.Subscription:
+			if msg.Count == 0 {
+				return nil
+			}
+		case redis.Message:
+			if string(msg.Data) == handler.queue.workerID {
+				continue
+			}
+			handler.manageMu.Lock()
+			handler.reloadModels(ctx, reloadRemote)
+			handler.manageMu.Unlock()
+		case error:
+			return msg
+		}
+	}
+}
+
+// watchModels reloads the models a debounce after the files under the model
+// directories stop changing. Dot files and directories, such as pending
+// uploads and the trash of models_path, are not watched.
+func (handler *TTShHandler) watchModels(ctx context.Context) {
+	if !handler.watch.enabled {
+		return
+	}
+	w, err := fsnotify.NewWatcher()
+	if err != nil {
+		logger.Errorf(ctx, "watch models: %s", err)
+		return
+	}
+	defer w.Close()
+	watched := 0
+	seen := make(map[string]bool)
+	for _, dir := range []string{handler.gptWeightsPath, handler.soVITSWeightsPath, handler.referAudioPath, handler.modelsPath} {
+		if dir == "" || seen[filepath.Clean(dir)] {
+			continue
+		}
+		seen[filepath.Clean(dir)] = true
+		if err := watchTree(w, dir); err != nil {
+			logger.Warnf(ctx, "watch models: %s", err)
+			continue
+		}
+		watched++
+	}
+	if watched == 0 {
+		return
+	}
+	logger.Infof(ctx, "watching %d model directories, debounce %s", watched, handler.watch.debounce)
+
+	timer := time.NewTimer(handler.watch.debounce)
+	timer.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case ev, ok := <-w.Events:
+			if !ok {
+				return
+			}
+			if strings.HasPrefix(filepath.Base(ev.Name), ".") {
+				continue
+			}
+			if ev.Has(fsnotify.Create) {
+				if stat, err := os.Stat(ev.Name); err == nil && stat.IsDir() {
+					if err := watchTree(w, ev.Name); err != nil {
+						logger.Warnf(ctx, "watch models: %s", err)
+					}
+				}
+			}
+			if !timer.Stop() {
+				select {
+				case <-timer.C:
+				default:
+				}
+			}
+			timer.Reset(handler.watch.debounce)
+		case err, ok := <-w.Errors:
+			if !ok {
+				return
+			}
+			logger.Warnf(ctx, "watch models: %s", err)
+		case <-timer.C:
+			handler.manageMu.Lock()
+			handler.reloadModels(ctx, reloadWatch)
+			handler.manageMu.Unlock()
+		}
+	}
+}
+
+// watchTree adds dir and the directories below it to w.
+func watchTree(w *fsnotify.Watcher, dir string) error {
+	return filepath.WalkDir(dir, func(path string, d os.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.IsDir() {
+			return nil
+		}
+		if path != dir && strings.HasPrefix(d.Name(), ".") {
+			return filepath.SkipDir
+		}
+		if err := w.Add(path); err != nil {
+			return fmt.Errorf("watch %s: %w", path, err)
+		}
+		return nil
+	})
+}
+
+type ModelEventsReq struct {
+	Since int64 `json:"since" form:"since"` // 只返回序号大于它的事件
+}
+
+type ModelEventsResp struct {
+	Events []ModelEvent `json:"events"`
+}
+
+// ModelEvents returns the recent model changes of this instance.
+func (handler *TTShHandler) ModelEvents(ctx context.Context, req *ModelEventsReq) (*ModelEventsResp, error) {
+	return &ModelEventsResp{Events: handler.modelEvents.since(req.Since)}, nil
+}
+
+// StreamModelEvents sends model changes as server-sent events until the
+// client goes away, starting with the recent ones after since.
+func (handler *TTShHandler) StreamModelEvents(ctx *gin.Context) {
+	req := &ModelEventsReq{}
+	if err := ctx.ShouldBindQuery(req); err != nil {
+		ctx.JSON(400, gin.H{"code": 400, "message": err.Error()})
+		return
+	}
+	past, events, cancel := handler.modelEvents.subscribe(req.Since)
+	defer cancel()
+	send := func(w io.Writer, ev ModelEvent) bool {
+		data, err := json.Marshal(ev)
+		if err != nil {
+			return false
+		}
+		_, err = fmt.Fprintf(w, "id: %d\nevent: models\ndata: %s\n\n", ev.Seq, data)
+		return err == nil
+	}
+	ctx.Header("Content-Type", "text/event-stream")
+	ctx.Header("Cache-Control", "no-cache")
+	ctx.Status(200)
+	for _, ev := range past {
+		if !send(ctx.Writer, ev) {
+			return
+		}
+	}
+	ctx.Writer.Flush()
+	keepAlive := time.NewTicker(30 * time.Second)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case <-ctx.Request.Context().Done():
+			return
+		case ev := <-events:
+			if !send(ctx.Writer, ev) {
+				return
+			}
+		case <-keepAlive.C:
+			if _, err := io.WriteString(ctx.Writer, ": keep-alive\n\n"); err != nil {
+				return
+			}
+		}
+		ctx.Writer.Flush()
+	}
+}
@@ -0,0 +1,56 @@
+package handler
+
+import (
+	"context"
+	"github.com/gomodule/redigo/redis"
+	"testing"
+	"time"
+	rds "ttsapi/storage/redis"
+)
+
+func TestModelReloadSubscriptionStopsWithContext(t *testing.T) {
+	env := newTestEnv(t, nil)
+	ctx, cancel := context.WithCancel(env.ctx)
+	defer cancel()
+	done := make(chan error, 1)
+	go func() { done <- env.handler.subscribeModelReloads(ctx) }()
+	for env.redis.PubSubNumSub(modelsChannel)[modelsChannel] == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	cancel()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("subscription ended with %s", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("subscription ignores its context")
+	}
+}
+
+func TestWatchReloadsAreNotPassedOn(t *testing.T) {
+	env := newTestEnv(t, nil)
+	psc := redis.PubSubConn{Conn: rds.Get()}
+	defer psc.Close()
+	if err := psc.Subscribe(modelsChannel); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := psc.Receive().(redis.Subscription); !ok {
+		t.Fatal("not subscribed")
+	}
+	receive := func() (redis.Message, bool) {
+		msg, ok := psc.ReceiveWithTimeout(200 * time.Millisecond).(redis.Message)
+		return msg, ok
+	}
+
+	env.handler.reloadModels(env.ctx, reloadManage)
+	if msg, ok := receive(); !ok || string(msg.Data) != env.handler.queue.workerID {
+		t.Fatalf("manage reload published %q, %v", msg.Data, ok)
+	}
+	// 超时后连接不能再用，放在最后
+	env.handler.reloadModels(env.ctx, reloadWatch)
+	if msg, ok := receive(); ok {
+		t.Fatalf("watch reload published %q", msg.Data)
+	}
+}
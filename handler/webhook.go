@@ -0,0 +1,434 @@
+package handler
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/gomodule/redigo/redis"
+	"github.com/google/uuid"
+	"github.com/pkg/errors"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"syscall"
+	"time"
+	"ttsapi/audio"
+	"ttsapi/config"
+	"ttsapi/logger"
+	"ttsapi/server/httpserver/middles/status"
+	rds "ttsapi/storage/redis"
+)
+
+const (
+	webhookSet         = "ttsapi:webhooks"          // 待投递的回调，score 为下一次投递时间(ms)
+	webhookAttempts    = "ttsapi:webhooks:attempts" // hash，任务 ID -> 已投递次数
+	webhookLogPrefix   = "ttsapi:webhook:log:"      // 每个任务的投递记录
+	webhookLease       = time.Minute                // 取出后在该时间内未完成视为投递进程已退出，至少为两倍请求超时
+	webhookLogMax      = 100
+	webhookPoll        = time.Second
+	signatureHeader    = "X-TTSAPI-Signature"
+	timestampHeader    = "X-TTSAPI-Timestamp"
+	deliveryHeader     = "X-TTSAPI-Delivery"
+	defaultHookTimeout = 10 * time.Second
+
+	defaultHookAttempts    = 8
+	defaultHookBackoffBase = 10 * time.Second
+	defaultHookBackoffMax  = time.Hour
+)
+
+// claimScript takes the earliest due delivery and pushes its score past the
+// lease so that no other instance delivers it at the same time.
+var claimScript = redis.NewScript(1, `
+local ids = redis.call('ZRANGEBYSCORE', KEYS[1], '-inf', ARGV[1], 'LIMIT', 0, 1)
+if #ids == 0 then
+	return false
+end
+redis.call('ZADD', KEYS[1], ARGV[2], ids[1])
+return ids[1]
+`)
+
+// blockedNets 回调地址不能落在的网段，回环、私有和链路本地地址另由 publicIP 判断
+var blockedNets = []*net.IPNet{
+	mustParseCIDR("0.0.0.0/8"),
+	mustParseCIDR("100.64.0.0/10"), // 运营商级 NAT
+	mustParseCIDR("198.18.0.0/15"), // 基准测试
+}
+
+func mustParseCIDR(s string) *net.IPNet {
+	_, n, err := net.ParseCIDR(s)
+	if err != nil {
+		panic(err)
+	}
+	return n
+}
+
+// publicIP reports whether ip may receive callbacks: it must not be a
+// loopback, private, link-local (including 169.254.169.254), unspecified or
+// multicast address.
+func publicIP(ip net.IP) bool {
+	if ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() || ip.IsMulticast() || ip.IsUnspecified() {
+		return false
+	}
+	for _, n := range blockedNets {
+		if n.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+type webhookOptions struct {
+	retry        retryPolicy
+	timeout      time.Duration
+	lease        time.Duration
+	allowPrivate bool
+	client       *http.Client
+}
+
+func newWebhookOptions(cfg *config.Webhook) webhookOptions {
+	opts := webhookOptions{
+		retry: retryPolicy{
+			maxAttempts: defaultHookAttempts,
+			backoffBase: defaultHookBackoffBase,
+			backoffMax:  defaultHookBackoffMax,
+		},
+		timeout: defaultHookTimeout,
+	}
+	if cfg != nil {
+		if cfg.MaxAttempts > 0 {
+			opts.retry.maxAttempts = cfg.MaxAttempts
+		}
+		if cfg.BackoffBase > 0 {
+			opts.retry.backoffBase = cfg.BackoffBase
+		}
+		if cfg.BackoffMax > 0 {
+			opts.retry.backoffMax = cfg.BackoffMax
+		}
+		if cfg.Timeout > 0 {
+			opts.timeout = cfg.Timeout
+		}
+		opts.allowPrivate = cfg.AllowPrivate
+	}
+	// 投递期间租约不能过期，否则其他实例会重复投递
+	opts.lease = webhookLease
+	if opts.lease < 2*opts.timeout {
+		opts.lease = 2 * opts.timeout
+	}
+	opts.client = &http.Client{Timeout: opts.timeout}
+	if !opts.allowPrivate {
+		// 提交时检查过的域名可能被重新解析到内网，连接时按实际地址再检查一次，重定向同样适用
+		dialer := &net.Dialer{Timeout: opts.timeout, Control: checkDialAddress}
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.Proxy = nil
+		transport.DialContext = dialer.DialContext
+		opts.client.Transport = transport
+	}
+	return opts
+}
+
+// checkDialAddress refuses connections to addresses that are not public.
+func checkDialAddress(network, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	if ip := net.ParseIP(host); ip == nil || !publicIP(ip) {
+		return errors.Errorf("callback address %s is not public", host)
+	}
+	return nil
+}
+
+// checkCallback validates a callback URL submitted with key. Unless
+// webhook.allow_private is set, every address the host resolves to must be
+// public.
+func (handler *TTShHandler) checkCallback(ctx context.Context, key *config.APIKey, callback string) error {
+	u, err := url.Parse(callback)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Hostname() == "" {
+		return errors.New("callbackUrl must be an absolute http(s) URL")
+	}
+	if key.WebhookSecret == "" {
+		return errors.New("no webhook secret configured for this key")
+	}
+	if handler.webhook.allowPrivate {
+		return nil
+	}
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, u.Hostname())
+	if err != nil {
+		return errors.Errorf("cannot resolve callbackUrl host %s", u.Hostname())
+	}
+	for _, addr := range addrs {
+		if !publicIP(addr.IP) {
+			return errors.Errorf("callbackUrl host %s resolves to a non-public address", u.Hostname())
+		}
+	}
+	return nil
+}
+
+// sign returns the signature of body sent at timestamp: the hex HMAC-SHA256 of
+// "<timestamp>.<body>" keyed with the webhook secret.
+func sign(secret, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte{'.'})
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// AudioInfo describes a result file.
+type AudioInfo struct {
+	Format        string `json:"format"`
+	SampleRate    int    `json:"sampleRate"`
+	Channels      int    `json:"channels"`
+	BitsPerSample int    `json:"bitsPerSample"`
+	DurationMs    int64  `json:"durationMs"`
+	Size          int64  `json:"size"`
+}
+
+// readAudioInfo reads the WAV or FLAC header of a stored result.
+func readAudioInfo(ctx context.Context, file string) (*AudioInfo, error) {
+	f, stat, err := openResult(ctx, file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	if path.Ext(file) == ".flac" {
+		format, frames, err := audio.ReadFLACHeader(f)
+		if err != nil {
+			return nil, err
+		}
+		return &AudioInfo{
+			Format:        string(audio.CodecFLAC),
+			SampleRate:    int(format.SampleRate),
+			Channels:      int(format.Channels),
+			BitsPerSample: int(format.BitsPerSample),
+			DurationMs:    int64(frames) * 1000 / int64(format.SampleRate),
+			Size:          stat.Size,
+		}, nil
+	}
+	format, dataSize, err := audio.ReadHeader(f)
+	if err != nil {
+		return nil, err
+	}
+	info := &AudioInfo{
+		Format:        string(audio.CodecWAV),
+		SampleRate:    int(format.SampleRate),
+		Channels:      int(format.Channels),
+		BitsPerSample: int(format.BitsPerSample),
+		Size:          stat.Size,
+	}
+	switch format.AudioFormat {
+	case audio.FormatMuLaw:
+		info.Format = string(audio.CodecMuLaw)
+	case audio.FormatALaw:
+		info.Format = string(audio.CodecALaw)
+	}
+	if format.ByteRate() > 0 && dataSize != audio.UnknownSize {
+		info.DurationMs = int64(dataSize) * 1000 / int64(format.ByteRate())
+	}
+	return info, nil
+}
+
+type WebhookPayload struct {
+	Id          string     `json:"id"`
+	State       taskState  `json:"state"`
+	Error       string     `json:"error,omitempty"`
+	Model       string     `json:"model"`
+	Audio       *AudioInfo `json:"audio,omitempty"`
+	Loudness    *Loudness  `json:"loudness,omitempty"`
+	DownloadURL string     `json:"downloadUrl,omitempty"`
+	CreatedAt   int64      `json:"createdAt"`
+	FinishedAt  int64      `json:"finishedAt"`
+}
+
+func newWebhookPayload(ctx context.Context, info *taskInfo) *WebhookPayload {
+	payload := &WebhookPayload{
+		Id:         info.Id,
+		State:      info.State,
+		Error:      info.Error,
+		Model:      info.Model.Name,
+		Loudness:   info.Loudness,
+		CreatedAt:  info.CreatedAt,
+		FinishedAt: info.FinishedAt,
+	}
+	if info.State == stateSucceeded {
+		audioInfo, err := readAudioInfo(ctx, resultFile(info))
+		if err != nil {
+			logger.Warnf(ctx, "read result of task %s: %s", info.Id, err)
+		}
+		payload.Audio = audioInfo
+		if base := config.Get().Server.PublicURL; base != "" {
+			payload.DownloadURL = fmt.Sprintf("%s/getResult?id=%s", base, url.QueryEscape(info.Id))
+		}
+	}
+	return payload
+}
+
+// Delivery is one attempt to deliver the webhook of a task.
+type Delivery struct {
+	Id         string `json:"id"`
+	Attempt    int    `json:"attempt"`
+	URL        string `json:"url"`
+	State      string `json:"state"` // 投递时任务的状态
+	StatusCode int    `json:"statusCode,omitempty"`
+	Error      string `json:"error,omitempty"`
+	DurationMs int64  `json:"durationMs"`
+	At         int64  `json:"at"`
+	NextAt     int64  `json:"nextAt,omitempty"` // 失败后下一次投递时间
+}
+
+// deliverLoop delivers due webhooks until ctx is done.
+func (handler *TTShHandler) deliverLoop(ctx context.Context) {
+	ticker := time.NewTicker(webhookPoll)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		// 每次只取一个，租约从该次投递开始计算
+		for ctx.Err() == nil {
+			id, err := handler.claimWebhook()
+			if err != nil {
+				if !errors.Is(err, redis.ErrNil) {
+					logger.Errorf(ctx, "claim webhook err: %s", err)
+				}
+				break
+			}
+			handler.deliver(ctx, id)
+		}
+	}
+}
+
+// claimWebhook leases the earliest due delivery. It returns redis.ErrNil when
+// nothing is due.
+func (handler *TTShHandler) claimWebhook() (string, error) {
+	conn := rds.Get()
+	defer conn.Close()
+	now := time.Now()
+	return redis.String(claimScript.Do(conn, webhookSet, now.UnixMilli(), now.Add(handler.webhook.lease).UnixMilli()))
+}
+
+// deliver posts the webhook of task id once and schedules a retry on failure.
+func (handler *TTShHandler) deliver(ctx context.Context, id string) {
+	conn := rds.Get()
+	defer conn.Close()
+	info, err := loadTask(conn, id)
+	if err != nil || info.Callback == "" || !info.State.terminal() {
+		// 任务已删除或重新入队，等下次结束时再回调
+		conn.Send("MULTI")
+		conn.Send("ZREM", webhookSet, id)
+		conn.Send("HDEL", webhookAttempts, id)
+		conn.Do("EXEC")
+		return
+	}
+	attempt, err := redis.Int(conn.Do("HINCRBY", webhookAttempts, id, 1))
+	if err != nil {
+		logger.Errorf(ctx, "count webhook attempts of %s err: %s", id, err)
+		return
+	}
+
+	d := &Delivery{Id: uuid.New().String(), Attempt: attempt, URL: info.Callback, State: string(info.State), At: nowMilli()}
+	start := time.Now()
+	d.StatusCode, err = handler.post(ctx, info, d.Id)
+	d.DurationMs = time.Since(start).Milliseconds()
+
+	conn.Send("MULTI")
+	if err == nil {
+		conn.Send("ZREM", webhookSet, id)
+		conn.Send("HDEL", webhookAttempts, id)
+	} else {
+		d.Error = err.Error()
+		if attempt < handler.webhook.retry.maxAttempts {
+			d.NextAt = time.Now().Add(handler.webhook.retry.backoff(attempt)).UnixMilli()
+			conn.Send("ZADD", webhookSet, d.NextAt, id)
+		} else {
+			logger.Errorf(ctx, "give up webhook of task %s after %d attempts: %s", id, attempt, err)
+			conn.Send("ZREM", webhookSet, id)
+			conn.Send("HDEL", webhookAttempts, id)
+		}
+	}
+	js, _ := json.Marshal(d)
+	conn.Send("RPUSH", webhookLogPrefix+id, js)
+	conn.Send("LTRIM", webhookLogPrefix+id, -webhookLogMax, -1)
+	if _, err := conn.Do("EXEC"); err != nil {
+		logger.Errorf(ctx, "record webhook delivery of %s err: %s", id, err)
+	}
+}
+
+// post sends the signed payload of info to its callback URL.
+func (handler *TTShHandler) post(ctx context.Context, info *taskInfo, deliveryId string) (int, error) {
+	key := keyByName(info.Owner)
+	if key == nil || key.WebhookSecret == "" {
+		return 0, errors.Errorf("no webhook secret for key %q", info.Owner)
+	}
+	body, err := json.Marshal(newWebhookPayload(ctx, info))
+	if err != nil {
+		return 0, err
+	}
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, info.Callback, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(timestampHeader, timestamp)
+	req.Header.Set(signatureHeader, sign(key.WebhookSecret, timestamp, body))
+	req.Header.Set(deliveryHeader, deliveryId)
+	resp, err := handler.webhook.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64*1024))
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return resp.StatusCode, errors.New("callback responded " + resp.Status)
+	}
+	return resp.StatusCode, nil
+}
+
+type WebhookDeliveriesReq struct {
+	Id string `form:"id"`
+}
+
+type WebhookDeliveriesResp struct {
+	Id         string      `json:"id"`
+	Callback   string      `json:"callbackUrl"`
+	Pending    bool        `json:"pending"`
+	NextAt     int64       `json:"nextAt,omitempty"`
+	Deliveries []*Delivery `json:"deliveries"`
+}
+
+// WebhookDeliveries returns the webhook delivery log of a task.
+func (handler *TTShHandler) WebhookDeliveries(ctx context.Context, req *WebhookDeliveriesReq) (*WebhookDeliveriesResp, error) {
+	info, err := handler.ownedTaskInfo(ctx, req.Id)
+	if err != nil {
+		return nil, err
+	}
+	conn := rds.Get()
+	defer conn.Close()
+	rsp := &WebhookDeliveriesResp{Id: info.Id, Callback: info.Callback, Deliveries: []*Delivery{}}
+	next, err := redis.Int64(conn.Do("ZSCORE", webhookSet, info.Id))
+	if err == nil {
+		rsp.Pending, rsp.NextAt = true, next
+	}
+	items, err := redis.ByteSlices(conn.Do("LRANGE", webhookLogPrefix+info.Id, 0, -1))
+	if err != nil {
+		return nil, &status.Status{Code: http.StatusInternalServerError, Message: err.Error()}
+	}
+	for _, item := range items {
+		d := &Delivery{}
+		if err := json.Unmarshal(item, d); err == nil {
+			rsp.Deliveries = append(rsp.Deliveries, d)
+		}
+	}
+	return rsp, nil
+}
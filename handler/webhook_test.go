@@ -0,0 +1,171 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+	"ttsapi/config"
+	"ttsapi/server/httpserver/middles/status"
+)
+
+func TestPublicIP(t *testing.T) {
+	cases := map[string]bool{
+		"93.184.216.34":    true,
+		"2606:4700::1111":  true,
+		"127.0.0.1":        false,
+		"10.1.2.3":         false,
+		"172.16.0.1":       false,
+		"192.168.1.1":      false,
+		"169.254.169.254":  false,
+		"0.0.0.0":          false,
+		"0.1.2.3":          false,
+		"100.64.0.1":       false,
+		"198.18.0.1":       false,
+		"224.0.0.1":        false,
+		"::1":              false,
+		"fe80::1":          false,
+		"fd00::1":          false,
+		"::ffff:127.0.0.1": false,
+	}
+	for addr, want := range cases {
+		if got := publicIP(net.ParseIP(addr)); got != want {
+			t.Errorf("publicIP(%s) = %v", addr, got)
+		}
+	}
+}
+
+func TestCheckCallback(t *testing.T) {
+	handler := &TTShHandler{webhook: newWebhookOptions(nil)}
+	key := &config.APIKey{Name: "k", WebhookSecret: "s"}
+	for _, callback := range []string{
+		"ftp://example.com/hook",
+		"/hook",
+		"http://127.0.0.1:8080/hook",
+		"http://169.254.169.254/latest/meta-data",
+		"http://[::1]/hook",
+		"http://10.0.0.1/hook",
+		"http://localhost/hook",
+	} {
+		if err := handler.checkCallback(context.Background(), key, callback); err == nil {
+			t.Errorf("%s accepted", callback)
+		}
+	}
+	if err := handler.checkCallback(context.Background(), key, "https://93.184.216.34/hook"); err != nil {
+		t.Errorf("public address rejected: %s", err)
+	}
+	if err := handler.checkCallback(context.Background(), &config.APIKey{Name: "k"}, "https://93.184.216.34/hook"); err == nil {
+		t.Error("key without a webhook secret accepted")
+	}
+
+	handler.webhook = newWebhookOptions(&config.Webhook{AllowPrivate: true})
+	if err := handler.checkCallback(context.Background(), key, "http://127.0.0.1:8080/hook"); err != nil {
+		t.Errorf("allow_private: %s", err)
+	}
+}
+
+func TestWebhookClientRefusesPrivateAddresses(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+	// 域名在提交后被解析到内网时，由连接时的检查拦截
+	_, err := newWebhookOptions(nil).client.Post(server.URL, "application/json", strings.NewReader("{}"))
+	if err == nil || !strings.Contains(err.Error(), "not public") {
+		t.Fatalf("post to %s: %v", server.URL, err)
+	}
+}
+
+func TestWebhookDelivery(t *testing.T) {
+	received := make(chan *http.Request, 1)
+	var body []byte
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ = io.ReadAll(r.Body)
+		received <- r
+	}))
+	defer server.Close()
+	env := newTestEnv(t, func(cfg *config.Config) {
+		cfg.Server.WebhookSecret = "hook-secret"
+		cfg.Resources.Webhook = &config.Webhook{AllowPrivate: true, Timeout: time.Minute}
+	})
+	if env.handler.webhook.lease != 2*time.Minute {
+		t.Fatalf("lease = %s, shorter than two request timeouts", env.handler.webhook.lease)
+	}
+
+	ctx := context.WithValue(env.ctx, callerKey, keyByName(defaultKeyName))
+	rsp, err := env.handler.NewTask(ctx, &NewTaskReq{Model: testModel, TextReq: TextReq{Text: "你好。", Lang: "zh"}, Callback: server.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := env.run(); err != nil {
+		t.Fatal(err)
+	}
+	if due := env.zset(webhookSet); len(due) != 1 || due[0] != rsp.Id {
+		t.Fatalf("due webhooks = %v", due)
+	}
+
+	before := time.Now()
+	id, err := env.handler.claimWebhook()
+	if err != nil || id != rsp.Id {
+		t.Fatalf("claimed %q, %v", id, err)
+	}
+	if score, _ := env.redis.ZScore(webhookSet, id); int64(score) < before.Add(env.handler.webhook.lease).UnixMilli() {
+		t.Fatal("claimed delivery is not leased")
+	}
+	if _, err := env.handler.claimWebhook(); err == nil {
+		t.Fatal("leased delivery claimed twice")
+	}
+
+	env.handler.deliver(env.ctx, id)
+	r := <-received
+	timestamp := r.Header.Get(timestampHeader)
+	if _, err := strconv.ParseInt(timestamp, 10, 64); err != nil {
+		t.Fatalf("timestamp %q", timestamp)
+	}
+	if r.Header.Get(signatureHeader) != sign("hook-secret", timestamp, body) {
+		t.Fatal("bad signature")
+	}
+	payload := &WebhookPayload{}
+	if err := json.Unmarshal(body, payload); err != nil || payload.Id != id || payload.State != stateSucceeded || payload.Audio == nil {
+		t.Fatalf("payload %s: %v", body, err)
+	}
+	if env.redis.Exists(webhookSet) {
+		t.Fatal("delivered webhook still scheduled")
+	}
+
+	log, err := env.handler.WebhookDeliveries(env.ctx, &WebhookDeliveriesReq{Id: id})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if log.Pending || len(log.Deliveries) != 1 || log.Deliveries[0].StatusCode != http.StatusOK {
+		t.Fatalf("deliveries = %+v", log)
+	}
+}
+
+func TestTasksAreVisibleToTheirOwner(t *testing.T) {
+	env := newTestEnv(t, func(cfg *config.Config) {
+		cfg.Server.APIKeys = []config.APIKey{{Key: "other-key", Name: "other"}}
+	})
+	id := env.submit(testModel, "你好。")
+	other := context.WithValue(env.ctx, callerKey, keyByName("other"))
+
+	if _, err := env.handler.TaskStatus(env.ctx, &TaskStatusReq{Id: id}); err != nil {
+		t.Fatalf("owner: %s", err)
+	}
+	if _, err := env.handler.TaskStatus(other, &TaskStatusReq{Id: id}); status.GetCode(err) != http.StatusNotFound {
+		t.Fatalf("taskStatus of another key: %v", err)
+	}
+	if _, err := env.handler.WebhookDeliveries(other, &WebhookDeliveriesReq{Id: id}); status.GetCode(err) != http.StatusNotFound {
+		t.Fatalf("webhookDeliveries of another key: %v", err)
+	}
+	if _, err := env.handler.CancelTask(other, &CancelTaskReq{Id: id}); status.GetCode(err) != http.StatusNotFound {
+		t.Fatalf("cancelTask of another key: %v", err)
+	}
+	if info := env.task(id); info.State != stateQueued {
+		t.Fatalf("task is %s", info.State)
+	}
+}
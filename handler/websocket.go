@@ -0,0 +1,217 @@
+package handler
+
+import (
+	"context"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"golang.org/x/net/websocket"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"ttsapi/audio"
+	"ttsapi/config"
+	"ttsapi/logger"
+	"ttsapi/text"
+)
+
+// 客户端 -> 服务端（文本帧, JSON）
+const (
+	wsText  = "text"  // 追加文本，遇到句子边界即开始合成
+	wsFlush = "flush" // 立即合成缓冲区中剩余的文本
+	wsClose = "close" // 合成剩余文本后关闭会话
+)
+
+// 服务端 -> 客户端（文本帧, JSON）；音频以二进制帧发送，内容为 segment_start 中 format 描述的 PCM
+const (
+	wsReady        = "ready"
+	wsSegmentStart = "segment_start"
+	wsSegmentEnd   = "segment_end"
+	wsError        = "error"
+	wsClosed       = "closed"
+)
+
+// 缓冲区超过该长度仍没有句子边界时强制切分，避免无限积压
+const wsMaxPending = 200
+
+type wsClientMessage struct {
+	Type string `json:"type"`
+	Text string `json:"text"`
+}
+
+type wsEvent struct {
+	Type    string        `json:"type"`
+	Model   string        `json:"model,omitempty"`
+	Segment int           `json:"segment,omitempty"`
+	Text    string        `json:"text,omitempty"`
+	Format  *audio.Format `json:"format,omitempty"`
+	Bytes   int           `json:"bytes,omitempty"`
+	Message string        `json:"message,omitempty"`
+}
+
+type wsSession struct {
+	handler *TTShHandler
+	conn    *websocket.Conn
+	model   string
+	lang    string // 会话内所有文本的 text_lang，为空时逐段识别
+	raw     bool   // 不做文本规范化
+	key     *config.APIKey
+	sendMu  sync.Mutex
+}
+
+// WebSocket opens a text-in / audio-out session bound to the model (and
+// optionally the text_lang, and raw=true to skip normalisation) given in the
+// query string. Text is buffered and synthesized sentence by sentence.
+func (handler *TTShHandler) WebSocket(ctx *gin.Context) {
+	model := ctx.Query("model")
+	if _, ok := handler.models()[model]; !ok {
+		ctx.JSON(http.StatusBadRequest, gin.H{"code": http.StatusBadRequest, "message": "model not found"})
+		return
+	}
+	lang := ctx.Query("lang")
+	if lang != "" && !textLangs[lang] {
+		ctx.JSON(http.StatusBadRequest, gin.H{"code": http.StatusBadRequest, "message": "unknown lang " + lang})
+		return
+	}
+	raw := ctx.Query("raw") == "true"
+	server := websocket.Server{
+		// 鉴权已经由 authorize 完成，这里校验 Origin 并选定子协议
+		Handshake: func(cfg *websocket.Config, r *http.Request) error {
+			if err := checkOrigin(r); err != nil {
+				logger.Warnf(r.Context(), "websocket: %s", err)
+				return err
+			}
+			// 只回应 ttsapi，携带密钥的子协议不能回显
+			offered := cfg.Protocol
+			cfg.Protocol = nil
+			for _, protocol := range offered {
+				if protocol == wsProtocol {
+					cfg.Protocol = []string{wsProtocol}
+				}
+			}
+			return nil
+		},
+		Handler: func(conn *websocket.Conn) {
+			session := &wsSession{handler: handler, conn: conn, model: model, lang: lang, raw: raw, key: caller(ctx)}
+			session.run(ctx.Request.Context())
+		},
+	}
+	server.ServeHTTP(ctx.Writer, ctx.Request)
+}
+
+// checkOrigin lets a browser open a session only from the origins in
+// server.websocket_origins, or from the same origin when none are configured.
+// Clients that send no Origin are not browsers and are let through.
+func checkOrigin(r *http.Request) error {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return nil
+	}
+	u, err := url.Parse(origin)
+	if err != nil {
+		return fmt.Errorf("bad origin %q", origin)
+	}
+	allowed := config.Get().Server.WebSocketOrigins
+	if len(allowed) == 0 {
+		if strings.EqualFold(u.Host, r.Host) {
+			return nil
+		}
+	}
+	for _, o := range allowed {
+		if o == "*" || strings.EqualFold(strings.TrimSuffix(o, "/"), u.Scheme+"://"+u.Host) {
+			return nil
+		}
+	}
+	return fmt.Errorf("origin %s is not allowed", origin)
+}
+
+func (s *wsSession) run(parent context.Context) {
+	ctx, cancel := context.WithCancel(parent)
+	defer cancel()
+	defer s.conn.Close()
+
+	sentences := make(chan string, 64)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		index := 0
+		for sentence := range sentences {
+			index++
+			if err := s.synthesize(ctx, index, sentence); err != nil {
+				// 会话已取消时继续消费 channel，避免读协程阻塞
+				if ctx.Err() != nil {
+					continue
+				}
+				s.send(wsEvent{Type: wsError, Segment: index, Message: err.Error()})
+			}
+		}
+	}()
+
+	s.send(wsEvent{Type: wsReady, Model: s.model})
+	pending := ""
+	for {
+		msg := wsClientMessage{}
+		if err := websocket.JSON.Receive(s.conn, &msg); err != nil {
+			// 连接断开：丢弃未合成的文本并中止正在进行的合成
+			cancel()
+			close(sentences)
+			<-done
+			return
+		}
+		switch msg.Type {
+		case wsText:
+			var complete []string
+			complete, pending = text.SplitSentences(pending+msg.Text, wsMaxPending)
+			for _, sentence := range complete {
+				sentences <- sentence
+			}
+		case wsFlush, wsClose:
+			if text := strings.TrimSpace(pending); text != "" {
+				sentences <- text
+			}
+			pending = ""
+			if msg.Type == wsClose {
+				close(sentences)
+				<-done
+				s.send(wsEvent{Type: wsClosed})
+				return
+			}
+		default:
+			s.send(wsEvent{Type: wsError, Message: "unknown message type " + msg.Type})
+		}
+	}
+}
+
+func (s *wsSession) synthesize(ctx context.Context, index int, text string) error {
+	t, err := s.handler.newTask(s.key, s.model, TextReq{Text: text, Lang: s.lang, Raw: s.raw}, nil)
+	if err != nil {
+		return err
+	}
+	total := 0
+	err = s.handler.streamTask(ctx, t, func(format audio.Format) error {
+		return s.send(wsEvent{Type: wsSegmentStart, Segment: index, Text: text, Format: &format})
+	}, func(chunk []byte) error {
+		total += len(chunk)
+		return s.sendBinary(chunk)
+	})
+	if err != nil {
+		return err
+	}
+	return s.send(wsEvent{Type: wsSegmentEnd, Segment: index, Bytes: total})
+}
+
+func (s *wsSession) send(event wsEvent) error {
+	s.sendMu.Lock()
+	defer s.sendMu.Unlock()
+	if err := websocket.JSON.Send(s.conn, event); err != nil {
+		logger.Debugf(context.Background(), "websocket send failed: %s", err)
+		return err
+	}
+	return nil
+}
+
+func (s *wsSession) sendBinary(data []byte) error {
+	s.sendMu.Lock()
+	defer s.sendMu.Unlock()
+	return websocket.Message.Send(s.conn, data)
+}
@@ -32,6 +32,7 @@ func newRouter(address string) httpserver.Server {
 		httpserver.WithName("template"),
 		httpserver.WithAddress(address),
 		httpserver.WithMiddles(),
+		httpserver.WithRedactQuery(handler.CredentialQueryParams...),
 	)
 
 	router := httpServer.GetKernel()
@@ -0,0 +1,56 @@
+package middles
+
+import (
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Logger 与 gin.Logger 相同，但把 redact 中的查询参数替换为 REDACTED，避免凭据写入访问日志
+func Logger(redact ...string) Middle {
+	return gin.LoggerWithFormatter(func(param gin.LogFormatterParams) string {
+		var statusColor, methodColor, resetColor string
+		if param.IsOutputColor() {
+			statusColor = param.StatusCodeColor()
+			methodColor = param.MethodColor()
+			resetColor = param.ResetColor()
+		}
+		if param.Latency > time.Minute {
+			param.Latency = param.Latency.Truncate(time.Second)
+		}
+		return fmt.Sprintf("[GIN] %v |%s %3d %s| %13v | %15s |%s %-7s %s %#v\n%s",
+			param.TimeStamp.Format("2006/01/02 - 15:04:05"),
+			statusColor, param.StatusCode, resetColor,
+			param.Latency,
+			param.ClientIP,
+			methodColor, param.Method, resetColor,
+			redactQuery(param.Path, redact),
+			param.ErrorMessage,
+		)
+	})
+}
+
+// redactQuery replaces the values of the query parameters named in redact.
+func redactQuery(path string, redact []string) string {
+	i := strings.IndexByte(path, '?')
+	if i < 0 || len(redact) == 0 {
+		return path
+	}
+	query, err := url.ParseQuery(path[i+1:])
+	if err != nil {
+		return path[:i] + "?REDACTED"
+	}
+	changed := false
+	for _, name := range redact {
+		if _, ok := query[name]; ok {
+			query.Set(name, "REDACTED")
+			changed = true
+		}
+	}
+	if !changed {
+		return path
+	}
+	return path[:i+1] + query.Encode()
+}
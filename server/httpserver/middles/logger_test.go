@@ -0,0 +1,17 @@
+package middles
+
+import "testing"
+
+func TestRedactQuery(t *testing.T) {
+	cases := []struct{ path, want string }{
+		{"/v1/ws", "/v1/ws"},
+		{"/v1/ws?model=a", "/v1/ws?model=a"},
+		{"/v1/ws?model=a&authorization=secret", "/v1/ws?authorization=REDACTED&model=a"},
+		{"/v1/ws?authorization=%zz", "/v1/ws?REDACTED"},
+	}
+	for _, c := range cases {
+		if got := redactQuery(c.path, []string{"authorization"}); got != c.want {
+			t.Errorf("redactQuery(%q) = %q, want %q", c.path, got, c.want)
+		}
+	}
+}
@@ -8,6 +8,8 @@ type Options struct {
 	Name    string
 	Address string
 	Middles []middles.Middle
+	// RedactQuery 访问日志中隐藏取值的查询参数，例如通过查询参数传递的凭据
+	RedactQuery []string
 }
 
 func newOptions(opts ...Option) Options {
@@ -41,3 +43,9 @@ func WithMiddles(ms ...middles.Middle) Option {
 		opt.Middles = ms
 	}
 }
+
+func WithRedactQuery(names ...string) Option {
+	return func(opt *Options) {
+		opt.RedactQuery = names
+	}
+}
@@ -37,7 +37,7 @@ func NewServerWithOptions(options Options) Server {
 	kernel.Use(
 		middles.Recovery(),
 		middles.FlowControlTag(),
-		gin.Logger(),
+		middles.Logger(options.RedactQuery...),
 	)
 
 	kernel.Use(options.Middles...) // user set middles
@@ -66,7 +66,7 @@ func (s *server) Run(ctx context.Context) error {
 	}()
 
 	// handle signal
-	ch := make(chan os.Signal)
+	ch := make(chan os.Signal, 1)
 	signal.Notify(ch, syscall.SIGTERM, syscall.SIGQUIT, syscall.SIGINT)
 	logger.Infof(ctx, "got signal %v, exit\n", <-ch)
 	srv.Shutdown(context.Background())
@@ -0,0 +1,103 @@
+// Package blob stores result files on the local disk or in an S3-compatible
+// object store, so that API nodes and workers do not need to share a disk.
+package blob
+
+import (
+	"context"
+	"github.com/pkg/errors"
+	"io"
+	"time"
+)
+
+var (
+	ErrNotFound    = errors.New("blob not found")
+	ErrUnsupported = errors.New("operation not supported by the blob store")
+)
+
+// Info describes a stored object.
+type Info struct {
+	Key         string
+	Size        int64
+	ModTime     time.Time
+	ContentType string
+}
+
+// Store is a flat key/value store for files. Keys use '/' as separator.
+type Store interface {
+	// Put stores r under key, replacing any existing object.
+	Put(ctx context.Context, key string, r io.ReadSeeker, contentType string) error
+	// Get opens the object for reading. The caller must close it.
+	Get(ctx context.Context, key string) (io.ReadCloser, *Info, error)
+	Stat(ctx context.Context, key string) (*Info, error)
+	// Copy stores a copy of the object src under dst, replacing any existing
+	// object. A missing src gives ErrNotFound.
+	Copy(ctx context.Context, src, dst string) error
+	// Delete removes the object; deleting a missing object is not an error.
+	Delete(ctx context.Context, key string) error
+	// List calls fn for every object whose key starts with prefix.
+	List(ctx context.Context, prefix string, fn func(*Info) error) error
+	// PresignGet returns a URL that downloads the object without credentials
+	// until expires elapses, or ErrUnsupported.
+	PresignGet(ctx context.Context, key string, expires time.Duration) (string, error)
+}
+
+// Config 结果文件的存储方式
+type Config struct {
+	Type string `mapstructure:"type"` // local(默认) 或 s3
+	Path string `mapstructure:"path"` // local: 存储目录，默认为 server.output_audio_path
+
+	Endpoint       string        `mapstructure:"endpoint"`        // s3: 如 http://127.0.0.1:9000
+	PublicEndpoint string        `mapstructure:"public_endpoint"` // s3: 预签名地址使用的域名，默认同 endpoint
+	Region         string        `mapstructure:"region"`          // 默认 us-east-1
+	Bucket         string        `mapstructure:"bucket"`
+	AccessKey      string        `mapstructure:"access_key"`
+	SecretKey      string        `mapstructure:"secret_key"`
+	PathStyle      bool          `mapstructure:"path_style"` // 使用 endpoint/bucket/key 形式的地址，MinIO 需要开启
+	Prefix         string        `mapstructure:"prefix"`     // 所有 key 的前缀
+	Timeout        time.Duration `mapstructure:"timeout"`    // 建立连接和等待响应头的超时，默认 30s
+
+	Presign       bool          `mapstructure:"presign"`        // getResult 重定向到预签名地址而不是由 API 转发
+	PresignExpiry time.Duration `mapstructure:"presign_expiry"` // 默认 15m
+}
+
+// defaultLocalPath 未配置目录时本地存储使用的目录
+const defaultLocalPath = "./output"
+
+var store Store
+
+// Init creates the store described by cfg; defaultPath is used as the local
+// directory when cfg is nil or has no path.
+func Init(ctx context.Context, cfg *Config, defaultPath string) error {
+	if cfg == nil {
+		cfg = &Config{}
+	}
+	switch cfg.Type {
+	case "", "local":
+		path := cfg.Path
+		if path == "" {
+			path = defaultPath
+		}
+		if path == "" {
+			path = defaultLocalPath
+		}
+		s, err := NewLocal(path)
+		if err != nil {
+			return err
+		}
+		store = s
+	case "s3":
+		s, err := NewS3(cfg)
+		if err != nil {
+			return err
+		}
+		store = s
+	default:
+		return errors.Errorf("unknown blob store type %q", cfg.Type)
+	}
+	return nil
+}
+
+// Get returns the store set up by Init.
+func Get() Store {
+	return store
+}
@@ -0,0 +1,177 @@
+package blob
+
+import (
+	"context"
+	"github.com/pkg/errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Local keeps objects as files below a root directory.
+type Local struct {
+	root string
+}
+
+var _ Store = (*Local)(nil)
+
+func NewLocal(root string) (*Local, error) {
+	if root == "" {
+		return nil, errors.New("local blob store needs a directory")
+	}
+	if err := os.MkdirAll(root, 0o755); err != nil {
+		return nil, err
+	}
+	return &Local{root: root}, nil
+}
+
+// path maps key to a file below root, rejecting keys that escape it.
+func (l *Local) path(key string) (string, error) {
+	clean := filepath.Clean("/" + key)
+	if clean == "/" || strings.Contains(key, "..") {
+		return "", errors.Errorf("invalid key %q", key)
+	}
+	return filepath.Join(l.root, clean), nil
+}
+
+func (l *Local) Put(ctx context.Context, key string, r io.ReadSeeker, contentType string) error {
+	p, err := l.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+		return err
+	}
+	// 先写临时文件再改名，读者不会看到写了一半的文件
+	tmp, err := os.CreateTemp(filepath.Dir(p), ".upload-*")
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(tmp, r)
+	if e := tmp.Close(); err == nil {
+		err = e
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), p)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+	return err
+}
+
+func (l *Local) Get(ctx context.Context, key string) (io.ReadCloser, *Info, error) {
+	p, err := l.path(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	f, err := os.Open(p)
+	if err != nil {
+		return nil, nil, notFound(err)
+	}
+	stat, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, nil, err
+	}
+	return f, l.info(key, stat), nil
+}
+
+func (l *Local) Stat(ctx context.Context, key string) (*Info, error) {
+	p, err := l.path(key)
+	if err != nil {
+		return nil, err
+	}
+	stat, err := os.Stat(p)
+	if err != nil {
+		return nil, notFound(err)
+	}
+	return l.info(key, stat), nil
+}
+
+func (l *Local) Copy(ctx context.Context, src, dst string) error {
+	p, err := l.path(src)
+	if err != nil {
+		return err
+	}
+	f, err := os.Open(p)
+	if err != nil {
+		return notFound(err)
+	}
+	defer f.Close()
+	return l.Put(ctx, dst, f, "")
+}
+
+func (l *Local) Delete(ctx context.Context, key string) error {
+	p, err := l.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(p); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+func (l *Local) List(ctx context.Context, prefix string, fn func(*Info) error) error {
+	return filepath.WalkDir(l.root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		rel, err := filepath.Rel(l.root, p)
+		if err != nil {
+			return err
+		}
+		key := filepath.ToSlash(rel)
+		if d.IsDir() {
+			// 跳过不可能匹配前缀的目录
+			if key != "." && !strings.HasPrefix(key+"/", prefix) && !strings.HasPrefix(prefix, key+"/") {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !strings.HasPrefix(key, prefix) || strings.HasPrefix(d.Name(), ".upload-") {
+			return nil
+		}
+		stat, err := d.Info()
+		if err != nil {
+			return nil
+		}
+		return fn(l.info(key, stat))
+	})
+}
+
+func (l *Local) PresignGet(ctx context.Context, key string, expires time.Duration) (string, error) {
+	return "", ErrUnsupported
+}
+
+func (l *Local) info(key string, stat fs.FileInfo) *Info {
+	return &Info{Key: key, Size: stat.Size(), ModTime: stat.ModTime(), ContentType: contentType(key)}
+}
+
+func notFound(err error) error {
+	if errors.Is(err, os.ErrNotExist) {
+		return ErrNotFound
+	}
+	return err
+}
+
+func contentType(key string) string {
+	switch filepath.Ext(key) {
+	case ".wav":
+		return "audio/wav"
+	case ".flac":
+		return "audio/flac"
+	case ".zip":
+		return "application/zip"
+	case ".json":
+		return "application/json"
+	}
+	return "application/octet-stream"
+}
@@ -0,0 +1,428 @@
+package blob
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"github.com/pkg/errors"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultRegion        = "us-east-1"
+	defaultPresignExpiry = 15 * time.Minute
+	defaultS3Timeout     = 30 * time.Second
+	maxPresignExpiry     = 7 * 24 * time.Hour // SigV4 允许的最长有效期
+
+	amzDateFormat   = "20060102T150405Z"
+	unsignedPayload = "UNSIGNED-PAYLOAD"
+	emptyHash       = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+)
+
+// S3 talks to an S3-compatible object store (AWS S3, MinIO, ...) with
+// requests signed by AWS Signature Version 4.
+type S3 struct {
+	endpoint  *url.URL
+	public    *url.URL // 预签名地址使用的 endpoint
+	region    string
+	bucket    string
+	accessKey string
+	secretKey string
+	pathStyle bool
+	prefix    string
+	client    *http.Client
+}
+
+var _ Store = (*S3)(nil)
+
+func NewS3(cfg *Config) (*S3, error) {
+	if cfg.Endpoint == "" || cfg.Bucket == "" {
+		return nil, errors.New("s3 blob store needs endpoint and bucket")
+	}
+	endpoint, err := url.Parse(cfg.Endpoint)
+	if err != nil || endpoint.Host == "" {
+		return nil, errors.Errorf("invalid s3 endpoint %q", cfg.Endpoint)
+	}
+	public := endpoint
+	if cfg.PublicEndpoint != "" {
+		public, err = url.Parse(cfg.PublicEndpoint)
+		if err != nil || public.Host == "" {
+			return nil, errors.Errorf("invalid s3 public endpoint %q", cfg.PublicEndpoint)
+		}
+	}
+	region := cfg.Region
+	if region == "" {
+		region = defaultRegion
+	}
+	prefix := strings.Trim(cfg.Prefix, "/")
+	if prefix != "" {
+		prefix += "/"
+	}
+	timeout := cfg.Timeout
+	if timeout <= 0 {
+		timeout = defaultS3Timeout
+	}
+	// 结果文件可能很大且按读取方的速度转发，不能限制整个请求的时长；
+	// 只限制建立连接和等待响应头，存储无响应时请求会及时失败
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = (&net.Dialer{Timeout: timeout, KeepAlive: 30 * time.Second}).DialContext
+	transport.TLSHandshakeTimeout = timeout
+	transport.ResponseHeaderTimeout = timeout
+	return &S3{
+		endpoint:  endpoint,
+		public:    public,
+		region:    region,
+		bucket:    cfg.Bucket,
+		accessKey: cfg.AccessKey,
+		secretKey: cfg.SecretKey,
+		pathStyle: cfg.PathStyle,
+		prefix:    prefix,
+		client:    &http.Client{Transport: transport},
+	}, nil
+}
+
+func (s *S3) Put(ctx context.Context, key string, r io.ReadSeeker, contentType string) error {
+	// 签名需要内容的 sha256，先读一遍再回到开头上传
+	h := sha256.New()
+	size, err := io.Copy(h, r)
+	if err != nil {
+		return err
+	}
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	req, err := s.newRequest(ctx, http.MethodPut, key, nil, io.NopCloser(r), hex.EncodeToString(h.Sum(nil)))
+	if err != nil {
+		return err
+	}
+	req.ContentLength = size
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	rsp, err := s.do(req)
+	if err != nil {
+		return err
+	}
+	return rsp.Body.Close()
+}
+
+func (s *S3) Get(ctx context.Context, key string) (io.ReadCloser, *Info, error) {
+	req, err := s.newRequest(ctx, http.MethodGet, key, nil, nil, emptyHash)
+	if err != nil {
+		return nil, nil, err
+	}
+	rsp, err := s.do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	return rsp.Body, s.info(key, rsp), nil
+}
+
+func (s *S3) Stat(ctx context.Context, key string) (*Info, error) {
+	req, err := s.newRequest(ctx, http.MethodHead, key, nil, nil, emptyHash)
+	if err != nil {
+		return nil, err
+	}
+	rsp, err := s.do(req)
+	if err != nil {
+		return nil, err
+	}
+	rsp.Body.Close()
+	return s.info(key, rsp), nil
+}
+
+func (s *S3) Copy(ctx context.Context, src, dst string) error {
+	u := s.objectURL(s.endpoint, dst)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, u.String(), nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("X-Amz-Copy-Source", escapePath("/"+s.bucket+"/"+s.prefix+src))
+	s.sign(req, u, emptyHash, time.Now().UTC())
+	rsp, err := s.do(req)
+	if err != nil {
+		return err
+	}
+	defer rsp.Body.Close()
+	// 复制失败时 S3 也可能返回 200，错误在响应体中
+	body, err := io.ReadAll(io.LimitReader(rsp.Body, 4096))
+	if err != nil {
+		return err
+	}
+	e := &s3Error{}
+	if xml.Unmarshal(body, e) == nil && e.Code != "" {
+		if e.Code == "NoSuchKey" {
+			return ErrNotFound
+		}
+		return errors.Errorf("s3 copy %s to %s: %s: %s", src, dst, e.Code, e.Message)
+	}
+	return nil
+}
+
+func (s *S3) Delete(ctx context.Context, key string) error {
+	req, err := s.newRequest(ctx, http.MethodDelete, key, nil, nil, emptyHash)
+	if err != nil {
+		return err
+	}
+	rsp, err := s.do(req)
+	if errors.Is(err, ErrNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return rsp.Body.Close()
+}
+
+type listResult struct {
+	Contents []struct {
+		Key          string    `xml:"Key"`
+		Size         int64     `xml:"Size"`
+		LastModified time.Time `xml:"LastModified"`
+	} `xml:"Contents"`
+	IsTruncated           bool   `xml:"IsTruncated"`
+	NextContinuationToken string `xml:"NextContinuationToken"`
+}
+
+func (s *S3) List(ctx context.Context, prefix string, fn func(*Info) error) error {
+	token := ""
+	for {
+		query := url.Values{"list-type": {"2"}, "prefix": {s.prefix + prefix}}
+		if token != "" {
+			query.Set("continuation-token", token)
+		}
+		req, err := s.newRequest(ctx, http.MethodGet, "", query, nil, emptyHash)
+		if err != nil {
+			return err
+		}
+		rsp, err := s.do(req)
+		if err != nil {
+			return err
+		}
+		result := &listResult{}
+		err = xml.NewDecoder(rsp.Body).Decode(result)
+		rsp.Body.Close()
+		if err != nil {
+			return errors.Wrap(err, "decode list response")
+		}
+		for _, c := range result.Contents {
+			key := strings.TrimPrefix(c.Key, s.prefix)
+			if err := fn(&Info{Key: key, Size: c.Size, ModTime: c.LastModified, ContentType: contentType(key)}); err != nil {
+				return err
+			}
+		}
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			return nil
+		}
+		token = result.NextContinuationToken
+	}
+}
+
+// PresignGet builds a query-string signed GET URL on the public endpoint.
+func (s *S3) PresignGet(ctx context.Context, key string, expires time.Duration) (string, error) {
+	if expires <= 0 {
+		expires = defaultPresignExpiry
+	}
+	if expires > maxPresignExpiry {
+		expires = maxPresignExpiry
+	}
+	return s.presign(key, expires, time.Now().UTC()), nil
+}
+
+func (s *S3) presign(key string, expires time.Duration, now time.Time) string {
+	u := s.objectURL(s.public, key)
+	query := url.Values{
+		"X-Amz-Algorithm":     {"AWS4-HMAC-SHA256"},
+		"X-Amz-Credential":    {s.accessKey + "/" + s.scope(now)},
+		"X-Amz-Date":          {now.Format(amzDateFormat)},
+		"X-Amz-Expires":       {strconv.Itoa(int(expires.Seconds()))},
+		"X-Amz-SignedHeaders": {"host"},
+	}
+	canonical := strings.Join([]string{
+		http.MethodGet,
+		u.EscapedPath(),
+		canonicalQuery(query),
+		"host:" + u.Host + "\n",
+		"host",
+		unsignedPayload,
+	}, "\n")
+	u.RawQuery = canonicalQuery(query) + "&X-Amz-Signature=" + s.signature(now, canonical)
+	return u.String()
+}
+
+// objectURL returns the URL of key (or of the bucket when key is empty).
+func (s *S3) objectURL(base *url.URL, key string) *url.URL {
+	u := *base
+	path := strings.TrimSuffix(u.Path, "/")
+	if s.pathStyle {
+		path += "/" + s.bucket
+	} else {
+		u.Host = s.bucket + "." + u.Host
+	}
+	path += "/"
+	if key != "" {
+		path += s.prefix + key
+	}
+	u.Path = path
+	u.RawPath = escapePath(path)
+	u.RawQuery = ""
+	return &u
+}
+
+func (s *S3) newRequest(ctx context.Context, method, key string, query url.Values, body io.ReadCloser, payloadHash string) (*http.Request, error) {
+	u := s.objectURL(s.endpoint, key)
+	u.RawQuery = canonicalQuery(query)
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), body)
+	if err != nil {
+		return nil, err
+	}
+	s.sign(req, u, payloadHash, time.Now().UTC())
+	return req, nil
+}
+
+// sign adds the SigV4 Authorization header to req, covering the host and
+// every x-amz-* header.
+func (s *S3) sign(req *http.Request, u *url.URL, payloadHash string, now time.Time) {
+	req.Header.Set("X-Amz-Date", now.Format(amzDateFormat))
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	values := map[string]string{"host": u.Host}
+	names := []string{"host"}
+	for name := range req.Header {
+		if lower := strings.ToLower(name); strings.HasPrefix(lower, "x-amz-") {
+			values[lower] = strings.TrimSpace(req.Header.Get(name))
+			names = append(names, lower)
+		}
+	}
+	sort.Strings(names)
+	var headers strings.Builder
+	for _, name := range names {
+		headers.WriteString(name + ":" + values[name] + "\n")
+	}
+	signed := strings.Join(names, ";")
+	canonical := strings.Join([]string{
+		req.Method,
+		u.EscapedPath(),
+		u.RawQuery,
+		headers.String(),
+		signed,
+		payloadHash,
+	}, "\n")
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.accessKey, s.scope(now), signed, s.signature(now, canonical)))
+}
+
+func (s *S3) scope(now time.Time) string {
+	return now.Format("20060102") + "/" + s.region + "/s3/aws4_request"
+}
+
+func (s *S3) signature(now time.Time, canonicalRequest string) string {
+	hash := sha256.Sum256([]byte(canonicalRequest))
+	toSign := "AWS4-HMAC-SHA256\n" + now.Format(amzDateFormat) + "\n" + s.scope(now) + "\n" + hex.EncodeToString(hash[:])
+	key := hmacSHA256([]byte("AWS4"+s.secretKey), now.Format("20060102"))
+	key = hmacSHA256(key, s.region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	return hex.EncodeToString(hmacSHA256(key, toSign))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// s3Error is the XML error document returned by S3.
+type s3Error struct {
+	Code    string `xml:"Code"`
+	Message string `xml:"Message"`
+}
+
+// do sends req and turns non-2xx responses into errors; 404 becomes ErrNotFound.
+func (s *S3) do(req *http.Request) (*http.Response, error) {
+	rsp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if rsp.StatusCode/100 == 2 {
+		return rsp, nil
+	}
+	defer rsp.Body.Close()
+	if rsp.StatusCode == http.StatusNotFound {
+		return nil, ErrNotFound
+	}
+	body, _ := io.ReadAll(io.LimitReader(rsp.Body, 4096))
+	e := &s3Error{}
+	if xml.Unmarshal(body, e) == nil && e.Code != "" {
+		return nil, errors.Errorf("s3 %s %s: %s: %s", req.Method, req.URL.Path, e.Code, e.Message)
+	}
+	return nil, errors.Errorf("s3 %s %s: %s", req.Method, req.URL.Path, rsp.Status)
+}
+
+func (s *S3) info(key string, rsp *http.Response) *Info {
+	info := &Info{Key: key, Size: rsp.ContentLength, ContentType: rsp.Header.Get("Content-Type")}
+	if t, err := http.ParseTime(rsp.Header.Get("Last-Modified")); err == nil {
+		info.ModTime = t
+	}
+	if info.ContentType == "" {
+		info.ContentType = contentType(key)
+	}
+	return info
+}
+
+// escapePath URI-encodes every segment of path the way SigV4 expects.
+func escapePath(path string) string {
+	segments := strings.Split(path, "/")
+	for i, seg := range segments {
+		segments[i] = escape(seg)
+	}
+	return strings.Join(segments, "/")
+}
+
+// canonicalQuery encodes query sorted by key with SigV4 escaping.
+func canonicalQuery(query url.Values) string {
+	if len(query) == 0 {
+		return ""
+	}
+	keys := make([]string, 0, len(query))
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var b bytes.Buffer
+	for _, k := range keys {
+		for _, v := range query[k] {
+			if b.Len() > 0 {
+				b.WriteByte('&')
+			}
+			b.WriteString(escape(k))
+			b.WriteByte('=')
+			b.WriteString(escape(v))
+		}
+	}
+	return b.String()
+}
+
+// escape percent-encodes everything except the RFC 3986 unreserved characters.
+func escape(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' || c == '-' || c == '_' || c == '.' || c == '~' {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
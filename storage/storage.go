@@ -1,8 +1,11 @@
 package storage
 
+import "ttsapi/storage/blob"
+
 type Storage struct {
 	Mongo      map[string]string `mapstructure:"mongo,omitempty"`
 	Mysql      map[string]string `mapstructure:"mysql,omitempty"`
 	Postgresql map[string]string `mapstructure:"postgresql,omitempty"`
 	Redis      string            `mapstructure:"redis,omitempty"`
+	Blob       *blob.Config      `mapstructure:"blob,omitempty"` // 结果文件存储，默认存放在 server.output_audio_path
 }
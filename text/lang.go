@@ -0,0 +1,208 @@
+package text
+
+import (
+	"sort"
+	"strings"
+	"unicode"
+)
+
+// 识别的语言
+const (
+	LangZh  = "zh"  // 普通话
+	LangYue = "yue" // 粤语
+	LangJa  = "ja"
+	LangEn  = "en"
+	LangKo  = "ko"
+)
+
+// cantonese 粤语书面语特有的字，出现在句中时整句的汉字按粤语处理
+const cantonese = "嘅咗喺啲佢冇嘢唔咁嚟睇畀乜嗰咩哋啱噉攞嘞囉噃冚嘥揾瞓攰"
+
+// Run is a stretch of text in one language. Start and End are rune offsets
+// into the detected text.
+type Run struct {
+	Lang  string `json:"lang"`
+	Text  string `json:"text"`
+	Start int    `json:"start"`
+	End   int    `json:"end"`
+}
+
+// Stats counts the runes of a text by script.
+type Stats struct {
+	Runes     int `json:"runes"`
+	Han       int `json:"han"`
+	Kana      int `json:"kana"`
+	Hangul    int `json:"hangul"`
+	Latin     int `json:"latin"`
+	Digits    int `json:"digits"`
+	Punct     int `json:"punct"`
+	Spaces    int `json:"spaces"`
+	Other     int `json:"other"`
+	Cantonese int `json:"cantonese"` // 粤语特有字的个数，已计入 Han
+}
+
+// Detection is the language segmentation of a text.
+type Detection struct {
+	Langs []string `json:"langs"` // 出现的语言，按字数从多到少
+	Runs  []Run    `json:"runs"`
+	Stats Stats    `json:"stats"`
+}
+
+// Main returns the language with the most letters.
+func (d *Detection) Main() string {
+	if len(d.Langs) == 0 {
+		return LangZh
+	}
+	return d.Langs[0]
+}
+
+// Has reports whether lang occurs in the text.
+func (d *Detection) Has(lang string) bool {
+	for _, l := range d.Langs {
+		if l == lang {
+			return true
+		}
+	}
+	return false
+}
+
+type script int
+
+const (
+	scriptNone script = iota // 数字、标点、空白等不决定语言的字符
+	scriptHan
+	scriptKana
+	scriptHangul
+	scriptLatin
+)
+
+func scriptOf(r rune) script {
+	switch {
+	case unicode.Is(unicode.Han, r):
+		return scriptHan
+	case unicode.In(r, unicode.Hiragana, unicode.Katakana) || r == 'ー':
+		return scriptKana
+	case unicode.Is(unicode.Hangul, r):
+		return scriptHangul
+	case unicode.Is(unicode.Latin, r):
+		return scriptLatin
+	}
+	return scriptNone
+}
+
+// Detect splits s into language runs. Kana mark Japanese and Hangul Korean;
+// Latin letters are English. Han characters are Chinese, unless the sentence
+// they are in contains kana (Japanese) or characters only written in
+// Cantonese. Digits, punctuation and spaces join the run before them, or the
+// first run when they lead the text. Text without any letter is Chinese.
+func Detect(s string) *Detection {
+	runes := []rune(s)
+	d := &Detection{Runs: []Run{}}
+	langs := make([]string, len(runes))
+	start := 0
+	for i := range runes {
+		if i+1 < len(runes) && !isSentenceEnd(runes, i) {
+			continue
+		}
+		d.Stats.add(runes[start : i+1])
+		classify(runes[start:i+1], langs[start:i+1])
+		start = i + 1
+	}
+
+	counts := make(map[string]int)
+	for i, lang := range langs {
+		if lang == "" {
+			continue
+		}
+		counts[lang]++
+		if n := len(d.Runs); n > 0 && d.Runs[n-1].Lang == lang {
+			d.Runs[n-1].End = i + 1
+			continue
+		}
+		if n := len(d.Runs); n > 0 {
+			d.Runs[n-1].End = i
+		} else {
+			i = 0 // 开头的标点归入第一段
+		}
+		d.Runs = append(d.Runs, Run{Lang: lang, Start: i, End: i + 1})
+	}
+	if len(d.Runs) == 0 && len(runes) > 0 {
+		d.Runs = append(d.Runs, Run{Lang: LangZh})
+	}
+	if n := len(d.Runs); n > 0 {
+		d.Runs[n-1].End = len(runes)
+	}
+	for i := range d.Runs {
+		d.Runs[i].Text = string(runes[d.Runs[i].Start:d.Runs[i].End])
+	}
+
+	for lang := range counts {
+		d.Langs = append(d.Langs, lang)
+	}
+	sort.Slice(d.Langs, func(i, j int) bool {
+		if counts[d.Langs[i]] != counts[d.Langs[j]] {
+			return counts[d.Langs[i]] > counts[d.Langs[j]]
+		}
+		return d.Langs[i] < d.Langs[j]
+	})
+	if len(d.Langs) == 0 {
+		d.Langs = []string{LangZh}
+	}
+	return d
+}
+
+// classify sets the language of every letter of one sentence.
+func classify(sentence []rune, langs []string) {
+	han := LangZh
+	for _, r := range sentence {
+		if scriptOf(r) == scriptKana {
+			han = LangJa
+			break
+		}
+		if strings.ContainsRune(cantonese, r) {
+			han = LangYue
+		}
+	}
+	for i, r := range sentence {
+		switch scriptOf(r) {
+		case scriptHan:
+			langs[i] = han
+		case scriptKana:
+			langs[i] = LangJa
+		case scriptHangul:
+			langs[i] = LangKo
+		case scriptLatin:
+			langs[i] = LangEn
+		}
+	}
+}
+
+func (s *Stats) add(runes []rune) {
+	for _, r := range runes {
+		s.Runes++
+		switch scriptOf(r) {
+		case scriptHan:
+			s.Han++
+			if strings.ContainsRune(cantonese, r) {
+				s.Cantonese++
+			}
+		case scriptKana:
+			s.Kana++
+		case scriptHangul:
+			s.Hangul++
+		case scriptLatin:
+			s.Latin++
+		default:
+			switch {
+			case unicode.IsDigit(r):
+				s.Digits++
+			case unicode.IsSpace(r):
+				s.Spaces++
+			case unicode.IsPunct(r) || unicode.IsSymbol(r):
+				s.Punct++
+			default:
+				s.Other++
+			}
+		}
+	}
+}
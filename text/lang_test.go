@@ -0,0 +1,51 @@
+package text
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+func TestDetect(t *testing.T) {
+	cases := []struct {
+		in    string
+		langs []string
+		runs  []string // 语言:文本
+	}{
+		{"你好，世界。", []string{LangZh}, []string{"zh:你好，世界。"}},
+		{"佢哋喺度食緊飯。", []string{LangYue}, []string{"yue:佢哋喺度食緊飯。"}},
+		{"東京に行きます。", []string{LangJa}, []string{"ja:東京に行きます。"}},
+		{"안녕하세요.", []string{LangKo}, []string{"ko:안녕하세요."}},
+		{"Hello, world.", []string{LangEn}, []string{"en:Hello, world."}},
+		{"", []string{LangZh}, nil},
+		{"123。", []string{LangZh}, []string{"zh:123。"}},
+		// 开头的标点归入第一段，其余的归入前一段；字数相同时按语言代码排序
+		{"“OK”好的", []string{LangEn, LangZh}, []string{"en:“OK”", "zh:好的"}},
+		{"我用iPhone拍照。", []string{LangEn, LangZh}, []string{"zh:我用", "en:iPhone", "zh:拍照。"}},
+		// 假名和粤语特有字只影响所在的句子
+		{"我去东京。東京に行きます。", []string{LangJa, LangZh}, []string{"zh:我去东京。", "ja:東京に行きます。"}},
+		{"你好。佢喺度。", []string{LangYue, LangZh}, []string{"zh:你好。", "yue:佢喺度。"}},
+		{"你好 안녕", []string{LangKo, LangZh}, []string{"zh:你好 ", "ko:안녕"}},
+	}
+	for _, c := range cases {
+		d := Detect(c.in)
+		var runs []string
+		for _, r := range d.Runs {
+			if string([]rune(c.in)[r.Start:r.End]) != r.Text {
+				t.Errorf("Detect(%q): run %+v does not match its offsets", c.in, r)
+			}
+			runs = append(runs, fmt.Sprintf("%s:%s", r.Lang, r.Text))
+		}
+		if !reflect.DeepEqual(d.Langs, c.langs) || !reflect.DeepEqual(runs, c.runs) {
+			t.Errorf("Detect(%q) = %q %q, want %q %q", c.in, d.Langs, runs, c.langs, c.runs)
+		}
+	}
+}
+
+func TestDetectStats(t *testing.T) {
+	s := Detect("佢说OK，3次！ ").Stats
+	want := Stats{Runes: 9, Han: 3, Latin: 2, Digits: 1, Punct: 2, Spaces: 1, Cantonese: 1}
+	if s != want {
+		t.Fatalf("stats = %+v, want %+v", s, want)
+	}
+}
@@ -0,0 +1,756 @@
+package text
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Rule rewrites the matches of a pattern into their spoken form.
+type Rule struct {
+	Name    string
+	Lang    string // 只在该语言的上下文中生效，为空时不限语言；zh 同时适用于粤语
+	Pattern *regexp.Regexp
+	// Replace returns the spoken form of match m (submatch indexes into s,
+	// as returned by FindAllStringSubmatchIndex) in lang, or false to leave
+	// the match as it is.
+	Replace func(s string, m []int, lang string) (string, bool)
+
+	builtin bool
+}
+
+// Change is one rewrite made while normalising.
+type Change struct {
+	Rule string `json:"rule"`
+	Lang string `json:"lang"`
+	From string `json:"from"`
+	To   string `json:"to"`
+}
+
+// Normalizer expands digits, dates, currencies, units and symbols into the
+// words a speaker would say. Rules run one after another over the whole
+// text, so earlier rules take precedence over later ones.
+type Normalizer struct {
+	rules []Rule
+}
+
+// NewNormalizer returns a normalizer running rules before the built-in ones,
+// except the built-in rules named in disable.
+func NewNormalizer(rules []Rule, disable []string) (*Normalizer, error) {
+	off := make(map[string]bool, len(disable))
+	for _, name := range disable {
+		if builtinRule(name) == nil {
+			return nil, fmt.Errorf("unknown normalisation rule %q", name)
+		}
+		off[name] = true
+	}
+	n := &Normalizer{rules: append([]Rule(nil), rules...)}
+	for _, r := range builtinRules {
+		if !off[r.Name] {
+			n.rules = append(n.rules, r)
+		}
+	}
+	return n, nil
+}
+
+// ReplaceRule builds a rule replacing the matches of pattern with template,
+// which may refer to submatches as $1 or ${name}.
+func ReplaceRule(name, lang, pattern, template string) (Rule, error) {
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return Rule{}, fmt.Errorf("rule %s: %w", name, err)
+	}
+	return Rule{
+		Name:    name,
+		Lang:    lang,
+		Pattern: re,
+		Replace: func(s string, m []int, lang string) (string, bool) {
+			return string(re.ExpandString(nil, template, s, m)), true
+		},
+	}, nil
+}
+
+// BuiltinRules lists the names of the built-in rules in the order they run.
+func BuiltinRules() []string {
+	names := make([]string, len(builtinRules))
+	for i, r := range builtinRules {
+		names[i] = r.Name
+	}
+	return names
+}
+
+var defaultNormalizer = &Normalizer{rules: builtinRules}
+
+// Normalize normalises s with the built-in rules.
+func Normalize(s, lang string) (string, []Change) {
+	return defaultNormalizer.Normalize(s, lang)
+}
+
+// Normalize rewrites s into its spoken form. lang is one of the Lang
+// constants; when empty the language of every match is taken from the text
+// around it. Built-in rules only know Chinese, Cantonese (read like
+// Chinese), Japanese and English and leave other languages untouched.
+func (n *Normalizer) Normalize(s, lang string) (string, []Change) {
+	s = foldDigits(s)
+	var changes []Change
+	for _, r := range n.rules {
+		matches := r.Pattern.FindAllStringSubmatchIndex(s, -1)
+		if matches == nil {
+			continue
+		}
+		var b strings.Builder
+		last := 0
+		for _, m := range matches {
+			l := lang
+			if l == "" {
+				l = contextLang(s, m[0], m[1])
+			}
+			if r.Lang != "" && r.Lang != l && !(r.Lang == LangZh && l == LangYue) {
+				continue
+			}
+			if r.builtin && l != LangZh && l != LangYue && l != LangJa && l != LangEn {
+				continue
+			}
+			to, ok := r.Replace(s, m, l)
+			if !ok || to == s[m[0]:m[1]] {
+				continue
+			}
+			b.WriteString(s[last:m[0]])
+			b.WriteString(to)
+			last = m[1]
+			changes = append(changes, Change{Rule: r.Name, Lang: l, From: s[m[0]:m[1]], To: to})
+		}
+		if last > 0 {
+			b.WriteString(s[last:])
+			s = b.String()
+		}
+	}
+	return s, changes
+}
+
+// foldDigits turns full-width digits into ASCII ones.
+func foldDigits(s string) string {
+	return strings.Map(func(r rune) rune {
+		if r >= '０' && r <= '９' {
+			return r - '０' + '0'
+		}
+		return r
+	}, s)
+}
+
+// contextLang guesses the language a match between start and end is read in
+// from the sentence around it: Japanese when the sentence has kana,
+// otherwise the script of the nearest letter before the match, or after it.
+func contextLang(s string, start, end int) string {
+	from, to := start, end
+	for from > 0 {
+		r, size := utf8.DecodeLastRuneInString(s[:from])
+		if strings.ContainsRune("。！？!?\n", r) {
+			break
+		}
+		from -= size
+	}
+	for to < len(s) {
+		r, size := utf8.DecodeRuneInString(s[to:])
+		if strings.ContainsRune("。！？!?\n", r) {
+			break
+		}
+		to += size
+	}
+	han := LangZh
+	for _, r := range s[from:to] {
+		if scriptOf(r) == scriptKana {
+			return LangJa
+		}
+		if strings.ContainsRune(cantonese, r) {
+			han = LangYue
+		}
+	}
+	langOf := func(r rune) string {
+		switch scriptOf(r) {
+		case scriptHan:
+			return han
+		case scriptHangul:
+			return LangKo
+		case scriptLatin:
+			return LangEn
+		}
+		return ""
+	}
+	for i := start; i > from; {
+		r, size := utf8.DecodeLastRuneInString(s[:i])
+		if l := langOf(r); l != "" {
+			return l
+		}
+		i -= size
+	}
+	for _, r := range s[end:to] {
+		if l := langOf(r); l != "" {
+			return l
+		}
+	}
+	return han
+}
+
+// numberPattern matches an unsigned number with optional thousands
+// separators and decimals, capturing the integer and fractional digits.
+const numberPattern = `(\d{1,3}(?:,\d{3})+|\d+)(?:\.(\d+))?`
+
+// group returns submatch i of m, or "" when it did not participate.
+func group(s string, m []int, i int) string {
+	if m[2*i] < 0 {
+		return ""
+	}
+	return s[m[2*i]:m[2*i+1]]
+}
+
+// integer strips the thousands separators off a captured integer part.
+func integer(s string) string {
+	return strings.ReplaceAll(s, ",", "")
+}
+
+// minus reports whether the sign captured as group i is a minus sign rather
+// than a hyphen between two words. Only Latin words and digits take a
+// hyphen; after CJK text or punctuation it is a minus (气温-5℃).
+func minus(s string, m []int, i int) bool {
+	if m[2*i] < 0 {
+		return false
+	}
+	if m[2*i] == 0 {
+		return true
+	}
+	r, _ := utf8.DecodeLastRuneInString(s[:m[2*i]])
+	return scriptOf(r) != scriptLatin && !unicode.IsDigit(r)
+}
+
+// glued reports whether the number between start and end runs into a Latin
+// word, a run of slashes or a run of dots, as in 1e10, MP3, HK$5, 2024/13/40,
+// 1.2.3 or 192.168.1.1. Such tokens are codes rather than numbers and are
+// left as they are.
+func glued(s string, start, end int) bool {
+	before, size := utf8.DecodeLastRuneInString(s[:start])
+	if strings.ContainsRune("$¥￥€£", before) {
+		before, _ = utf8.DecodeLastRuneInString(s[:start-size])
+	}
+	after, _ := utf8.DecodeRuneInString(s[end:])
+	if before == '/' || before == '.' {
+		if r, _ := utf8.DecodeLastRuneInString(s[:start-1]); unicode.IsDigit(r) {
+			return true
+		}
+	}
+	if after == '/' || after == '.' {
+		if r, _ := utf8.DecodeRuneInString(s[end+1:]); unicode.IsDigit(r) {
+			return true
+		}
+	}
+	return scriptOf(before) == scriptLatin || scriptOf(after) == scriptLatin
+}
+
+// sign returns the spoken prefix of the sign captured as group i, or the
+// sign itself when it is a hyphen.
+func sign(s string, m []int, i int, lang string) string {
+	if !minus(s, m, i) {
+		return group(s, m, i)
+	}
+	switch lang {
+	case LangJa:
+		return "マイナス"
+	case LangEn:
+		return "minus "
+	}
+	return "负"
+}
+
+// spokenNumber reads a number, digit by digit when it has leading zeros.
+func spokenNumber(lang, integer, frac string) string {
+	if len(integer) > 1 && integer[0] == '0' {
+		switch lang {
+		case LangJa:
+			return digitsOf(integer, jaDigits, "")
+		case LangEn:
+			return enDigits(integer)
+		}
+		return digitsOf(integer, zhDigits, "")
+	}
+	return number(lang, integer, frac)
+}
+
+func builtinRule(name string) *Rule {
+	for i := range builtinRules {
+		if builtinRules[i].Name == name {
+			return &builtinRules[i]
+		}
+	}
+	return nil
+}
+
+func builtin(name, pattern string, replace func(s string, m []int, lang string) (string, bool)) Rule {
+	return Rule{Name: name, Pattern: regexp.MustCompile(pattern), Replace: replace, builtin: true}
+}
+
+// builtinRules 内置规则，按顺序执行
+var builtinRules = []Rule{
+	builtin("date", `(\d{4})\s*[-/.年]\s*(\d{1,2})\s*[-/.月]\s*(\d{1,2})(?:\s*[日号])?`, replaceDate),
+	builtin("year", `(\d{4})\s*年`, replaceYear),
+	builtin("time", `(\d{1,2})[:：](\d{2})(?:[:：](\d{2}))?`, replaceTime),
+	builtin("phone", `\+\d{1,3}[\s-]?(?:\(\d{1,4}\)[\s-]?)?\d{2,4}(?:[\s-]?\d{2,4}){1,3}|\(\d{2,4}\)\s?\d{3,4}[\s-]?\d{4}|\d{2,4}-\d{3,4}-\d{4}|\b1[3-9]\d{9}\b`, replacePhone),
+	builtin("currency", `(\bUS\$|[¥￥$€£]|\b(?:USD|CNY|RMB|JPY|EUR|GBP)\s?)`+numberPattern+`|`+numberPattern+`\s?(USD|CNY|RMB|JPY|EUR|GBP)\b`, replaceCurrency),
+	builtin("range", `(\d+(?:\.\d+)?)\s?([~～\-–])\s?(\d+(?:\.\d+)?)\s?(?:([%％])|`+unitPattern+`)?`, replaceRange),
+	builtin("percent", `([-−])?`+numberPattern+`\s?[%％]`, replacePercent),
+	builtin("unit", `([-−])?`+numberPattern+`\s?`+unitPattern, replaceUnit),
+	builtin("ordinal", `\b(\d+)(st|nd|rd|th)\b`, replaceOrdinal),
+	builtin("fraction", `\b(\d+)/(\d+)\b`, replaceFraction),
+	builtin("operator", `\s?[+×÷=＝]\s?`, replaceOperator),
+	builtin("abbreviation", `\b(Mr|Mrs|Ms|Dr|Prof|No|vs|etc|approx|e\.g|i\.e)\.`, replaceAbbreviation),
+	builtin("symbol", `[&@]`, replaceSymbol),
+	builtin("number", `([-−])?`+numberPattern, replaceNumber),
+}
+
+var enMonths = []string{"", "January", "February", "March", "April", "May", "June",
+	"July", "August", "September", "October", "November", "December"}
+
+func replaceDate(s string, m []int, lang string) (string, bool) {
+	year, _ := strconv.Atoi(group(s, m, 1))
+	month, _ := strconv.Atoi(group(s, m, 2))
+	day, _ := strconv.Atoi(group(s, m, 3))
+	if month < 1 || month > 12 || day < 1 || day > 31 {
+		return "", false
+	}
+	if time.Date(year, time.Month(month), day, 0, 0, 0, 0, time.UTC).Day() != day {
+		return "", false
+	}
+	switch lang {
+	case LangJa:
+		return jaInteger(group(s, m, 1)) + "年" + jaInteger(strconv.Itoa(month)) + "月" + jaInteger(strconv.Itoa(day)) + "日", true
+	case LangEn:
+		return enMonths[month] + " " + enOrdinal(enInteger(strconv.Itoa(day))) + ", " + enYear(year), true
+	}
+	return digitsOf(group(s, m, 1), zhDigits, "") + "年" + zhInteger(strconv.Itoa(month)) + "月" + zhInteger(strconv.Itoa(day)) + "日", true
+}
+
+// replaceYear reads years digit by digit in Chinese (二零二四年).
+func replaceYear(s string, m []int, lang string) (string, bool) {
+	switch lang {
+	case LangJa:
+		return jaInteger(group(s, m, 1)) + "年", true
+	case LangEn:
+		return "", false
+	}
+	return digitsOf(group(s, m, 1), zhDigits, "") + "年", true
+}
+
+func replaceTime(s string, m []int, lang string) (string, bool) {
+	hour, _ := strconv.Atoi(group(s, m, 1))
+	minute, _ := strconv.Atoi(group(s, m, 2))
+	second := -1
+	if sec := group(s, m, 3); sec != "" {
+		second, _ = strconv.Atoi(sec)
+	}
+	if hour > 24 || minute > 59 || second > 59 {
+		return "", false
+	}
+	h, min, sec := strconv.Itoa(hour), strconv.Itoa(minute), strconv.Itoa(second)
+	switch lang {
+	case LangJa:
+		ret := jaInteger(h) + "時"
+		if minute > 0 {
+			ret += jaInteger(min) + "分"
+		}
+		if second > 0 {
+			ret += jaInteger(sec) + "秒"
+		}
+		return ret, true
+	case LangEn:
+		ret := enInteger(h)
+		switch {
+		case minute == 0 && second <= 0:
+			ret += " o'clock"
+		case minute < 10:
+			ret += " oh " + enInteger(min)
+		default:
+			ret += " " + enInteger(min)
+		}
+		if second > 0 {
+			ret += " and " + enInteger(sec) + " seconds"
+		}
+		return ret, true
+	}
+	ret := zhInteger(h) + "点"
+	if hour == 2 {
+		ret = "两点"
+	}
+	if minute > 0 {
+		if minute < 10 {
+			ret += "零"
+		}
+		ret += zhInteger(min) + "分"
+	}
+	if second > 0 {
+		ret += zhInteger(sec) + "秒"
+	}
+	return ret, true
+}
+
+// replacePhone reads phone numbers digit by digit, pausing between groups.
+// Chinese reads 1 as 幺.
+func replacePhone(s string, m []int, lang string) (string, bool) {
+	digits, plus, sep := zhDigits, "加", "，"
+	switch lang {
+	case LangJa:
+		digits, plus, sep = append([]string{"ゼロ"}, jaDigits[1:]...), "プラス", "、"
+	case LangEn:
+		digits, plus, sep = enOnes[:10], "plus", ", "
+	default:
+		digits = append([]string{}, zhDigits...)
+		digits[1] = "幺"
+	}
+	var groups []string
+	var cur []string
+	flush := func() {
+		if len(cur) > 0 {
+			if lang == LangEn {
+				groups = append(groups, strings.Join(cur, " "))
+			} else {
+				groups = append(groups, strings.Join(cur, ""))
+			}
+			cur = nil
+		}
+	}
+	for _, r := range s[m[0]:m[1]] {
+		switch {
+		case r >= '0' && r <= '9':
+			cur = append(cur, digits[r-'0'])
+		case r == '+':
+			cur = append(cur, plus)
+		default:
+			flush()
+		}
+	}
+	flush()
+	return strings.Join(groups, sep), true
+}
+
+// currency names a currency in each language; the English minor unit is
+// used for amounts with two decimals.
+type currency struct {
+	zh, ja, en, ens, minor, minors string
+}
+
+var currencies = map[string]currency{
+	"CNY": {"元", "人民元", "yuan", "yuan", "", ""},
+	"JPY": {"日元", "円", "yen", "yen", "", ""},
+	"USD": {"美元", "ドル", "dollar", "dollars", "cent", "cents"},
+	"EUR": {"欧元", "ユーロ", "euro", "euros", "cent", "cents"},
+	"GBP": {"英镑", "ポンド", "pound", "pounds", "penny", "pence"},
+}
+
+func currencyCode(symbol, lang string) string {
+	switch strings.TrimSpace(symbol) {
+	case "¥", "￥":
+		// 日文语境下的 ¥ 是日元
+		if lang == LangJa {
+			return "JPY"
+		}
+		return "CNY"
+	case "$", "US$":
+		return "USD"
+	case "€":
+		return "EUR"
+	case "£":
+		return "GBP"
+	case "RMB":
+		return "CNY"
+	}
+	return strings.TrimSpace(symbol)
+}
+
+func replaceCurrency(s string, m []int, lang string) (string, bool) {
+	symbol, integ, frac := group(s, m, 1), group(s, m, 2), group(s, m, 3)
+	if before, _ := utf8.DecodeLastRuneInString(s[:m[0]]); symbol != "" && scriptOf(before) == scriptLatin {
+		// HK$、C$ 等带字母前缀的符号不是美元
+		return "", false
+	}
+	if symbol == "" {
+		symbol, integ, frac = group(s, m, 6), group(s, m, 4), group(s, m, 5)
+	}
+	c, ok := currencies[currencyCode(symbol, lang)]
+	if !ok {
+		return "", false
+	}
+	integ = integer(integ)
+	switch lang {
+	case LangJa:
+		return number(lang, integ, frac) + c.ja, true
+	case LangEn:
+		if c.minor != "" && len(frac) == 2 {
+			cents := strings.TrimLeft(frac, "0")
+			var parts []string
+			if strings.TrimLeft(integ, "0") != "" || cents == "" {
+				parts = append(parts, enCount(integ, c.en, c.ens))
+			}
+			if cents != "" {
+				parts = append(parts, enCount(cents, c.minor, c.minors))
+			}
+			return strings.Join(parts, " and "), true
+		}
+		if frac != "" {
+			return number(lang, integ, frac) + " " + c.ens, true
+		}
+		return enCount(integ, c.en, c.ens), true
+	}
+	return number(lang, integ, frac) + c.zh, true
+}
+
+// enCount reads n followed by the singular or plural noun.
+func enCount(n, one, many string) string {
+	if strings.TrimLeft(n, "0") == "1" {
+		return "one " + one
+	}
+	return enInteger(n) + " " + many
+}
+
+// unit names a unit of measure in each language. zh, ja and en are format
+// strings taking the spoken number; enOne is used for exactly one.
+type unit struct {
+	zh, ja, en, enOne string
+}
+
+var units = map[string]unit{
+	"km/h": {"每小时%s公里", "時速%sキロ", "%s kilometers per hour", "one kilometer per hour"},
+	"kWh":  {"%s千瓦时", "%sキロワット時", "%s kilowatt hours", "one kilowatt hour"},
+	"kW":   {"%s千瓦", "%sキロワット", "%s kilowatts", "one kilowatt"},
+	"kg":   {"%s千克", "%sキログラム", "%s kilograms", "one kilogram"},
+	"mg":   {"%s毫克", "%sミリグラム", "%s milligrams", "one milligram"},
+	"g":    {"%s克", "%sグラム", "%s grams", "one gram"},
+	"km":   {"%s公里", "%sキロメートル", "%s kilometers", "one kilometer"},
+	"cm":   {"%s厘米", "%sセンチメートル", "%s centimeters", "one centimeter"},
+	"mm":   {"%s毫米", "%sミリメートル", "%s millimeters", "one millimeter"},
+	"m":    {"%s米", "%sメートル", "%s meters", "one meter"},
+	"ml":   {"%s毫升", "%sミリリットル", "%s milliliters", "one milliliter"},
+	"mL":   {"%s毫升", "%sミリリットル", "%s milliliters", "one milliliter"},
+	"L":    {"%s升", "%sリットル", "%s liters", "one liter"},
+	"m²":   {"%s平方米", "%s平方メートル", "%s square meters", "one square meter"},
+	"㎡":    {"%s平方米", "%s平方メートル", "%s square meters", "one square meter"},
+	"m³":   {"%s立方米", "%s立方メートル", "%s cubic meters", "one cubic meter"},
+	"°C":   {"%s摄氏度", "摂氏%s度", "%s degrees Celsius", "one degree Celsius"},
+	"℃":    {"%s摄氏度", "摂氏%s度", "%s degrees Celsius", "one degree Celsius"},
+	"°F":   {"%s华氏度", "華氏%s度", "%s degrees Fahrenheit", "one degree Fahrenheit"},
+	"℉":    {"%s华氏度", "華氏%s度", "%s degrees Fahrenheit", "one degree Fahrenheit"},
+}
+
+// unitPattern captures a unit as one of two groups: units ending in a letter
+// must not run into a following word, symbol units need no boundary.
+const unitPattern = `(?:(km/h|kWh|kW|kg|mg|km|cm|mm|ml|mL|°C|°F|g|m|L)\b|(m²|㎡|m³|℃|℉))`
+
+func spokenUnit(lang, name, spoken string) string {
+	u := units[name]
+	switch lang {
+	case LangJa:
+		return fmt.Sprintf(u.ja, spoken)
+	case LangEn:
+		if spoken == "one" {
+			return u.enOne
+		}
+		return fmt.Sprintf(u.en, spoken)
+	}
+	return fmt.Sprintf(u.zh, spoken)
+}
+
+func spokenPercent(lang, spoken string) string {
+	switch lang {
+	case LangJa:
+		return spoken + "パーセント"
+	case LangEn:
+		return spoken + " percent"
+	}
+	return "百分之" + spoken
+}
+
+func spokenDecimal(lang, s string) string {
+	integ, frac, _ := strings.Cut(s, ".")
+	return spokenNumber(lang, integ, frac)
+}
+
+// replaceRange reads "3-5", "20~30℃" and "10-20%" as ranges. Hyphens
+// between long numbers are left to the other rules (dates, codes).
+func replaceRange(s string, m []int, lang string) (string, bool) {
+	from, sep, to := group(s, m, 1), group(s, m, 2), group(s, m, 3)
+	if sep != "~" && sep != "～" && (len(from) > 4 || len(to) > 4) {
+		return "", false
+	}
+	a, b := spokenDecimal(lang, from), spokenDecimal(lang, to)
+	word := "到"
+	switch lang {
+	case LangJa:
+		word = "から"
+	case LangEn:
+		word = " to "
+	}
+	switch {
+	case group(s, m, 4) != "":
+		if lang == LangZh || lang == LangYue {
+			return spokenPercent(lang, a) + word + spokenPercent(lang, b), true
+		}
+		return a + word + spokenPercent(lang, b), true
+	case group(s, m, 5) != "" || group(s, m, 6) != "":
+		name := group(s, m, 5) + group(s, m, 6)
+		return a + word + spokenUnit(lang, name, b), true
+	}
+	return a + word + b, true
+}
+
+func replacePercent(s string, m []int, lang string) (string, bool) {
+	spoken := spokenNumber(lang, integer(group(s, m, 2)), group(s, m, 3))
+	return sign(s, m, 1, lang) + spokenPercent(lang, spoken), true
+}
+
+func replaceUnit(s string, m []int, lang string) (string, bool) {
+	spoken := spokenNumber(lang, integer(group(s, m, 2)), group(s, m, 3))
+	name := group(s, m, 4) + group(s, m, 5)
+	prefix := sign(s, m, 1, lang)
+	if (lang == LangZh || lang == LangYue) && temperature(name) && minus(s, m, 1) {
+		prefix = "零下"
+	}
+	return prefix + spokenUnit(lang, name, spoken), true
+}
+
+func temperature(unit string) bool {
+	switch unit {
+	case "°C", "℃", "°F", "℉":
+		return true
+	}
+	return false
+}
+
+func replaceOrdinal(s string, m []int, lang string) (string, bool) {
+	if lang != LangEn {
+		return "", false
+	}
+	return enOrdinal(enInteger(group(s, m, 1))), true
+}
+
+func replaceFraction(s string, m []int, lang string) (string, bool) {
+	num, den := group(s, m, 1), group(s, m, 2)
+	if strings.TrimLeft(den, "0") == "" || glued(s, m[0], m[1]) {
+		return "", false
+	}
+	if len(strings.TrimLeft(num, "0")) > maxSpokenDigits || len(strings.TrimLeft(den, "0")) > maxSpokenDigits {
+		// 逐位读出的分母没有意义
+		return "", false
+	}
+	switch lang {
+	case LangJa:
+		return jaInteger(den) + "分の" + jaInteger(num), true
+	case LangEn:
+		var name string
+		switch strings.TrimLeft(den, "0") {
+		case "2":
+			name = "half"
+		case "4":
+			name = "quarter"
+		default:
+			name = enOrdinal(enInteger(den))
+		}
+		if strings.TrimLeft(num, "0") != "1" {
+			if name == "half" {
+				name = "halve"
+			}
+			name += "s"
+		}
+		return enInteger(num) + " " + name, true
+	}
+	return zhInteger(den) + "分之" + zhInteger(num), true
+}
+
+var operators = map[string][3]string{
+	"+": {"加", "足す", "plus"},
+	"×": {"乘以", "かける", "times"},
+	"÷": {"除以", "割る", "divided by"},
+	"=": {"等于", "イコール", "equals"},
+	"＝": {"等于", "イコール", "equals"},
+}
+
+// replaceOperator reads arithmetic operators written between two numbers.
+func replaceOperator(s string, m []int, lang string) (string, bool) {
+	before, _ := utf8.DecodeLastRuneInString(s[:m[0]])
+	after, _ := utf8.DecodeRuneInString(s[m[1]:])
+	if !unicode.IsDigit(before) || !unicode.IsDigit(after) {
+		return "", false
+	}
+	words := operators[strings.TrimSpace(s[m[0]:m[1]])]
+	switch lang {
+	case LangJa:
+		return words[1], true
+	case LangEn:
+		return enWord(s, m, words[2]), true
+	}
+	return words[0], true
+}
+
+// enWord pads an English word replacing a symbol with the spaces it lacks.
+func enWord(s string, m []int, word string) string {
+	if before, _ := utf8.DecodeLastRuneInString(s[:m[0]]); m[0] > 0 && !unicode.IsSpace(before) {
+		word = " " + word
+	}
+	if after, _ := utf8.DecodeRuneInString(s[m[1]:]); m[1] < len(s) && !unicode.IsSpace(after) {
+		word += " "
+	}
+	return word
+}
+
+var abbreviations = map[string]string{
+	"Mr":     "Mister",
+	"Mrs":    "Missus",
+	"Ms":     "Miz",
+	"Dr":     "Doctor",
+	"Prof":   "Professor",
+	"No":     "number",
+	"vs":     "versus",
+	"etc":    "et cetera",
+	"approx": "approximately",
+	"e.g":    "for example",
+	"i.e":    "that is",
+}
+
+func replaceAbbreviation(s string, m []int, lang string) (string, bool) {
+	if lang != LangEn {
+		return "", false
+	}
+	abbr := group(s, m, 1)
+	if abbr == "No" {
+		// 只有后面跟数字时才是 number
+		rest := strings.TrimLeft(s[m[1]:], " ")
+		if rest == "" || rest[0] < '0' || rest[0] > '9' {
+			return "", false
+		}
+	}
+	return abbreviations[abbr], true
+}
+
+var symbols = map[string][3]string{
+	"&": {"和", "アンド", "and"},
+	"@": {"艾特", "アット", "at"},
+}
+
+func replaceSymbol(s string, m []int, lang string) (string, bool) {
+	words := symbols[s[m[0]:m[1]]]
+	switch lang {
+	case LangJa:
+		return words[1], true
+	case LangEn:
+		return enWord(s, m, words[2]), true
+	}
+	return words[0], true
+}
+
+func replaceNumber(s string, m []int, lang string) (string, bool) {
+	if glued(s, m[4], m[1]) {
+		return "", false
+	}
+	spoken := spokenNumber(lang, integer(group(s, m, 2)), group(s, m, 3))
+	return sign(s, m, 1, lang) + spoken, true
+}
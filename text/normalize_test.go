@@ -0,0 +1,46 @@
+package text
+
+import "testing"
+
+func TestNormalize(t *testing.T) {
+	cases := []struct {
+		in, lang, want string
+	}{
+		{"2024-01-05", "", "二零二四年一月五日"},
+		{"It is 3/4 of it", "", "It is three quarters of it"},
+		{"第3名", "", "第三名"},
+		{"3-5个", "", "三到五个"},
+		{"costs $5.50", "", "costs five dollars and fifty cents"},
+		{"It costs US$5.", "", "It costs five dollars."},
+		{"US$5", LangEn, "five dollars"},
+		{"¥1,250", "", "一千二百五十元"},
+		{"35%", "", "百分之三十五"},
+		{"3.5kg", "", "三点五千克"},
+		{"2024-10-18", "", "二零二四年十月十八日"},
+
+		// CJK 文字或标点后的 - 是负号
+		{"气温-5℃", "", "气温零下五摄氏度"},
+		{"-5℃", LangZh, "零下五摄氏度"},
+		{"温度是-3", "", "温度是负三"},
+		{"気温は-5℃です", "", "気温はマイナス摂氏五度です"},
+		{"A-1", "", "A-one"},
+
+		// 越界或有歧义的记号保持原样
+		{"HK$5", "", "HK$5"},
+		{"1e10", "", "1e10"},
+		{"MP3", "", "MP3"},
+		{"2024/13/40", "", "2024/13/40"},
+		{"2024/2/30", "", "2024/2/30"},
+		{"1/0", "", "1/0"},
+		{"1/1000000000000000000000", "", "1/1000000000000000000000"},
+		{"版本1.2.3", "", "版本1.2.3"},
+		{"IP 192.168.1.1", "", "IP 192.168.1.1"},
+		{"IP 192.168.1.1", LangEn, "IP 192.168.1.1"},
+		{"共3.5个。", "", "共三点五个。"},
+	}
+	for _, c := range cases {
+		if got, _ := Normalize(c.in, c.lang); got != c.want {
+			t.Errorf("Normalize(%q, %q) = %q, want %q", c.in, c.lang, got, c.want)
+		}
+	}
+}
@@ -0,0 +1,281 @@
+package text
+
+import (
+	"strconv"
+	"strings"
+)
+
+// 数字的读法。输入都是不带符号和千位分隔符的十进制数字串。
+
+var (
+	zhDigits = []string{"零", "一", "二", "三", "四", "五", "六", "七", "八", "九"}
+	jaDigits = []string{"〇", "一", "二", "三", "四", "五", "六", "七", "八", "九"}
+	enOnes   = []string{"zero", "one", "two", "three", "four", "five", "six", "seven", "eight", "nine",
+		"ten", "eleven", "twelve", "thirteen", "fourteen", "fifteen", "sixteen", "seventeen", "eighteen", "nineteen"}
+	enTens   = []string{"", "", "twenty", "thirty", "forty", "fifty", "sixty", "seventy", "eighty", "ninety"}
+	enScales = []string{"", "thousand", "million", "billion", "trillion"}
+)
+
+// maxSpokenDigits 更长的数字逐位读
+const maxSpokenDigits = 15
+
+// digitsOf reads every digit of s on its own.
+func digitsOf(s string, digits []string, sep string) string {
+	words := make([]string, 0, len(s))
+	for _, c := range s {
+		if c >= '0' && c <= '9' {
+			words = append(words, digits[c-'0'])
+		}
+	}
+	return strings.Join(words, sep)
+}
+
+func enDigits(s string) string {
+	return digitsOf(s, enOnes[:10], " ")
+}
+
+// groups4 splits s into groups of four digits, least significant first.
+func groups4(s string) []int {
+	var groups []int
+	for len(s) > 0 {
+		start := len(s) - 4
+		if start < 0 {
+			start = 0
+		}
+		g, _ := strconv.Atoi(s[start:])
+		groups = append(groups, g)
+		s = s[:start]
+	}
+	return groups
+}
+
+// zhInteger reads s as a Chinese cardinal, e.g. 1250 -> 一千二百五十.
+func zhInteger(s string) string {
+	s = strings.TrimLeft(s, "0")
+	if s == "" {
+		return zhDigits[0]
+	}
+	if len(s) > maxSpokenDigits {
+		return digitsOf(s, zhDigits, "")
+	}
+	units := []string{"", "万", "亿", "万亿"}
+	groups := groups4(s)
+	var b strings.Builder
+	zero := false
+	for i := len(groups) - 1; i >= 0; i-- {
+		g := groups[i]
+		if g == 0 {
+			zero = b.Len() > 0
+			continue
+		}
+		if b.Len() > 0 && (zero || g < 1000) {
+			b.WriteString("零")
+		}
+		if g == 2 && i > 0 {
+			b.WriteString("两")
+		} else {
+			b.WriteString(zhUnder10000(g))
+		}
+		b.WriteString(units[i])
+		zero = false
+	}
+	ret := b.String()
+	// 10~19 读作十、十一……而不是一十
+	if strings.HasPrefix(ret, "一十") {
+		ret = strings.TrimPrefix(ret, "一")
+	}
+	return ret
+}
+
+func zhUnder10000(g int) string {
+	places := []string{"", "十", "百", "千"}
+	var b strings.Builder
+	zero := false
+	for p := 3; p >= 0; p-- {
+		d := g / pow10(p) % 10
+		if d == 0 {
+			zero = b.Len() > 0
+			continue
+		}
+		if zero {
+			b.WriteString("零")
+			zero = false
+		}
+		if d == 2 && p == 3 {
+			b.WriteString("两")
+		} else {
+			b.WriteString(zhDigits[d])
+		}
+		b.WriteString(places[p])
+	}
+	return b.String()
+}
+
+// jaInteger reads s as a Japanese cardinal in kanji, e.g. 1250 -> 千二百五十.
+func jaInteger(s string) string {
+	s = strings.TrimLeft(s, "0")
+	if s == "" {
+		return "ゼロ"
+	}
+	if len(s) > maxSpokenDigits {
+		return digitsOf(s, jaDigits, "")
+	}
+	units := []string{"", "万", "億", "兆"}
+	groups := groups4(s)
+	var b strings.Builder
+	for i := len(groups) - 1; i >= 0; i-- {
+		g := groups[i]
+		if g == 0 {
+			continue
+		}
+		// 万以上的单位前千要读作一千，如一千万
+		b.WriteString(jaUnder10000(g, i > 0))
+		b.WriteString(units[i])
+	}
+	return b.String()
+}
+
+func jaUnder10000(g int, keepIchiSen bool) string {
+	places := []string{"", "十", "百", "千"}
+	var b strings.Builder
+	for p := 3; p >= 0; p-- {
+		d := g / pow10(p) % 10
+		if d == 0 {
+			continue
+		}
+		if d != 1 || p == 0 || (p == 3 && keepIchiSen) {
+			b.WriteString(jaDigits[d])
+		}
+		b.WriteString(places[p])
+	}
+	return b.String()
+}
+
+// enInteger reads s as an English cardinal, e.g. 1250 -> one thousand two
+// hundred fifty.
+func enInteger(s string) string {
+	s = strings.TrimLeft(s, "0")
+	if s == "" {
+		return enOnes[0]
+	}
+	if len(s) > maxSpokenDigits {
+		return enDigits(s)
+	}
+	var parts []string
+	scale := 0
+	for len(s) > 0 {
+		start := len(s) - 3
+		if start < 0 {
+			start = 0
+		}
+		g, _ := strconv.Atoi(s[start:])
+		if g > 0 {
+			words := enUnder1000(g)
+			if enScales[scale] != "" {
+				words += " " + enScales[scale]
+			}
+			parts = append([]string{words}, parts...)
+		}
+		s = s[:start]
+		scale++
+	}
+	return strings.Join(parts, " ")
+}
+
+func enUnder1000(n int) string {
+	var words []string
+	if n >= 100 {
+		words = append(words, enOnes[n/100], "hundred")
+		n %= 100
+	}
+	if n > 0 {
+		words = append(words, enUnder100(n))
+	}
+	return strings.Join(words, " ")
+}
+
+func enUnder100(n int) string {
+	if n < 20 {
+		return enOnes[n]
+	}
+	if n%10 == 0 {
+		return enTens[n/10]
+	}
+	return enTens[n/10] + "-" + enOnes[n%10]
+}
+
+// enYear reads a year the way it is spoken: 1999 -> nineteen ninety-nine,
+// 2005 -> two thousand five, 2024 -> twenty twenty-four.
+func enYear(n int) string {
+	switch {
+	case n < 1000 || n >= 10000:
+		return enInteger(strconv.Itoa(n))
+	case n%1000 < 10 && n/1000 == 2:
+		return enInteger(strconv.Itoa(n))
+	case n%100 == 0:
+		return enUnder100(n/100) + " hundred"
+	case n%100 < 10:
+		return enUnder100(n/100) + " oh " + enOnes[n%100]
+	}
+	return enUnder100(n/100) + " " + enUnder100(n%100)
+}
+
+// enOrdinal turns the last word of a cardinal into its ordinal form.
+func enOrdinal(cardinal string) string {
+	i := strings.LastIndexAny(cardinal, " -") + 1
+	head, last := cardinal[:i], cardinal[i:]
+	switch last {
+	case "one":
+		last = "first"
+	case "two":
+		last = "second"
+	case "three":
+		last = "third"
+	case "five":
+		last = "fifth"
+	case "eight":
+		last = "eighth"
+	case "nine":
+		last = "ninth"
+	case "twelve":
+		last = "twelfth"
+	default:
+		if strings.HasSuffix(last, "y") {
+			last = strings.TrimSuffix(last, "y") + "ieth"
+		} else {
+			last += "th"
+		}
+	}
+	return head + last
+}
+
+// number reads a decimal number "int[.frac]" in lang.
+func number(lang, integer, frac string) string {
+	var ret string
+	switch lang {
+	case LangJa:
+		ret = jaInteger(integer)
+		if frac != "" {
+			ret += "点" + digitsOf(frac, jaDigits, "")
+		}
+	case LangEn:
+		ret = enInteger(integer)
+		if frac != "" {
+			ret += " point " + enDigits(frac)
+		}
+	default:
+		ret = zhInteger(integer)
+		if frac != "" {
+			ret += "点" + digitsOf(frac, zhDigits, "")
+		}
+	}
+	return ret
+}
+
+func pow10(p int) int {
+	n := 1
+	for ; p > 0; p-- {
+		n *= 10
+	}
+	return n
+}
@@ -0,0 +1,188 @@
+// Package text prepares input text for synthesis.
+package text
+
+import (
+	"strings"
+	"unicode"
+)
+
+// closers 结束符后紧跟的引号、括号归入当前句
+const closers = "\"'”’」』）)】》"
+
+// Split breaks s into segments of at most maxLen runes. It cuts at sentence
+// ends first, then at clause punctuation and finally at whitespace or, for
+// text without spaces, at maxLen. Consecutive short sentences are packed into
+// one segment as long as it stays within maxLen.
+func Split(s string, maxLen int) []string {
+	if maxLen <= 0 {
+		maxLen = 1
+	}
+	var pieces []string
+	for _, sentence := range Sentences(s) {
+		if runeLen(sentence) <= maxLen {
+			pieces = append(pieces, sentence)
+			continue
+		}
+		for _, clause := range pack(cut(sentence, isClauseEnd), maxLen) {
+			if runeLen(clause) <= maxLen {
+				pieces = append(pieces, clause)
+				continue
+			}
+			pieces = append(pieces, hardSplit(clause, maxLen)...)
+		}
+	}
+	return pack(pieces, maxLen)
+}
+
+// Sentences splits s at sentence ends, dropping empty sentences.
+func Sentences(s string) []string {
+	sentences, rest := SplitSentences(s, 0)
+	if rest = strings.TrimSpace(rest); rest != "" {
+		sentences = append(sentences, rest)
+	}
+	return sentences
+}
+
+// SplitSentences splits text that may still grow, such as a stream, at
+// sentence ends. It returns the complete sentences and the remainder after
+// the last one. A '.' at the very end stays in the remainder until the next
+// rune tells whether it ends a sentence. With maxPending > 0 a run of that
+// many runes without a sentence end is cut as well.
+func SplitSentences(s string, maxPending int) (sentences []string, rest string) {
+	runes := []rune(s)
+	start := 0
+	for i := 0; i < len(runes); i++ {
+		end := isSentenceEnd(runes, i) && !(runes[i] == '.' && i+1 == len(runes))
+		if !end && (maxPending <= 0 || i-start+1 < maxPending) {
+			continue
+		}
+		next := closeSentence(runes, i)
+		if sentence := strings.TrimSpace(string(runes[start:next])); sentence != "" {
+			sentences = append(sentences, sentence)
+		}
+		start = next
+		i = next - 1
+	}
+	return sentences, string(runes[start:])
+}
+
+// closeSentence returns where the piece ending at runes[i] stops, closing
+// quotes and brackets included.
+func closeSentence(runes []rune, i int) int {
+	end := i + 1
+	for end < len(runes) && strings.ContainsRune(closers, runes[end]) {
+		end++
+	}
+	return end
+}
+
+// cut splits s after every rune for which isEnd reports true.
+func cut(s string, isEnd func(runes []rune, i int) bool) []string {
+	var ret []string
+	runes := []rune(s)
+	start := 0
+	for i := 0; i < len(runes); i++ {
+		if !isEnd(runes, i) {
+			continue
+		}
+		end := closeSentence(runes, i)
+		if piece := strings.TrimSpace(string(runes[start:end])); piece != "" {
+			ret = append(ret, piece)
+		}
+		start = end
+		i = end - 1
+	}
+	if piece := strings.TrimSpace(string(runes[start:])); piece != "" {
+		ret = append(ret, piece)
+	}
+	return ret
+}
+
+func isSentenceEnd(runes []rune, i int) bool {
+	switch runes[i] {
+	case '。', '！', '？', '!', '?', '\n', '…', '．':
+		return true
+	case '.':
+		// 英文句号需要后面跟空白或位于末尾，避免把小数和缩写切开
+		return i+1 == len(runes) || unicode.IsSpace(runes[i+1])
+	}
+	return false
+}
+
+func isClauseEnd(runes []rune, i int) bool {
+	switch runes[i] {
+	case '，', '、', '；', '：', '—', ';', ':':
+		return true
+	case ',':
+		// 1,000 之类的数字不切
+		return i+1 == len(runes) || !unicode.IsDigit(runes[i+1])
+	}
+	return false
+}
+
+// hardSplit cuts s into chunks of at most maxLen runes, preferring the last
+// whitespace of each window.
+func hardSplit(s string, maxLen int) []string {
+	var ret []string
+	runes := []rune(s)
+	for len(runes) > maxLen {
+		end := maxLen
+		for i := maxLen; i > maxLen/2; i-- {
+			if unicode.IsSpace(runes[i]) {
+				end = i
+				break
+			}
+		}
+		if piece := strings.TrimSpace(string(runes[:end])); piece != "" {
+			ret = append(ret, piece)
+		}
+		runes = runes[end:]
+	}
+	if piece := strings.TrimSpace(string(runes)); piece != "" {
+		ret = append(ret, piece)
+	}
+	return ret
+}
+
+// pack joins consecutive pieces while the result stays within maxLen runes.
+func pack(pieces []string, maxLen int) []string {
+	var ret []string
+	current, n := "", 0
+	for _, piece := range pieces {
+		l := runeLen(piece)
+		sep := separator(current, piece)
+		if current != "" && n+len(sep)+l > maxLen {
+			ret = append(ret, current)
+			current, n, sep = "", 0, ""
+		}
+		current += sep + piece
+		n += len(sep) + l
+	}
+	if current != "" {
+		ret = append(ret, current)
+	}
+	return ret
+}
+
+// separator returns the space needed between a and b, which is none when
+// either side is CJK.
+func separator(a, b string) string {
+	if a == "" || b == "" {
+		return ""
+	}
+	last := []rune(a)[runeLen(a)-1]
+	first := []rune(b)[0]
+	if isCJK(last) || isCJK(first) {
+		return ""
+	}
+	return " "
+}
+
+func isCJK(r rune) bool {
+	return unicode.In(r, unicode.Han, unicode.Hiragana, unicode.Katakana, unicode.Hangul) ||
+		(r >= 0x3000 && r <= 0x303F) || (r >= 0xFF00 && r <= 0xFFEF)
+}
+
+func runeLen(s string) int {
+	return len([]rune(s))
+}
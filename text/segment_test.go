@@ -0,0 +1,85 @@
+package text
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSentences(t *testing.T) {
+	cases := []struct {
+		in   string
+		want []string
+	}{
+		{"你好。今天天气不错！", []string{"你好。", "今天天气不错！"}},
+		{"他说：“走吧。”然后离开了", []string{"他说：“走吧。”", "然后离开了"}},
+		{"Pi is 3.14. Really?", []string{"Pi is 3.14.", "Really?"}},
+		{"Mr.Smith is here.", []string{"Mr.Smith is here."}},
+		{"一行\n\n二行", []string{"一行", "二行"}},
+		{"  ", nil},
+	}
+	for _, c := range cases {
+		if got := Sentences(c.in); !reflect.DeepEqual(got, c.want) {
+			t.Errorf("Sentences(%q) = %q, want %q", c.in, got, c.want)
+		}
+	}
+}
+
+func TestSplitSentences(t *testing.T) {
+	cases := []struct {
+		in         string
+		maxPending int
+		want       []string
+		rest       string
+	}{
+		{"你好。今天", 0, []string{"你好。"}, "今天"},
+		// 末尾的句号要等下一个字符才能确定
+		{"It costs 3.", 0, nil, "It costs 3."},
+		{"It costs 3. Fine", 0, []string{"It costs 3."}, " Fine"},
+		{"好吗？」", 0, []string{"好吗？」"}, ""},
+		{"一二三四五", 2, []string{"一二", "三四"}, "五"},
+	}
+	for _, c := range cases {
+		got, rest := SplitSentences(c.in, c.maxPending)
+		if !reflect.DeepEqual(got, c.want) || rest != c.rest {
+			t.Errorf("SplitSentences(%q, %d) = %q, %q; want %q, %q", c.in, c.maxPending, got, rest, c.want, c.rest)
+		}
+	}
+
+	// 分多次到达的文本与一次到达的切分结果相同
+	stream, pending := []string(nil), ""
+	for _, chunk := range []string{"Hello", " world.", " How are", " you? 很好", "。"} {
+		var done []string
+		done, pending = SplitSentences(pending+chunk, 0)
+		stream = append(stream, done...)
+	}
+	want := Sentences("Hello world. How are you? 很好。")
+	if !reflect.DeepEqual(stream, want) || pending != "" {
+		t.Errorf("streamed %q + %q, want %q", stream, pending, want)
+	}
+}
+
+func TestSplit(t *testing.T) {
+	cases := []struct {
+		in     string
+		maxLen int
+		want   []string
+	}{
+		{"短句。也短。", 10, []string{"短句。也短。"}},
+		{"第一句比较长。第二句也不短。", 8, []string{"第一句比较长。", "第二句也不短。"}},
+		{"这一句很长，需要在逗号处切开，才能放下。", 9, []string{"这一句很长，", "需要在逗号处切开，", "才能放下。"}},
+		{"一二三四五六七八九十", 4, []string{"一二三四", "五六七八", "九十"}},
+		{"one two three four", 9, []string{"one two", "three", "four"}},
+		{"1,000,000 apples, please.", 30, []string{"1,000,000 apples, please."}},
+	}
+	for _, c := range cases {
+		got := Split(c.in, c.maxLen)
+		if !reflect.DeepEqual(got, c.want) {
+			t.Errorf("Split(%q, %d) = %q, want %q", c.in, c.maxLen, got, c.want)
+		}
+		for _, piece := range got {
+			if runeLen(piece) > c.maxLen {
+				t.Errorf("Split(%q, %d): %q is too long", c.in, c.maxLen, piece)
+			}
+		}
+	}
+}
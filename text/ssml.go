@@ -0,0 +1,669 @@
+package text
+
+import (
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+// 支持的 SSML 子集：speak、p、s、break(time/strength)、prosody(rate)、
+// voice(name)、say-as(interpret-as/format)、sub(alias)
+
+const xmlNamespace = "http://www.w3.org/XML/1998/namespace"
+
+// maxBreak SSML 规定 break 最长 10 秒
+const maxBreak = 10 * time.Second
+
+// 语速倍数的范围，与 GPT-SoVITS 的 speed_factor 一致
+const (
+	minRate = 0.5
+	maxRate = 2
+)
+
+var breakStrengths = map[string]time.Duration{
+	"none":     0,
+	"x-weak":   100 * time.Millisecond,
+	"weak":     250 * time.Millisecond,
+	"medium":   500 * time.Millisecond,
+	"strong":   750 * time.Millisecond,
+	"x-strong": 1250 * time.Millisecond,
+}
+
+var rateKeywords = map[string]float64{
+	"x-slow":  0.5,
+	"slow":    0.75,
+	"medium":  1,
+	"default": 1,
+	"fast":    1.25,
+	"x-fast":  1.5,
+}
+
+// sayAsKinds say-as 支持的 interpret-as
+var sayAsKinds = map[string]bool{
+	"characters": true,
+	"spell-out":  true,
+	"verbatim":   true,
+	"digits":     true,
+	"cardinal":   true,
+	"number":     true,
+	"ordinal":    true,
+	"date":       true,
+	"time":       true,
+	"telephone":  true,
+	"currency":   true,
+}
+
+// SSMLError reports malformed or unsupported markup at a position of the
+// document.
+type SSMLError struct {
+	Offset int    `json:"offset"` // 字节偏移
+	Line   int    `json:"line"`   // 从 1 开始
+	Column int    `json:"column"` // 从 1 开始，按字符计
+	Msg    string `json:"message"`
+}
+
+func (e *SSMLError) Error() string {
+	return fmt.Sprintf("ssml line %d, column %d: %s", e.Line, e.Column, e.Msg)
+}
+
+func ssmlError(doc string, offset int, format string, args ...interface{}) *SSMLError {
+	if offset > len(doc) {
+		offset = len(doc)
+	}
+	line, column := 1, 1
+	for _, r := range doc[:offset] {
+		if r == '\n' {
+			line, column = line+1, 1
+		} else {
+			column++
+		}
+	}
+	return &SSMLError{Offset: offset, Line: line, Column: column, Msg: fmt.Sprintf(format, args...)}
+}
+
+// Speech is one item of an SSML document: text read with one voice, rate
+// and language, or, when Break is set, a pause.
+type Speech struct {
+	Voice  string        `json:"voice,omitempty"` // <voice name>，为空时使用请求的模型
+	Rate   float64       `json:"rate,omitempty"`  // <prosody rate> 的语速倍数，1 为正常
+	Lang   string        `json:"lang,omitempty"`  // xml:lang 对应的语言，为空时按上下文判断
+	Text   string        `json:"text,omitempty"`  // 原文，say-as 的内容未展开
+	Break  bool          `json:"break,omitempty"`
+	Pause  time.Duration `json:"pause,omitempty"`
+	Offset int           `json:"offset"` // 在文档中的字节偏移
+
+	parts []speechPart
+}
+
+type speechPart struct {
+	text      string
+	interpret string // say-as 的 interpret-as，为空是普通文本
+	format    string
+}
+
+// Render returns the text to synthesize: say-as content expanded as asked
+// and the rest normalised by n, if not nil.
+func (s *Speech) Render(n *Normalizer) string {
+	var raw strings.Builder
+	bounds := make([][2]int, len(s.parts))
+	for i, p := range s.parts {
+		bounds[i][0] = raw.Len()
+		raw.WriteString(p.text)
+		bounds[i][1] = raw.Len()
+	}
+	// say-as 的结果用私用区字符占位，不再经过规范化
+	var b strings.Builder
+	var kept []string
+	for i, p := range s.parts {
+		if p.interpret == "" {
+			b.WriteString(p.text)
+			continue
+		}
+		lang := s.Lang
+		if lang == "" {
+			lang = contextLang(raw.String(), bounds[i][0], bounds[i][1])
+		}
+		spoken := p.text
+		if lang == LangZh || lang == LangYue || lang == LangJa || lang == LangEn {
+			spoken, _ = sayAs(p.interpret, p.format, p.text, lang)
+		}
+		b.WriteRune(placeholder + rune(len(kept)))
+		kept = append(kept, spoken)
+	}
+	out := b.String()
+	if n != nil {
+		out, _ = n.Normalize(out, s.Lang)
+	}
+	return Canonical(expandPlaceholders(out, kept))
+}
+
+// placeholder 私用区的第一个字符，say-as 的结果依次从这里编号
+const placeholder = '\uE000'
+
+// expandPlaceholders puts the say-as results back, with a space where one
+// would run into a neighbouring Latin word.
+func expandPlaceholders(s string, kept []string) string {
+	if len(kept) == 0 {
+		return s
+	}
+	var b strings.Builder
+	var last rune
+	afterKept := false
+	for _, r := range s {
+		if r >= placeholder && int(r-placeholder) < len(kept) {
+			spoken := kept[r-placeholder]
+			if first, _ := utf8.DecodeRuneInString(spoken); latinWord(last) && latinWord(first) {
+				b.WriteByte(' ')
+			}
+			b.WriteString(spoken)
+			last, _ = utf8.DecodeLastRuneInString(spoken)
+			afterKept = true
+			continue
+		}
+		if afterKept && latinWord(last) && latinWord(r) {
+			b.WriteByte(' ')
+		}
+		afterKept = false
+		b.WriteRune(r)
+		last = r
+	}
+	return b.String()
+}
+
+// latinWord reports whether r belongs to a word written with spaces around it.
+func latinWord(r rune) bool {
+	return r < 0x250 && (unicode.IsLetter(r) || unicode.IsDigit(r))
+}
+
+type ssmlFrame struct {
+	name  string
+	start int
+	voice string
+	rate  float64
+	lang  string
+}
+
+type ssmlParser struct {
+	doc    string
+	voice  func(name string) bool
+	stack  []ssmlFrame
+	items  []Speech
+	cur    *Speech
+	inline *speechPart // 正在读取的 say-as 或 sub
+	root   bool
+}
+
+// ParseSSML parses doc into the speech and pauses it describes. voice
+// reports whether a <voice name> is known. Errors are *SSMLError.
+func ParseSSML(doc string, voice func(name string) bool) ([]Speech, error) {
+	p := &ssmlParser{doc: doc, voice: voice}
+	d := xml.NewDecoder(strings.NewReader(doc))
+	for {
+		start := int(d.InputOffset())
+		tok, err := d.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, p.syntaxError(err, start, int(d.InputOffset()))
+		}
+		if err := p.token(tok, start, int(d.InputOffset())); err != nil {
+			return nil, err
+		}
+	}
+	if !p.root {
+		return nil, ssmlError(doc, 0, "missing <speak>")
+	}
+	for _, item := range p.items {
+		if !item.Break {
+			return p.items, nil
+		}
+	}
+	return nil, ssmlError(doc, 0, "no text to speak")
+}
+
+// syntaxError locates a decoder error: at the end for a truncated document,
+// else at the start of the token that failed.
+func (p *ssmlParser) syntaxError(err error, start, end int) error {
+	msg := err.Error()
+	var syntax *xml.SyntaxError
+	if errors.As(err, &syntax) {
+		msg = syntax.Msg
+	}
+	if msg == "unexpected EOF" {
+		if n := len(p.stack); n > 0 {
+			return ssmlError(p.doc, len(p.doc), "<%s> is not closed", p.stack[n-1].name)
+		}
+		return ssmlError(p.doc, len(p.doc), "%s", msg)
+	}
+	// 字符数据中的错误（如未知实体）出现在 start 之后，定位到出错的 &
+	if i := strings.IndexByte(p.doc[start:end], '&'); i >= 0 && p.doc[start] != '<' {
+		return ssmlError(p.doc, start+i, "%s", msg)
+	}
+	return ssmlError(p.doc, start, "%s", msg)
+}
+
+func (p *ssmlParser) errorf(offset int, format string, args ...interface{}) error {
+	return ssmlError(p.doc, offset, format, args...)
+}
+
+func (p *ssmlParser) token(tok xml.Token, start, end int) error {
+	switch t := tok.(type) {
+	case xml.StartElement:
+		return p.start(t, start, end)
+	case xml.EndElement:
+		return p.end()
+	case xml.CharData:
+		return p.text(string(t), start)
+	case xml.Directive:
+		return p.errorf(start, "unsupported directive")
+	}
+	// 注释和 <?xml?> 声明忽略
+	return nil
+}
+
+func (p *ssmlParser) top() ssmlFrame {
+	if len(p.stack) == 0 {
+		return ssmlFrame{rate: 1}
+	}
+	return p.stack[len(p.stack)-1]
+}
+
+func (p *ssmlParser) start(t xml.StartElement, start, end int) error {
+	name := t.Name.Local
+	parent := p.top()
+	switch {
+	case len(p.stack) == 0 && p.root:
+		return p.errorf(start, "content after </speak>")
+	case len(p.stack) == 0 && name != "speak":
+		return p.errorf(start, "root element must be <speak>, got <%s>", name)
+	case len(p.stack) > 0 && name == "speak":
+		return p.errorf(start, "nested <speak>")
+	case p.inline != nil || parent.name == "break":
+		return p.errorf(start, "<%s> is not allowed inside <%s>", name, parent.name)
+	}
+	frame := parent
+	frame.name, frame.start = name, start
+
+	var attrs map[string]xml.Attr
+	var err error
+	switch name {
+	case "speak":
+		p.root = true
+		attrs, err = p.attrs(t, start, end, "version")
+	case "p", "s":
+		attrs, err = p.attrs(t, start, end)
+		p.flush()
+	case "voice":
+		if attrs, err = p.attrs(t, start, end, "name"); err != nil {
+			return err
+		}
+		a, ok := attrs["name"]
+		if !ok {
+			return p.errorf(start, "<voice> needs a name")
+		}
+		if !p.voice(a.Value) {
+			return p.errorf(p.attrOffset(start, end, a), "unknown voice %q", a.Value)
+		}
+		p.flush()
+		frame.voice = a.Value
+	case "prosody":
+		if attrs, err = p.attrs(t, start, end, "rate"); err != nil {
+			return err
+		}
+		a, ok := attrs["rate"]
+		if !ok {
+			return p.errorf(start, "<prosody> needs a rate")
+		}
+		if frame.rate, err = parseRate(a.Value, parent.rate); err != nil {
+			return p.errorf(p.attrOffset(start, end, a), "%s", err)
+		}
+		p.flush()
+	case "break":
+		if attrs, err = p.attrs(t, start, end, "time", "strength"); err != nil {
+			return err
+		}
+		pause, err := p.breakPause(attrs, start, end)
+		if err != nil {
+			return err
+		}
+		p.flush()
+		p.items = append(p.items, Speech{Break: true, Pause: pause, Offset: start})
+	case "say-as":
+		if attrs, err = p.attrs(t, start, end, "interpret-as", "format", "detail"); err != nil {
+			return err
+		}
+		a, ok := attrs["interpret-as"]
+		if !ok {
+			return p.errorf(start, "<say-as> needs interpret-as")
+		}
+		if !sayAsKinds[a.Value] {
+			return p.errorf(p.attrOffset(start, end, a), "unsupported interpret-as %q", a.Value)
+		}
+		p.inline = &speechPart{interpret: a.Value, format: attrs["format"].Value}
+	case "sub":
+		if attrs, err = p.attrs(t, start, end, "alias"); err != nil {
+			return err
+		}
+		a, ok := attrs["alias"]
+		if !ok {
+			return p.errorf(start, "<sub> needs an alias")
+		}
+		p.inline = &speechPart{text: a.Value}
+	default:
+		return p.errorf(start, "unsupported element <%s>", name)
+	}
+	if err != nil {
+		return err
+	}
+	if a, ok := attrs["xml:lang"]; ok {
+		if frame.lang, err = ssmlLang(a.Value); err != nil {
+			return p.errorf(p.attrOffset(start, end, a), "%s", err)
+		}
+		if frame.lang != parent.lang {
+			p.flush()
+		}
+	}
+	p.stack = append(p.stack, frame)
+	return nil
+}
+
+func (p *ssmlParser) end() error {
+	frame := p.stack[len(p.stack)-1]
+	p.stack = p.stack[:len(p.stack)-1]
+	switch frame.name {
+	case "speak", "p", "s", "voice", "prosody":
+		p.flush()
+	case "say-as":
+		part := *p.inline
+		p.inline = nil
+		if _, err := sayAs(part.interpret, part.format, part.text, LangZh); err != nil {
+			return p.errorf(frame.start, "%s", err)
+		}
+		cur := p.current(frame.start)
+		cur.parts = append(cur.parts, part)
+	case "sub":
+		part := *p.inline
+		p.inline = nil
+		cur := p.current(frame.start)
+		cur.parts = append(cur.parts, part)
+	}
+	return nil
+}
+
+func (p *ssmlParser) text(s string, start int) error {
+	if len(p.stack) == 0 {
+		if strings.TrimSpace(s) != "" {
+			return p.errorf(start, "text outside <speak>")
+		}
+		return nil
+	}
+	if p.top().name == "break" && strings.TrimSpace(s) != "" {
+		return p.errorf(start, "<break> must be empty")
+	}
+	if p.inline != nil {
+		// sub 的内容由 alias 代替
+		if p.inline.interpret != "" {
+			p.inline.text += s
+		}
+		return nil
+	}
+	if strings.TrimSpace(s) == "" && p.cur == nil {
+		return nil
+	}
+	offset := start + len(s) - len(strings.TrimLeft(s, " \t\r\n"))
+	cur := p.current(offset)
+	cur.parts = append(cur.parts, speechPart{text: s})
+	return nil
+}
+
+// current returns the speech being collected, starting one at offset with
+// the voice, rate and language in effect.
+func (p *ssmlParser) current(offset int) *Speech {
+	if p.cur == nil {
+		frame := p.top()
+		p.cur = &Speech{Voice: frame.voice, Rate: frame.rate, Lang: frame.lang, Offset: offset}
+	}
+	return p.cur
+}
+
+// flush ends the speech being collected.
+func (p *ssmlParser) flush() {
+	if p.cur == nil {
+		return
+	}
+	var b strings.Builder
+	for _, part := range p.cur.parts {
+		b.WriteString(part.text)
+	}
+	p.cur.Text = Canonical(b.String())
+	if p.cur.Text != "" {
+		p.items = append(p.items, *p.cur)
+	}
+	p.cur = nil
+}
+
+// attrs returns the attributes of t by name, xml:lang included, rejecting
+// the ones not in allowed.
+func (p *ssmlParser) attrs(t xml.StartElement, start, end int, allowed ...string) (map[string]xml.Attr, error) {
+	attrs := make(map[string]xml.Attr, len(t.Attr))
+	for _, a := range t.Attr {
+		switch {
+		case a.Name.Space == "xmlns" || a.Name.Space == "" && a.Name.Local == "xmlns":
+			continue
+		case t.Name.Local == "speak" && a.Name.Space != "" && a.Name.Space != "xml" && a.Name.Space != xmlNamespace:
+			// 如 xsi:schemaLocation
+			continue
+		case a.Name.Local == "lang" && (a.Name.Space == "xml" || a.Name.Space == xmlNamespace):
+			attrs["xml:lang"] = a
+			continue
+		}
+		ok := a.Name.Space == ""
+		if ok {
+			ok = false
+			for _, name := range allowed {
+				if a.Name.Local == name {
+					ok = true
+					break
+				}
+			}
+		}
+		if !ok {
+			return nil, p.errorf(p.attrOffset(start, end, a), "unsupported attribute %s on <%s>", a.Name.Local, t.Name.Local)
+		}
+		attrs[a.Name.Local] = a
+	}
+	return attrs, nil
+}
+
+// attrOffset finds attribute a in the start tag between start and end.
+func (p *ssmlParser) attrOffset(start, end int, a xml.Attr) int {
+	re := regexp.MustCompile(`[\s]([\w.-]+:)?` + regexp.QuoteMeta(a.Name.Local) + `\s*=`)
+	if loc := re.FindStringIndex(p.doc[start:end]); loc != nil {
+		return start + loc[0] + 1
+	}
+	return start
+}
+
+func (p *ssmlParser) breakPause(attrs map[string]xml.Attr, start, end int) (time.Duration, error) {
+	if a, ok := attrs["time"]; ok {
+		v := strings.TrimSpace(a.Value)
+		d, err := time.ParseDuration(v)
+		if err != nil || !(strings.HasSuffix(v, "ms") || strings.HasSuffix(v, "s")) {
+			return 0, p.errorf(p.attrOffset(start, end, a), "invalid break time %q, expected e.g. 500ms or 1.5s", a.Value)
+		}
+		if d < 0 || d > maxBreak {
+			return 0, p.errorf(p.attrOffset(start, end, a), "break time must be between 0 and %s", maxBreak)
+		}
+		return d, nil
+	}
+	if a, ok := attrs["strength"]; ok {
+		d, ok := breakStrengths[a.Value]
+		if !ok {
+			return 0, p.errorf(p.attrOffset(start, end, a), "unknown break strength %q", a.Value)
+		}
+		return d, nil
+	}
+	return breakStrengths["medium"], nil
+}
+
+// parseRate reads a prosody rate: a keyword, a multiplier ("1.2"), a
+// percentage of the normal rate ("120%") or a change relative to the
+// enclosing rate ("+20%").
+func parseRate(v string, parent float64) (float64, error) {
+	v = strings.TrimSpace(v)
+	rate, ok := rateKeywords[v]
+	if !ok {
+		var err error
+		if strings.HasSuffix(v, "%") {
+			rate, err = strconv.ParseFloat(strings.TrimSuffix(v, "%"), 64)
+			switch {
+			case err != nil:
+			case strings.HasPrefix(v, "+") || strings.HasPrefix(v, "-"):
+				rate = parent * (1 + rate/100)
+			default:
+				rate /= 100
+			}
+		} else {
+			rate, err = strconv.ParseFloat(v, 64)
+		}
+		if err != nil {
+			return 0, fmt.Errorf("invalid rate %q", v)
+		}
+	}
+	rate = math.Round(rate*100) / 100
+	if rate < minRate || rate > maxRate {
+		return 0, fmt.Errorf("rate %q gives %.2fx, must be between %vx and %vx", v, rate, minRate, maxRate)
+	}
+	return rate, nil
+}
+
+// ssmlLang maps an xml:lang tag to a language.
+func ssmlLang(tag string) (string, error) {
+	primary, region, _ := strings.Cut(strings.ToLower(tag), "-")
+	switch primary {
+	case "zh", "cmn":
+		if region == "hk" || region == "mo" {
+			return LangYue, nil
+		}
+		return LangZh, nil
+	case "yue":
+		return LangYue, nil
+	case "ja":
+		return LangJa, nil
+	case "en":
+		return LangEn, nil
+	case "ko":
+		return LangKo, nil
+	}
+	return "", fmt.Errorf("unsupported xml:lang %q", tag)
+}
+
+var (
+	cardinalPattern  = regexp.MustCompile(`^([-−])?` + numberPattern + `$`)
+	telephonePattern = regexp.MustCompile(`^\+?[\d\s().-]+$`)
+	digitRun         = regexp.MustCompile(`\d+`)
+)
+
+// sayAs reads s as interpret says, in lang.
+func sayAs(interpret, format, s, lang string) (string, error) {
+	s = strings.TrimSpace(foldDigits(s))
+	if s == "" {
+		return "", errors.New("empty <say-as>")
+	}
+	switch interpret {
+	case "characters", "spell-out", "verbatim":
+		return spellOut(s, lang), nil
+	case "digits":
+		if !digitRun.MatchString(s) {
+			return "", fmt.Errorf("%q has no digits", s)
+		}
+		return spellOut(s, lang), nil
+	case "cardinal", "number":
+		m := cardinalPattern.FindStringSubmatchIndex(s)
+		if m == nil {
+			return "", fmt.Errorf("cannot read %q as a number", s)
+		}
+		spoken, _ := replaceNumber(s, m, lang)
+		return spoken, nil
+	case "ordinal":
+		if digitRun.FindString(s) != s {
+			return "", fmt.Errorf("cannot read %q as an ordinal", s)
+		}
+		if lang == LangEn {
+			return enOrdinal(enInteger(s)), nil
+		}
+		return "第" + number(lang, s, ""), nil
+	case "date":
+		fields := digitRun.FindAllString(s, -1)
+		if len(fields) != 3 {
+			return "", fmt.Errorf("cannot read %q as a date", s)
+		}
+		var y, m, d string
+		switch format {
+		case "", "ymd":
+			y, m, d = fields[0], fields[1], fields[2]
+		case "mdy":
+			m, d, y = fields[0], fields[1], fields[2]
+		case "dmy":
+			d, m, y = fields[0], fields[1], fields[2]
+		default:
+			return "", fmt.Errorf("unsupported date format %q, expected ymd, mdy or dmy", format)
+		}
+		return applyRule("date", y+"-"+m+"-"+d, lang)
+	case "time":
+		return applyRule("time", s, lang)
+	case "telephone":
+		if !telephonePattern.MatchString(s) {
+			return "", fmt.Errorf("cannot read %q as a telephone number", s)
+		}
+		spoken, _ := replacePhone(s, []int{0, len(s)}, lang)
+		return spoken, nil
+	case "currency":
+		return applyRule("currency", s, lang)
+	}
+	return "", fmt.Errorf("unsupported interpret-as %q", interpret)
+}
+
+// applyRule reads all of s with one built-in rule.
+func applyRule(name, s, lang string) (string, error) {
+	r := builtinRule(name)
+	m := r.Pattern.FindStringSubmatchIndex(s)
+	if m != nil && m[0] == 0 && m[1] == len(s) {
+		if spoken, ok := r.Replace(s, m, lang); ok {
+			return spoken, nil
+		}
+	}
+	return "", fmt.Errorf("cannot read %q as %s", s, name)
+}
+
+// spellOut reads s character by character: digits by name, letters as
+// capitals.
+func spellOut(s, lang string) string {
+	digits := zhDigits
+	switch lang {
+	case LangJa:
+		digits = jaDigits
+	case LangEn:
+		digits = enOnes[:10]
+	}
+	var words []string
+	for _, r := range s {
+		switch {
+		case r >= '0' && r <= '9':
+			words = append(words, digits[r-'0'])
+		case r == ' ' || r == '\t' || r == '\n':
+		default:
+			words = append(words, strings.ToUpper(string(r)))
+		}
+	}
+	return strings.Join(words, " ")
+}
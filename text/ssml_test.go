@@ -0,0 +1,55 @@
+package text
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestSSMLErrorPosition(t *testing.T) {
+	known := func(name string) bool { return name == "alice" }
+	cases := []struct {
+		doc                  string
+		offset, line, column int
+	}{
+		{"<p>你好</p>", 0, 1, 1},
+		{"<speak><break/></speak>", 0, 1, 1},
+		// 未闭合时指向文档末尾
+		{"<speak>你好", 13, 1, 10},
+		{"<speak>你好</speak>x", 21, 1, 18},
+		{"<speak><audio src=\"x\"/></speak>", 7, 1, 8},
+		{"<speak>汉字 <foo/></speak>", 14, 1, 11},
+		// 属性错误指向属性本身，列按字符计
+		{"<speak>\n  <voice name=\"bob\">你好</voice></speak>", 17, 2, 10},
+		{"<speak>\n<prosody rate=\"9\">快</prosody></speak>", 17, 2, 10},
+		{"<speak>你好<break time=\"20s\"/></speak>", 20, 1, 17},
+		{"<speak><s xml:lang=\"fr\">bonjour</s></speak>", 10, 1, 11},
+		// 未知实体指向 &
+		{"<speak>你&nope;好</speak>", 10, 1, 9},
+		{"<speak>好<say-as interpret-as=\"date\">abc</say-as></speak>", 10, 1, 9},
+	}
+	for _, c := range cases {
+		_, err := ParseSSML(c.doc, known)
+		var e *SSMLError
+		if !errors.As(err, &e) {
+			t.Errorf("ParseSSML(%q) = %v, want an SSMLError", c.doc, err)
+			continue
+		}
+		if e.Offset != c.offset || e.Line != c.line || e.Column != c.column {
+			t.Errorf("ParseSSML(%q) at %d (%d:%d), want %d (%d:%d): %s", c.doc, e.Offset, e.Line, e.Column, c.offset, c.line, c.column, e.Msg)
+		}
+	}
+}
+
+func TestSSMLLang(t *testing.T) {
+	items, err := ParseSSML(`<speak>你好<s xml:lang="ja">東京</s><s xml:lang="zh-HK">你好</s></speak>`, func(string) bool { return false })
+	if err != nil {
+		t.Fatal(err)
+	}
+	var langs []string
+	for _, item := range items {
+		langs = append(langs, item.Lang)
+	}
+	if len(langs) != 3 || langs[0] != "" || langs[1] != LangJa || langs[2] != LangYue {
+		t.Fatalf("langs = %q", langs)
+	}
+}